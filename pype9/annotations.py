@@ -42,3 +42,23 @@ BUILD_PROPS = 'BuildProperties'
 # Additional variables (temporary until 9MLv2)
 ADDITIONAL_VARS = 'AdditionalVariables'
 INITIAL_REGIME = 'InitialRegime'
+
+# Origin of networks imported from SONATA
+SONATA = 'Sonata'
+SONATA_POPULATION = 'Population'
+SONATA_NODE_IDS = 'NodeIds'
+
+# Spatial structure of populations
+STRUCTURE = 'Structure'
+STRUCTURE_TYPE = 'Type'
+STRUCTURE_PARAMS = 'Parameters'
+
+# Plasticity with state that is simulated for each connection (i.e. converted
+# into an "event-driven" synapse model)
+PLASTICITY = 'Plasticity'
+PLASTICITY_PROJECTION = 'Projection'
+PLASTICITY_PRE_PORT = 'PreEventPort'
+PLASTICITY_POST_PORT = 'PostEventPort'
+PLASTICITY_WEIGHT = 'Weight'
+PLASTICITY_RECEIVE_PORT = 'ReceivePort'
+PLASTICITY_WEIGHT_PARAM = 'WeightParameter'
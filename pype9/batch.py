@@ -0,0 +1,501 @@
+"""
+  Runs batches of simulations over grid or random sweeps of the properties
+  (and initial values) of a 9ML model, collecting the recordings of every run
+  into a single indexed HDF5 store.
+
+  Sweeps are specified in YAML or JSON files of the form::
+
+      mode: grid  # or 'random'
+      num_samples: 20  # only used for random sweeps
+      seed: 12345  # seeds the sampling of random sweeps and the simulations
+      parameters:
+        a:
+          values: [0.02, 0.03]
+          units: 1/ms
+        d:
+          start: 2.0
+          stop: 8.0
+          num: 4
+          units: mV/ms
+
+  where the ranges of random sweeps are given by either a list of 'values' to
+  choose from or the 'low' and 'high' bounds of a uniform distribution.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+from builtins import object, range, zip, next
+from itertools import product
+import json
+import multiprocessing
+import yaml
+import numpy
+import h5py
+import neo
+import quantities as pq
+import nineml
+from nineml import units as un
+from pype9.exceptions import Pype9UsageError
+from pype9.simulate import load_backend
+from pype9.utils.units import parse_units
+from pype9.utils.mpi import mpi_comm, is_mpi_master, MPI_ROOT
+from pype9.utils.logging import logger
+
+
+class ParameterRange(object):
+    """
+    The range of values a property or initial value is swept over
+
+    Parameters
+    ----------
+    name : str
+        Name of the parameter or state variable
+    units : nineml.Unit
+        The units of the values
+    values : list(float) | None
+        The explicit values to sweep over
+    low : float | None
+        The lower bound of the values drawn in random sweeps
+    high : float | None
+        The upper bound of the values drawn in random sweeps
+    """
+
+    def __init__(self, name, units, values=None, low=None, high=None):
+        if (values is None) == (low is None or high is None):
+            raise Pype9UsageError(
+                "Either 'values' or both 'low' and 'high' need to be provided "
+                "for range of '{}' parameter".format(name))
+        self.name = name
+        self.units = units
+        self.values = (numpy.asarray(values, dtype=float)
+                       if values is not None else None)
+        self.low = low
+        self.high = high
+
+    @classmethod
+    def from_dict(cls, name, dct):
+        if 'units' not in dct:
+            raise Pype9UsageError(
+                "Units not provided for range of '{}' parameter".format(name))
+        units = parse_units(dct['units'])
+        values = dct.get('values', None)
+        if 'num' in dct:
+            if values is not None:
+                raise Pype9UsageError(
+                    "Both 'values' and 'start', 'stop' and 'num' provided for "
+                    "range of '{}' parameter".format(name))
+            values = numpy.linspace(float(dct['start']), float(dct['stop']),
+                                    int(dct['num']))
+        return cls(name, units, values=values, low=dct.get('low', None),
+                   high=dct.get('high', None))
+
+    def sample(self, rng):
+        if self.values is not None:
+            value = rng.choice(self.values)
+        else:
+            value = rng.uniform(low=self.low, high=self.high)
+        return float(value)
+
+    def __repr__(self):
+        if self.values is not None:
+            rng_str = 'values={}'.format(list(self.values))
+        else:
+            rng_str = 'low={}, high={}'.format(self.low, self.high)
+        return "ParameterRange('{}', {}, units={})".format(
+            self.name, rng_str, self.units.name)
+
+
+class Sweep(object):
+    """
+    A grid or random sweep over the properties and initial values of a 9ML
+    DynamicsProperties model
+
+    Parameters
+    ----------
+    model : nineml.DynamicsProperties
+        The model to sweep the properties of
+    ranges : list(ParameterRange)
+        The ranges of the parameters and state variables to sweep over
+    mode : str
+        Either 'grid', in which every combination of the values of the ranges
+        is simulated, or 'random', in which 'num_samples' values are drawn
+        from each range
+    num_samples : int | None
+        The number of points to sample in random sweeps
+    seed : int | None
+        The seed used to sample points in random sweeps and from which the
+        seeds of each simulation are derived
+    """
+
+    MODES = ('grid', 'random')
+
+    def __init__(self, model, ranges, mode='grid', num_samples=None,
+                 seed=None):
+        if not isinstance(model, nineml.DynamicsProperties):
+            raise Pype9UsageError(
+                "Sweeps can only be performed over DynamicsProperties models, "
+                "not {}".format(model))
+        if mode not in self.MODES:
+            raise Pype9UsageError(
+                "Unrecognised sweep mode '{}', can be one of '{}'"
+                .format(mode, "', '".join(self.MODES)))
+        component_class = model.component_class
+        for rng in ranges:
+            if rng.name in component_class.parameter_names:
+                dimension = component_class.parameter(rng.name).dimension
+            elif rng.name in component_class.state_variable_names:
+                dimension = component_class.state_variable(rng.name).dimension
+            else:
+                raise Pype9UsageError(
+                    "'{}' in sweep is not a parameter or state variable of "
+                    "'{}'".format(rng.name, component_class.name))
+            if rng.units.dimension != dimension:
+                raise Pype9UsageError(
+                    "Units of '{}' range ({}) do not match its dimension ({})"
+                    .format(rng.name, rng.units, dimension))
+        if mode == 'grid':
+            if any(r.values is None for r in ranges):
+                raise Pype9UsageError(
+                    "Explicit values need to be provided for all ranges of "
+                    "grid sweeps")
+            values = list(product(*(r.values for r in ranges)))
+        else:
+            if num_samples is None:
+                raise Pype9UsageError(
+                    "'num_samples' needs to be provided for random sweeps")
+            rng = numpy.random.RandomState(seed)
+            values = [tuple(r.sample(rng) for r in ranges)
+                      for _ in range(num_samples)]
+        self._model = model
+        self._ranges = list(ranges)
+        self._mode = mode
+        self._seed = seed
+        self._values = numpy.asarray(values, dtype=float).reshape(
+            (len(values), len(self._ranges)))
+        seed_rng = numpy.random.RandomState(seed)
+        self._seeds = seed_rng.randint(1, 2 ** 31 - 1, size=len(values))
+
+    @classmethod
+    def read(cls, path, model):
+        """
+        Reads a sweep specification from a YAML or JSON file (see module
+        docstring for the format)
+
+        Parameters
+        ----------
+        path : str
+            Path to the sweep specification file
+        model : nineml.DynamicsProperties
+            The model to sweep the properties of
+        """
+        with open(path) as f:
+            if path.endswith('.json'):
+                spec = json.load(f)
+            else:
+                spec = yaml.safe_load(f)
+        try:
+            params = spec['parameters']
+        except (KeyError, TypeError):
+            raise Pype9UsageError(
+                "No 'parameters' section found in sweep specification '{}'"
+                .format(path))
+        ranges = [ParameterRange.from_dict(n, d)
+                  for n, d in sorted(params.items())]
+        return cls(model, ranges, mode=spec.get('mode', 'grid'),
+                   num_samples=spec.get('num_samples', None),
+                   seed=spec.get('seed', None))
+
+    @property
+    def model(self):
+        return self._model
+
+    @property
+    def ranges(self):
+        return self._ranges
+
+    @property
+    def mode(self):
+        return self._mode
+
+    @property
+    def parameter_names(self):
+        return [r.name for r in self._ranges]
+
+    @property
+    def values(self):
+        "The values of each point of the sweep (num_points x num_params)"
+        return self._values
+
+    def __len__(self):
+        return len(self._values)
+
+    def __iter__(self):
+        for i in range(len(self)):
+            yield self.point(i)
+
+    def point(self, index):
+        """
+        The values of the swept parameters at the given point of the sweep
+
+        Returns
+        -------
+        point : dict(str, nineml.Quantity)
+            The swept values of the parameters and state variables
+        """
+        return dict((r.name, float(v) * r.units)
+                    for r, v in zip(self._ranges, self._values[index]))
+
+    def seed(self, index):
+        "The seed used for the simulation of the given point"
+        return int(self._seeds[index])
+
+    def properties(self, index):
+        """
+        The properties and initial states of the model at the given point of
+        the sweep
+
+        Returns
+        -------
+        properties : nineml.DynamicsProperties
+            The properties of the model with the swept properties overridden
+        initial_states : dict(str, nineml.Quantity)
+            The initial values of the model with the swept initial values
+            overridden
+        """
+        point = self.point(index)
+        properties = [
+            nineml.Property(p.name, point[p.name]) if p.name in point else p
+            for p in self._model.properties]
+        initial_states = dict((iv.name, iv.quantity)
+                              for iv in self._model.initial_values)
+        initial_states.update(
+            (n, q) for n, q in point.items()
+            if n in self._model.component_class.state_variable_names)
+        return (nineml.DynamicsProperties(
+            '{}_{}'.format(self._model.name, index),
+            definition=self._model.component_class, properties=properties,
+            initial_values=[nineml.Initial(n, q)
+                            for n, q in initial_states.items()],
+            initial_regime=self._model.initial_regime), initial_states)
+
+
+def run(sweep, simulator, t_stop, dt, record, store_path, processes=1,
+        use_mpi=False, build_mode='lazy', build_dir=None, build_version=None):
+    """
+    Runs a simulation for each point in the sweep and saves the recordings
+    into a single HDF5 store (see ``read``)
+
+    Parameters
+    ----------
+    sweep : Sweep
+        The sweep to simulate
+    simulator : str
+        The simulator backend to use (see pype9.simulate.SIMULATORS)
+    t_stop : nineml.Quantity (time)
+        Duration of each simulation
+    dt : nineml.Quantity (time)
+        Time step of the simulations
+    record : list(str)
+        Names of the send ports/state variables to record in each simulation
+    store_path : str
+        Path of the HDF5 file to save the recordings to
+    processes : int
+        The number of processes to run the simulations over on each node (the
+        simulation processes are forked from the calling process)
+    use_mpi : bool
+        Whether to distribute the points of the sweep over the MPI ranks the
+        script is run on. NB: each rank simulates its share of the points
+        independently
+    build_mode : str
+        The build mode used to build the model (see CellMetaClass)
+    build_dir : str | None
+        The base directory to build the model in
+    build_version : str | None
+        Version appended to the name of the built model
+    """
+    if not record:
+        raise Pype9UsageError(
+            "At least one port or state variable needs to be recorded")
+    backend = load_backend(simulator)
+    # Build the cell class before the simulation processes are forked so the
+    # model is only built once
+    Cell = backend.CellMetaClass(
+        sweep.model.component_class, build_mode=build_mode,
+        build_base_dir=build_dir, build_version=build_version)
+    batch = (sweep, Cell, backend.Simulation, t_stop, dt, record, build_dir)
+    if use_mpi:
+        indices = list(range(mpi_comm.rank, len(sweep), mpi_comm.size))
+    else:
+        indices = list(range(len(sweep)))
+    logger.info("Running {} of {} simulations in the sweep over '{}'"
+                .format(len(indices), len(sweep), "', '".join(
+                    sweep.parameter_names)))
+    if processes > 1:
+        # The batch is passed to the worker processes when they are forked,
+        # as the built cell class can't be pickled, so they are forked
+        # explicitly whatever the default start method of the platform is
+        pool = _fork_context().Pool(processes, initializer=_init_worker,
+                                    initargs=(batch,))
+        try:
+            results = pool.map(_simulate_in_worker, indices)
+        finally:
+            pool.close()
+            pool.join()
+    else:
+        results = [_simulate(i, batch) for i in indices]
+    results = list(zip(indices, results))
+    if use_mpi:
+        gathered = mpi_comm.gather(results, root=MPI_ROOT)
+        if not is_mpi_master():
+            return
+        results = [r for rank_results in gathered for r in rank_results]
+    _write_store(store_path, sweep, simulator, t_stop, dt, sorted(results))
+    logger.info("Saved recordings of {} simulations to '{}'"
+                .format(len(results), store_path))
+
+
+def read(store_path):
+    """
+    Reads the recordings saved in a batch store
+
+    Parameters
+    ----------
+    store_path : str
+        Path of the HDF5 store written by ``run``
+
+    Returns
+    -------
+    runs : list(tuple(dict(str, float), neo.Segment))
+        The swept values (in the units of the sweep ranges, which are saved
+        in the 'units' annotation of the segments) and recordings of each run
+    """
+    runs = []
+    with h5py.File(store_path, 'r') as f:
+        names = [_str(n) for n in f['parameters'].attrs['names']]
+        units = [_str(u) for u in f['parameters'].attrs['units']]
+        values = f['parameters'][...]
+        for i in range(len(values)):
+            point = dict((n, float(v)) for n, v in zip(names, values[i]))
+            group = f['runs'][str(i)]
+            seg = neo.Segment(name='run{}'.format(i))
+            seg.annotate(seed=int(group.attrs['seed']),
+                         units=dict(zip(names, units)), **point)
+            for port_name, dset in sorted(group.items()):
+                if _str(dset.attrs['type']) == 'spikes':
+                    seg.spiketrains.append(neo.SpikeTrain(
+                        dset[...], units=_str(dset.attrs['units']),
+                        t_start=dset.attrs['t_start'] * pq.ms,
+                        t_stop=dset.attrs['t_stop'] * pq.ms, name=port_name))
+                else:
+                    seg.analogsignals.append(neo.AnalogSignal(
+                        dset[...], units=_str(dset.attrs['units']),
+                        t_start=dset.attrs['t_start'] * pq.ms,
+                        sampling_period=(dset.attrs['sampling_period'] *
+                                         pq.ms),
+                        name=port_name))
+            runs.append((point, seg))
+    return runs
+
+
+def _fork_context():
+    """
+    The multiprocessing context that starts the worker processes by forking
+    the calling process (the default on Python 2)
+    """
+    try:
+        return multiprocessing.get_context('fork')
+    except AttributeError:
+        return multiprocessing
+    except ValueError:
+        raise Pype9UsageError(
+            "Simulations can only be run over multiple processes on "
+            "platforms that support forking them (use 'processes=1' or MPI "
+            "instead)")
+
+
+# The batch simulated by a worker process of the pool (see '_init_worker')
+_worker_batch = None
+
+
+def _init_worker(batch):
+    "Stores the batch to simulate in a worker process of the pool"
+    global _worker_batch
+    _worker_batch = batch
+
+
+def _simulate_in_worker(index):
+    return _simulate(index, _worker_batch)
+
+
+def _simulate(index, batch):
+    """
+    Simulates a single point of the sweep and returns its recordings as a
+    list of (port_name, type, values, attributes) tuples
+    """
+    sweep, Cell, Simulation, t_stop, dt, record, build_dir = batch
+    properties, initial_states = sweep.properties(index)
+    component_class = sweep.model.component_class
+    initial_regime = sweep.model.initial_regime
+    if initial_regime is None:
+        initial_regime = next(component_class.regimes).name
+    logger.info("Simulating point {} of sweep ({})".format(
+        index, ', '.join('{}={}'.format(n, q)
+                         for n, q in sorted(sweep.point(index).items()))))
+    with Simulation(dt=dt, seed=sweep.seed(index),
+                    build_base_dir=build_dir) as sim:
+        cell = Cell(properties, regime_=initial_regime, **initial_states)
+        for port_name in record:
+            cell.record(port_name)
+        sim.run(t_stop)
+    recordings = []
+    for port_name in record:
+        data = cell.recording(port_name)
+        if isinstance(data, neo.SpikeTrain):
+            recordings.append((port_name, 'spikes',
+                               numpy.asarray(data.rescale(pq.ms)), {
+                                   'units': 'ms',
+                                   't_start': float(data.t_start.rescale(
+                                       pq.ms)),
+                                   't_stop': float(data.t_stop.rescale(
+                                       pq.ms))}))
+        else:
+            recordings.append((port_name, 'analog',
+                               numpy.ravel(numpy.asarray(data)), {
+                                   'units': data.units.dimensionality.string,
+                                   't_start': float(data.t_start.rescale(
+                                       pq.ms)),
+                                   'sampling_period': float(
+                                       data.sampling_period.rescale(pq.ms))}))
+    return recordings
+
+
+def _write_store(store_path, sweep, simulator, t_stop, dt, results):
+    with h5py.File(store_path, 'w') as f:
+        f.attrs['model'] = sweep.model.name
+        f.attrs['simulator'] = simulator
+        f.attrs['mode'] = sweep.mode
+        f.attrs['t_stop'] = float(t_stop.in_units(un.ms))
+        f.attrs['dt'] = float(dt.in_units(un.ms))
+        params = f.create_dataset('parameters', data=sweep.values)
+        params.attrs['names'] = numpy.array(sweep.parameter_names,
+                                            dtype='S')
+        params.attrs['units'] = numpy.array(
+            [r.units.name for r in sweep.ranges], dtype='S')
+        runs = f.create_group('runs')
+        for index, recordings in results:
+            group = runs.create_group(str(index))
+            group.attrs['seed'] = sweep.seed(index)
+            for port_name, rec_type, values, attrs in recordings:
+                dset = group.create_dataset(port_name, data=values)
+                dset.attrs['type'] = rec_type
+                for key, val in attrs.items():
+                    dset.attrs[key] = val
+
+
+def _str(value):
+    "Strings may be read from HDF5 attributes as bytes"
+    return value.decode('utf-8') if isinstance(value, bytes) else str(value)
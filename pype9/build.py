@@ -0,0 +1,564 @@
+"""
+  A "fluent" API for constructing 9ML dynamics classes in Python instead of
+  writing them in XML/YAML by hand, e.g.::
+
+      from nineml import units as un
+      from pype9.build import DynamicsBuilder
+
+      builder = (
+          DynamicsBuilder('LeakyIntegrateAndFire')
+          .parameter('tau', un.ms)
+          .parameter('R', un.Mohm)
+          .parameter('v_threshold', un.mV)
+          .parameter('v_reset', un.mV)
+          .state_variable('v', un.mV)
+          .analog_reduce_port('i_ext', un.nA)
+          .analog_send_port('v')
+          .constant('v_rest', -65.0 * un.mV))
+      (builder.regime('subthreshold')
+       .ode('v', '(v_rest - v + R * i_ext) / tau')
+       .on_condition('v > v_threshold', assign={'v': 'v_reset'},
+                     emit='spike'))
+      lif = builder.build()
+      builder.save('./lif.xml')
+
+  The dimensions of all of the expressions are checked when the class is
+  built (see pype9.check), and the built class can be passed straight to the
+  CellMetaClass of any of the simulator backends. Quantities can be bound to
+  names in the expressions with keyword arguments, in which case they are
+  added to the class as constants.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from builtins import object
+from past.builtins import basestring
+from collections import OrderedDict
+import nineml
+from nineml import units as un
+from nineml.abstraction import (
+    Dynamics, Regime, TimeDerivative, OnCondition, OnEvent, StateAssignment,
+    OutputEvent, Parameter, StateVariable, Constant, Alias, AnalogSendPort,
+    AnalogReceivePort, AnalogReducePort, EventSendPort, EventReceivePort)
+from nineml.user import DynamicsProperties, Property, Initial
+from pype9.check import Report, check_dynamics, DimensionChecker
+from pype9.exceptions import Pype9UsageError, Pype9DimensionError
+
+
+class DynamicsBuilder(object):
+    """
+    Builds a 9ML dynamics class from its elements, which are added with the
+    methods of the builder (each of which returns the builder so they can be
+    chained)
+
+    Parameters
+    ----------
+    name : str
+        The name of the dynamics class
+    """
+
+    def __init__(self, name):
+        self.name = name
+        self._parameters = OrderedDict()
+        self._state_variables = OrderedDict()
+        self._constants = OrderedDict()
+        self._aliases = OrderedDict()
+        self._analog_send_ports = OrderedDict()
+        self._analog_receive_ports = OrderedDict()
+        self._event_send_ports = OrderedDict()
+        self._event_receive_ports = OrderedDict()
+        self._regimes = OrderedDict()
+        self._initial_values = {}
+
+    def parameter(self, name, dimension=None):
+        """
+        Adds a parameter to the class
+
+        Parameters
+        ----------
+        name : str
+            Name of the parameter
+        dimension : nineml.Dimension | nineml.Unit | None
+            The dimension of the parameter (or a unit of the dimension). If
+            None the parameter is dimensionless
+        """
+        self._add(self._parameters, name,
+                  Parameter(name, dimension=_dimension(dimension)))
+        return self
+
+    def state_variable(self, name, dimension=None, initial=None):
+        """
+        Adds a state variable to the class
+
+        Parameters
+        ----------
+        name : str
+            Name of the state variable
+        dimension : nineml.Dimension | nineml.Unit | None
+            The dimension of the state variable (or a unit of the dimension).
+            If None the state variable is dimensionless
+        initial : nineml.Quantity | float | None
+            The default initial value of the state variable used by
+            ``properties``
+        """
+        self._add(self._state_variables, name,
+                  StateVariable(name, dimension=_dimension(dimension)))
+        if initial is not None:
+            self._initial_values[name] = initial
+        return self
+
+    def constant(self, name, quantity):
+        """
+        Adds a constant to the class
+
+        Parameters
+        ----------
+        name : str
+            Name of the constant
+        quantity : nineml.Quantity | float
+            The value of the constant (floats are dimensionless)
+        """
+        quantity = _quantity(quantity)
+        self._add(self._constants, name,
+                  Constant(name, float(quantity.value), quantity.units))
+        return self
+
+    def alias(self, name, rhs, **quantities):
+        """
+        Adds an alias to the class
+
+        Parameters
+        ----------
+        name : str
+            Name of the alias
+        rhs : str | sympy.Expr
+            The expression of the alias
+        quantities : dict(str, nineml.Quantity)
+            Quantities referred to by name in the expression, which are added
+            to the class as constants
+        """
+        self._bind(quantities)
+        self._add(self._aliases, name, Alias(name, rhs))
+        return self
+
+    def analog_send_port(self, name, dimension=None):
+        """
+        Exposes a state variable or alias of the class via an analog send port
+
+        Parameters
+        ----------
+        name : str
+            Name of the state variable or alias to expose
+        dimension : nineml.Dimension | nineml.Unit | None
+            The dimension of the port. If None it is determined from the
+            exposed state variable or alias when the class is built
+        """
+        if name in self._analog_send_ports:
+            raise Pype9UsageError(
+                "'{}' has already been exposed in '{}'".format(name,
+                                                              self.name))
+        self._analog_send_ports[name] = (
+            _dimension(dimension) if dimension is not None else None)
+        return self
+
+    def analog_receive_port(self, name, dimension=None):
+        """
+        Adds an analog receive port to the class
+
+        Parameters
+        ----------
+        name : str
+            Name of the port
+        dimension : nineml.Dimension | nineml.Unit | None
+            The dimension of the port (or a unit of the dimension). If None
+            the port is dimensionless
+        """
+        self._add(self._analog_receive_ports, name,
+                  AnalogReceivePort(name, dimension=_dimension(dimension)))
+        return self
+
+    def analog_reduce_port(self, name, dimension=None, operator='+'):
+        """
+        Adds an analog reduce port to the class, which can receive any number
+        of connections
+
+        Parameters
+        ----------
+        name : str
+            Name of the port
+        dimension : nineml.Dimension | nineml.Unit | None
+            The dimension of the port (or a unit of the dimension). If None
+            the port is dimensionless
+        operator : str
+            The operator used to reduce the connected values
+        """
+        self._add(self._analog_receive_ports, name,
+                  AnalogReducePort(name, dimension=_dimension(dimension),
+                                   operator=operator))
+        return self
+
+    def event_send_port(self, name):
+        """
+        Adds an event send port to the class (event send ports are also added
+        automatically when they are emitted by transitions)
+        """
+        self._add(self._event_send_ports, name, EventSendPort(name))
+        return self
+
+    def event_receive_port(self, name):
+        """
+        Adds an event receive port to the class (event receive ports are also
+        added automatically when they are handled by on-events)
+        """
+        self._add(self._event_receive_ports, name, EventReceivePort(name))
+        return self
+
+    def regime(self, name):
+        """
+        Returns the builder of the named regime, which is created if it
+        doesn't exist
+
+        Parameters
+        ----------
+        name : str
+            Name of the regime
+        """
+        try:
+            return self._regimes[name]
+        except KeyError:
+            regime = self._regimes[name] = RegimeBuilder(self, name)
+            return regime
+
+    def build(self):
+        """
+        Builds the dynamics class, checking the dimensions of its expressions
+
+        Returns
+        -------
+        dynamics : nineml.Dynamics
+            The built dynamics class
+        """
+        if not self._regimes:
+            self.regime('default')
+        for regime in self._regimes.values():
+            for transition in regime._transitions:
+                target = transition.target_regime_name
+                if target is not None and target not in self._regimes:
+                    raise Pype9UsageError(
+                        "Target regime '{}' of transition from '{}' regime "
+                        "has not been added to '{}'".format(
+                            target, regime.name, self.name))
+        analog_ports = list(self._analog_receive_ports.values())
+        # Determine the dimensions of the send ports that weren't provided
+        checker = DimensionChecker(self._dynamics(analog_ports))
+        for name, dimension in self._analog_send_ports.items():
+            if dimension is None:
+                try:
+                    dimension = checker.symbol_dimension(name)
+                except Pype9DimensionError as e:
+                    raise Pype9DimensionError(
+                        "Could not determine the dimension of analog send "
+                        "port '{}' of '{}': {}".format(name, self.name, e))
+            analog_ports.append(AnalogSendPort(name, dimension=dimension))
+        dynamics = self._dynamics(analog_ports)
+        report = Report()
+        check_dynamics(dynamics, report)
+        if report.errors:
+            raise Pype9DimensionError(
+                "Could not build '{}' dynamics:\n{}".format(
+                    self.name, '\n'.join(str(e) for e in report.errors)))
+        return dynamics
+
+    def properties(self, name=None, initial_regime=None, **values):
+        """
+        Builds the dynamics class and returns a set of properties for it
+
+        Parameters
+        ----------
+        name : str | None
+            Name of the properties. If None the name of the class with the
+            suffix 'Properties' is used
+        initial_regime : str | None
+            The initial regime of the properties. If None the first regime
+            added to the builder is used
+        values : dict(str, nineml.Quantity | float)
+            The values of the parameters and initial values of the state
+            variables (which override the initial values passed to
+            ``state_variable``)
+
+        Returns
+        -------
+        properties : nineml.DynamicsProperties
+            The properties of the built dynamics class
+        """
+        dynamics = self.build()
+        if name is None:
+            name = self.name + 'Properties'
+        if initial_regime is None:
+            initial_regime = next(iter(self._regimes))
+        initial_values = dict(self._initial_values)
+        properties = []
+        for key, value in values.items():
+            if key in self._parameters:
+                properties.append(Property(key, _quantity(value)))
+            elif key in self._state_variables:
+                initial_values[key] = value
+            else:
+                raise Pype9UsageError(
+                    "'{}' is not a parameter or state variable of '{}'"
+                    .format(key, self.name))
+        return DynamicsProperties(
+            name=name, definition=dynamics, properties=properties,
+            initial_values=[Initial(n, _quantity(v))
+                            for n, v in sorted(initial_values.items())],
+            initial_regime=initial_regime)
+
+    def save(self, url, properties=None, **kwargs):
+        """
+        Builds the dynamics class and writes it (along with a set of its
+        properties if provided) to file. The format is determined from the
+        extension of the file (e.g. '.xml' or '.yml')
+
+        Parameters
+        ----------
+        url : str
+            The path of the file to write
+        properties : nineml.DynamicsProperties | None
+            Properties of the dynamics class to write along with it (e.g. as
+            returned by ``properties``)
+        kwargs : dict
+            Keyword arguments passed to ``nineml.write`` (e.g. 'version')
+        """
+        elements = [self.build()]
+        if properties is not None:
+            elements.append(properties)
+        nineml.write(url, *elements, **kwargs)
+
+    def serialize(self, format='xml', version=2,  # @ReservedAssignment
+                  **kwargs):
+        """
+        Builds the dynamics class and returns its serialized form as a string
+
+        Parameters
+        ----------
+        format : str
+            The format to serialize to ('xml', 'yaml', 'json', etc...)
+        version : int
+            The version of 9ML to serialize to
+        """
+        return self.build().serialize(format=format, version=version,
+                                      to_str=True, **kwargs)
+
+    def _dynamics(self, analog_ports):
+        return Dynamics(
+            name=self.name,
+            parameters=list(self._parameters.values()),
+            state_variables=list(self._state_variables.values()),
+            constants=list(self._constants.values()),
+            aliases=list(self._aliases.values()),
+            regimes=[r._regime() for r in self._regimes.values()],
+            analog_ports=analog_ports,
+            event_ports=(list(self._event_send_ports.values()) +
+                         list(self._event_receive_ports.values())))
+
+    def _add(self, elements, name, element):
+        if self._defines(name):
+            raise Pype9UsageError(
+                "'{}' has already been added to '{}'".format(name, self.name))
+        elements[name] = element
+
+    def _defines(self, name):
+        return any(name in d for d in (
+            self._parameters, self._state_variables, self._constants,
+            self._aliases, self._analog_receive_ports, self._event_send_ports,
+            self._event_receive_ports))
+
+    def _bind(self, quantities):
+        """
+        Adds the quantities bound to names in an expression as constants,
+        checking that they match constants that have already been added under
+        the same name
+        """
+        for name, quantity in quantities.items():
+            quantity = _quantity(quantity)
+            try:
+                constant = self._constants[name]
+            except KeyError:
+                self.constant(name, quantity)
+            else:
+                if (float(quantity.value) != constant.value or
+                        quantity.units != constant.units):
+                    raise Pype9UsageError(
+                        "'{}' is bound to {} but has already been added to "
+                        "'{}' as {} {}".format(name, quantity, self.name,
+                                               constant.value,
+                                               constant.units))
+
+
+class RegimeBuilder(object):
+    """
+    Builds a regime of a dynamics class (see DynamicsBuilder.regime). Each
+    method returns the regime builder so they can be chained
+
+    Parameters
+    ----------
+    builder : DynamicsBuilder
+        The builder of the dynamics class the regime belongs to
+    name : str
+        The name of the regime
+    """
+
+    def __init__(self, builder, name):
+        self.builder = builder
+        self.name = name
+        self._time_derivatives = OrderedDict()
+        self._transitions = []
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *args):
+        pass
+
+    def ode(self, variable, rhs, **quantities):
+        """
+        Sets the time derivative of a state variable in the regime
+
+        Parameters
+        ----------
+        variable : str
+            Name of the state variable
+        rhs : str | sympy.Expr
+            The expression of the time derivative
+        quantities : dict(str, nineml.Quantity)
+            Quantities referred to by name in the expression, which are added
+            to the class as constants
+        """
+        if variable not in self.builder._state_variables:
+            raise Pype9UsageError(
+                "'{}' is not a state variable of '{}'".format(
+                    variable, self.builder.name))
+        if variable in self._time_derivatives:
+            raise Pype9UsageError(
+                "Time derivative of '{}' has already been set in '{}' regime"
+                .format(variable, self.name))
+        self.builder._bind(quantities)
+        self._time_derivatives[variable] = TimeDerivative(variable, rhs)
+        return self
+
+    def on_condition(self, trigger, target=None, assign=None, emit=None,
+                     **quantities):
+        """
+        Adds a transition that is triggered by a condition
+
+        Parameters
+        ----------
+        trigger : str | sympy.Expr
+            The condition that triggers the transition
+        target : str | None
+            Name of the regime the transition moves to. If None the
+            transition stays in the regime
+        assign : dict(str, str) | list(str) | None
+            The state assignments of the transition, either a dictionary
+            mapping state variables onto their new values, or a list of
+            assignment strings (e.g. 'v = v_reset')
+        emit : str | list(str) | None
+            The event send port(s) the transition emits events from
+        quantities : dict(str, nineml.Quantity)
+            Quantities referred to by name in the expressions, which are
+            added to the class as constants
+        """
+        self.builder._bind(quantities)
+        self._transitions.append(OnCondition(
+            trigger, target_regime_name=target,
+            state_assignments=self._state_assignments(assign),
+            output_events=self._output_events(emit)))
+        return self
+
+    def on_event(self, port, target=None, assign=None, emit=None,
+                 **quantities):
+        """
+        Adds a transition that is triggered by events received by a port
+        (which is added to the class if it hasn't been already)
+
+        Parameters
+        ----------
+        port : str
+            Name of the event receive port
+        target : str | None
+            Name of the regime the transition moves to. If None the
+            transition stays in the regime
+        assign : dict(str, str) | list(str) | None
+            The state assignments of the transition, either a dictionary
+            mapping state variables onto their new values, or a list of
+            assignment strings (e.g. 'g = g + weight')
+        emit : str | list(str) | None
+            The event send port(s) the transition emits events from
+        quantities : dict(str, nineml.Quantity)
+            Quantities referred to by name in the expressions, which are
+            added to the class as constants
+        """
+        if port not in self.builder._event_receive_ports:
+            self.builder.event_receive_port(port)
+        self.builder._bind(quantities)
+        self._transitions.append(OnEvent(
+            port, target_regime_name=target,
+            state_assignments=self._state_assignments(assign),
+            output_events=self._output_events(emit)))
+        return self
+
+    def regime(self, name):
+        "Returns the builder of another regime of the class (for chaining)"
+        return self.builder.regime(name)
+
+    def build(self):
+        "Builds the dynamics class the regime belongs to (for chaining)"
+        return self.builder.build()
+
+    def _regime(self):
+        return Regime(*self._time_derivatives.values(), name=self.name,
+                      transitions=self._transitions)
+
+    def _state_assignments(self, assign):
+        if assign is None:
+            return []
+        if isinstance(assign, dict):
+            return [StateAssignment(v, rhs) for v, rhs in assign.items()]
+        # Assignment strings are parsed by nineml
+        return list(assign)
+
+    def _output_events(self, emit):
+        if emit is None:
+            return []
+        if isinstance(emit, basestring):
+            emit = [emit]
+        for port in emit:
+            if port not in self.builder._event_send_ports:
+                self.builder.event_send_port(port)
+        return [OutputEvent(p) for p in emit]
+
+
+def _dimension(dimension):
+    "Returns the dimension of a unit (or dimensionless if None)"
+    if dimension is None:
+        return un.dimensionless
+    elif isinstance(dimension, un.Unit):
+        return dimension.dimension
+    elif isinstance(dimension, un.Dimension):
+        return dimension
+    raise Pype9UsageError(
+        "Expected a dimension or unit, found {}".format(dimension))
+
+
+def _quantity(value):
+    "Converts floats into dimensionless quantities"
+    if isinstance(value, un.Quantity):
+        return value
+    try:
+        return float(value) * un.unitless
+    except (TypeError, ValueError):
+        raise Pype9UsageError(
+            "Expected a quantity or a float, found {}".format(value))
@@ -0,0 +1,577 @@
+"""
+  Static analysis of 9ML models, which is used to validate them before they
+  are simulated (see 'pype9 check'). The checks:
+
+    * fully resolve the 9ML document
+    * check the dimensional consistency of every expression, state assignment,
+      trigger condition, analog send port and property
+    * verify that every receive port of the populations and projections in
+      networks (or of single cells) is connected or explicitly ignored
+    * check that there is a plugin for every non-standard connection rule
+    * run the code generation of the requested simulator backends without
+      compiling the generated code
+
+  and report warnings for unused parameters and receive ports, state
+  variables that may grow without bound and missing initial values/regimes.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from builtins import object
+from collections import namedtuple
+from itertools import chain
+import shutil
+import tempfile
+import sympy
+from sympy.logic.boolalg import BooleanFunction, BooleanAtom
+import nineml
+from nineml import units as un
+from nineml.exceptions import NineMLNameError
+from pype9.exceptions import Pype9DimensionError
+from pype9.simulate import load_backend
+
+ERROR = 'error'
+WARNING = 'warning'
+
+# Standard-library connection rules that are supported natively
+STANDARD_CONNECTION_RULES = ('AllToAll', 'OneToOne', 'Explicit',
+                             'Probabilistic', 'RandomFanIn', 'RandomFanOut')
+
+# Functions that return the dimension of their arguments (which must match)
+DIMENSION_PRESERVING_FUNCTIONS = (sympy.Abs, sympy.Min, sympy.Max,
+                                  sympy.floor, sympy.ceiling)
+
+
+class Issue(namedtuple('Issue', ('severity', 'element', 'message'))):
+    """
+    An issue found in a 9ML model
+
+    Parameters
+    ----------
+    severity : str
+        Either 'error', if the model can't be simulated, or 'warning'
+    element : str
+        The name of the element (e.g. component class or population) the
+        issue was found in
+    message : str
+        Description of the issue
+    """
+
+    def __str__(self):
+        return "{:<8} {}: {}".format(self.severity.upper(), self.element,
+                                     self.message)
+
+
+class Report(object):
+    """
+    The issues found in a model by 'check'
+    """
+
+    def __init__(self):
+        self._issues = []
+
+    def __iter__(self):
+        return iter(self._issues)
+
+    def __len__(self):
+        return len(self._issues)
+
+    def __str__(self):
+        return '\n'.join(chain(
+            (str(i) for i in self._issues),
+            ["{} error(s), {} warning(s)".format(len(self.errors),
+                                                 len(self.warnings))]))
+
+    def error(self, element, message):
+        self._issues.append(Issue(ERROR, element, message))
+
+    def warning(self, element, message):
+        self._issues.append(Issue(WARNING, element, message))
+
+    @property
+    def errors(self):
+        return [i for i in self._issues if i.severity == ERROR]
+
+    @property
+    def warnings(self):
+        return [i for i in self._issues if i.severity == WARNING]
+
+    @property
+    def passed(self):
+        return not self.errors
+
+
+def check(model, simulators=(), ignore=(), build_dir=None,
+          build_version=None):
+    """
+    Checks a 9ML model and returns a report of the issues found in it
+
+    Parameters
+    ----------
+    model : nineml.Document | nineml.Network | nineml.DynamicsProperties |
+            nineml.Dynamics
+        The model to check. If a document is provided all of its elements are
+        checked and the receive ports of the dynamics classes aren't checked
+        for connections
+    simulators : list(str)
+        The simulator backends to run the code generation of (without
+        compiling the generated code)
+    ignore : list(str)
+        Receive ports that are allowed to be unconnected, either '<port>' or
+        '<population/projection>.<port>'
+    build_dir : str | None
+        Base directory to generate the code in. If None a temporary directory
+        is used and removed afterwards
+    build_version : str | None
+        Version appended to the names of the generated classes
+    """
+    report = Report()
+    if isinstance(model, nineml.Document):
+        try:
+            elements = list(model.elements)
+        except Exception as e:
+            report.error(model.url, "Could not resolve document: {}"
+                         .format(e))
+            return report
+        for elem in elements:
+            if isinstance(elem, nineml.Dynamics):
+                check_dynamics(elem, report)
+            elif isinstance(elem, nineml.DynamicsProperties):
+                check_properties(elem, report)
+            elif isinstance(elem, nineml.Network):
+                check_network(elem, report, ignore=ignore)
+        to_generate = []
+    elif isinstance(model, nineml.Network):
+        check_network(model, report, ignore=ignore)
+        to_generate = [model]
+    else:
+        if isinstance(model, nineml.DynamicsProperties):
+            check_properties(model, report)
+            component_class = model.component_class
+        else:
+            check_dynamics(model, report)
+            component_class = model
+        check_cell_ports(component_class, report, ignore=ignore)
+        to_generate = [component_class]
+    if report.passed:
+        for simulator in simulators:
+            for elem in to_generate:
+                check_code_generation(elem, simulator, report,
+                                      build_dir=build_dir,
+                                      build_version=build_version)
+    elif simulators and to_generate:
+        report.warning(model.name, "Skipped code generation as errors were "
+                       "found in the model")
+    return report
+
+
+class DimensionChecker(object):
+    """
+    Determines the dimensions of the expressions of a component class,
+    raising a Pype9DimensionError if they are inconsistent
+
+    Parameters
+    ----------
+    component_class : nineml.Dynamics
+        The component class the expressions belong to
+    """
+
+    def __init__(self, component_class):
+        self.component_class = component_class
+        self._alias_dims = {}
+        self._resolving = set()
+
+    def dimension(self, expr):
+        "Returns the dimension of a sympy expression"
+        if expr.is_Number or isinstance(expr, sympy.NumberSymbol):
+            return un.dimensionless
+        elif isinstance(expr, sympy.Symbol):
+            return self.symbol_dimension(str(expr))
+        elif isinstance(expr, sympy.Add):
+            dims = [self.dimension(a) for a in expr.args]
+            for arg, dim in zip(expr.args[1:], dims[1:]):
+                if dim != dims[0]:
+                    raise Pype9DimensionError(
+                        "Cannot add '{}' ({}) and '{}' ({})".format(
+                            expr.args[0], dims[0], arg, dim))
+            return dims[0]
+        elif isinstance(expr, sympy.Mul):
+            dim = un.dimensionless
+            for arg in expr.args:
+                dim = dim * self.dimension(arg)
+            return dim
+        elif isinstance(expr, sympy.Pow):
+            base_dim = self.dimension(expr.base)
+            if expr.exp.is_Number:
+                if base_dim == un.dimensionless:
+                    return un.dimensionless
+                try:
+                    return base_dim ** (int(expr.exp) if expr.exp.is_Integer
+                                        else float(expr.exp))
+                except Exception:
+                    raise Pype9DimensionError(
+                        "Cannot raise '{}' ({}) to the power of {}"
+                        .format(expr.base, base_dim, expr.exp))
+            self._dimensionless(expr.exp, expr)
+            self._dimensionless(expr.base, expr)
+            return un.dimensionless
+        elif isinstance(expr, sympy.Piecewise):
+            dims = []
+            for branch, condition in expr.args:
+                self.condition(condition)
+                dims.append(self.dimension(branch))
+            if any(d != dims[0] for d in dims[1:]):
+                raise Pype9DimensionError(
+                    "Branches of '{}' have different dimensions ({})"
+                    .format(expr, ', '.join(str(d) for d in dims)))
+            return dims[0]
+        elif isinstance(expr, DIMENSION_PRESERVING_FUNCTIONS):
+            dims = [self.dimension(a) for a in expr.args]
+            if any(d != dims[0] for d in dims[1:]):
+                raise Pype9DimensionError(
+                    "Arguments of '{}' have different dimensions ({})"
+                    .format(expr, ', '.join(str(d) for d in dims)))
+            return dims[0]
+        elif isinstance(expr, sympy.Function):
+            # Transcendental and random functions take dimensionless arguments
+            for arg in expr.args:
+                self._dimensionless(arg, expr)
+            return un.dimensionless
+        else:
+            raise Pype9DimensionError(
+                "Cannot determine the dimension of '{}'".format(expr))
+
+    def condition(self, expr):
+        "Checks the dimensions of the sides of (in)equalities in a condition"
+        if isinstance(expr, sympy.Rel):
+            lhs_dim = self.dimension(expr.lhs)
+            rhs_dim = self.dimension(expr.rhs)
+            # Comparisons with zero are valid for any dimension
+            if lhs_dim != rhs_dim and not (expr.lhs.is_zero or
+                                           expr.rhs.is_zero):
+                raise Pype9DimensionError(
+                    "Cannot compare '{}' ({}) with '{}' ({})".format(
+                        expr.lhs, lhs_dim, expr.rhs, rhs_dim))
+        elif isinstance(expr, BooleanFunction):
+            for arg in expr.args:
+                self.condition(arg)
+        elif not isinstance(expr, BooleanAtom):
+            raise Pype9DimensionError(
+                "'{}' is not a boolean condition".format(expr))
+
+    def symbol_dimension(self, name):
+        "Returns the dimension of a symbol in the component class"
+        cc = self.component_class
+        if name == 't':
+            return un.time
+        elif name in cc.alias_names:
+            try:
+                return self._alias_dims[name]
+            except KeyError:
+                if name in self._resolving:
+                    raise Pype9DimensionError(
+                        "Alias '{}' is defined in terms of itself"
+                        .format(name))
+                self._resolving.add(name)
+                try:
+                    dim = self.dimension(cc.alias(name).rhs)
+                finally:
+                    self._resolving.remove(name)
+                self._alias_dims[name] = dim
+                return dim
+        elif name in cc.constant_names:
+            return cc.constant(name).units.dimension
+        try:
+            return cc.dimension_of(name)
+        except NineMLNameError:
+            raise Pype9DimensionError(
+                "Unrecognised symbol '{}'".format(name))
+
+    def _dimensionless(self, arg, expr):
+        dim = self.dimension(arg)
+        if dim != un.dimensionless:
+            raise Pype9DimensionError(
+                "'{}' in '{}' should be dimensionless ({})"
+                .format(arg, expr, dim))
+
+
+def transitions(component_class):
+    "Iterates over all the transitions of a component class"
+    return chain(*(chain(r.on_conditions, r.on_events)
+                   for r in component_class.regimes))
+
+
+def check_dynamics(component_class, report):
+    """
+    Checks the dimensional consistency of the expressions of a Dynamics class
+    and reports unused parameters/receive ports and state variables that may
+    grow without bound
+    """
+    name = component_class.name
+    checker = DimensionChecker(component_class)
+    used = set()
+
+    def check_expr(description, expr, expected=None):
+        used.update(str(s) for s in expr.free_symbols)
+        try:
+            dim = checker.dimension(expr)
+        except Pype9DimensionError as e:
+            report.error(name, "Inconsistent dimensions in {}: {}"
+                         .format(description, e))
+            return
+        if expected is not None and dim != expected and not expr.is_zero:
+            report.error(name, "Dimension of {} ({}) should be {}".format(
+                description, dim, expected))
+
+    for alias in component_class.aliases:
+        check_expr("alias '{}'".format(alias.name), alias.rhs)
+    for regime in component_class.regimes:
+        for td in regime.time_derivatives:
+            check_expr(
+                "time derivative of '{}' in '{}' regime".format(
+                    td.variable, regime.name), td.rhs,
+                expected=(component_class.state_variable(td.variable)
+                          .dimension / un.time))
+    for regime in component_class.regimes:
+        desc = "transition from '{}' regime".format(regime.name)
+        for on_condition in regime.on_conditions:
+            trigger = on_condition.trigger.rhs
+            used.update(str(s) for s in trigger.free_symbols)
+            try:
+                checker.condition(trigger)
+            except Pype9DimensionError as e:
+                report.error(name, "Inconsistent dimensions in trigger '{}' "
+                             "of {}: {}".format(trigger, desc, e))
+        for on_event in regime.on_events:
+            used.add(on_event.src_port_name)
+        for transition in chain(regime.on_conditions, regime.on_events):
+            for sa in transition.state_assignments:
+                check_expr(
+                    "assignment to '{}' in {}".format(sa.variable, desc),
+                    sa.rhs, expected=component_class.state_variable(
+                        sa.variable).dimension)
+    for port in component_class.analog_send_ports:
+        try:
+            dim = checker.symbol_dimension(port.name)
+        except Pype9DimensionError as e:
+            report.error(name, "Could not determine dimension of analog send "
+                         "port '{}': {}".format(port.name, e))
+            continue
+        if dim != port.dimension:
+            report.error(name, "Dimension of analog send port '{}' ({}) "
+                         "doesn't match the variable it exposes ({})"
+                         .format(port.name, port.dimension, dim))
+    for param_name in component_class.parameter_names:
+        if param_name not in used:
+            report.warning(name, "Parameter '{}' isn't used".format(
+                param_name))
+    for port_name in chain(component_class.analog_receive_port_names,
+                           component_class.analog_reduce_port_names):
+        if port_name not in used:
+            report.warning(name, "Analog receive port '{}' isn't used"
+                           .format(port_name))
+    for sv in component_class.state_variables:
+        derivs = [td for r in component_class.regimes
+                  for td in r.time_derivatives if td.variable == sv.name]
+        if not derivs or any(sv.name in (str(s) for s in td.rhs.free_symbols)
+                             for td in derivs):
+            # Constant between events or decays/grows with its value
+            continue
+        resets = [sa for t in transitions(component_class)
+                  for sa in t.state_assignments
+                  if (sa.variable == sv.name and
+                      sv.name not in (str(s) for s in sa.rhs.free_symbols))]
+        if not resets:
+            report.warning(name, "State variable '{}' may grow without bound"
+                           " as its time derivative doesn't depend on it and "
+                           "it is never reset".format(sv.name))
+
+
+def check_properties(properties, report, check_class=True):
+    """
+    Checks that the properties match the parameters of the component class
+    and reports missing initial values/regimes
+    """
+    name = properties.name
+    component_class = properties.component_class
+    if check_class:
+        check_dynamics(component_class, report)
+    prop_names = set()
+    for prop in properties.properties:
+        prop_names.add(prop.name)
+        try:
+            param = component_class.parameter(prop.name)
+        except NineMLNameError:
+            report.error(name, "Property '{}' doesn't match a parameter of "
+                         "'{}'".format(prop.name, component_class.name))
+            continue
+        if prop.units.dimension != param.dimension:
+            report.error(name, "Units of property '{}' ({}) don't match the "
+                         "dimension of the parameter ({})".format(
+                             prop.name, prop.units, param.dimension))
+    for param_name in sorted(set(component_class.parameter_names) -
+                             prop_names):
+        report.error(name, "Missing property for parameter '{}'"
+                     .format(param_name))
+    init_names = set()
+    for init in properties.initial_values:
+        init_names.add(init.name)
+        try:
+            sv = component_class.state_variable(init.name)
+        except NineMLNameError:
+            report.error(name, "Initial value '{}' doesn't match a state "
+                         "variable of '{}'".format(init.name,
+                                                   component_class.name))
+            continue
+        if init.units.dimension != sv.dimension:
+            report.error(name, "Units of initial value '{}' ({}) don't match "
+                         "the dimension of the state variable ({})".format(
+                             init.name, init.units, sv.dimension))
+    for sv_name in sorted(set(component_class.state_variable_names) -
+                          init_names):
+        report.warning(name, "Missing initial value for '{}' (it will need "
+                       "to be provided when it is simulated)".format(sv_name))
+    if (component_class.num_regimes > 1 and
+            getattr(properties, 'initial_regime', None) is None):
+        report.warning(name, "Missing initial regime (it will need to be "
+                       "provided when it is simulated)")
+
+
+def _ignored(ignore, element_name, port_name):
+    return (port_name in ignore or
+            '{}.{}'.format(element_name, port_name) in ignore)
+
+
+def _report_unconnected(report, element_name, component_class, connected,
+                        ignore, context, analog_errors=True):
+    for port in component_class.receive_ports:
+        if (port.name in connected or
+                _ignored(ignore, element_name, port.name)):
+            continue
+        if analog_errors and port.nineml_type == 'AnalogReceivePort':
+            report.error(element_name, "Analog receive port '{}' is not "
+                         "connected {}".format(port.name, context))
+        else:
+            report.warning(element_name, "{} '{}' is not connected {}".format(
+                {'AnalogReceivePort': 'Analog receive port',
+                 'AnalogReducePort': 'Analog reduce port'}.get(
+                     port.nineml_type, 'Event receive port'),
+                port.name, context))
+
+
+def check_cell_ports(component_class, report, ignore=()):
+    """
+    Reports the receive ports of a single cell, which will need to have
+    signals played into them unless they are ignored
+    """
+    _report_unconnected(
+        report, component_class.name, component_class, set(), ignore,
+        "(it needs to have a signal played into it, or be explicitly "
+        "ignored)", analog_errors=False)
+
+
+def _includes(pop_or_selection, population):
+    return (pop_or_selection == population or
+            (pop_or_selection.nineml_type == 'Selection' and
+             population in pop_or_selection.populations))
+
+
+def check_network(network, report, ignore=()):
+    """
+    Checks the populations and projections of a network and verifies that
+    all of their receive ports are connected (or explicitly ignored)
+    """
+    checked = []
+    for pop in network.populations:
+        if pop.cell.component_class not in checked:
+            check_dynamics(pop.cell.component_class, report)
+            checked.append(pop.cell.component_class)
+        check_properties(pop.cell, report, check_class=False)
+        connected = set(
+            pc.receive_port_name for proj in network.projections
+            for pc in proj.port_connections
+            if ((pc.receiver_role == 'post' and _includes(proj.post, pop)) or
+                (pc.receiver_role == 'pre' and _includes(proj.pre, pop))))
+        _report_unconnected(report, pop.name, pop.cell.component_class,
+                            connected, ignore, "by any projection")
+    for proj in network.projections:
+        for role in ('response', 'plasticity'):
+            props = getattr(proj, role)
+            if props is None:
+                continue
+            if props.component_class not in checked:
+                check_dynamics(props.component_class, report)
+                checked.append(props.component_class)
+            check_properties(props, report, check_class=False)
+            connected = set(pc.receive_port_name
+                            for pc in proj.port_connections
+                            if pc.receiver_role == role)
+            _report_unconnected(report, proj.name, props.component_class,
+                                connected, ignore,
+                                "in the projection ({})".format(role))
+        if proj.delay.units.dimension != un.time:
+            report.error(proj.name, "Units of delay ({}) are not a time"
+                         .format(proj.delay.units))
+        check_connection_rule(proj, report)
+
+
+def check_connection_rule(projection, report):
+    "Checks that there is a plugin for non-standard connection rules"
+    from pype9.simulate.common.network.connection_rules import (
+        rule_name, connection_rule_plugin, registered_connection_rules)
+    rule_properties = projection.connectivity.rule_properties
+    lib_type = rule_name(rule_properties)
+    if (lib_type not in STANDARD_CONNECTION_RULES and
+            connection_rule_plugin(rule_properties) is None):
+        report.error(projection.name, "No plugin is registered for the '{}' "
+                     "connection rule (registered plugins '{}')".format(
+                         lib_type, "', '".join(registered_connection_rules())))
+
+def check_code_generation(model, simulator, report, build_dir=None,
+                          build_version=None):
+    """
+    Runs the code generation of the simulator backend for the model (or the
+    flattened component arrays of a network) without compiling it
+    """
+    from pype9.simulate.common.cells import WithSynapses
+    from pype9.simulate.common.cells.base import BUILD_NAME_SUFFIX
+    try:
+        CodeGenerator = load_backend(simulator, 'code_gen').CodeGenerator
+    except ImportError as e:
+        report.warning(model.name, "Skipped code generation for {} as it "
+                       "could not be imported: {}".format(simulator, e))
+        return
+    if isinstance(model, nineml.Network):
+        from pype9.simulate.common.network.base import Network
+        component_arrays, _, _ = Network._flatten_to_arrays_and_conns(model)
+        component_classes = [ca.dynamics_properties.component_class
+                             for ca in component_arrays.values()]
+    else:
+        component_classes = [model]
+    tmp_dir = None
+    if build_dir is None:
+        build_dir = tmp_dir = tempfile.mkdtemp()
+    try:
+        code_generator = CodeGenerator(base_dir=build_dir, use_cache=False)
+        for component_class in component_classes:
+            url = component_class.url
+            component_class = component_class.clone()
+            if not isinstance(component_class, WithSynapses):
+                component_class = WithSynapses.wrap(component_class)
+            name = component_class.name + BUILD_NAME_SUFFIX
+            if build_version is not None:
+                name += build_version
+            try:
+                build_component_class = code_generator.transform_for_build(
+                    name=name, component_class=component_class)
+                code_generator.generate(build_component_class,
+                                        build_mode='generate_only', url=url)
+            except Exception as e:
+                report.error(component_class.name, "Code generation for {} "
+                             "failed: {}".format(simulator, e))
+    finally:
+        if tmp_dir is not None:
+            shutil.rmtree(tmp_dir, ignore_errors=True)
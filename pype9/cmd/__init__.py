@@ -1,4 +1,11 @@
 from . import convert
 from . import simulate
 from . import plot
+from . import sweep
+from . import cache
+from . import merge
+from . import compare
+from . import check
+from . import submit
+from . import status
 from . import help  # @ReservedAssignment
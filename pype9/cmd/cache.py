@@ -0,0 +1,65 @@
+"""
+Lists and purges the entries of the persistent build cache, in which compiled
+simulator libraries are stored so that unchanged models skip code generation
+and compilation, e.g.::
+
+    $ pype9 cache list
+    $ pype9 cache purge --simulator nest --older_than 30
+"""
+from __future__ import print_function
+from argparse import ArgumentParser
+from pype9.simulate import SIMULATORS
+from pype9.utils.logging import logger
+
+
+def argparser():
+    parser = ArgumentParser(prog='pype9 cache',
+                            description=__doc__)
+    parser.add_argument('action', choices=('list', 'purge'),
+                        help="Whether to list or purge the cache entries")
+    parser.add_argument('--cache_dir', type=str, default=None,
+                        help=("The directory of the build cache (defaults to "
+                              "PYPE9_CACHE_DIR environment variable or "
+                              "'~/.pype9/cache')"))
+    parser.add_argument('--simulator', type=str, default=None,
+                        choices=SIMULATORS,
+                        help="Only select entries built for the simulator")
+    parser.add_argument('--name', type=str, default=None,
+                        help="Only select entries of the named component class")
+    parser.add_argument('--older_than', type=float, default=None,
+                        metavar='DAYS',
+                        help=("Only select entries that haven't been used in "
+                              "the given number of days"))
+    return parser
+
+
+def run(argv):
+    import time
+    from datetime import datetime
+    from pype9.simulate.common.code_gen.cache import BuildCache
+    args = argparser().parse_args(argv)
+
+    cache = BuildCache(args.cache_dir)
+    entries = cache.entries()
+    if args.simulator is not None:
+        entries = [e for e in entries if e.simulator == args.simulator]
+    if args.name is not None:
+        entries = [e for e in entries if e.name == args.name]
+    if args.older_than is not None:
+        cutoff = time.time() - args.older_than * 24 * 60 * 60
+        entries = [e for e in entries if e.last_used < cutoff]
+    if args.action == 'list':
+        if not entries:
+            print("No matching entries in build cache at '{}'"
+                  .format(cache.root))
+        for entry in entries:
+            print("{}  {:<8} {:<30} {:>10.1f} KB  {}  {}".format(
+                entry.key[:12], entry.simulator, entry.name,
+                entry.size / 1024.0,
+                datetime.fromtimestamp(entry.last_used).strftime(
+                    '%Y-%m-%d %H:%M'),
+                entry.url))
+    else:
+        cache.purge(entries)
+        logger.info("Purged {} entries from build cache at '{}'"
+                    .format(len(entries), cache.root))
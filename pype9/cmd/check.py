@@ -0,0 +1,77 @@
+"""
+Checks a 9ML model without simulating it. The document is fully resolved, the
+dimensional consistency of every expression is checked, the receive ports of
+the populations and projections (or of a single cell) are verified to be
+connected (or explicitly ignored with the '--ignore' option), and the code
+generation of each of the given simulators is run without compiling the
+generated code, e.g.::
+
+    $ pype9 check //neuron/Izhikevich#SampleIzhikevich --simulator neuron nest
+
+A report of the errors and warnings (e.g. unused parameters, state variables
+that may grow without bound and missing initial values) is printed and the
+command exits with a non-zero status if any errors are found (or warnings with
+the '--strict' option).
+"""
+from __future__ import print_function
+from argparse import ArgumentParser
+from pype9.simulate import SIMULATORS
+from pype9.utils.logging import logger
+
+
+def argparser():
+    parser = ArgumentParser(prog='pype9 check',
+                            description=__doc__)
+    parser.add_argument('model', type=str,
+                        help=("Path to the nineml model to check. Either a "
+                              "document, in which case all of its elements "
+                              "are checked, or a model within a document "
+                              "(i.e. /path/to/file.xml#model_name)"))
+    parser.add_argument('--simulator', type=str, nargs='+', default=[],
+                        choices=SIMULATORS,
+                        help=("Simulators to run the code generation of "
+                              "(without compiling the generated code)"))
+    parser.add_argument('--ignore', type=str, action='append', default=[],
+                        metavar='PORT',
+                        help=("Receive port that is allowed to be "
+                              "unconnected, either PORT or "
+                              "POPULATION/PROJECTION.PORT"))
+    parser.add_argument('--strict', action='store_true', default=False,
+                        help=("Exit with a non-zero status if any warnings "
+                              "are reported"))
+    parser.add_argument('--build_dir', default=None, type=str,
+                        help=("Base directory to generate the code in (a "
+                              "temporary directory is used by default)"))
+    parser.add_argument('--build_version', type=str, default=None,
+                        help=("Version to append to name to use when building "
+                              "component classes"))
+    return parser
+
+
+def run(argv):
+    """
+    Checks the model and prints the report, returning 1 if any errors (or
+    warnings in strict mode) are found
+    """
+    from nineml.exceptions import NineMLException
+    from pype9.check import check, Report
+    from pype9.utils.arguments import nineml_document
+
+    args = argparser().parse_args(argv)
+
+    try:
+        # Returns the document, or the model if the path includes '#<name>'
+        model = nineml_document(args.model)
+    except (NineMLException, IOError) as e:
+        report = Report()
+        report.error(args.model, "Could not load model: {}".format(e))
+    else:
+        report = check(model, simulators=args.simulator, ignore=args.ignore,
+                       build_dir=args.build_dir,
+                       build_version=args.build_version)
+    print(report)
+    if not report.passed or (args.strict and report.warnings):
+        logger.error("Check of '{}' failed".format(args.model))
+        return 1
+    logger.info("Check of '{}' passed".format(args.model))
+    return 0
@@ -0,0 +1,204 @@
+"""
+Simulates a 9ML model on multiple simulator backends, with the same seeds,
+properties and inputs, and reports quantitative measures of how much the
+recordings diverge between them. Analog signals are compared by the RMS of
+their difference and spike trains by the number of spikes that can't be paired
+within a tolerance, e.g.::
+
+    $ pype9 compare //neuron/Izhikevich#SampleIzhikevich 100.0 0.01 \\
+      --simulators neuron nest --record V --record spike_output \\
+      --init_value U -14.0 mV/ms --init_value V -65.0 mV \\
+      --rms_tolerance 0.5 --spike_tolerance 0.1
+
+The command exits with a non-zero status if any of the tolerances are exceeded
+so it can be used to validate models in continuous integration. An overlay of
+the recordings can be saved with the '--plot' option.
+
+Other than '--record', which only takes the name of the port/state-variable
+(and optional start time), the options are passed to 'pype9 simulate' for each
+simulator.
+"""
+from __future__ import print_function
+from argparse import ArgumentParser
+from itertools import combinations
+from collections import OrderedDict
+from pype9.simulate import SIMULATORS
+from pype9.simulate.common.code_gen import BaseCodeGenerator
+from pype9.utils.logging import logger
+
+
+def argparser():
+    parser = ArgumentParser(prog='pype9 compare',
+                            description=__doc__)
+    parser.add_argument('model', type=str,
+                        help=("Path to the nineml model to compare (see "
+                              "'pype9 simulate')"))
+    parser.add_argument('time', type=float,
+                        help="Time to run the simulations for (ms)")
+    parser.add_argument('timestep', type=float,
+                        help=("Timestep used to solve the differential "
+                              "equations (ms)"))
+    parser.add_argument('--simulators', type=str, nargs='+',
+                        choices=SIMULATORS, default=['neuron', 'nest'],
+                        help=("The simulators to compare (default "
+                              "%(default)s). The recordings of every pair of "
+                              "simulators are compared"))
+    parser.add_argument('--record', type=str, nargs='+', action='append',
+                        default=[],
+                        help=("Record the send port or state variable and "
+                              "compare it between the simulators. Takes "
+                              "either 1 or 3 arguments: PORT/STATE-VARIABLE "
+                              "[T_START T_START_UNITS]"))
+    parser.add_argument('--rms_tolerance', type=float, default=1.0,
+                        help=("The maximum RMS difference between analog "
+                              "signals, in the units they are recorded in by "
+                              "the first simulator (default %(default)s)"))
+    parser.add_argument('--spike_tolerance', type=float, default=0.5,
+                        help=("The maximum difference between the times of "
+                              "spikes (ms) for them to be paired (default "
+                              "%(default)s)"))
+    parser.add_argument('--max_spike_mismatches', type=int, default=0,
+                        help=("The maximum number of spikes in a pair of "
+                              "spike trains that can't be paired (default "
+                              "%(default)s)"))
+    parser.add_argument('--plot', type=str, default=None,
+                        metavar='FILENAME',
+                        help=("Save an overlay plot of the recordings of each "
+                              "simulator to file"))
+    parser.add_argument('--prop', nargs=3, action='append',
+                        metavar=('PARAM', 'VALUE', 'UNITS'), default=[],
+                        help=("Set the property to the given value"))
+    parser.add_argument('--init_regime', type=str, default=None,
+                        help=("Initial regime for dynamics"))
+    parser.add_argument('--init_value', nargs=3, default=[], action='append',
+                        metavar=('STATE-VARIABLE', 'VALUE', 'UNITS'),
+                        help=("Initial value of a state variable"))
+    parser.add_argument('--play', type=str, nargs=2, action='append',
+                        metavar=('PORT', 'FILENAME'), default=[],
+                        help=("Name of receive port and filename with signal "
+                              "to play it into"))
+    parser.add_argument('--seed', type=int, default=None,
+                        help=("Random seed used by every simulator. If not "
+                              "provided one is generated and shared between "
+                              "them"))
+    parser.add_argument('--properties_seed', type=int, default=None,
+                        help=("Random seed used to create network connections "
+                              "and properties"))
+    parser.add_argument('--min_delay', nargs=2, metavar=('DELAY', 'UNITS'),
+                        default=None,
+                        help=("The minimum delay of the model (only "
+                              "applicable for single cell NEST simulations)"))
+    parser.add_argument('--device_delay', nargs=2, metavar=('DELAY', 'UNITS'),
+                        default=None,
+                        help=("The delay applied to signals played into ports "
+                              "of the model (only applicable for NEST "
+                              "simulations)"))
+    parser.add_argument('--build_mode', type=str, default='lazy',
+                        help=("The strategy used to build and compile the "
+                              "model. Can be one of '{}' (default %(default)s)"
+                              .format("', '".join(
+                                  BaseCodeGenerator.BUILD_MODE_OPTIONS))))
+    parser.add_argument('--build_dir', default=None, type=str,
+                        help=("Base build directory"))
+    parser.add_argument('--build_version', type=str, default=None,
+                        help=("Version to append to name to use when building "
+                              "component classes"))
+    return parser
+
+
+def run(argv):
+    """
+    Runs the simulations and compares them, returning 1 if any of the
+    tolerances are exceeded
+    """
+    import os.path
+    import shutil
+    import tempfile
+    import numpy
+    import neo.io
+    import quantities as pq
+    from pype9.exceptions import Pype9UsageError
+    from pype9.compare import compare_segments
+    from pype9.cmd import simulate
+
+    args = argparser().parse_args(argv)
+
+    if len(args.simulators) < 2:
+        raise Pype9UsageError(
+            "At least two simulators need to be provided to compare ({})"
+            .format(args.simulators))
+    if not args.record:
+        raise Pype9UsageError(
+            "No recorders set, please specify at least one with the '--record'"
+            " option")
+    for rec in args.record:
+        if len(rec) not in (1, 3):
+            raise Pype9UsageError(
+                "Record options can have either 1 or 3 arguments (provided "
+                "{}): PORT/STATE-VARIABLE [T_START T_START_UNITS]"
+                .format(len(rec)))
+    record_names = [rec[0] for rec in args.record]
+    seed = args.seed
+    if seed is None:
+        seed = int(numpy.random.randint(1, 2 ** 31 - 1))
+        logger.info("Using {} as the seed for all simulators".format(seed))
+
+    tmp_dir = tempfile.mkdtemp()
+    try:
+        recordings = OrderedDict()
+        for simulator in args.simulators:
+            sim_argv = [args.model, simulator, str(args.time),
+                        str(args.timestep), '--seed', str(seed),
+                        '--build_mode', args.build_mode]
+            fnames = []
+            for i, rec in enumerate(args.record):
+                fname = os.path.join(tmp_dir, '{}-{}.neo.pkl'.format(
+                    simulator, i))
+                sim_argv.extend(['--record', rec[0], fname] + list(rec[1:]))
+                fnames.append(fname)
+            for opt in ('prop', 'init_value', 'play'):
+                for vals in getattr(args, opt):
+                    sim_argv.extend(['--' + opt] + list(vals))
+            for opt in ('init_regime', 'properties_seed', 'build_dir',
+                        'build_version'):
+                if getattr(args, opt) is not None:
+                    sim_argv.extend(['--' + opt, str(getattr(args, opt))])
+            for opt in ('min_delay', 'device_delay'):
+                if getattr(args, opt) is not None:
+                    sim_argv.extend(['--' + opt] + list(getattr(args, opt)))
+            logger.info("Simulating '{}' with {}".format(args.model,
+                                                         simulator))
+            simulate.run(sim_argv)
+            recordings[simulator] = [neo.io.PickleIO(f).read()[0]
+                                     for f in fnames]
+    finally:
+        shutil.rmtree(tmp_dir)
+
+    failed = False
+    print("{:<10} {:<10} {:<30} {:<18} {:>12} {:>12}  {}".format(
+        'sim1', 'sim2', 'recording', 'metric', 'value', 'tolerance',
+        'result'))
+    for sim1, sim2 in combinations(args.simulators, 2):
+        for name, seg1, seg2 in zip(record_names, recordings[sim1],
+                                    recordings[sim2]):
+            for comp in compare_segments(
+                    seg1, seg2, rms_tolerance=args.rms_tolerance,
+                    spike_tolerance=args.spike_tolerance * pq.ms,
+                    max_spike_mismatches=args.max_spike_mismatches):
+                failed |= not comp.passed
+                print("{:<10} {:<10} {:<30} {:<18} {:>12.6g} {:>12.6g}  {}"
+                      .format(sim1, sim2, '{}:{}'.format(name, comp.name),
+                              comp.metric, comp.value, comp.tolerance,
+                              'PASS' if comp.passed else 'FAIL'))
+    if args.plot is not None:
+        import matplotlib
+        matplotlib.use('Agg')  # Set to use Agg so DISPLAY is not required
+        from pype9.plot import plot_comparison
+        plot_comparison(recordings, record_names, save=args.plot, show=False)
+    if failed:
+        logger.error("Recordings of '{}' diverge between simulators by more "
+                     "than the given tolerances".format(args.model))
+        return 1
+    logger.info("Recordings of '{}' match between simulators ({}) within the "
+                "given tolerances".format(args.model,
+                                          ', '.join(args.simulators)))
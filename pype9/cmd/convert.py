@@ -1,29 +1,91 @@
 """
 Tool to convert 9ML files between different supported formats (e.g. XML_,
 JSON_, YAML_) and 9ML versions.
+
+With '--format sonata', SONATA_ networks (circuit config files) can be
+converted into 9ML networks, e.g.::
+
+    $ pype9 convert --format sonata circuit_config.json my_network.xml
+
+and simulation output saved in Neo_ format can be converted into SONATA_
+spike/report files, e.g.::
+
+    $ pype9 convert --format sonata my_recording.neo.pkl my_recording.h5
+
+With '--format neuroml' (the default for files ending in '.nml'), the LEMS
+ComponentTypes and components of NeuroML2_ documents can be converted into 9ML
+Dynamics classes and properties, e.g.::
+
+    $ pype9 convert izhikevich.nml izhikevich.xml \\
+      --lems_include ~/git/NeuroML2/NeuroML2CoreTypes
+
+where '--lems_include' points to the directory containing the LEMS
+definitions of the standard NeuroML2 types (if the model uses them).
 """
 from argparse import ArgumentParser
 from pype9.utils.arguments import nineml_document
 from pype9.utils.logging import logger
 
+FORMATS = ('nineml', 'sonata', 'neuroml')
+
 
 def argparser():
     parser = ArgumentParser(prog='pype9 convert',
                             description=__doc__)
-    parser.add_argument('in_file', type=nineml_document,
-                        help="9ML file to be converted")
+    parser.add_argument('in_file', type=str,
+                        help=("9ML file to be converted (or SONATA config/Neo "
+                              "file if '--format sonata')"))
     parser.add_argument('out_file', help="Converted filename")
     parser.add_argument('--nineml_version', '-v', type=str, default=None,
                         help="The version of nineml to output")
+    parser.add_argument('--format', '-f', type=str, choices=FORMATS,
+                        default=None,
+                        help=("The format of the file to convert from/to 9ML "
+                              "(default 'neuroml' for files ending in '.nml' "
+                              "and 'nineml' otherwise)"))
+    parser.add_argument('--sonata_population', type=str, default='pype9',
+                        help=("The name of the node population written to "
+                              "SONATA output files (default %(default)s)"))
+    parser.add_argument('--lems_include', type=str, action='append',
+                        default=[], metavar='DIR',
+                        help=("Directory to search for included LEMS files, "
+                              "such as the NeuroML2 core types, when "
+                              "converting NeuroML2 documents. Can be provided "
+                              "multiple times"))
     return parser
 
 
 def run(argv):
     args = argparser().parse_args(argv)
 
-    doc = args.in_file.clone()
     kwargs = {}
     if args.nineml_version is not None:
         kwargs['version'] = args.nineml_version
-    doc.write(args.out_file, **kwargs)
+    fmt = args.format
+    if fmt is None:
+        from pype9.io import neuroml
+        fmt = ('neuroml' if args.in_file.endswith(neuroml.EXTENSION)
+               else 'nineml')
+    if fmt == 'neuroml':
+        # Convert NeuroML2/LEMS model into 9ML
+        from pype9.io import neuroml
+        doc = neuroml.read(args.in_file, include_dirs=args.lems_include)
+        doc.write(args.out_file, **kwargs)
+    elif fmt == 'sonata':
+        from pype9.io import sonata
+        if sonata.is_config(args.in_file):
+            # Convert SONATA network into 9ML network
+            import nineml
+            network = sonata.read(args.in_file)
+            doc = nineml.Document(network)
+            doc.write(args.out_file, **kwargs)
+        else:
+            # Convert simulation output in Neo format to SONATA output
+            import neo.io
+            seg = neo.io.PickleIO(filename=args.in_file).read()[0]
+            sonata.write(args.out_file, seg,
+                         population=args.sonata_population)
+    else:
+        doc = nineml_document(args.in_file).clone()
+        doc.write(args.out_file, **kwargs)
     logger.info("Converted '{}' to '{}'".format(args.in_file, args.out_file))
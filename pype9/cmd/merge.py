@@ -0,0 +1,72 @@
+"""
+Merges recordings of a network population that were written to separate files
+by each MPI process (i.e. with 'pype9 simulate --mpi --mpi_output per_rank')
+into a single file, e.g.::
+
+    $ mpirun -n 4 pype9 simulate my_network.xml nest 100.0 0.01 --mpi \\
+      --mpi_output per_rank --record Exc.spike_out exc.neo.pkl
+    $ pype9 merge exc.neo.pkl --num_ranks 4
+
+The per-process files can also be listed explicitly with the '--inputs'
+option. Files ending in '.nwb' are read and written in NWB format and all
+other files in Neo format.
+"""
+from argparse import ArgumentParser
+from pype9.utils.logging import logger
+
+
+def argparser():
+    parser = ArgumentParser(prog='pype9 merge',
+                            description=__doc__)
+    parser.add_argument('output', type=str,
+                        help=("The file to write the merged recordings to. "
+                              "Unless '--inputs' is provided the files to "
+                              "merge are assumed to have been written to "
+                              "this path with the ranks of the MPI processes "
+                              "inserted before the extension (e.g. "
+                              "'exc.neo.0.pkl', 'exc.neo.1.pkl', ...)"))
+    parser.add_argument('--num_ranks', type=int, default=None,
+                        help=("The number of MPI processes the recordings "
+                              "were written by"))
+    parser.add_argument('--inputs', type=str, nargs='+', default=None,
+                        metavar='FILENAME',
+                        help="The per-process files to merge")
+    return parser
+
+
+def run(argv):
+    from pype9.exceptions import Pype9UsageError
+    from pype9.utils.mpi import rank_path, merge_segments
+    args = argparser().parse_args(argv)
+
+    if args.inputs is not None:
+        if args.num_ranks is not None:
+            raise Pype9UsageError(
+                "Only one of '--inputs' and '--num_ranks' can be provided")
+        inputs = args.inputs
+    elif args.num_ranks is not None:
+        inputs = [rank_path(args.output, i) for i in range(args.num_ranks)]
+    else:
+        raise Pype9UsageError(
+            "Either '--inputs' or '--num_ranks' needs to be provided")
+    merged = merge_segments(read_recording(p) for p in inputs)
+    write_recording(args.output, merged)
+    logger.info("Merged recordings from {} files into '{}'"
+                .format(len(inputs), args.output))
+
+
+def read_recording(path):
+    import neo.io
+    from pype9.io import nwb
+    if path.endswith(nwb.EXTENSION):
+        return nwb.read(path)
+    return neo.io.PickleIO(path).read()[0]
+
+
+def write_recording(path, segment):
+    import neo.io
+    from pype9.io import nwb
+    if path.endswith(nwb.EXTENSION):
+        nwb.write(path, segment)
+    else:
+        neo.io.PickleIO(path).write(segment)
@@ -3,7 +3,20 @@ Simple tool for plotting the output of PyPe9 simulations using Matplotlib_.
 Since Pype9 output is stored in Neo_ format, it can be used to plot generic
 Neo_ files but it also includes handling of Pype9-specific annotations, such as
 regime transitions.
+
+The figure can be split into multiple panels combining raster plots of spike
+trains (grouped by population), firing-rate histograms and analog signals,
+e.g.::
+
+    $ pype9 plot exc.neo.pkl inh.neo.pkl --panels raster rate analog:V \\
+      --bin_width 5.0 --style paper.mplstyle --save brunel.pdf
+
+where the spike trains of the recordings of each file are grouped into a
+separate population if they aren't annotated with one. Styles are specified
+by Matplotlib style names or matplotlibrc-like files, and interactive plots
+are written with Plotly or Bokeh if the output filename ends in '.html'.
 """
+import os.path
 from argparse import ArgumentParser
 from pype9.utils.arguments import existing_file
 from pype9.utils.logging import logger  # @UnusedImport
@@ -12,10 +25,12 @@ from pype9.utils.logging import logger  # @UnusedImport
 def argparser():
     parser = ArgumentParser(prog='pype9 plot',
                             description=__doc__)
-    parser.add_argument('filename', type=existing_file,
-                        help="Neo file outputted from a PyPe9 simulation")
+    parser.add_argument('filenames', type=existing_file, nargs='+',
+                        metavar='FILENAME',
+                        help="Neo file(s) outputted from a PyPe9 simulation")
     parser.add_argument('--save', type=str, default=None,
-                        help="Location to save the figure to")
+                        help=("Location to save the figure to (interactive "
+                              "HTML if it ends in '.html')"))
     parser.add_argument('--dims', type=int, nargs=2, default=(10, 8),
                         metavar=('WIDTH', 'HEIGHT'),
                         help="Dimensions of the plot")
@@ -23,6 +38,32 @@ def argparser():
                         help="Whether to show the plot or not")
     parser.add_argument('--resolution', type=float, default=300.0,
                         help="Resolution of the figure when it is saved")
+    parser.add_argument('--title', type=str, default=None,
+                        help="The title of the figure")
+    parser.add_argument('--panels', type=str, nargs='+', default=None,
+                        metavar='PANEL',
+                        help=("The panels of the figure from top to bottom, "
+                              "'raster', 'rate' or 'analog' (optionally "
+                              "followed by ':<signal-name>', e.g. "
+                              "'analog:V'). Defaults to a raster plot above "
+                              "the analog signals"))
+    parser.add_argument('--bin_width', type=float, default=None,
+                        help=("The width of the bins of the firing-rate "
+                              "histograms (ms), adds a 'rate' panel below the "
+                              "raster plot if '--panels' isn't provided"))
+    parser.add_argument('--group_by', type=str, default='source_population',
+                        metavar='ANNOTATION',
+                        help=("The annotation the spike trains are grouped "
+                              "by in raster plots and rate histograms "
+                              "(default %(default)s)"))
+    parser.add_argument('--style', type=str, default=None,
+                        help=("Matplotlib style name or path to a "
+                              "matplotlibrc-like style file to plot the "
+                              "figure with"))
+    parser.add_argument('--html_library', type=str, default='plotly',
+                        choices=('plotly', 'bokeh'),
+                        help=("The library used to write interactive HTML "
+                              "plots (default %(default)s)"))
     return parser
 
 
@@ -30,17 +71,57 @@ def run(argv):
     import neo
     from pype9.exceptions import Pype9UsageError
     args = argparser().parse_args(argv)
-    if args.hide:
+    html = args.save is not None and args.save.endswith('.html')
+    if args.hide or html:
         import matplotlib  # @IgnorePep8
         matplotlib.use('Agg')  # Set to use Agg so DISPLAY is not required
-    from pype9.plot import plot  # @IgnorePep8
+    from pype9.plot import plot, plot_html  # @IgnorePep8
 
-    segments = neo.PickleIO(args.filename).read()
-    if len(segments) > 1:
-        raise Pype9UsageError(
-            "Expected only a single recording segment in file '{}', found {}."
-            .format(args.filename, len(segments)))
+    segments = []
+    for fname in args.filenames:
+        file_segments = neo.PickleIO(fname).read()
+        if len(file_segments) > 1:
+            raise Pype9UsageError(
+                "Expected only a single recording segment in file '{}', "
+                "found {}.".format(fname, len(file_segments)))
+        segments.append(file_segments[0])
 
-    seg = segments[0]
-    plot(seg, dims=args.dims, show=not args.hide, resolution=args.resolution,
-         save=args.save)
+    if len(segments) == 1:
+        seg = segments[0]
+    else:
+        seg = combine_segments(segments, args.filenames, args.group_by)
+    if html:
+        plot_html(seg, args.save, panels=args.panels,
+                  bin_width=args.bin_width, group_by=args.group_by,
+                  title=args.title, library=args.html_library,
+                  show=not args.hide)
+    else:
+        plot(seg, dims=args.dims, show=not args.hide,
+             resolution=args.resolution, save=args.save, title=args.title,
+             panels=args.panels, bin_width=args.bin_width,
+             group_by=args.group_by, style=args.style)
+
+
+def combine_segments(segments, filenames, group_by):
+    """
+    Combines the segments read from multiple files into a single segment,
+    annotating the spike trains that aren't already grouped with the name of
+    the file they were read from and prefixing the names of analog signals
+    with it
+    """
+    import neo
+    combined = neo.Segment()
+    for seg, fname in zip(segments, filenames):
+        # Strip all extensions, e.g. 'exc.neo.pkl' -> 'exc'
+        group = os.path.basename(fname).split('.')[0]
+        for spiketrain in seg.spiketrains:
+            if group_by not in spiketrain.annotations:
+                spiketrain.annotate(**{group_by: group})
+            combined.spiketrains.append(spiketrain)
+        for signal in seg.analogsignals:
+            signal.name = '{}.{}'.format(
+                group, signal.name if signal.name else len(
+                    combined.analogsignals))
+            combined.analogsignals.append(signal)
+        combined.epochs.extend(seg.epochs)
+    return combined
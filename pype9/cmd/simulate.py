@@ -1,6 +1,7 @@
 """
 Simulates a single cell defined by a 9ML Dynamics or DynamicsProperties, or a
-complete 9ML network, using either Neuron_ or NEST_ as the simulator backend.
+complete 9ML network, using either Neuron_, NEST_ or Arbor_ as the simulator
+backend.
 
 Send ports and state-variables of the simulation can be recorded and saved to
 file in Neo_ format using the '--record' option, e.g.::
@@ -8,6 +9,11 @@ file in Neo_ format using the '--record' option, e.g.::
     $ pype9 simulate my_cell.xml nest 100.0 0.01 \\
       --record my_event_port ~/my_even_port.neo.pkl
 
+Recordings are saved in NWB_ format instead if the filename ends with '.nwb',
+and recordings from networks in SONATA_ format if the filename ends with
+'.h5'. The format can also be set explicitly with the '--record_format'
+option.
+
 For single-cell simulations, analog and event inputs stored in Neo_ format
 can be "played" into ports of the Dynamics class using the '--play' option
 e.g.::
@@ -16,24 +22,115 @@ e.g.::
       --record my_event_port data-dir/my_even_port.neo.pkl \\
       --play my_analog_receive_port data-dir/my_input_current.neo.pkl
 
+Analog signals can be played into any analog receive port with matching
+dimension and are interpolated linearly between their sample points if
+'--interpolation linear' is provided. The membrane voltage of a single cell
+can be clamped to a signal with the '--voltage_clamp' option and the current
+injected by the clamp recorded by passing 'clamp_current' as the port to
+'--record', e.g.::
+
+    $ pype9 simulate my_cell.xml nest 100.0 0.01 \\
+      --voltage_clamp data-dir/steps.neo.pkl --series_resistance 0.01 \\
+      --record clamp_current data-dir/clamp_current.neo.pkl
+
+
+The state of the simulation at the end of the run can be saved with the
+'--save_state' option and the simulation resumed from it with the
+'--restore' option, in which case the simulation is run from the time of the
+saved state until the given time, e.g.::
+
+    $ pype9 simulate my_cell.xml neuron 50.0 0.01 \\
+      --record v data-dir/v_first.neo.pkl --save_state checkpoint.h5
+    $ pype9 simulate my_cell.xml neuron 100.0 0.01 \\
+      --record v data-dir/v.neo.pkl --restore checkpoint.h5
+
+Network simulations can be distributed over multiple processes by running
+the command with ``mpirun`` and passing the '--mpi' option (NEURON and NEST
+backends only). Recordings are gathered to the master process, which writes
+them to file, or written to a separate file by each process if
+'--mpi_output per_rank' is provided (which can be merged afterwards with
+'pype9 merge'), e.g.::
+
+    $ mpirun -n 4 pype9 simulate my_network.xml nest 100.0 0.01 --mpi \
+      --record Exc.spike_out exc.neo.pkl
+
+NEURON simulations can be run with CoreNEURON (on the CPU or GPU) by passing
+the '--coreneuron' option (and '--gpu' to run on the GPU), in which case the
+generated mechanisms are built to be compatible with CoreNEURON, e.g.::
+
+    $ pype9 simulate my_network.xml neuron 1000.0 0.025 --coreneuron --gpu \
+      --record Exc.spike_out exc.neo.pkl
+
+Multi-epoch stimulation protocols with repeated trials (e.g. F-I curves,
+chirps and paired pulses) can be played into single cells by passing a
+protocol file (YAML or JSON, see ``pype9.protocol``) to the '--protocol'
+option, e.g.::
+
+    $ pype9 simulate my_cell.xml neuron 2000.0 0.01 \
+      --record v data-dir/v.neo.pkl --protocol fi_curve.yml
+
+in which case the Neo_ recordings are split into a segment for each recorded
+epoch of each trial (NWB recordings are written continuously with the epochs
+in the epochs table).
+
+A reproducibility manifest, recording the hash of the model, its properties,
+all the seeds of each process/thread, the simulator and package versions, the
+hash of the code-generation templates, the time step and the ODE solver (see
+``pype9.repro``), is written along with the recordings (with the extension of
+the first recording replaced by '.manifest.json') or to the path given to the
+'--manifest' option. The simulation can be replayed from the manifest with the
+'--reproduce' option, which writes the new recordings into the directory given
+to '--output_dir' (defaults to 'reproduced' next to the manifest), e.g.::
+
+    $ pype9 simulate --reproduce data-dir/v.manifest.json \
+      --output_dir data-dir/replay
+
+The replay is bit-for-bit identical where the backend allows, which requires
+that it is run on the same number of MPI processes with the same simulator
+version. Differences between the environments are reported as warnings (or
+errors if '--strict' is provided).
+
+The progress of the simulation can be displayed with the '--progress' option,
+which shows a progress bar if tqdm_ is installed (and logs the progress
+otherwise) at the interval given to '--progress_interval' (1% of the run by
+default). Pressing Ctrl-C while the simulation is running cancels it cleanly at
+the next progress report, after which the recordings up to that point are
+written to file as usual (pressing Ctrl-C again aborts the simulation), e.g.::
+
+    $ pype9 simulate my_network.xml nest 60000.0 0.1 --progress \
+      --record Exc.spike_out exc.neo.pkl
+
+Networks described in SONATA_ can also be simulated by passing the path to
+their circuit config file (JSON), provided the node and edge types reference
+9ML models (see ``pype9.io.sonata``).
 
 Properties, initial values and the initial regime (for single cells) can be
 overridden with the '--prop', '--initial_value' and '--initial_regime'
 respectively and must be provided for every parameter/state-variable if they
 are not in the model description file.
 """
-from builtins import next
+from builtins import next, object
 import collections
+import signal
 from argparse import ArgumentParser
 from nineml import units as un
+from pype9.simulate import SIMULATORS, load_backend
 from pype9.simulate.common.code_gen import BaseCodeGenerator
 import quantities as pq
 from pype9.utils.arguments import nineml_model
 from pype9.utils.units import parse_units
 from pype9.utils.logging import logger
+from pype9.repro import MANIFEST_EXTENSION
 
 RecordSpec = collections.namedtuple('RecordSpec', 'port fname t_start')
 
+RECORD_FORMATS = ('neo', 'nwb', 'sonata')
+
+# The name passed to '--record' to record the current of the voltage clamp
+CLAMP_CURRENT = 'clamp_current'
+
+MPI_OUTPUTS = ('gather', 'per_rank')
+
 
 def argparser():
     parser = ArgumentParser(prog='pype9 simulate',
@@ -46,7 +143,8 @@ def argparser():
                               "with multiple components, the name of component"
                               " to simulated must be appended after a #, "
                               "e.g. //neuron/izhikevich#izhikevich"))
-    parser.add_argument('simulator', choices=('neuron', 'nest'), type=str,
+    parser.add_argument('simulator',
+                        choices=SIMULATORS, type=str,
                         help="Which simulator backend to use")
     parser.add_argument('time', type=float,
                         help="Time to run the simulation for (ms)")
@@ -68,10 +166,35 @@ def argparser():
                               "Each record option can have either 2 or 4 "
                               "arguments: PORT/STATE-VARIABLE FILENAME "
                               "[T_START T_START_UNITS]"))
+    parser.add_argument('--record_format', '--record-format', type=str,
+                        choices=RECORD_FORMATS, default=None,
+                        help=("The format to save the recordings in. If not "
+                              "provided it is determined from the extension "
+                              "of the filename ('.nwb' for NWB, '.h5' for "
+                              "SONATA (networks only) and Neo otherwise)"))
     parser.add_argument('--play', type=str, nargs=2, action='append',
                         metavar=('PORT', 'FILENAME'), default=[],
                         help=("Name of receive port and filename with signal "
                               "to play it into"))
+    parser.add_argument('--interpolation', type=str, default='step',
+                        choices=('step', 'linear'),
+                        help=("How analog signals played into the cell are "
+                              "interpolated between their sample points "
+                              "(default %(default)s)"))
+    parser.add_argument('--voltage_clamp', type=str, default=None,
+                        metavar='FILENAME',
+                        help=("Filename of a signal to clamp the membrane "
+                              "voltage of a single cell to"))
+    parser.add_argument('--series_resistance', type=float, default=1e-3,
+                        metavar='MOHM',
+                        help=("The series resistance of the voltage clamp in "
+                              "MOhm (default %(default)s)"))
+    parser.add_argument('--protocol', type=str, default=None,
+                        metavar='FILENAME',
+                        help=("Protocol file (YAML or JSON) describing the "
+                              "stimuli played into the ports of a single "
+                              "cell over multiple epochs and trials (see "
+                              "pype9.protocol)"))
     parser.add_argument('--seed', type=int, default=None,
                         help=("Random seed used to create network and "
                               "properties"))
@@ -79,6 +202,12 @@ def argparser():
                         help=("Random seed used to create network connections "
                               "and properties. If not provided it is generated"
                               " from the '--seed' option."))
+    parser.add_argument('--manifest', type=str, default=None,
+                        metavar='FILENAME',
+                        help=("Path to write the reproducibility manifest to. "
+                              "If not provided it is written alongside the "
+                              "first recording with the '{}' extension"
+                              .format(MANIFEST_EXTENSION)))
     parser.add_argument('--min_delay', nargs=2, metavar=('DELAY', 'UNITS'),
                         default=None,
                         help=("The minimum delay of the model (only "
@@ -98,6 +227,61 @@ def argparser():
     parser.add_argument('--build_version', type=str, default=None,
                         help=("Version to append to name to use when building "
                               "component classes"))
+    parser.add_argument('--restore', type=str, default=None,
+                        metavar='FILENAME',
+                        help=("Restore the state of the simulation from a "
+                              "file saved with '--save_state' before running "
+                              "it"))
+    parser.add_argument('--save_state', type=str, default=None,
+                        metavar='FILENAME',
+                        help=("Save the state of the simulation to file at the "
+                              "end of the run so it can be resumed with "
+                              "'--restore'"))
+    parser.add_argument('--mpi', action='store_true', default=False,
+                        help=("Distribute the network simulation over the "
+                              "MPI processes the command is run on with "
+                              "mpirun (NEURON and NEST only)"))
+    parser.add_argument('--mpi_output', type=str, choices=MPI_OUTPUTS,
+                        default='gather',
+                        help=("Whether the recordings are gathered to the "
+                              "master process and written to a single file "
+                              "or each process writes the data recorded from "
+                              "its local cells to a separate file, with its "
+                              "rank inserted before the extension (default "
+                              "%(default)s)"))
+    parser.add_argument('--coreneuron', action='store_true', default=False,
+                        help=("Build CoreNEURON-compatible mechanisms and run "
+                              "the simulation with CoreNEURON (NEURON only)"))
+    parser.add_argument('--gpu', action='store_true', default=False,
+                        help=("Run the CoreNEURON simulation on the GPU "
+                              "(requires '--coreneuron')"))
+    parser.add_argument('--progress', action='store_true', default=False,
+                        help=("Display the progress of the simulation (with "
+                              "a progress bar if tqdm is installed)"))
+    parser.add_argument('--progress_interval', type=float, default=None,
+                        metavar='INTERVAL',
+                        help=("The interval of simulation time between "
+                              "progress reports (ms). Defaults to 1%% of the "
+                              "run"))
+    return parser
+
+
+def reproduce_argparser():
+    parser = ArgumentParser(prog='pype9 simulate --reproduce',
+                            description=("Replays a simulation from the "
+                                         "manifest written by 'pype9 "
+                                         "simulate'"))
+    parser.add_argument('--reproduce', type=str, required=True,
+                        metavar='MANIFEST',
+                        help="The manifest of the simulation to replay")
+    parser.add_argument('--output_dir', type=str, default=None,
+                        help=("The directory to write the recordings of the "
+                              "replay to (default 'reproduced' in the "
+                              "directory of the manifest)"))
+    parser.add_argument('--strict', action='store_true', default=False,
+                        help=("Raise an error instead of a warning if the "
+                              "environment differs from the one the manifest "
+                              "was created in"))
     return parser
 
 
@@ -105,8 +289,12 @@ def run(argv):
     """
     Runs the simulation script from the provided arguments
     """
+    if '--reproduce' in argv:
+        return reproduce(argv)
     import nineml
     from pype9.exceptions import Pype9UsageError
+    from pype9.utils.mpi import mpi_comm, is_mpi_master, rank_path
+    from pype9.repro import Manifest, default_manifest_path
     import neo.io
 
     args = argparser().parse_args(argv)
@@ -114,18 +302,52 @@ def run(argv):
     time = args.time * un.ms
     timestep = args.timestep * un.ms
 
-    if args.simulator == 'neuron':
-        from pype9.simulate.neuron import Network, CellMetaClass, Simulation  # @UnusedImport @IgnorePep8
-    elif args.simulator == 'nest':
-        from pype9.simulate.nest import Network, CellMetaClass, Simulation  # @Reimport @IgnorePep8
-    else:
-        assert False
+    backend = load_backend(args.simulator)
+    Network = backend.Network
+    CellMetaClass = backend.CellMetaClass
+    Simulation = backend.Simulation
 
     if not args.record:
         raise Pype9UsageError(
             "No recorders set, please specify at least one with the '--record'"
             " option")
 
+    if args.mpi:
+        if args.simulator == 'arbor':
+            raise Pype9UsageError(
+                "The '--mpi' option is only supported by the NEURON and NEST "
+                "backends (Arbor distributes simulations over MPI processes "
+                "via its execution context)")
+        elif args.simulator == 'genn':
+            raise Pype9UsageError(
+                "The '--mpi' option is only supported by the NEURON and NEST "
+                "backends (GeNN simulations run on a single GPU)")
+        if mpi_comm.size == 1:
+            logger.warning("'--mpi' option provided but the simulation is "
+                           "only running on a single process")
+    elif mpi_comm.size > 1 and args.simulator != 'arbor':
+        raise Pype9UsageError(
+            "Running on {} MPI processes, please provide the '--mpi' option "
+            "to distribute the network simulation over them"
+            .format(mpi_comm.size))
+
+    if args.coreneuron or args.gpu:
+        if args.simulator != 'neuron':
+            raise Pype9UsageError(
+                "The '--coreneuron' and '--gpu' options can only be used with "
+                "the NEURON simulator")
+        if not args.coreneuron:
+            raise Pype9UsageError(
+                "The '--gpu' option requires the '--coreneuron' option")
+        # The code generator is shared between the simulation and the cell
+        # classes so that they are built to be CoreNEURON compatible
+        code_gen_kwargs = {'code_generator': backend.CodeGenerator(
+            base_dir=args.build_dir, coreneuron=True)}
+        sim_kwargs = dict(code_gen_kwargs, coreneuron=True, gpu=args.gpu)
+    else:
+        code_gen_kwargs = {'build_base_dir': args.build_dir}
+        sim_kwargs = {}
+
     min_delay = (float(args.min_delay[0]) *
                     parse_units(args.min_delay[1])
                     if args.min_delay is not None else 1.0 * un.ms)
@@ -164,28 +386,67 @@ def run(argv):
             "from complete document) does not contain any projections"
             .format(model))
 
+    if args.mpi and not isinstance(model, nineml.Network):
+        raise Pype9UsageError(
+            "The '--mpi' option can only be used with network simulations "
+            "({} is not a network)".format(model))
+
+    if args.voltage_clamp is not None and isinstance(model, nineml.Network):
+        raise Pype9UsageError(
+            "The '--voltage_clamp' option can only be used with single cell "
+            "simulations ({} is a network)".format(model))
+
+    if args.protocol is not None:
+        if isinstance(model, nineml.Network):
+            raise Pype9UsageError(
+                "The '--protocol' option can only be used with single cell "
+                "simulations ({} is a network)".format(model))
+        from pype9.protocol import Protocol
+        protocol = Protocol.read(args.protocol)
+        if protocol.duration > args.time:
+            raise Pype9UsageError(
+                "Simulation time ({} ms) is shorter than the duration of the "
+                "protocol in '{}' ({} ms)".format(args.time, args.protocol,
+                                                  protocol.duration))
+    else:
+        protocol = None
+
     if isinstance(model, nineml.Network):
         with Simulation(dt=timestep, seed=args.seed,
                         properties_seed=args.properties_seed,
-                        device_delay=device_delay,
-                        **model.delay_limits()) as sim:
+                        device_delay=device_delay, **dict(
+                            model.delay_limits(),
+                            **dict(code_gen_kwargs, **sim_kwargs))) as sim:
             # Construct the network
             logger.info("Constructing network")
+            # The cell classes of the network are built with the code
+            # generator of the simulation (e.g. for CoreNEURON)
             network = Network(model, build_mode=args.build_mode,
-                              build_base_dir=args.build_dir)
+                              **code_gen_kwargs)
             logger.info("Finished constructing the '{}' network"
                         .format(model.name))
             for rspec in record_specs:
                 pop_name, port_name = rspec.port.split('.')
                 network.component_array(pop_name).record(port_name)
             logger.info("Running the simulation")
-            sim.run(time)
+            run_simulation(sim, time, args)
+            metadata = simulation_metadata(sim, model, args)
+            manifest = Manifest.create(sim, model, argv=argv)
         logger.info("Writing recorded data to file")
+        per_rank = args.mpi_output == 'per_rank'
         for rspec in record_specs:
             pop_name, port_name = rspec.port.split('.')
             pop = network.component_array(pop_name)
-            neo.PickleIO(rspec.fname).write(pop.recording(
-                port_name, t_start=rspec.t_start))
+            data = pop.recording(port_name, t_start=rspec.t_start,
+                                 gather=not per_rank)
+            if per_rank:
+                write_recording(rank_path(rspec.fname), data,
+                                args.record_format, metadata, model=model,
+                                pop_name=pop_name)
+            elif is_mpi_master():
+                # Only the master process holds the gathered recordings
+                write_recording(rspec.fname, data, args.record_format,
+                                metadata, model=model, pop_name=pop_name)
     else:
         assert isinstance(model, (nineml.DynamicsProperties, nineml.Dynamics))
         # Override properties passed as options
@@ -220,20 +481,29 @@ def run(argv):
         # FIXME: A bit of a hack until better detection of input currents is
         #        implemented in neuron code gen.
         external_currents = []
-        for port_name, _ in args.play:
-            if component_class.port(port_name).dimension == un.current:
+        play_ports = [p for p, _ in args.play]
+        if protocol is not None:
+            play_ports.extend(protocol.analog_port_names)
+        for port_name in play_ports:
+            if (component_class.port(port_name).dimension == un.current and
+                    port_name not in external_currents):
                 external_currents.append(port_name)
+        build_kwargs = dict(code_gen_kwargs)
+        if args.voltage_clamp is not None and args.simulator == 'nest':
+            # NEST cells need to be built with the voltage clamp
+            build_kwargs['voltage_clamp'] = True
         # Build cell class
         Cell = CellMetaClass(component_class,
                              build_mode=args.build_mode,
                              external_currents=external_currents,
                              build_version=args.build_version,
-                             build_base_dir=args.build_dir)
+                             **build_kwargs)
         record_regime = False
         with Simulation(dt=timestep, seed=args.seed,
+                        properties_seed=args.properties_seed,
                         min_delay=min_delay,
                         device_delay=device_delay,
-                        build_base_dir=args.build_dir) as sim:
+                        **dict(code_gen_kwargs, **sim_kwargs)) as sim:
             # Create cell
             cell = Cell(props, regime_=init_regime, **init_state)
             # Play inputs
@@ -249,9 +519,27 @@ def run(argv):
                             .format(signal.t_start, signal.t_stop,
                                     signal.sampling_period, port_name))
                 # Input is an event train or analog signal
-                cell.play(port_name, signal)
+                cell.play(port_name, signal, interpolation=args.interpolation)
+            if args.voltage_clamp is not None:
+                voltages = neo.io.PickleIO(
+                    filename=args.voltage_clamp).read()[0].analogsignals[0]
+                logger.info("Clamping voltage to signal (t_start: {}, "
+                            "t_stop: {}, dt: {})".format(
+                                voltages.t_start, voltages.t_stop,
+                                voltages.sampling_period))
+                cell.voltage_clamp(
+                    voltages, series_resistance=args.series_resistance,
+                    interpolation=args.interpolation)
+            if protocol is not None:
+                logger.info("Playing stimuli of protocol '{}' ({} trials) "
+                            "into ports '{}'".format(
+                                args.protocol, protocol.num_trials,
+                                "', '".join(protocol.port_names)))
+                protocol.play(cell, args.timestep)
             # Set up recorders
             for rspec in record_specs:
+                if rspec.port == CLAMP_CURRENT:
+                    continue  # Recorded by the voltage clamp
                 if (component_class.num_regimes > 1 and component_class.port(
                         rspec.port).communicates == 'analog'):
                     record_regime = True
@@ -259,7 +547,14 @@ def run(argv):
             if record_regime:
                 cell.record_regime()
             # Run simulation
-            sim.run(time)
+            run_simulation(sim, time, args)
+            metadata = simulation_metadata(sim, model, args)
+            initial_values = dict((iv.name, iv.quantity)
+                                  for iv in props.initial_values)
+            initial_values.update(init_state)
+            manifest = Manifest.create(
+                sim, model, properties=props, initial_values=initial_values,
+                initial_regime=init_regime, argv=argv)
         # Collect data into Neo Segments
         fnames = set(r.fname for r in record_specs)
         data_segs = {}
@@ -267,7 +562,10 @@ def run(argv):
             data_segs[fname] = neo.Segment(
                 description="Simulation of '{}' cell".format(model.name))
         for rspec in record_specs:
-            data = cell.recording(rspec.port, t_start=rspec.t_start)
+            if rspec.port == CLAMP_CURRENT:
+                data = cell.clamp_current(t_start=rspec.t_start)
+            else:
+                data = cell.recording(rspec.port, t_start=rspec.t_start)
             if isinstance(data, neo.AnalogSignal):
                 data_segs[rspec.fname].analogsignals.append(data)
             else:
@@ -276,5 +574,220 @@ def run(argv):
                 data_segs[rspec.fname].epochs.append(cell.regime_epochs())
         # Write data to file
         for fname, data_seg in data_segs.items():
-            neo.io.PickleIO(fname).write(data_seg)
+            data = data_seg
+            if protocol is not None:
+                if recording_format(fname, args.record_format) == 'neo':
+                    # Split the recordings into trials and epochs
+                    data = protocol.split(data_seg)
+                else:
+                    data_seg.epochs.append(protocol.epochs_annotation())
+            write_recording(fname, data, args.record_format, metadata)
+    if is_mpi_master():
+        manifest.write(args.manifest if args.manifest is not None
+                       else default_manifest_path(record_specs[0].fname))
     logger.info("Finished simulation of '{}' for {}".format(model.name, time))
+
+
+def reproduce(argv):
+    """
+    Replays a simulation from its manifest, checking that the environment
+    and the replayed simulation match it
+    """
+    import os.path
+    from pype9.exceptions import Pype9RuntimeError
+    from pype9.utils.mpi import mpi_comm, is_mpi_master
+    from pype9.repro import Manifest, default_manifest_path
+    args = reproduce_argparser().parse_args(argv)
+    manifest = Manifest.read(args.reproduce)
+    output_dir = args.output_dir
+    if output_dir is None:
+        output_dir = os.path.join(
+            os.path.dirname(os.path.abspath(args.reproduce)), 'reproduced')
+    if is_mpi_master() and not os.path.exists(output_dir):
+        os.makedirs(output_dir)
+    replay_argv = manifest.reproduce_argv(output_dir)
+    replay_args = argparser().parse_args(replay_argv)
+    diffs = manifest.environment_differences(
+        num_processes=mpi_comm.size, model=replay_args.model)
+    if diffs:
+        msg = ("The environment differs from the one manifest '{}' was "
+               "created in, so the replay may not be identical:\n    {}"
+               .format(args.reproduce, '\n    '.join(diffs)))
+        if args.strict:
+            raise Pype9RuntimeError(msg)
+        logger.warning(msg)
+    logger.info("Replaying simulation of '{}' from manifest '{}' into '{}'"
+                .format(manifest.model['name'], args.reproduce, output_dir))
+    run(replay_argv)
+    if is_mpi_master():
+        manifest_path = replay_args.manifest
+        if manifest_path is None:
+            manifest_path = default_manifest_path(replay_args.record[0][1])
+        replay_diffs = manifest.differences(Manifest.read(manifest_path))
+        if replay_diffs:
+            logger.warning(
+                "Replayed simulation differs from manifest '{}':\n    {}"
+                .format(args.reproduce, '\n    '.join(replay_diffs)))
+        else:
+            logger.info("Replayed simulation matches manifest '{}'"
+                        .format(args.reproduce))
+
+
+def run_simulation(sim, time, args):
+    """
+    Runs the simulation until 'time', restoring its state beforehand and/or
+    saving it afterwards if requested
+    """
+    from pype9.exceptions import Pype9UsageError
+    if args.restore is not None:
+        sim.restore_state(args.restore)
+        logger.info("Resuming simulation from {}".format(sim.t))
+    duration = float(time.in_units(un.ms)) - float(sim.t.in_units(un.ms))
+    if duration <= 0.0:
+        raise Pype9UsageError(
+            "Simulation time ({}) must be greater than the time of the "
+            "restored state ({})".format(time, sim.t))
+    progress_bar = None
+    if args.progress or args.progress_interval is not None:
+        interval = (args.progress_interval * un.ms
+                    if args.progress_interval is not None else None)
+        progress_bar = ProgressBar.create(duration)
+        sim.register_progress(progress_bar, interval=interval)
+
+    def cancel(signum, frame):  # @UnusedVariable
+        logger.warning("Cancelling the simulation (press Ctrl-C again to "
+                       "abort)")
+        signal.signal(signal.SIGINT, orig_handler)
+        sim.cancel()
+
+    orig_handler = signal.signal(signal.SIGINT, cancel)
+    try:
+        sim.run(duration * un.ms)
+    finally:
+        signal.signal(signal.SIGINT, orig_handler)
+        if progress_bar is not None:
+            progress_bar.close()
+    if sim.cancelled:
+        logger.warning("Simulation was cancelled at {}, only the data "
+                       "recorded up to then will be written".format(sim.t))
+    if args.save_state is not None:
+        sim.save_state(args.save_state)
+
+
+class ProgressBar(object):
+    """
+    Displays the Progress reports of a simulation in a tqdm progress bar,
+    logging them instead if tqdm isn't installed (or on the slave MPI
+    processes)
+
+    Parameters
+    ----------
+    bar : tqdm.tqdm | None
+        The progress bar to update (in ms of simulation time)
+    """
+
+    def __init__(self, bar):
+        self._bar = bar
+
+    @classmethod
+    def create(cls, duration):
+        """
+        Creates a progress bar for a run of 'duration' (ms)
+        """
+        from pype9.utils.mpi import is_mpi_master
+        if not is_mpi_master():
+            return cls(None)
+        try:
+            from tqdm import tqdm
+        except ImportError:
+            logger.info("Install tqdm to display a progress bar")
+            return cls(None)
+        return cls(tqdm(total=duration, unit='ms', unit_scale=True,
+                        desc='Simulating'))
+
+    def __call__(self, progress):
+        from pype9.simulate.common.simulation import log_progress
+        if self._bar is None:
+            log_progress(progress)
+            return
+        self._bar.update(progress.t - progress.t_start - self._bar.n)
+        if progress.wall_time_per_second is not None:
+            self._bar.set_postfix(
+                wall_per_bio_s='{:.3g} s'.format(
+                    progress.wall_time_per_second))
+
+    def close(self):
+        if self._bar is not None:
+            self._bar.close()
+
+
+def simulation_metadata(sim, model, args):
+    """
+    Metadata describing the simulation that is saved along with recordings
+    in formats that support it (i.e. NWB)
+    """
+    return {'model_url': model.url,
+            'model_name': model.name,
+            'simulator': sim.name,
+            'num_processes': sim.num_processes(),
+            'coreneuron': args.coreneuron,
+            'protocol': args.protocol,
+            'dt_ms': float(sim.dt.in_units(un.ms)),
+            't_stop_ms': float(sim.t.in_units(un.ms)),
+            'seed': args.seed,
+            'properties_seed': args.properties_seed,
+            'dynamics_seeds': [int(s) for s in sim.all_dynamics_seeds],
+            'properties_seeds': [int(s) for s in sim.all_properties_seeds]}
+
+
+def write_recording(fname, data, record_format, metadata, model=None,
+                    pop_name=None):
+    """
+    Writes the recorded data to file in the given format, or the format
+    determined from the extension of the filename if None
+    """
+    import neo.io
+    from pype9.exceptions import Pype9UsageError
+    from pype9.io import nwb
+    record_format = recording_format(fname, record_format, pop_name=pop_name)
+    if record_format == 'nwb':
+        nwb.write(fname, data, metadata=metadata)
+    elif record_format == 'sonata':
+        if pop_name is None:
+            raise Pype9UsageError(
+                "Recordings can only be saved in SONATA format for network "
+                "simulations")
+        write_sonata(fname, data, model, pop_name)
+    else:
+        neo.io.PickleIO(fname).write(data)
+
+
+def recording_format(fname, record_format, pop_name=None):
+    """
+    Determines the format to write the recordings in from the extension of the
+    filename, if it isn't given explicitly
+    """
+    from pype9.io import nwb
+    if record_format is None:
+        if fname.endswith(nwb.EXTENSION):
+            record_format = 'nwb'
+        elif fname.endswith('.h5') and pop_name is not None:
+            record_format = 'sonata'
+        else:
+            record_format = 'neo'
+    return record_format
+
+
+def write_sonata(fname, data, model, pop_name):
+    """
+    Writes the recorded data to SONATA output format, using the original node
+    IDs if the network was read from SONATA
+    """
+    from nineml.exceptions import NineMLNameError
+    from pype9.exceptions import Pype9UsageError
+    from pype9.io import sonata
+    try:
+        sonata_pop, node_ids = sonata.get_node_ids(model.population(pop_name))
+    except (NineMLNameError, Pype9UsageError):
+        sonata_pop, node_ids = pop_name, None
+    sonata.write(fname, data, population=sonata_pop, node_ids=node_ids)
@@ -0,0 +1,62 @@
+"""
+Prints the state of jobs submitted with 'pype9 submit' and retrieves the
+recordings of completed jobs (copying them to the paths that were passed to
+'pype9 simulate'), e.g.::
+
+    $ pype9 status 123456
+    $ pype9 status 123456 --wait
+
+If no job ID is given the states of all submitted jobs are listed.
+"""
+from __future__ import print_function
+from argparse import ArgumentParser
+from pype9.utils.logging import logger
+
+
+def argparser():
+    parser = ArgumentParser(prog='pype9 status',
+                            description=__doc__)
+    parser.add_argument('job_id', type=str, nargs='?', default=None,
+                        help=("The ID of the job (or the path of its job "
+                              "directory)"))
+    parser.add_argument('--jobs_dir', type=str, default=None,
+                        help=("The directory the jobs were packaged into "
+                              "(defaults to PYPE9_JOBS_DIR environment "
+                              "variable or '~/.pype9/jobs')"))
+    parser.add_argument('--wait', action='store_true', default=False,
+                        help="Wait for the job to finish")
+    parser.add_argument('--interval', type=float, default=30.0,
+                        help=("The time between polls of the state of the job "
+                              "when waiting (s) (default %(default)s)"))
+    parser.add_argument('--no_retrieve', action='store_true', default=False,
+                        help=("Don't retrieve the recordings of the job if "
+                              "it has completed"))
+    return parser
+
+
+def run(argv):
+    from pype9.submit import Job, COMPLETED, FAILED
+    args = argparser().parse_args(argv)
+
+    if args.job_id is None:
+        jobs = Job.all(base_dir=args.jobs_dir)
+        if not jobs:
+            print("No submitted jobs found")
+        for job in jobs:
+            print("{:<12} {:<6} {:<10} {:<30} {}".format(
+                job.job_id, job.scheduler, job.update(), job.name,
+                job.submitted))
+        return 0
+    job = Job.find(args.job_id, base_dir=args.jobs_dir)
+    if args.wait:
+        state = job.wait(interval=args.interval)
+    else:
+        state = job.update()
+    print(state)
+    if state == COMPLETED and not args.no_retrieve and not job.retrieved:
+        for path in job.retrieve():
+            logger.info("Retrieved '{}'".format(path))
+    elif state == FAILED:
+        logger.error("Job {} failed (see '{}')".format(job.job_id, job.path))
+        return 1
+    return 0
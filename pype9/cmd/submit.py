@@ -0,0 +1,109 @@
+"""
+Packages a simulation (model, protocol, inputs and code-generation artifacts)
+into a job directory and submits it to a SLURM or PBS scheduler. The arguments
+of the simulation are passed to 'pype9 simulate' on the compute nodes and
+follow the scheduler options after a '--' separator, e.g.::
+
+    $ pype9 submit slurm --nodes 2 --tasks_per_node 16 --walltime 02:00:00 \\
+      --module nest/2.14 -- my_network.xml nest 1000.0 0.01 --mpi \\
+      --record Exc.spike_out exc.neo.pkl
+
+The state of the job can be queried with 'pype9 status <job-id>', which
+copies the recordings back to the paths passed to 'pype9 simulate' once the
+job has completed (as does passing the '--wait' option to 'pype9 submit').
+"""
+from __future__ import print_function
+from argparse import ArgumentParser
+from pype9.utils.logging import logger
+
+SCHEDULERS = ('slurm', 'pbs')
+
+
+def argparser():
+    parser = ArgumentParser(prog='pype9 submit',
+                            description=__doc__)
+    parser.add_argument('scheduler', choices=SCHEDULERS,
+                        help="The scheduler to submit the job to")
+    parser.add_argument('--name', type=str, default=None,
+                        help=("The name of the job (defaults to the name of "
+                              "the model)"))
+    parser.add_argument('--nodes', type=int, default=1,
+                        help=("The number of nodes to request (default "
+                              "%(default)s)"))
+    parser.add_argument('--tasks_per_node', type=int, default=1,
+                        help=("The number of MPI tasks to run on each node "
+                              "(default %(default)s)"))
+    parser.add_argument('--cpus_per_task', type=int, default=1,
+                        help=("The number of CPUs to allocate to each task "
+                              "(default %(default)s)"))
+    parser.add_argument('--walltime', type=str, default='01:00:00',
+                        help=("The maximum time the job can run for, "
+                              "HH:MM:SS (default %(default)s)"))
+    parser.add_argument('--memory', type=str, default=None,
+                        help="The memory to request per node (e.g. 4G)")
+    parser.add_argument('--queue', type=str, default=None,
+                        help="The partition/queue to submit the job to")
+    parser.add_argument('--account', type=str, default=None,
+                        help="The account to charge the job to")
+    parser.add_argument('--module', type=str, action='append', default=[],
+                        help=("Environment module to load before running the "
+                              "simulation (can be repeated)"))
+    parser.add_argument('--setup', type=str, action='append', default=[],
+                        metavar='CMD',
+                        help=("Shell command to run before running the "
+                              "simulation, e.g. 'source ~/env/bin/activate' "
+                              "(can be repeated)"))
+    parser.add_argument('--directive', type=str, action='append', default=[],
+                        help=("Additional directive to add to the header of "
+                              "the job script, without the '#SBATCH'/'#PBS' "
+                              "prefix (can be repeated)"))
+    parser.add_argument('--launcher', type=str, default=None,
+                        help=("The command used to launch simulations over "
+                              "MPI processes (defaults to 'srun' for SLURM "
+                              "and 'mpirun' for PBS)"))
+    parser.add_argument('--pype9_cmd', type=str, default='pype9',
+                        help=("The command used to run 'pype9' on the compute "
+                              "nodes (default %(default)s)"))
+    parser.add_argument('--jobs_dir', type=str, default=None,
+                        help=("The directory to package the job into "
+                              "(defaults to PYPE9_JOBS_DIR environment "
+                              "variable or '~/.pype9/jobs')"))
+    parser.add_argument('--wait', action='store_true', default=False,
+                        help=("Wait for the job to finish and retrieve its "
+                              "recordings"))
+    parser.add_argument('--interval', type=float, default=30.0,
+                        help=("The time between polls of the state of the job "
+                              "when waiting (s) (default %(default)s)"))
+    return parser
+
+
+def run(argv):
+    from pype9.exceptions import Pype9UsageError
+    from pype9.submit import Job, COMPLETED
+    from pype9.cmd.simulate import argparser as simulate_argparser
+    if '--' not in argv:
+        raise Pype9UsageError(
+            "The arguments to pass to 'pype9 simulate' need to be provided "
+            "after a '--' separator")
+    sep = argv.index('--')
+    args = argparser().parse_args(argv[:sep])
+    simulate_args = argv[sep + 1:]
+    # Check the arguments of the simulation are valid before submitting it
+    simulate_argparser().parse_args(simulate_args)
+    job = Job.create(
+        simulate_args, args.scheduler, name=args.name, base_dir=args.jobs_dir,
+        nodes=args.nodes, tasks_per_node=args.tasks_per_node,
+        cpus_per_task=args.cpus_per_task, walltime=args.walltime,
+        memory=args.memory, queue=args.queue, account=args.account,
+        modules=args.module, setup=args.setup, directives=args.directive)
+    job_id = job.submit(pype9_cmd=args.pype9_cmd, launcher=args.launcher)
+    print(job_id)
+    if args.wait:
+        state = job.wait(interval=args.interval)
+        if state != COMPLETED:
+            logger.error("Job {} {} (see '{}')".format(job_id, state,
+                                                       job.path))
+            return 1
+        for path in job.retrieve():
+            logger.info("Retrieved '{}'".format(path))
+    return 0
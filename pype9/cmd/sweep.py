@@ -0,0 +1,88 @@
+"""
+Runs a batch of simulations of a 9ML DynamicsProperties model over a grid or
+random sweep of its properties and initial values, saving the recordings of
+every simulation into a single indexed HDF5 store, e.g.::
+
+    $ pype9 sweep //neuron/Izhikevich#SampleIzhikevich nest 100.0 0.01 \\
+      my_sweep.yml my_sweep.h5 --record V --processes 4
+
+The ranges of the sweep are specified in a YAML or JSON file (see
+``pype9.batch`` for the format). The store can be read back into Neo_ segments
+with ``pype9.batch.read``.
+
+To distribute the sweep over multiple nodes of a cluster use the '--mpi'
+option along with the MPI_ command ``mpirun -n <nnodes> pype9 sweep <options>``
+"""
+from argparse import ArgumentParser
+from nineml import units as un
+from pype9.simulate import SIMULATORS
+from pype9.simulate.common.code_gen import BaseCodeGenerator
+from pype9.utils.arguments import nineml_model
+from pype9.utils.logging import logger
+
+
+def argparser():
+    parser = ArgumentParser(prog='pype9 sweep',
+                            description=__doc__)
+    parser.add_argument('model', type=nineml_model,
+                        help=("Path to nineml DynamicsProperties model to "
+                              "sweep the properties of (see 'pype9 simulate')"))
+    parser.add_argument('simulator',
+                        choices=SIMULATORS,
+                        type=str, help="Which simulator backend to use")
+    parser.add_argument('time', type=float,
+                        help="Time to run each simulation for (ms)")
+    parser.add_argument('timestep', type=float,
+                        help=("Timestep used to solve the differential "
+                              "equations (ms)"))
+    parser.add_argument('sweep', type=str,
+                        help=("YAML or JSON file specifying the ranges of the "
+                              "sweep"))
+    parser.add_argument('store', type=str,
+                        help=("HDF5 file to store the recordings of the "
+                              "simulations in"))
+    parser.add_argument('--record', type=str, nargs='+', default=[],
+                        metavar='PORT',
+                        help=("The send ports or state variables to record "
+                              "in each simulation"))
+    parser.add_argument('--processes', type=int, default=1,
+                        help=("The number of processes to run the simulations "
+                              "over on each node (default %(default)s)"))
+    parser.add_argument('--mpi', action='store_true', default=False,
+                        help=("Distribute the simulations over the MPI "
+                              "ranks the command is run on"))
+    parser.add_argument('--build_mode', type=str, default='lazy',
+                        help=("The strategy used to build and compile the "
+                              "model. Can be one of '{}' (default %(default)s)"
+                              .format("', '".join(
+                                  BaseCodeGenerator.BUILD_MODE_OPTIONS))))
+    parser.add_argument('--build_dir', default=None, type=str,
+                        help=("Base build directory"))
+    parser.add_argument('--build_version', type=str, default=None,
+                        help=("Version to append to name to use when building "
+                              "component classes"))
+    return parser
+
+
+def run(argv):
+    """
+    Runs the sweep from the provided arguments
+    """
+    import nineml
+    from pype9.exceptions import Pype9UsageError
+    from pype9 import batch
+
+    args = argparser().parse_args(argv)
+
+    if not isinstance(args.model, nineml.DynamicsProperties):
+        raise Pype9UsageError(
+            "Sweeps can only be performed over DynamicsProperties models, "
+            "not {}".format(args.model))
+    sweep = batch.Sweep.read(args.sweep, args.model)
+    batch.run(sweep, args.simulator, args.time * un.ms, args.timestep * un.ms,
+              record=args.record, store_path=args.store,
+              processes=args.processes, use_mpi=args.mpi,
+              build_mode=args.build_mode, build_dir=args.build_dir,
+              build_version=args.build_version)
+    logger.info("Finished sweep of '{}' over {} points".format(
+        args.model.name, len(sweep)))
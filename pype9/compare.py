@@ -0,0 +1,166 @@
+"""
+  Quantitative comparison of recordings of the same model simulated on
+  different simulator backends, which is used to validate that a model behaves
+  identically in each of them (see 'pype9 compare').
+
+  Analog signals are compared by the root-mean-square (RMS) of their
+  difference over the period they overlap, after the second signal has been
+  interpolated onto the times of the first. Spike trains are compared by the
+  number of spikes that cannot be paired with a spike in the other train
+  within a given tolerance.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+from builtins import zip
+from collections import namedtuple
+import numpy
+import quantities as pq
+from pype9.exceptions import Pype9UsageError
+
+
+class Comparison(namedtuple('Comparison', ('name', 'metric', 'value',
+                                           'tolerance'))):
+    """
+    The result of comparing a recorded signal or spike train between two
+    simulations
+
+    Parameters
+    ----------
+    name : str
+        Name of the compared signal/spike train
+    metric : str
+        The metric used to compare it, either 'rms' or 'spike_mismatches'
+    value : float
+        The value of the metric
+    tolerance : float
+        The maximum value of the metric for the recordings to be considered
+        equivalent
+    """
+
+    @property
+    def passed(self):
+        return self.value <= self.tolerance
+
+
+def rms_difference(signal1, signal2):
+    """
+    The root-mean-square difference between two analog signals (in the units
+    of the first signal) over the period they overlap. If the signals have
+    multiple channels the maximum over the channels is returned
+
+    Parameters
+    ----------
+    signal1 : neo.AnalogSignal
+        The reference signal
+    signal2 : neo.AnalogSignal
+        The signal to compare against the reference, which is interpolated
+        onto the times of the reference signal
+    """
+    try:
+        signal2 = signal2.rescale(signal1.units)
+    except ValueError:
+        raise Pype9UsageError(
+            "Cannot compare signals with incompatible units ({} and {})"
+            .format(signal1.units, signal2.units))
+    times1 = numpy.asarray(signal1.times.rescale(pq.ms))
+    times2 = numpy.asarray(signal2.times.rescale(pq.ms))
+    values1 = numpy.asarray(signal1).reshape(len(times1), -1)
+    values2 = numpy.asarray(signal2).reshape(len(times2), -1)
+    if values1.shape[1] != values2.shape[1]:
+        raise Pype9UsageError(
+            "Cannot compare signals with different numbers of channels ({} "
+            "and {})".format(values1.shape[1], values2.shape[1]))
+    overlap = numpy.logical_and(times1 >= times2[0], times1 <= times2[-1])
+    if not numpy.any(overlap):
+        raise Pype9UsageError("Signals to compare do not overlap in time")
+    rms = 0.0
+    for chan1, chan2 in zip(values1.T, values2.T):
+        diff = chan1[overlap] - numpy.interp(times1[overlap], times2, chan2)
+        rms = max(rms, float(numpy.sqrt(numpy.mean(diff ** 2))))
+    return rms
+
+
+def spike_time_mismatches(train1, train2, tolerance):
+    """
+    The number of spikes in either spike train that cannot be paired with a
+    spike in the other train within the tolerance
+
+    Parameters
+    ----------
+    train1 : neo.SpikeTrain
+        The reference spike train
+    train2 : neo.SpikeTrain
+        The spike train to compare against the reference
+    tolerance : quantities.Quantity (time)
+        The maximum difference between the times of paired spikes
+    """
+    times1 = numpy.sort(numpy.asarray(train1.rescale(pq.ms)))
+    times2 = numpy.sort(numpy.asarray(train2.rescale(pq.ms)))
+    tol = float(pq.Quantity(tolerance).rescale(pq.ms))
+    i = j = matched = 0
+    while i < len(times1) and j < len(times2):
+        if abs(times1[i] - times2[j]) <= tol:
+            matched += 1
+            i += 1
+            j += 1
+        elif times1[i] < times2[j]:
+            i += 1
+        else:
+            j += 1
+    return len(times1) + len(times2) - 2 * matched
+
+
+def compare_segments(segment1, segment2, rms_tolerance, spike_tolerance,
+                     max_spike_mismatches=0):
+    """
+    Compares the analog signals and spike trains of two recorded segments,
+    which are paired by their order in the segments
+
+    Parameters
+    ----------
+    segment1 : neo.Segment
+        The reference recording
+    segment2 : neo.Segment
+        The recording to compare against the reference
+    rms_tolerance : float
+        The maximum RMS difference between paired analog signals (in the units
+        of the reference signal)
+    spike_tolerance : quantities.Quantity (time)
+        The maximum difference between the times of paired spikes
+    max_spike_mismatches : int
+        The maximum number of spikes that can't be paired between two spike
+        trains
+
+    Returns
+    -------
+    comparisons : list(Comparison)
+        The comparison of each pair of analog signals and spike trains
+    """
+    if (len(segment1.analogsignals) != len(segment2.analogsignals) or
+            len(segment1.spiketrains) != len(segment2.spiketrains)):
+        raise Pype9UsageError(
+            "Cannot compare segments with different numbers of analog signals "
+            "({} and {}) or spike trains ({} and {})".format(
+                len(segment1.analogsignals), len(segment2.analogsignals),
+                len(segment1.spiketrains), len(segment2.spiketrains)))
+    comparisons = []
+    for i, (sig1, sig2) in enumerate(zip(segment1.analogsignals,
+                                         segment2.analogsignals)):
+        comparisons.append(Comparison(
+            sig1.name if sig1.name else 'signal{}'.format(i), 'rms',
+            rms_difference(sig1, sig2), rms_tolerance))
+    for i, (st1, st2) in enumerate(zip(segment1.spiketrains,
+                                       segment2.spiketrains)):
+        comparisons.append(Comparison(
+            '{}[{}]'.format(st1.name if st1.name else 'spikes',
+                            st1.annotations.get('source_index', i)),
+            'spike_mismatches',
+            spike_time_mismatches(st1, st2, spike_tolerance),
+            max_spike_mismatches))
+    return comparisons
+
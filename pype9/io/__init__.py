@@ -0,0 +1,9 @@
+"""
+  Readers and writers for converting models and simulation output to and from
+  formats used by other tools (e.g. SONATA)
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
@@ -0,0 +1,728 @@
+"""
+  Import of cell and synapse models from NeuroML2_/LEMS_ documents into 9ML.
+
+  The LEMS ComponentTypes defined in (or included by) the document are mapped
+  onto 9ML Dynamics classes, and the components of those types onto 9ML
+  DynamicsProperties, with the units of their parameters preserved.
+  ComponentTypes are mapped as follows:
+
+    * Parameters -> Parameters (Fixed parameters -> Constants)
+    * Constants -> Constants
+    * DerivedParameters, DerivedVariables -> Aliases
+    * ConditionalDerivedVariables -> piecewise Aliases
+    * DerivedVariables that select and reduce values of child components (e.g.
+      the synaptic currents) -> AnalogReducePorts
+    * Requirements -> AnalogReceivePorts
+    * Exposures -> AnalogSendPorts
+    * EventPorts -> EventSendPorts/EventReceivePorts
+    * Regimes, TimeDerivatives, OnCondition and OnEvent handlers -> Regimes,
+      TimeDerivatives, OnConditions and OnEvents (OnEntry assignments are
+      merged into the transitions into the regime)
+
+  Initial values are taken from the OnStart assignments where they are
+  assigned from a parameter or a numeric value. The hierarchical structure of
+  LEMS (Children, Attachments, Structure), KineticSchemes and the 'random'
+  and 'H' functions are not supported.
+
+  As the standard NeuroML2 cell types (e.g. 'izhikevich2007Cell') are defined
+  in the NeuroML2CoreTypes LEMS files, which are implicitly included by
+  NeuroML2 documents, the directory containing them (i.e. the
+  'NeuroML2CoreTypes' directory of the NeuroML2 repository) needs to be passed
+  in 'include_dirs' to convert components of these types.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+from builtins import object
+from collections import OrderedDict
+from itertools import chain
+import os.path
+import re
+from xml.etree import ElementTree
+import sympy
+import nineml
+from nineml import units as un
+from nineml.user import DynamicsProperties, Property, Initial
+from nineml.abstraction import (
+    Dynamics, Regime, Parameter, Constant, Alias, StateVariable,
+    TimeDerivative, StateAssignment, OutputEvent, OnCondition, OnEvent,
+    AnalogSendPort, AnalogReceivePort, AnalogReducePort, EventSendPort,
+    EventReceivePort)
+from pype9.exceptions import Pype9UsageError, Pype9Unsupported9MLException
+from pype9.utils.logging import logger
+
+EXTENSION = '.nml'
+
+CORE_TYPES_FILE = 'NeuroML2CoreTypes.xml'
+
+DEFAULT_REGIME = 'default'
+
+# Dimensions and units defined in NeuroMLCoreDimensions.xml, which are
+# implicitly available in NeuroML2 documents
+CORE_DIMENSIONS = {
+    'time': {'t': 1},
+    'per_time': {'t': -1},
+    'voltage': {'m': 1, 'l': 2, 't': -3, 'i': -1},
+    'per_voltage': {'m': -1, 'l': -2, 't': 3, 'i': 1},
+    'conductance': {'m': -1, 'l': -2, 't': 3, 'i': 2},
+    'conductanceDensity': {'m': -1, 'l': -4, 't': 3, 'i': 2},
+    'capacitance': {'m': -1, 'l': -2, 't': 4, 'i': 2},
+    'specificCapacitance': {'m': -1, 'l': -4, 't': 4, 'i': 2},
+    'resistance': {'m': 1, 'l': 2, 't': -3, 'i': -2},
+    'resistivity': {'m': 1, 'l': 3, 't': -3, 'i': -2},
+    'charge': {'t': 1, 'i': 1},
+    'charge_per_mole': {'t': 1, 'i': 1, 'n': -1},
+    'current': {'i': 1},
+    'currentDensity': {'l': -2, 'i': 1},
+    'length': {'l': 1},
+    'area': {'l': 2},
+    'volume': {'l': 3},
+    'concentration': {'l': -3, 'n': 1},
+    'substance': {'n': 1},
+    'permeability': {'l': 1, 't': -1},
+    'temperature': {'k': 1},
+    'idealGasConstantDims': {'m': 1, 'l': 2, 't': -2, 'k': -1, 'n': -1},
+    'rho_factor': {'l': -1, 't': -1, 'i': -1, 'n': 1},
+    'conductance_per_voltage': {'m': -2, 'l': -4, 't': 6, 'i': 3}}
+
+# Maps unit symbols onto their dimension, power of ten, scale and offset
+CORE_UNITS = {
+    's': ('time', 0, 1.0, 0.0),
+    'ms': ('time', -3, 1.0, 0.0),
+    'min': ('time', 0, 60.0, 0.0),
+    'hour': ('time', 0, 3600.0, 0.0),
+    'per_s': ('per_time', 0, 1.0, 0.0),
+    'Hz': ('per_time', 0, 1.0, 0.0),
+    'per_ms': ('per_time', 3, 1.0, 0.0),
+    'per_min': ('per_time', 0, 1.0 / 60.0, 0.0),
+    'per_hour': ('per_time', 0, 1.0 / 3600.0, 0.0),
+    'V': ('voltage', 0, 1.0, 0.0),
+    'mV': ('voltage', -3, 1.0, 0.0),
+    'per_V': ('per_voltage', 0, 1.0, 0.0),
+    'per_mV': ('per_voltage', 3, 1.0, 0.0),
+    'S': ('conductance', 0, 1.0, 0.0),
+    'mS': ('conductance', -3, 1.0, 0.0),
+    'uS': ('conductance', -6, 1.0, 0.0),
+    'nS': ('conductance', -9, 1.0, 0.0),
+    'pS': ('conductance', -12, 1.0, 0.0),
+    'S_per_m2': ('conductanceDensity', 0, 1.0, 0.0),
+    'mS_per_cm2': ('conductanceDensity', 1, 1.0, 0.0),
+    'S_per_cm2': ('conductanceDensity', 4, 1.0, 0.0),
+    'F': ('capacitance', 0, 1.0, 0.0),
+    'uF': ('capacitance', -6, 1.0, 0.0),
+    'nF': ('capacitance', -9, 1.0, 0.0),
+    'pF': ('capacitance', -12, 1.0, 0.0),
+    'F_per_m2': ('specificCapacitance', 0, 1.0, 0.0),
+    'uF_per_cm2': ('specificCapacitance', -2, 1.0, 0.0),
+    'ohm': ('resistance', 0, 1.0, 0.0),
+    'kohm': ('resistance', 3, 1.0, 0.0),
+    'Mohm': ('resistance', 6, 1.0, 0.0),
+    'ohm_m': ('resistivity', 0, 1.0, 0.0),
+    'kohm_cm': ('resistivity', 1, 1.0, 0.0),
+    'ohm_cm': ('resistivity', -2, 1.0, 0.0),
+    'C': ('charge', 0, 1.0, 0.0),
+    'C_per_mol': ('charge_per_mole', 0, 1.0, 0.0),
+    'A': ('current', 0, 1.0, 0.0),
+    'uA': ('current', -6, 1.0, 0.0),
+    'nA': ('current', -9, 1.0, 0.0),
+    'pA': ('current', -12, 1.0, 0.0),
+    'A_per_m2': ('currentDensity', 0, 1.0, 0.0),
+    'uA_per_cm2': ('currentDensity', -2, 1.0, 0.0),
+    'mA_per_cm2': ('currentDensity', 1, 1.0, 0.0),
+    'm': ('length', 0, 1.0, 0.0),
+    'cm': ('length', -2, 1.0, 0.0),
+    'um': ('length', -6, 1.0, 0.0),
+    'm2': ('area', 0, 1.0, 0.0),
+    'cm2': ('area', -4, 1.0, 0.0),
+    'um2': ('area', -12, 1.0, 0.0),
+    'm3': ('volume', 0, 1.0, 0.0),
+    'cm3': ('volume', -6, 1.0, 0.0),
+    'litre': ('volume', -3, 1.0, 0.0),
+    'um3': ('volume', -18, 1.0, 0.0),
+    'mol_per_m3': ('concentration', 0, 1.0, 0.0),
+    'mol_per_cm3': ('concentration', 6, 1.0, 0.0),
+    'M': ('concentration', 3, 1.0, 0.0),
+    'mM': ('concentration', 0, 1.0, 0.0),
+    'mol': ('substance', 0, 1.0, 0.0),
+    'm_per_s': ('permeability', 0, 1.0, 0.0),
+    'cm_per_s': ('permeability', -2, 1.0, 0.0),
+    'um_per_ms': ('permeability', -3, 1.0, 0.0),
+    'cm_per_ms': ('permeability', 1, 1.0, 0.0),
+    'K': ('temperature', 0, 1.0, 0.0),
+    'degC': ('temperature', 0, 1.0, 273.15),
+    'J_per_K_per_mol': ('idealGasConstantDims', 0, 1.0, 0.0),
+    'mol_per_m_per_A_per_s': ('rho_factor', 0, 1.0, 0.0),
+    'S_per_V': ('conductance_per_voltage', 0, 1.0, 0.0),
+    'nS_per_mV': ('conductance_per_voltage', -6, 1.0, 0.0)}
+
+# Maps LEMS operators onto their 9ML equivalents
+OPERATORS = [('.gt.', '>'), ('.lt.', '<'), ('.geq.', '>='), ('.leq.', '<='),
+             ('.eq.', '=='), ('.neq.', '!='), ('^', '**')]
+
+# LEMS elements that only describe the structure of models, simulations or
+# the documentation, which are not converted
+IGNORED_ELEMENTS = ('notes', 'annotation', 'property', 'network', 'Target',
+                    'Simulation', 'Assertion', 'ComponentTypeNotes')
+IGNORED_TYPE_ELEMENTS = ('Children', 'Child', 'Attachments', 'Text', 'Path',
+                         'ComponentReference', 'Link', 'IndexParameter',
+                         'InstanceRequirement', 'Collection',
+                         'PairCollection', 'Simulation', 'Structure')
+UNSUPPORTED_FUNCTIONS = ('random', 'H')
+# Attributes of NeuroML2 components which aren't parameters
+RESERVED_ATTRIBUTES = ('id', 'name', 'type', 'metaid', 'neuroLexId', 'notes')
+
+QUANTITY_RE = re.compile(
+    r'^\s*([-+]?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?)\s*'
+    r'([A-Za-z_][A-Za-z0-9_]*)?\s*$')
+
+
+def read(path, include_dirs=()):
+    """
+    Reads the LEMS ComponentTypes and components in a NeuroML2 (or LEMS)
+    document and converts them into 9ML Dynamics and DynamicsProperties
+
+    Parameters
+    ----------
+    path : str
+        Path to the NeuroML2 or LEMS file
+    include_dirs : list(str)
+        Directories to search for included LEMS files (and the
+        NeuroML2CoreTypes files) that aren't found relative to the including
+        file
+
+    Returns
+    -------
+    document : nineml.Document
+        A 9ML document containing the converted Dynamics classes and
+        DynamicsProperties
+    """
+    reader = LemsReader(include_dirs)
+    reader.load(path)
+    component_classes = OrderedDict()
+    properties = []
+    for type_name, elem in reader.components:
+        if type_name not in reader.component_types:
+            logger.warning(
+                "Skipping component '{}' as there is no definition of its "
+                "ComponentType '{}' (if it is a NeuroML2 core type, the "
+                "directory containing '{}' needs to be provided as an include "
+                "directory)".format(elem.get('id'), type_name,
+                                    CORE_TYPES_FILE))
+            continue
+        if type_name not in component_classes:
+            component_classes[type_name] = reader.dynamics(type_name)
+        properties.append(reader.properties(elem, type_name,
+                                            component_classes[type_name]))
+    for type_name in reader.local_types:
+        if (type_name not in component_classes and
+                reader.has_dynamics(type_name)):
+            component_classes[type_name] = reader.dynamics(type_name)
+    if not component_classes:
+        raise Pype9UsageError(
+            "Did not find any ComponentTypes with dynamics to convert in '{}'"
+            .format(path))
+    logger.info("Converted {} ComponentTypes and {} components from '{}'"
+                .format(len(component_classes), len(properties), path))
+    return nineml.Document(*chain(component_classes.values(), properties))
+
+
+def is_neuroml(path):
+    """
+    Checks whether the file is a NeuroML2 document, either by its extension
+    or the root element of the XML
+    """
+    if path.endswith(EXTENSION):
+        return True
+    try:
+        return _tag(ElementTree.parse(path).getroot()) in ('neuroml', 'Lems')
+    except (ElementTree.ParseError, IOError):
+        return False
+
+
+class LemsReader(object):
+    """
+    Loads the definitions of dimensions, units, ComponentTypes and components
+    from LEMS files and converts them into 9ML
+
+    Parameters
+    ----------
+    include_dirs : list(str)
+        Directories to search for included files that aren't found relative
+        to the including file
+    """
+
+    def __init__(self, include_dirs=()):
+        self.include_dirs = list(include_dirs)
+        self.dimensions = dict(CORE_DIMENSIONS)
+        self.units = dict(CORE_UNITS)
+        self.component_types = OrderedDict()
+        # The components and ComponentTypes defined in the files being
+        # converted (as opposed to those in the include directories)
+        self.components = []
+        self.local_types = []
+        self._loaded = set()
+
+    def load(self, path, local=True):
+        path = os.path.abspath(path)
+        if path in self._loaded:
+            return
+        self._loaded.add(path)
+        try:
+            root = ElementTree.parse(path).getroot()
+        except ElementTree.ParseError as e:
+            raise Pype9UsageError(
+                "Could not parse '{}' as XML: {}".format(path, e))
+        if _tag(root) not in ('neuroml', 'Lems'):
+            raise Pype9UsageError(
+                "'{}' is not a NeuroML2 or LEMS document (root element is "
+                "'{}')".format(path, _tag(root)))
+        if _tag(root) == 'neuroml':
+            # NeuroML2 documents implicitly include the core types
+            core_path = self._find(CORE_TYPES_FILE)
+            if core_path is not None:
+                self.load(core_path, local=False)
+        for elem in root:
+            tag = _tag(elem)
+            if tag in ('include', 'Include'):
+                inc_path, in_include_dir = self._find(
+                    elem.get('href', elem.get('file')),
+                    os.path.dirname(path), with_location=True)
+                if inc_path is None:
+                    logger.warning(
+                        "Could not find '{}' included by '{}'".format(
+                            elem.get('href', elem.get('file')), path))
+                else:
+                    self.load(inc_path, local=local and not in_include_dir)
+            elif tag == 'Dimension':
+                self.dimensions[elem.get('name')] = dict(
+                    (d, int(elem.get(d))) for d in 'mltiknj'
+                    if elem.get(d) is not None)
+            elif tag == 'Unit':
+                self.units[elem.get('symbol')] = (
+                    elem.get('dimension'), int(elem.get('power', 0)),
+                    float(elem.get('scale', 1.0)),
+                    float(elem.get('offset', 0.0)))
+            elif tag == 'ComponentType':
+                self.component_types[elem.get('name')] = elem
+                if local:
+                    self.local_types.append(elem.get('name'))
+            elif tag in IGNORED_ELEMENTS or tag in ('Constant',):
+                # Top-level constants are only referenced by LEMS simulations
+                continue
+            elif local:
+                # Components are either specified by generic 'Component'
+                # elements or elements named after their type (NeuroML2)
+                self.components.append(
+                    (elem.get('type') if tag == 'Component' else tag, elem))
+
+    def has_dynamics(self, type_name):
+        return any(_tag(e) == 'Dynamics'
+                   for ct in self._lineage(type_name) for e in ct)
+
+    def dynamics(self, type_name):
+        """
+        Converts a LEMS ComponentType (and the types it extends) into a 9ML
+        Dynamics class
+        """
+        parameters = OrderedDict()
+        constants = OrderedDict()
+        aliases = OrderedDict()
+        state_variables = OrderedDict()
+        exposures = OrderedDict()
+        receive_ports = OrderedDict()
+        reduce_ports = OrderedDict()
+        event_ports = OrderedDict()
+        time_derivatives = OrderedDict()
+        transitions = []
+        regimes = OrderedDict()
+        on_entry = {}
+        for ct in self._lineage(type_name):
+            for elem in ct:
+                tag = _tag(elem)
+                name = elem.get('name')
+                if tag in ('Parameter', 'Property'):
+                    parameters[name] = Parameter(
+                        name, dimension=self.dimension(elem.get('dimension')))
+                elif tag == 'Fixed':
+                    try:
+                        param = parameters.pop(elem.get('parameter'))
+                    except KeyError:
+                        raise Pype9UsageError(
+                            "Fixed parameter '{}' of '{}' is not a parameter "
+                            "of the types it extends".format(
+                                elem.get('parameter'), type_name))
+                    qty = self.quantity(elem.get('value'))
+                    constants[param.name] = Constant(param.name, qty.value,
+                                                     qty.units)
+                elif tag == 'Constant':
+                    qty = self.quantity(elem.get('value'))
+                    constants[name] = Constant(name, qty.value, qty.units)
+                elif tag == 'DerivedParameter':
+                    aliases[name] = Alias(name, _expr(elem.get('value')))
+                elif tag == 'Exposure':
+                    exposures[name] = self.dimension(elem.get('dimension'))
+                elif tag == 'Requirement':
+                    receive_ports[name] = AnalogReceivePort(
+                        name, dimension=self.dimension(elem.get('dimension')))
+                elif tag == 'EventPort':
+                    if elem.get('direction') == 'out':
+                        event_ports[name] = EventSendPort(name)
+                    else:
+                        event_ports[name] = EventReceivePort(name)
+                elif tag == 'Dynamics':
+                    for dyn_elem in elem:
+                        dyn_tag = _tag(dyn_elem)
+                        dyn_name = dyn_elem.get('name')
+                        if dyn_tag == 'StateVariable':
+                            state_variables[dyn_name] = StateVariable(
+                                dyn_name, dimension=self.dimension(
+                                    dyn_elem.get('dimension')))
+                            self._exposure(dyn_elem, aliases)
+                        elif dyn_tag == 'DerivedVariable':
+                            if dyn_elem.get('select') is not None:
+                                self._selection(dyn_elem, receive_ports,
+                                                reduce_ports)
+                            else:
+                                aliases[dyn_name] = Alias(
+                                    dyn_name, _expr(dyn_elem.get('value')))
+                                self._exposure(dyn_elem, aliases)
+                        elif dyn_tag == 'ConditionalDerivedVariable':
+                            aliases[dyn_name] = Alias(
+                                dyn_name, _piecewise(dyn_elem))
+                            self._exposure(dyn_elem, aliases)
+                        elif dyn_tag == 'TimeDerivative':
+                            time_derivatives[dyn_elem.get('variable')] = (
+                                _expr(dyn_elem.get('value')))
+                        elif dyn_tag in ('OnCondition', 'OnEvent'):
+                            transitions.append(_handler(dyn_elem))
+                        elif dyn_tag == 'Regime':
+                            regime_tds = OrderedDict()
+                            regime_trans = []
+                            for reg_elem in dyn_elem:
+                                reg_tag = _tag(reg_elem)
+                                if reg_tag == 'TimeDerivative':
+                                    regime_tds[reg_elem.get('variable')] = (
+                                        _expr(reg_elem.get('value')))
+                                elif reg_tag in ('OnCondition', 'OnEvent'):
+                                    regime_trans.append(_handler(reg_elem))
+                                elif reg_tag == 'OnEntry':
+                                    on_entry[dyn_name] = _assignments(
+                                        reg_elem)
+                            regimes[dyn_name] = (regime_tds, regime_trans)
+                        elif dyn_tag in ('OnStart', 'OnEntry'):
+                            continue  # Handled in 'properties' method
+                        elif dyn_tag == 'KineticScheme':
+                            raise Pype9Unsupported9MLException(
+                                "KineticSchemes (in '{}') are not supported"
+                                .format(type_name))
+                        else:
+                            logger.warning(
+                                "Ignoring '{}' element in dynamics of '{}'"
+                                .format(dyn_tag, type_name))
+                elif tag in IGNORED_TYPE_ELEMENTS:
+                    logger.debug("Ignoring '{}' element of '{}'"
+                                 .format(tag, type_name))
+                else:
+                    logger.warning("Ignoring '{}' element of '{}'"
+                                   .format(tag, type_name))
+        if not regimes:
+            regimes[DEFAULT_REGIME] = (OrderedDict(), [])
+        nineml_regimes = []
+        for regime_name, (regime_tds, regime_trans) in regimes.items():
+            # Time derivatives and handlers outside of regimes apply to all
+            # regimes
+            tds = OrderedDict(time_derivatives)
+            tds.update(regime_tds)
+            nineml_regimes.append(Regime(
+                *[TimeDerivative(v, rhs) for v, rhs in tds.items()],
+                name=regime_name,
+                transitions=[self._transition(t, on_entry)
+                             for t in chain(transitions, regime_trans)]))
+        analog_ports = list(chain(receive_ports.values(),
+                                  reduce_ports.values()))
+        for name, dimension in exposures.items():
+            if name in state_variables or name in aliases:
+                analog_ports.append(AnalogSendPort(name, dimension=dimension))
+            else:
+                logger.debug("Not exposing '{}' of '{}' as it isn't a state "
+                             "or derived variable".format(name, type_name))
+        return Dynamics(
+            name=type_name,
+            parameters=list(parameters.values()),
+            constants=list(constants.values()),
+            aliases=list(aliases.values()),
+            state_variables=list(state_variables.values()),
+            analog_ports=analog_ports,
+            event_ports=list(event_ports.values()),
+            regimes=nineml_regimes)
+
+    def properties(self, elem, type_name, component_class):
+        """
+        Converts a component into 9ML DynamicsProperties of the Dynamics class
+        converted from its ComponentType
+        """
+        name = elem.get('id', elem.get('name'))
+        if name is None:
+            raise Pype9UsageError(
+                "Component of type '{}' doesn't have an 'id'".format(
+                    type_name))
+        props = OrderedDict()
+        for attr, value in elem.attrib.items():
+            if attr in RESERVED_ATTRIBUTES:
+                continue
+            if attr not in component_class.parameter_names:
+                logger.warning(
+                    "Ignoring '{}' attribute of '{}' as it isn't a parameter "
+                    "of '{}'".format(attr, name, type_name))
+                continue
+            props[attr] = self.quantity(value)
+        missing = [p for p in component_class.parameter_names
+                   if p not in props]
+        if missing:
+            raise Pype9UsageError(
+                "Values for '{}' parameters weren't provided for '{}'"
+                .format("', '".join(missing), name))
+        initial_values = []
+        initial_regime = None
+        for ct in self._lineage(type_name):
+            for dyn in (e for e in ct if _tag(e) == 'Dynamics'):
+                for dyn_elem in dyn:
+                    if _tag(dyn_elem) == 'OnStart':
+                        for var, rhs in _assignments(dyn_elem):
+                            initial_values.append(self._initial(
+                                var, rhs, props, component_class, name))
+                    elif (_tag(dyn_elem) == 'Regime' and
+                            dyn_elem.get('initial') == 'true'):
+                        initial_regime = dyn_elem.get('name')
+        return DynamicsProperties(
+            name, definition=component_class,
+            properties=[Property(n, q) for n, q in props.items()],
+            initial_values=[i for i in initial_values if i is not None],
+            initial_regime=initial_regime)
+
+    def dimension(self, name):
+        """
+        Returns the 9ML dimension matching the LEMS dimension name
+        """
+        if name in (None, 'none'):
+            return un.dimensionless
+        try:
+            powers = self.dimensions[name]
+        except KeyError:
+            raise Pype9UsageError(
+                "Unrecognised dimension '{}'".format(name))
+        dimension = un.Dimension(name, **powers)
+        # Use the standard 9ML dimension if there is one with the same name
+        std_dim = getattr(un, name, None)
+        if (isinstance(std_dim, un.Dimension) and
+                list(std_dim) == list(dimension)):
+            dimension = std_dim
+        return dimension
+
+    def quantity(self, value_str):
+        """
+        Converts a LEMS value string (e.g. '-60mV') into a 9ML quantity
+        """
+        match = QUANTITY_RE.match(value_str)
+        if match is None:
+            raise Pype9UsageError(
+                "Could not parse '{}' as a LEMS quantity".format(value_str))
+        value = float(match.group(1))
+        symbol = match.group(2)
+        if symbol is None:
+            return un.Quantity(value, un.unitless)
+        try:
+            dim_name, power, scale, offset = self.units[symbol]
+        except KeyError:
+            raise Pype9UsageError(
+                "Unrecognised unit '{}' in '{}'".format(symbol, value_str))
+        dimension = self.dimension(dim_name)
+        if scale != 1.0:
+            # 9ML units can only be scaled by powers of ten so the scale is
+            # applied to the value
+            value *= scale
+            symbol = next(
+                (s for s, u in sorted(self.units.items())
+                 if u == (dim_name, power, 1.0, offset)),
+                '{}_e{}'.format(dim_name, power))
+        units = un.Unit(symbol, dimension=dimension, power=power,
+                        offset=offset)
+        # Use the standard 9ML units if there are ones with the same name
+        std_units = getattr(un, symbol, None)
+        if (isinstance(std_units, un.Unit) and
+                list(std_units.dimension) == list(dimension) and
+                std_units.power == power and std_units.offset == offset):
+            units = std_units
+        return un.Quantity(value, units)
+
+    def _lineage(self, type_name):
+        """
+        Returns the ComponentType and the types it extends, base type first
+        """
+        lineage = []
+        while type_name is not None:
+            try:
+                ct = self.component_types[type_name]
+            except KeyError:
+                if lineage:
+                    logger.warning(
+                        "Definition of '{}', which is extended by '{}', was "
+                        "not found".format(type_name,
+                                           lineage[0].get('name')))
+                    break
+                raise Pype9UsageError(
+                    "Definition of ComponentType '{}' was not found"
+                    .format(type_name))
+            lineage.insert(0, ct)
+            type_name = ct.get('extends')
+        return lineage
+
+    def _find(self, path, base_dir=None, with_location=False):
+        """
+        Finds an included file relative to the including file or in the
+        include directories
+        """
+        found = None
+        in_include_dir = False
+        if base_dir is not None and os.path.exists(
+                os.path.join(base_dir, path)):
+            found = os.path.join(base_dir, path)
+        else:
+            for include_dir in self.include_dirs:
+                if os.path.exists(os.path.join(include_dir, path)):
+                    found = os.path.join(include_dir, path)
+                    in_include_dir = True
+                    break
+        return (found, in_include_dir) if with_location else found
+
+    def _exposure(self, elem, aliases):
+        """
+        Adds an alias for variables that are exposed under a different name
+        """
+        exposure = elem.get('exposure')
+        if exposure is not None and exposure != elem.get('name'):
+            aliases[exposure] = Alias(exposure, elem.get('name'))
+
+    def _selection(self, elem, receive_ports, reduce_ports):
+        """
+        Converts derived variables that select values from child components
+        into analog receive (single value) or reduce (multiple values) ports
+        """
+        name = elem.get('name')
+        dimension = self.dimension(elem.get('dimension'))
+        reduce_op = elem.get('reduce')
+        if reduce_op is None:
+            receive_ports[name] = AnalogReceivePort(name, dimension=dimension)
+        elif reduce_op in ('add', 'multiply'):
+            reduce_ports[name] = AnalogReducePort(
+                name, dimension=dimension,
+                operator=('+' if reduce_op == 'add' else '*'))
+        else:
+            raise Pype9Unsupported9MLException(
+                "Unsupported reduce operation '{}' of '{}'".format(reduce_op,
+                                                                   name))
+
+    def _transition(self, handler, on_entry):
+        tag, trigger, assignments, outputs, target = handler
+        assignments = [StateAssignment(v, rhs) for v, rhs in chain(
+            assignments, on_entry.get(target, []))]
+        outputs = [OutputEvent(p) for p in outputs]
+        if tag == 'OnEvent':
+            return OnEvent(trigger, state_assignments=assignments,
+                           output_events=outputs, target_regime_name=target)
+        return OnCondition(trigger, state_assignments=assignments,
+                           output_events=outputs, target_regime_name=target)
+
+    def _initial(self, variable, rhs, props, component_class, name):
+        """
+        Determines the initial value of a state variable from an OnStart
+        assignment (if it is assigned a parameter or a numeric value)
+        """
+        sv = component_class.state_variable(variable)
+        if rhs in props:
+            return Initial(variable, props[rhs])
+        try:
+            value = float(rhs)
+        except ValueError:
+            pass
+        else:
+            if sv.dimension == un.dimensionless:
+                return Initial(variable, un.Quantity(value, un.unitless))
+            elif value == 0.0:
+                # Zero has the same value in all units so the first unit
+                # with matching dimensions is used
+                for symbol, (dim_name, _, _, offset) in sorted(
+                        self.units.items()):
+                    if (offset == 0.0 and dim_name in self.dimensions and
+                            list(self.dimension(dim_name)) ==
+                            list(sv.dimension)):
+                        return Initial(variable, self.quantity('0' + symbol))
+        logger.warning(
+            "Could not determine initial value of '{}' in '{}' from '{}', "
+            "it will need to be set explicitly".format(variable, name, rhs))
+        return None
+
+
+def _tag(elem):
+    "Strips the namespace from the tag of the element"
+    return elem.tag.split('}')[-1]
+
+
+def _expr(expr):
+    """
+    Converts a LEMS expression into 9ML syntax
+    """
+    for func in UNSUPPORTED_FUNCTIONS:
+        if re.search(r'\b{}\s*\('.format(func), expr):
+            raise Pype9Unsupported9MLException(
+                "The '{}' function (used in '{}') is not supported"
+                .format(func, expr))
+    for lems_op, nineml_op in OPERATORS:
+        expr = expr.replace(lems_op, ' {} '.format(nineml_op))
+    # Wrap the operands of logical operators in parentheses as '&' and '|'
+    # have higher precedence than comparisons
+    if '.and.' in expr or '.or.' in expr:
+        expr = '({})'.format(
+            expr.replace('.and.', ') & (').replace('.or.', ') | ('))
+    return re.sub(r'\s+', ' ', expr).strip()
+
+
+def _piecewise(elem):
+    """
+    Converts the cases of a ConditionalDerivedVariable into a piecewise
+    expression
+    """
+    pieces = []
+    for case in elem:
+        if _tag(case) != 'Case':
+            continue
+        condition = case.get('condition')
+        pieces.append(
+            (sympy.sympify(_expr(case.get('value'))),
+             sympy.sympify(_expr(condition)) if condition is not None
+             else True))
+    return sympy.Piecewise(*pieces)
+
+
+def _assignments(elem):
+    return [(e.get('variable'), _expr(e.get('value')))
+            for e in elem if _tag(e) == 'StateAssignment']
+
+
+def _handler(elem):
+    """
+    Reads an OnCondition or OnEvent element into a tuple of the its tag,
+    trigger (condition expression or port name), state assignments, output
+    events and target regime
+    """
+    tag = _tag(elem)
+    trigger = (_expr(elem.get('test')) if tag == 'OnCondition'
+               else elem.get('port'))
+    outputs = [e.get('port') for e in elem if _tag(e) == 'EventOut']
+    targets = [e.get('regime') for e in elem if _tag(e) == 'Transition']
+    return (tag, trigger, _assignments(elem), outputs,
+            targets[0] if targets else None)
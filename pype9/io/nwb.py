@@ -0,0 +1,158 @@
+"""
+  Export of simulation output to the Neurodata Without Borders (NWB 2.0)
+  format (https://www.nwb.org) via pynwb, so that recordings can be loaded
+  directly by standard electrophysiology analysis tools.
+
+  Analog signals are written as TimeSeries in the acquisition group of the
+  file, spike trains as rows of the Units table and regime epochs as rows of
+  the epochs table. Simulation metadata (e.g. model URL, seeds and time step)
+  is stored as JSON in the 'notes' field of the file.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+from builtins import str
+from datetime import datetime
+import json
+import uuid
+import numpy
+import quantities as pq
+import neo
+from pype9.exceptions import Pype9UsageError, Pype9ImportError
+from pype9.version import __version__
+
+EXTENSION = '.nwb'
+
+
+def write(path, segment, description=None, metadata=None):
+    """
+    Writes the spike trains, analog signals and epochs of a Neo segment to a
+    NWB file
+
+    Parameters
+    ----------
+    path : str
+        Path of the output NWB file
+    segment : neo.Segment
+        The recorded simulation output
+    description : str | None
+        Description of the simulation, used as the session description of the
+        NWB file
+    metadata : dict(str, object) | None
+        Simulation metadata (e.g. model URL, seeds, time step) to store in the
+        file. Must be serializable to JSON
+    """
+    pynwb = _import_pynwb()
+    if not (segment.analogsignals or segment.spiketrains):
+        raise Pype9UsageError(
+            "No spike trains or analog signals were found in segment to write "
+            "to '{}'".format(path))
+    if description is None:
+        description = (segment.description if segment.description
+                       else 'Pype9 simulation')
+    if metadata is None:
+        metadata = {}
+    nwbfile = pynwb.NWBFile(
+        session_description=description,
+        identifier=str(uuid.uuid4()),
+        session_start_time=datetime.now(_local_timezone()),
+        source_script='Pype9 {}'.format(__version__),
+        notes=json.dumps(metadata, sort_keys=True))
+    names = set()
+    for i, signal in enumerate(segment.analogsignals):
+        name = _unique_name(signal.name if signal.name else 'signal{}'
+                            .format(i), names)
+        nwbfile.add_acquisition(pynwb.TimeSeries(
+            name=name,
+            data=numpy.asarray(signal),
+            unit=signal.units.dimensionality.string,
+            starting_time=float(signal.t_start.rescale(pq.s)),
+            rate=float(signal.sampling_rate.rescale(pq.Hz))))
+    if segment.spiketrains:
+        nwbfile.add_unit_column('name', 'Name of the recorded port')
+        for i, spiketrain in enumerate(segment.spiketrains):
+            nwbfile.add_unit(
+                id=int(spiketrain.annotations.get('source_index', i)),
+                spike_times=numpy.asarray(spiketrain.rescale(pq.s)),
+                name=spiketrain.name if spiketrain.name else '')
+    for epoch in segment.epochs:
+        for time, duration, label in zip(epoch.times.rescale(pq.s),
+                                         epoch.durations.rescale(pq.s),
+                                         epoch.labels):
+            nwbfile.add_epoch(float(time), float(time + duration),
+                              tags=[_str(label)])
+    with pynwb.NWBHDF5IO(path, 'w') as io:
+        io.write(nwbfile)
+
+
+def read(path):
+    """
+    Reads the analog signals and spike trains written to a NWB file by
+    ``write`` back into a Neo segment
+
+    Parameters
+    ----------
+    path : str
+        Path of the NWB file
+
+    Returns
+    -------
+    segment : neo.Segment
+        The recorded simulation output, annotated with the simulation metadata
+    """
+    pynwb = _import_pynwb()
+    with pynwb.NWBHDF5IO(path, 'r') as io:
+        nwbfile = io.read()
+        segment = neo.Segment(description=nwbfile.session_description)
+        if nwbfile.notes:
+            segment.annotate(**json.loads(nwbfile.notes))
+        for name, series in sorted(nwbfile.acquisition.items()):
+            segment.analogsignals.append(neo.AnalogSignal(
+                series.data[()], units=series.unit, name=name,
+                t_start=series.starting_time * pq.s,
+                sampling_rate=series.rate * pq.Hz))
+        if nwbfile.units is not None:
+            units = nwbfile.units.to_dataframe()
+            t_stop = max([max(t) for t in units['spike_times'] if len(t)] +
+                         [float(s.t_stop.rescale(pq.s))
+                          for s in segment.analogsignals] + [0.0])
+            for index, row in units.iterrows():
+                spiketrain = neo.SpikeTrain(
+                    numpy.asarray(row['spike_times']), units='s',
+                    t_stop=float(t_stop), name=row['name'])
+                spiketrain.annotate(source_index=int(index))
+                segment.spiketrains.append(spiketrain)
+    return segment
+
+
+def _import_pynwb():
+    try:
+        import pynwb
+    except ImportError:
+        raise Pype9ImportError(
+            "The 'pynwb' package needs to be installed to read/write NWB "
+            "files")
+    return pynwb
+
+
+def _local_timezone():
+    from dateutil.tz import tzlocal
+    return tzlocal()
+
+
+def _unique_name(name, names):
+    unique = name
+    count = 1
+    while unique in names:
+        unique = '{}_{}'.format(name, count)
+        count += 1
+    names.add(unique)
+    return unique
+
+
+def _str(label):
+    return label.decode('utf-8') if isinstance(label, bytes) else str(label)
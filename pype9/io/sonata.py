@@ -0,0 +1,687 @@
+"""
+  Import of networks from, and export of simulation output to, the SONATA
+  format (https://github.com/AllenInstitute/sonata).
+
+  As SONATA doesn't describe the dynamics of the cells and synapses, the
+  'model_template' column of the node and edge types tables needs to
+  reference a 9ML DynamicsProperties object, e.g.
+  'nineml:./izhikevich.xml#SampleIzhikevich' (relative to the point neuron or
+  synaptic models directories in the 'components' section of the config).
+  Values from 'dynamics_params' JSON files in the types tables, or the
+  'dynamics_params' sub-groups of node groups, override the properties of the
+  referenced 9ML object and are interpreted in the same units. Synaptic
+  weights are interpreted in NEST units (e.g. nS, pA) and delays in ms.
+
+  The ports the edges are connected to are inferred when there is only one
+  candidate, otherwise they need to be provided by the 'source_port',
+  'receive_port', 'weight_port', 'response_port' and 'target_port' columns of
+  the edge types table.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+from builtins import str, range
+from past.builtins import basestring
+from collections import OrderedDict
+from itertools import chain
+import os.path
+import re
+import csv
+import json
+import numpy
+import h5py
+import quantities as pq
+import neo
+import nineml
+import ninemlcatalog
+from nineml import units as un
+from nineml.user import (
+    Network, Population, Projection, DynamicsProperties,
+    ConnectionRuleProperties, Property)
+from nineml.user.component import Quantity
+from nineml.abstraction import (
+    Dynamics, Regime, Parameter, AnalogSendPort, ConnectionRule)
+from nineml.values import ArrayValue
+from pype9.simulate.common.units import UnitHandler as BaseUnitHandler
+from pype9.annotations import (
+    PYPE9_NS, SONATA, SONATA_POPULATION, SONATA_NODE_IDS)
+from pype9.exceptions import Pype9UsageError
+from pype9.utils.logging import logger
+
+NINEML_PREFIX = 'nineml:'
+CATALOG_PREFIX = 'catalog://'
+
+# Values in SONATA tables that signify a missing value
+NULL_VALUES = ('NULL', 'None', '')
+
+EXPLICIT_RULE = ConnectionRule(
+    name='Explicit',
+    standard_library='http://nineml.net/9ML/1.0/connectionrules/Explicit',
+    parameters=[Parameter('sourceIndicies'),
+                Parameter('destinationIndicies')])
+
+
+class UnitHandler(BaseUnitHandler):
+    """
+    The units the (unitless) synaptic weights in SONATA files are interpreted
+    in, which match the conventions of point-neuron models built for NEST
+    """
+
+    basis = [un.ms, un.mV, un.pA, un.mM, un.pF, un.um, un.nS, un.K, un.cd]
+    compounds = []
+
+    unit_name_map = {un.ms: 'ms', un.mV: 'mV', un.pA: 'pA', un.mM: 'mM',
+                     un.pF: 'pF', un.um: 'um', un.nS: 'nS', un.K: 'K',
+                     un.cd: 'cd'}
+
+    (A, cache, si_lengths) = BaseUnitHandler._init_matrices_and_cache(
+        basis, compounds)
+
+    def _units_for_code_gen(self, units):
+        return self.compound_to_units_str(units)
+
+
+def read(path, name=None):
+    """
+    Reads a SONATA network into a 9ML network, which can be passed to the
+    Network class of any of the simulator backends. A 9ML population is
+    created for each node type of each SONATA node population and a 9ML
+    projection for each edge type between each pair of 9ML populations.
+
+    Parameters
+    ----------
+    path : str
+        Path to the SONATA circuit config (JSON) file
+    name : str | None
+        Name of the network. If None the name of the config file is used
+
+    Returns
+    -------
+    network : nineml.Network
+        The 9ML network
+    """
+    config = read_config(path)
+    if name is None:
+        name = _escape(os.path.splitext(os.path.basename(path))[0])
+    components = config.get('components', {})
+    networks = config.get('networks', {})
+    populations = []
+    node_maps = {}
+    for nodes in networks.get('nodes', []):
+        types = _read_types(nodes['node_types_file'])
+        models_dir = components.get(
+            'point_neuron_models_dir',
+            os.path.dirname(nodes['node_types_file']))
+        with h5py.File(nodes['nodes_file'], 'r') as f:
+            for sonata_pop, group in f['nodes'].items():
+                pops, node_maps[sonata_pop] = _read_nodes(
+                    sonata_pop, group, types, models_dir)
+                populations.extend(pops)
+    projections = []
+    for edges in networks.get('edges', []):
+        types = _read_types(edges['edge_types_file'])
+        models_dir = components.get(
+            'synaptic_models_dir', os.path.dirname(edges['edge_types_file']))
+        with h5py.File(edges['edges_file'], 'r') as f:
+            for sonata_pop, group in f['edges'].items():
+                projections.extend(_read_edges(sonata_pop, group, types,
+                                               models_dir, node_maps))
+    logger.info("Read {} populations and {} projections from SONATA network "
+                "'{}'".format(len(populations), len(projections), path))
+    return Network(name, populations=populations, projections=projections)
+
+
+def is_config(path):
+    """
+    Checks whether the file is a SONATA circuit config file (as opposed to a
+    9ML document serialized to JSON)
+    """
+    if not path.endswith('.json'):
+        return False
+    try:
+        with open(path) as f:
+            return 'networks' in json.load(f)
+    except (IOError, ValueError):
+        return False
+
+
+def read_config(path):
+    """
+    Reads a SONATA config file, substituting the variables defined in the
+    manifest and converting relative paths to absolute paths
+
+    Parameters
+    ----------
+    path : str
+        Path to the config file
+    """
+    with open(path) as f:
+        config = json.load(f)
+    config_dir = os.path.dirname(os.path.abspath(path))
+    manifest = dict((k.lstrip('$'), v)
+                    for k, v in config.pop('manifest', {}).items())
+    manifest['configdir'] = config_dir
+
+    def substitute(value, key=''):
+        if isinstance(value, basestring):
+            orig = prev = value
+            value = None
+            # Substitute repeatedly as manifest variables can be nested, which
+            # can't take more passes than there are variables unless they
+            # refer to themselves (directly or indirectly)
+            for _ in range(len(manifest) + 1):
+                value = re.sub(
+                    r'\$\{?(\w+)\}?',
+                    lambda m: str(manifest.get(m.group(1), m.group(0))),
+                    prev)
+                if value == prev:
+                    break
+                prev = value
+            else:
+                raise Pype9UsageError(
+                    "Could not substitute the manifest variables in '{}' in "
+                    "{} as they are defined recursively".format(orig, path))
+            if key.endswith(('_file', '_dir')) and not os.path.isabs(value):
+                value = os.path.normpath(os.path.join(config_dir, value))
+            return value
+        elif isinstance(value, dict):
+            return dict((k, substitute(v, k)) for k, v in value.items())
+        elif isinstance(value, list):
+            return [substitute(v, key) for v in value]
+        return value
+
+    return substitute(config)
+
+
+def get_node_ids(population):
+    """
+    Returns the SONATA population name and node IDs of a population read from
+    a SONATA network, which can be passed to 'write_spikes'/'write_report'
+    to write its recordings back in terms of the original nodes
+
+    Parameters
+    ----------
+    population : nineml.Population
+        A population of a network read using 'read'
+    """
+    sonata_pop = population.annotations.get((SONATA, PYPE9_NS),
+                                            SONATA_POPULATION, default=None)
+    ids = population.annotations.get((SONATA, PYPE9_NS), SONATA_NODE_IDS,
+                                     default=None)
+    if sonata_pop is None or ids is None:
+        raise Pype9UsageError(
+            "Population '{}' was not read from a SONATA network"
+            .format(population.name))
+    return sonata_pop, [int(i) for i in ids.split(',')]
+
+
+def write(path, segment, population='pype9', node_ids=None):
+    """
+    Writes the spike trains and analog signals of a Neo segment to a SONATA
+    output file
+
+    Parameters
+    ----------
+    path : str
+        Path of the output (HDF5) file
+    segment : neo.Segment
+        The recorded simulation output
+    population : str
+        The name of the SONATA node population the recording belongs to
+    node_ids : list(int) | None
+        The node IDs corresponding to each spike train/analog signal channel.
+        If None they are taken from the 'source_index' annotations of the
+        signals or their order in the segment
+    """
+    mode = 'w'
+    if segment.spiketrains:
+        write_spikes(path, segment.spiketrains, population=population,
+                     node_ids=node_ids, mode=mode)
+        mode = 'a'
+    if segment.analogsignals:
+        write_report(path, segment.analogsignals, population=population,
+                     node_ids=node_ids, mode=mode)
+    elif not segment.spiketrains:
+        raise Pype9UsageError(
+            "No spike trains or analog signals were found in segment to write "
+            "to '{}'".format(path))
+
+
+def write_spikes(path, spiketrains, population='pype9', node_ids=None,
+                 mode='a'):
+    """
+    Writes spike trains to a SONATA spikes file
+
+    Parameters
+    ----------
+    path : str
+        Path of the output (HDF5) file
+    spiketrains : list(neo.SpikeTrain) | neo.Segment
+        The spike trains to write
+    population : str
+        The name of the SONATA node population the spike trains belong to
+    node_ids : list(int) | None
+        The node IDs corresponding to each spike train. If None they are taken
+        from the 'source_index' annotations of the spike trains or their order
+    mode : str
+        The mode the HDF5 file is opened with
+    """
+    if isinstance(spiketrains, neo.Segment):
+        spiketrains = spiketrains.spiketrains
+    ids = _node_ids(spiketrains, node_ids)
+    times = numpy.concatenate(
+        [numpy.asarray(st.rescale(pq.ms))
+         for st in spiketrains] + [numpy.array([])])
+    senders = numpy.concatenate(
+        [numpy.ones(len(st), dtype='uint64') * i
+         for st, i in zip(spiketrains, ids)] +
+        [numpy.array([], dtype='uint64')])
+    order = numpy.argsort(times, kind='mergesort')
+    with h5py.File(path, mode) as f:
+        group = f.require_group('spikes').create_group(population)
+        group.attrs['sorting'] = 'by_time'
+        timestamps = group.create_dataset('timestamps', data=times[order])
+        timestamps.attrs['units'] = 'ms'
+        group.create_dataset('node_ids', data=senders[order])
+    logger.info("Wrote {} spikes from {} nodes to SONATA spikes file '{}'"
+                .format(len(times), len(spiketrains), path))
+
+
+def write_report(path, signals, population='pype9', node_ids=None,
+                 mode='a'):
+    """
+    Writes analog signals to a SONATA (cell) report file
+
+    Parameters
+    ----------
+    path : str
+        Path of the output (HDF5) file
+    signals : list(neo.AnalogSignal) | neo.Segment
+        The analog signals to write, which must share the same timing and
+        units
+    population : str
+        The name of the SONATA node population the signals belong to
+    node_ids : list(int) | None
+        The node IDs corresponding to each channel of the signals. If None
+        they are taken from the 'source_index' annotations of the signals or
+        their order
+    mode : str
+        The mode the HDF5 file is opened with
+    """
+    if isinstance(signals, neo.Segment):
+        signals = signals.analogsignals
+    if not signals:
+        raise Pype9UsageError(
+            "No analog signals provided to write to '{}'".format(path))
+    first = signals[0]
+    columns = []
+    for sig in signals:
+        if (sig.t_start != first.t_start or
+                sig.sampling_period != first.sampling_period or
+                len(sig) != len(first)):
+            raise Pype9UsageError(
+                "Analog signals written to SONATA reports need to have the "
+                "same start time, sampling period and length ('{}' and '{}'"
+                " do not)".format(first.name, sig.name))
+        if sig.units.dimensionality != first.units.dimensionality:
+            raise Pype9UsageError(
+                "Analog signals written to SONATA reports need to have the "
+                "same units ('{}' and '{}' do not)".format(first.name,
+                                                           sig.name))
+        columns.append(numpy.asarray(sig.magnitude).reshape(len(sig), -1))
+    data = numpy.hstack(columns)
+    if node_ids is None:
+        if all(c.shape[1] == 1 for c in columns):
+            node_ids = _node_ids(signals, None)
+        else:
+            node_ids = numpy.arange(data.shape[1])
+    elif len(node_ids) != data.shape[1]:
+        raise Pype9UsageError(
+            "Number of node IDs ({}) does not match the number of channels "
+            "in the analog signals ({})".format(len(node_ids),
+                                                data.shape[1]))
+    t_start = float(first.t_start.rescale(pq.ms))
+    dt = float(first.sampling_period.rescale(pq.ms))
+    with h5py.File(path, mode) as f:
+        group = f.require_group('report').create_group(population)
+        dset = group.create_dataset('data', data=data.astype('float32'))
+        dset.attrs['units'] = first.units.dimensionality.string
+        mapping = group.create_group('mapping')
+        mapping.create_dataset('node_ids',
+                               data=numpy.asarray(node_ids, dtype='uint64'))
+        mapping.create_dataset('element_ids',
+                               data=numpy.zeros(data.shape[1], dtype='uint32'))
+        mapping.create_dataset('index_pointer',
+                               data=numpy.arange(data.shape[1] + 1,
+                                                 dtype='uint64'))
+        time = mapping.create_dataset(
+            'time', data=[t_start, t_start + dt * data.shape[0], dt])
+        time.attrs['units'] = 'ms'
+    logger.info("Wrote {} channels to SONATA report file '{}'"
+                .format(data.shape[1], path))
+
+
+def _read_nodes(sonata_pop, group, types, models_dir):
+    """
+    Creates a 9ML population for each node type in the SONATA node population
+
+    Returns
+    -------
+    populations : list(nineml.Population)
+        The 9ML populations
+    node_map : dict(int, (nineml.Population, int))
+        Mapping from the SONATA node IDs to the 9ML populations and indices
+    """
+    type_ids = group['node_type_id'][...]
+    if 'node_id' in group:
+        ids = group['node_id'][...]
+    else:
+        ids = numpy.arange(len(type_ids))
+    group_ids = group['node_group_id'][...]
+    group_indices = group['node_group_index'][...]
+    unique_type_ids = [int(t) for t in numpy.unique(type_ids)]
+    # Use the 'pop_name' of the node types to name the 9ML populations if
+    # they are unique
+    labels = [types[t].get('pop_name', t) for t in unique_type_ids]
+    if len(set(labels)) != len(labels):
+        labels = unique_type_ids
+    populations = []
+    node_map = {}
+    for type_id, label in zip(unique_type_ids, labels):
+        mask = type_ids == type_id
+        pop_ids = ids[mask]
+        name = _escape('{}_{}'.format(sonata_pop, label))
+        template, overrides = _load_template(types[type_id], models_dir,
+                                             name)
+        overrides.update(_group_values(group, group_ids[mask],
+                                       group_indices[mask]))
+        pop = Population(name, size=len(pop_ids),
+                         cell=_properties(name + '_props', template,
+                                          overrides))
+        pop.annotations.set((SONATA, PYPE9_NS), SONATA_POPULATION,
+                            sonata_pop)
+        pop.annotations.set((SONATA, PYPE9_NS), SONATA_NODE_IDS,
+                            ','.join(str(int(i)) for i in pop_ids))
+        node_map.update((int(n), (pop, i)) for i, n in enumerate(pop_ids))
+        populations.append(pop)
+    return populations, node_map
+
+
+def _read_edges(sonata_pop, group, types, models_dir, node_maps):
+    """
+    Creates a 9ML projection for each edge type between each pair of 9ML
+    populations in the SONATA edge population
+    """
+    source_ids = group['source_node_id']
+    target_ids = group['target_node_id']
+    maps = []
+    for dset in (source_ids, target_ids):
+        node_pop = dset.attrs['node_population']
+        if isinstance(node_pop, bytes):
+            node_pop = node_pop.decode('utf-8')
+        try:
+            maps.append(node_maps[node_pop])
+        except KeyError:
+            raise Pype9UsageError(
+                "Node population '{}' referenced by '{}' edges was not found "
+                "in the network nodes files".format(node_pop, sonata_pop))
+    source_map, target_map = maps
+    sources = [source_map[int(i)] for i in source_ids[...]]
+    targets = [target_map[int(i)] for i in target_ids[...]]
+    type_ids = group['edge_type_id'][...]
+    num_edges = len(type_ids)
+    if 'edge_group_id' in group:
+        group_ids = group['edge_group_id'][...]
+        group_indices = group['edge_group_index'][...]
+    else:
+        group_ids = numpy.zeros(num_edges, dtype=int)
+        group_indices = numpy.arange(num_edges)
+    # Group the edges by their type and the 9ML populations they connect
+    grouped = OrderedDict()
+    for i, (type_id, (pre, _), (post, _)) in enumerate(zip(type_ids, sources,
+                                                           targets)):
+        grouped.setdefault((int(type_id), pre.name, post.name),
+                           []).append(i)
+    projections = []
+    for (type_id, pre_name, post_name), indices in grouped.items():
+        indices = numpy.asarray(indices)
+        edge_type = types[type_id]
+        pre = sources[indices[0]][0]
+        post = targets[indices[0]][0]
+        name = _escape('{}_{}_{}_to_{}'.format(sonata_pop, type_id, pre_name,
+                                               post_name))
+        values = _group_values(group, group_ids[indices],
+                               group_indices[indices])
+        weights = values.pop('syn_weight', edge_type.get('syn_weight'))
+        delays = values.pop('delay', edge_type.get('delay'))
+        if weights is None or delays is None:
+            raise Pype9UsageError(
+                "Both 'syn_weight' and 'delay' need to be provided for the "
+                "edges of type {} in '{}' edge population".format(type_id,
+                                                                 sonata_pop))
+        template, overrides = _load_template(edge_type, models_dir, name)
+        overrides.update(values)
+        response = _properties(name + '_response', template, overrides)
+        resp_cls = response.component_class
+        source_port = _select_port(
+            edge_type, 'source_port',
+            pre.cell.component_class.event_send_port_names, name)
+        receive_port = _select_port(
+            edge_type, 'receive_port', resp_cls.event_receive_port_names, name)
+        weight_port = _select_port(
+            edge_type, 'weight_port', chain(resp_cls.analog_receive_port_names,
+                                            resp_cls.analog_reduce_port_names),
+            name)
+        response_port = _select_port(
+            edge_type, 'response_port', resp_cls.analog_send_port_names, name)
+        target_port = _select_port(
+            edge_type, 'target_port',
+            post.cell.component_class.analog_reduce_port_names, name)
+        dimension = resp_cls.port(weight_port).dimension
+        plasticity = DynamicsProperties(
+            name=name + '_weight', definition=_static_plasticity(dimension),
+            properties=[Property('weight', Quantity(
+                _value(weights), UnitHandler.dimension_to_units(dimension)))])
+        connectivity = ConnectionRuleProperties(
+            name + '_connectivity', EXPLICIT_RULE,
+            properties={
+                'sourceIndicies': Quantity(
+                    ArrayValue([sources[i][1] for i in indices]),
+                    un.unitless),
+                'destinationIndicies': Quantity(
+                    ArrayValue([targets[i][1] for i in indices]),
+                    un.unitless)})
+        projections.append(Projection(
+            name=name, pre=pre, post=post, response=response,
+            plasticity=plasticity, connection_rule_properties=connectivity,
+            port_connections=[
+                ('pre', source_port, 'response', receive_port),
+                ('response', response_port, 'post', target_port),
+                ('plasticity', 'fixed_weight', 'response', weight_port)],
+            delay=Quantity(_value(delays), un.ms)))
+    return projections
+
+
+def _read_types(path):
+    """
+    Reads a SONATA node or edge types table (space-separated CSV) into a
+    dictionary of rows indexed by type ID
+    """
+    types = {}
+    with open(path) as f:
+        reader = csv.DictReader(f, delimiter=' ', skipinitialspace=True)
+        for row in reader:
+            row = dict((k, v) for k, v in row.items()
+                       if k and v not in NULL_VALUES)
+            try:
+                type_id = row.pop('node_type_id', None)
+                if type_id is None:
+                    type_id = row.pop('edge_type_id')
+            except KeyError:
+                raise Pype9UsageError(
+                    "Row in SONATA types file '{}' is missing a type ID ({})"
+                    .format(path, row))
+            types[int(type_id)] = row
+    return types
+
+
+def _load_template(row, models_dir, name):
+    """
+    Loads the 9ML properties referenced by the 'model_template' column of a
+    types table along with the property values in the 'dynamics_params' JSON
+    file (if provided)
+    """
+    try:
+        template = row['model_template']
+    except KeyError:
+        raise Pype9UsageError(
+            "No 'model_template' provided for '{}'".format(name))
+    if not template.startswith(NINEML_PREFIX):
+        raise Pype9UsageError(
+            "Only 9ML model templates ('{}<url>#<name>') are supported, "
+            "found '{}' for '{}'".format(NINEML_PREFIX, template, name))
+    url = template[len(NINEML_PREFIX):]
+    if url.startswith(CATALOG_PREFIX):
+        props = ninemlcatalog.load(url[len(CATALOG_PREFIX):])
+    else:
+        props = nineml.read(url, relative_to=models_dir)
+    if not isinstance(props, DynamicsProperties):
+        raise Pype9UsageError(
+            "Model template of '{}' needs to reference a 9ML "
+            "DynamicsProperties object, found {}".format(name, props))
+    overrides = {}
+    if 'dynamics_params' in row:
+        params_path = row['dynamics_params']
+        if not os.path.isabs(params_path):
+            params_path = os.path.join(models_dir, params_path)
+        with open(params_path) as f:
+            overrides = json.load(f)
+    return props, overrides
+
+
+def _group_values(group, group_ids, group_indices):
+    """
+    Collects the values of the datasets in the node/edge groups (and their
+    'dynamics_params' sub-groups) for the selected nodes/edges
+    """
+    values = {}
+    for group_id in numpy.unique(group_ids):
+        mask = group_ids == group_id
+        try:
+            sub_group = group[str(int(group_id))]
+        except KeyError:
+            continue  # No values stored for the group
+        dsets = [(n, d) for n, d in sub_group.items()
+                 if isinstance(d, h5py.Dataset)]
+        if 'dynamics_params' in sub_group:
+            dsets.extend(sub_group['dynamics_params'].items())
+        for dname, dset in dsets:
+            vals = values.setdefault(dname, numpy.empty(len(group_ids)) *
+                                     numpy.nan)
+            vals[mask] = dset[...][group_indices[mask]]
+    return values
+
+
+def _properties(name, template, overrides):
+    """
+    Creates a copy of the template properties with the override values
+    (in the units of the template properties) substituted
+    """
+    props = []
+    initial_values = []
+    names = set()
+    for prop, prop_list in chain(
+            ((p, props) for p in template.properties),
+            ((iv, initial_values) for iv in template.initial_values)):
+        if prop.name in overrides:
+            prop = Property(prop.name, Quantity(_value(overrides[prop.name]),
+                                                prop.units))
+        prop_list.append(prop)
+        names.add(prop.name)
+    # Reserved values in node/edge groups (e.g. positions) are ignored
+    unknown = [n for n in overrides
+               if n not in names and n not in ('x', 'y', 'z') and
+               not n.startswith('rotation_angle')]
+    if unknown:
+        logger.warning(
+            "Ignoring values for '{}', which are not properties or initial "
+            "values of '{}'".format("', '".join(unknown), template.name))
+    return DynamicsProperties(
+        name, definition=template.component_class, properties=props,
+        initial_values=initial_values,
+        initial_regime=template.initial_regime)
+
+
+def _value(values):
+    """
+    Converts the values into a single value if they are all the same or an
+    array value otherwise
+    """
+    values = numpy.asarray(values, dtype=float).ravel()
+    if numpy.isnan(values).any():
+        raise Pype9UsageError(
+            "Values were not provided for all nodes/edges")
+    if len(values) == 1 or (values == values[0]).all():
+        return float(values[0])
+    return ArrayValue(values.tolist())
+
+
+def _select_port(row, column, candidates, name):
+    """
+    Selects the port from the column of the types table or from the
+    candidates if there is only one
+    """
+    if column in row:
+        return row[column]
+    candidates = list(candidates)
+    if len(candidates) != 1:
+        raise Pype9UsageError(
+            "Could not infer '{}' of '{}' projection from the candidates "
+            "('{}'), please specify it in the '{}' column of the edge types "
+            "table".format(column, name, "', '".join(candidates), column))
+    return candidates[0]
+
+
+_static_plasticities = {}
+
+
+def _static_plasticity(dimension):
+    """
+    Returns the dynamics used to supply the static weights of the edges
+    """
+    try:
+        return _static_plasticities[dimension.name]
+    except KeyError:
+        dynamics = _static_plasticities[dimension.name] = Dynamics(
+            name='SonataStatic_' + dimension.name,
+            aliases=['fixed_weight := weight'],
+            regimes=[Regime(name='default')],
+            analog_ports=[AnalogSendPort('fixed_weight',
+                                         dimension=dimension)],
+            parameters=[Parameter('weight', dimension=dimension)])
+        return dynamics
+
+
+def _node_ids(signals, node_ids):
+    if node_ids is None:
+        return [s.annotations.get('source_index', i)
+                for i, s in enumerate(signals)]
+    if len(node_ids) != len(signals):
+        raise Pype9UsageError(
+            "Number of node IDs ({}) does not match the number of signals "
+            "({})".format(len(node_ids), len(signals)))
+    return node_ids
+
+
+def _escape(name):
+    """
+    Converts a SONATA name into a valid 9ML name
+    """
+    name = re.sub(r'\W', '_', str(name))
+    if not name or name[0].isdigit():
+        name = 'sonata_' + name
+    return name
@@ -1,83 +1,284 @@
+from __future__ import division
 from builtins import str
 from builtins import next
+import numpy
 import matplotlib.pyplot as plt
 import matplotlib.patches as mpatches
 from collections import defaultdict, OrderedDict
 import quantities as pq
+from pype9.exceptions import Pype9UsageError, Pype9ImportError
 from pype9.utils.logging import logger
 
+# The types of panels that can be included in a plot. Analog panels can be
+# restricted to a single signal by appending its name, e.g. 'analog:V'
+PANEL_TYPES = ('raster', 'rate', 'analog')
+
+# The annotation spike trains are grouped by in raster plots and rate
+# histograms (set by PyNN on the spike trains recorded from populations)
+GROUP_ANNOTATION = 'source_population'
+
+HTML_LIBRARIES = ('plotly', 'bokeh')
+
 
 def plot(seg, dims=(20, 16), resolution=300, save=None, show=True,
-         regime_alpha=0.05, regime_linestyle=':', title=None):
+         regime_alpha=0.05, regime_linestyle=':', title=None, panels=None,
+         bin_width=None, group_by=GROUP_ANNOTATION, style=None):
+    """
+    Plots the spike trains and analog signals of a recorded segment in a
+    multi-panel figure
+
+    Parameters
+    ----------
+    seg : neo.Segment
+        The recorded segment to plot
+    panels : list(str) | None
+        The panels of the figure from top to bottom, 'raster', 'rate' or
+        'analog' (optionally followed by ':<signal-name>' to only plot a
+        single signal). Defaults to a raster plot of the spike trains (and a
+        rate histogram if 'bin_width' is provided) above the analog signals
+    bin_width : float | None
+        The width of the bins of the rate histograms (ms)
+    group_by : str
+        The annotation the spike trains are grouped by (e.g. population) in
+        raster plots and rate histograms
+    style : str | dict | None
+        A Matplotlib style name, the path to a matplotlibrc-like style file or
+        a dictionary of rc parameters to plot the figure with
+    """
+    if title is None:
+        title = 'PyPe9 Simulation Output'
+    panels = parse_panels(seg, panels, bin_width=bin_width)
+    with plt.style.context(style if style is not None else []):
+        fig, axes = plt.subplots(len(panels), 1, squeeze=False)
+        fig.suptitle(title)
+        fig.set_figwidth(dims[0])
+        fig.set_figheight(dims[1])
+        # Set the dimension of the figure
+        plt_name = seg.name + ' ' if seg.name else ''
+        for ax, (panel_type, name) in zip(axes[:, 0], panels):
+            plt.sca(ax)
+            if panel_type == 'raster':
+                _plot_raster(seg, plt_name, group_by)
+            elif panel_type == 'rate':
+                _plot_rates(seg, plt_name, bin_width, group_by)
+            else:
+                _plot_analog(seg, plt_name, name, regime_alpha,
+                             regime_linestyle)
+        if save is not None:
+            fig.savefig(save, dpi=resolution)
+            logger.info("Saved{} figure to '{}'".format(plt_name, save))
+        if show:
+            plt.show()
+
+
+def plot_html(seg, save, panels=None, bin_width=None,
+              group_by=GROUP_ANNOTATION, title=None, library='plotly',
+              show=False, regime_alpha=0.1):
+    """
+    Plots the spike trains and analog signals of a recorded segment to an
+    interactive HTML page with Plotly or Bokeh (see ``plot`` for the layout
+    options)
+
+    Parameters
+    ----------
+    seg : neo.Segment
+        The recorded segment to plot
+    save : str
+        The path of the HTML file to save the plot to
+    library : str
+        The plotting library to use, 'plotly' or 'bokeh'
+    show : bool
+        Whether to open the saved plot in a browser
+    """
+    if library not in HTML_LIBRARIES:
+        raise Pype9UsageError(
+            "Unrecognised HTML plotting library '{}', can be one of '{}'"
+            .format(library, "', '".join(HTML_LIBRARIES)))
     if title is None:
         title = 'PyPe9 Simulation Output'
-    num_subplots = bool(seg.analogsignals) + bool(seg.spiketrains)
-    fig, axes = plt.subplots(num_subplots, 1)
+    panels = parse_panels(seg, panels, bin_width=bin_width)
+    if library == 'plotly':
+        _plot_plotly(seg, save, panels, bin_width, group_by, title, show,
+                     regime_alpha)
+    else:
+        _plot_bokeh(seg, save, panels, bin_width, group_by, title, show,
+                    regime_alpha)
+    logger.info("Saved interactive figure to '{}'".format(save))
+
+
+def parse_panels(seg, panels=None, bin_width=None):
+    """
+    Parses the panel specifications of a plot into a list of (type, name)
+    tuples, checking they can be plotted from the segment
+
+    Parameters
+    ----------
+    seg : neo.Segment
+        The recorded segment to plot
+    panels : list(str) | None
+        The panel specifications (see ``plot``)
+    bin_width : float | None
+        The width of the bins of the rate histograms (ms)
+    """
+    if panels is None:
+        panels = []
+        if seg.spiketrains:
+            panels.append('raster')
+            if bin_width is not None:
+                panels.append('rate')
+        if seg.analogsignals:
+            panels.append('analog')
+    parsed = []
+    for panel in panels:
+        panel_type, _, name = panel.partition(':')
+        name = name if name else None
+        if panel_type not in PANEL_TYPES:
+            raise Pype9UsageError(
+                "Unrecognised panel type '{}', can be one of '{}'"
+                .format(panel_type, "', '".join(PANEL_TYPES)))
+        if panel_type in ('raster', 'rate') and not seg.spiketrains:
+            raise Pype9UsageError(
+                "Cannot plot '{}' panel as there are no spike trains in the "
+                "recording".format(panel_type))
+        if panel_type == 'rate' and bin_width is None:
+            raise Pype9UsageError(
+                "The bin width needs to be provided to plot rate histograms")
+        if panel_type == 'analog':
+            analog_signals(seg, name)  # Check there are signals to plot
+        parsed.append((panel_type, name))
+    if not parsed:
+        raise Pype9UsageError("Nothing to plot in the recording")
+    return parsed
+
+
+def analog_signals(seg, name=None):
+    """
+    The analog signals of the segment, or only the one with the given name
+    """
+    if name is None:
+        signals = list(seg.analogsignals)
+    else:
+        signals = [s for s in seg.analogsignals if s.name == name]
+    if not signals:
+        raise Pype9UsageError(
+            "No analog signals{} in the recording".format(
+                " named '{}'".format(name) if name is not None else ''))
+    return signals
+
+
+def group_spiketrains(spiketrains, group_by=GROUP_ANNOTATION):
+    """
+    Groups spike trains by the value of an annotation (e.g. population),
+    preserving the order of the groups. Spike trains without the
+    annotation are grouped under None
+    """
+    groups = OrderedDict()
+    for spiketrain in spiketrains:
+        groups.setdefault(spiketrain.annotations.get(group_by, None),
+                          []).append(spiketrain)
+    return groups
+
+
+def raster_data(spiketrains, group_by=GROUP_ANNOTATION):
+    """
+    The spike times and cell indices of each group of spike trains, with the
+    cells of consecutive groups stacked on top of each other
+
+    Returns
+    -------
+    data : list(tuple(object, numpy.array, list(int)))
+        The name, spike times (ms) and cell indices of each group
+    """
+    data = []
+    offset = 0
+    for name, group in group_spiketrains(spiketrains, group_by).items():
+        spike_times = []
+        ids = []
+        for i, spiketrain in enumerate(group):
+            spike_times.extend(spiketrain.rescale(pq.ms).magnitude)
+            ids.extend([offset + i] * len(spiketrain))
+        data.append((name, numpy.array(spike_times), ids))
+        offset += len(group)
+    return data
+
+
+def firing_rates(spiketrains, bin_width, group_by=GROUP_ANNOTATION):
+    """
+    The mean firing rate of the cells of each group of spike trains in bins
+    of the given width
+
+    Parameters
+    ----------
+    spiketrains : list(neo.SpikeTrain)
+        The spike trains to calculate the rates of
+    bin_width : float
+        The width of the bins (ms)
+
+    Returns
+    -------
+    rates : list(tuple(object, numpy.array, numpy.array))
+        The name, bin centres (ms) and firing rates (Hz) of each group
+    """
+    if bin_width <= 0.0:
+        raise Pype9UsageError(
+            "Bin width must be positive ({} ms)".format(bin_width))
+    t_start = float(spiketrains[0].t_start.rescale(pq.ms))
+    t_stop = float(spiketrains[0].t_stop.rescale(pq.ms))
+    num_bins = max(int(numpy.ceil((t_stop - t_start) / bin_width)), 1)
+    edges = t_start + numpy.arange(num_bins + 1) * bin_width
+    rates = []
+    for name, group in group_spiketrains(spiketrains, group_by).items():
+        times = numpy.concatenate(
+            [st.rescale(pq.ms).magnitude for st in group])
+        counts = numpy.histogram(times, edges)[0]
+        rates.append((name, edges[:-1] + bin_width / 2.0,
+                      counts / (len(group) * bin_width / 1000.0)))
+    return rates
+
+
+def plot_comparison(recordings, names, dims=(20, 16), resolution=300,
+                    save=None, show=True, title=None):
+    """
+    Overlays the recordings of the same model simulated on different
+    simulators (see 'pype9 compare'), with a subplot for each recording
+
+    Parameters
+    ----------
+    recordings : dict(str, list(neo.Segment))
+        The recorded segments of each simulator
+    names : list(str)
+        The names of the recordings (i.e. the recorded ports)
+    """
+    if title is None:
+        title = 'PyPe9 Simulator Comparison'
+    fig, axes = plt.subplots(len(names), 1, squeeze=False)
     fig.suptitle(title)
     fig.set_figwidth(dims[0])
     fig.set_figheight(dims[1])
-    # Set the dimension of the figure
-    plt_name = seg.name + ' ' if seg.name else ''
-    if seg.spiketrains:
-        spike_times = []
-        ids = []
-        for i, spiketrain in enumerate(seg.spiketrains):
-            spike_times.extend(spiketrain)
-            ids.extend([i] * len(spiketrain))
-        plt.sca(axes[0] if num_subplots > 1 else axes)
-        plt.scatter(spike_times, ids)
-        plt.xlim((seg.spiketrains[0].t_start, seg.spiketrains[0].t_stop))
-        plt.ylim((-1, len(seg.spiketrains)))
-        plt.xlabel('Times (ms)')
-        plt.ylabel('Cell Indices')
-        plt.title("{}Spike Trains".format(plt_name), fontsize=12)
-    if seg.analogsignals:
-        legend = []
-        plt.sca(axes[-1] if num_subplots > 1 else axes)
-        units = set(s.units.dimensionality.string for s in seg.analogsignals)
-        # Plot signals
-        for i, signal in enumerate(seg.analogsignals):
-            un_str = (signal.units.dimensionality.string
-                      if len(units) > 1 else '')
-            label = signal.name + un_str if signal.name else str(i)
-            line, = plt.plot(signal.times, signal, label=label)
-            legend.append(line)
-        # Plot regime epochs (if present)
-        for epochs in seg.epochs:
-            # Generate colours for each regime
-            labels = sort_epochs_by_duration(epochs)
-            # Make the 'mode' regime transparent
-            label_colours = OrderedDict([(labels[0], None)])
-            for label in labels[1:]:
-                label_colours[label] = plt.gca()._get_lines.get_next_color()
-            for label, start, duration in zip(epochs.labels,
-                                              epochs.times,
-                                              epochs.durations):
-                if label_colours[label] is not None:
-                    end = start + duration
-                    plt.axvspan(start, end, facecolor=label_colours[label],
-                                alpha=regime_alpha)
-                    plt.axvline(start, linestyle=regime_linestyle,
-                                color='gray', linewidth=0.5)
-                    plt.axvline(end, linestyle=regime_linestyle, color='gray',
-                                linewidth=0.5)
-            for label, colour in label_colours.items():
-                if colour is None:
-                    colour = 'white'
-                legend.append(
-                    mpatches.Patch(facecolor=colour, edgecolor='grey',
-                                   label=label + ' regime', linewidth=0.5,
-                                   linestyle=regime_linestyle))
-        plt.xlim((seg.analogsignals[0].t_start, seg.analogsignals[0].t_stop))
+    num_sims = len(recordings)
+    for i, name in enumerate(names):
+        plt.sca(axes[i][0])
+        for j, (simulator, segments) in enumerate(recordings.items()):
+            seg = segments[i]
+            colour = 'C{}'.format(j)
+            for signal in seg.analogsignals:
+                plt.plot(signal.times, signal, color=colour, label=simulator,
+                         linestyle='-' if j == 0 else '--')
+            spike_times = []
+            ids = []
+            for k, spiketrain in enumerate(seg.spiketrains):
+                spike_times.extend(spiketrain)
+                # Offset the spikes of each simulator so they don't overlap
+                ids.extend([k + j / num_sims] * len(spiketrain))
+            if spike_times:
+                plt.scatter(spike_times, ids, color=colour, label=simulator,
+                            marker='|')
         plt.xlabel('Time (ms)')
-        un_str = (' ({})'.format(next(iter(units)))
-                  if len(units) == 1 else '')
-        plt.ylabel('Analog signals{}'.format(un_str))
-        plt.title("{}Analog Signals".format(plt_name), fontsize=12)
-        plt.legend(handles=legend)
+        plt.title(name, fontsize=12)
+        plt.legend()
     if save is not None:
         fig.savefig(save, dpi=resolution)
-        logger.info("Saved{} figure to '{}'".format(plt_name, save))
+        logger.info("Saved comparison figure to '{}'".format(save))
     if show:
         plt.show()
 
@@ -88,3 +289,226 @@ def sort_epochs_by_duration(epocharray):
                                epocharray.durations):
         total_durations[label] += duration
     return sorted(total_durations, key=lambda l: -total_durations[l])
+
+
+def regime_spans(epochs):
+    """
+    The start and end times (ms) of the epochs of each regime, apart from the
+    regime the cell spent the longest in, which is left unshaded
+
+    Returns
+    -------
+    mode : str
+        The label of the regime the cell spent the longest in
+    spans : OrderedDict(str, list(tuple(float, float)))
+        The start and end times of the epochs of the other regimes
+    """
+    labels = sort_epochs_by_duration(epochs)
+    spans = OrderedDict((label, []) for label in labels[1:])
+    for label, start, duration in zip(epochs.labels, epochs.times,
+                                      epochs.durations):
+        if label in spans:
+            start = float(start.rescale(pq.ms))
+            spans[label].append(
+                (start, start + float(duration.rescale(pq.ms))))
+    return labels[0], spans
+
+
+def _plot_raster(seg, plt_name, group_by):
+    data = raster_data(seg.spiketrains, group_by)
+    for name, spike_times, ids in data:
+        plt.scatter(spike_times, ids,
+                    label=(str(name) if name is not None else None))
+    plt.xlim((seg.spiketrains[0].t_start, seg.spiketrains[0].t_stop))
+    plt.ylim((-1, len(seg.spiketrains)))
+    plt.xlabel('Times (ms)')
+    plt.ylabel('Cell Indices')
+    plt.title("{}Spike Trains".format(plt_name), fontsize=12)
+    if len(data) > 1:
+        plt.legend()
+
+
+def _plot_rates(seg, plt_name, bin_width, group_by):
+    rates = firing_rates(seg.spiketrains, bin_width, group_by)
+    for name, centres, group_rates in rates:
+        plt.plot(centres, group_rates, drawstyle='steps-mid',
+                 label=(str(name) if name is not None else None))
+    plt.xlim((seg.spiketrains[0].t_start, seg.spiketrains[0].t_stop))
+    plt.xlabel('Time (ms)')
+    plt.ylabel('Firing rate (Hz)')
+    plt.title("{}Firing Rates ({} ms bins)".format(plt_name, bin_width),
+              fontsize=12)
+    if len(rates) > 1:
+        plt.legend()
+
+
+def _plot_analog(seg, plt_name, name, regime_alpha, regime_linestyle):
+    signals = analog_signals(seg, name)
+    legend = []
+    units = set(s.units.dimensionality.string for s in signals)
+    # Plot signals
+    for i, signal in enumerate(signals):
+        un_str = (signal.units.dimensionality.string
+                  if len(units) > 1 else '')
+        label = signal.name + un_str if signal.name else str(i)
+        line, = plt.plot(signal.times, signal, label=label)
+        legend.append(line)
+    # Plot regime epochs (if present)
+    for epochs in seg.epochs:
+        # Generate colours for each regime
+        labels = sort_epochs_by_duration(epochs)
+        # Make the 'mode' regime transparent
+        label_colours = OrderedDict([(labels[0], None)])
+        for label in labels[1:]:
+            label_colours[label] = plt.gca()._get_lines.get_next_color()
+        for label, start, duration in zip(epochs.labels,
+                                          epochs.times,
+                                          epochs.durations):
+            if label_colours[label] is not None:
+                end = start + duration
+                plt.axvspan(start, end, facecolor=label_colours[label],
+                            alpha=regime_alpha)
+                plt.axvline(start, linestyle=regime_linestyle,
+                            color='gray', linewidth=0.5)
+                plt.axvline(end, linestyle=regime_linestyle, color='gray',
+                            linewidth=0.5)
+        for label, colour in label_colours.items():
+            if colour is None:
+                colour = 'white'
+            legend.append(
+                mpatches.Patch(facecolor=colour, edgecolor='grey',
+                               label=label + ' regime', linewidth=0.5,
+                               linestyle=regime_linestyle))
+    plt.xlim((signals[0].t_start, signals[0].t_stop))
+    plt.xlabel('Time (ms)')
+    un_str = (' ({})'.format(next(iter(units)))
+              if len(units) == 1 else '')
+    if name is None:
+        plt.ylabel('Analog signals{}'.format(un_str))
+        plt.title("{}Analog Signals".format(plt_name), fontsize=12)
+    else:
+        plt.ylabel('{}{}'.format(name, un_str))
+        plt.title("{}{}".format(plt_name, name), fontsize=12)
+    plt.legend(handles=legend)
+
+
+def _panel_title(panel_type, name, bin_width):
+    if panel_type == 'raster':
+        return 'Spike Trains'
+    elif panel_type == 'rate':
+        return 'Firing Rates ({} ms bins)'.format(bin_width)
+    return name if name is not None else 'Analog Signals'
+
+
+def _signal_label(signal, index):
+    return '{} ({})'.format(signal.name if signal.name else index,
+                            signal.units.dimensionality.string)
+
+
+def _plot_plotly(seg, save, panels, bin_width, group_by, title, show,
+                 regime_alpha):
+    try:
+        import plotly.offline
+        import plotly.graph_objs as go
+        from plotly.subplots import make_subplots
+        from plotly.colors import DEFAULT_PLOTLY_COLORS as palette
+    except ImportError:
+        raise Pype9ImportError(
+            "The 'plotly' package needs to be installed to write interactive "
+            "plots with it")
+    fig = make_subplots(
+        rows=len(panels), cols=1, shared_xaxes=True,
+        subplot_titles=[_panel_title(t, n, bin_width) for t, n in panels])
+    for row, (panel_type, name) in enumerate(panels, start=1):
+        if panel_type == 'raster':
+            for group, spike_times, ids in raster_data(seg.spiketrains,
+                                                       group_by):
+                fig.add_trace(go.Scattergl(
+                    x=spike_times, y=ids, mode='markers', marker={'size': 3},
+                    name=str(group) if group is not None else 'spikes'),
+                    row=row, col=1)
+            fig.update_yaxes(title_text='Cell Indices', row=row, col=1)
+        elif panel_type == 'rate':
+            for group, centres, rates in firing_rates(
+                    seg.spiketrains, bin_width, group_by):
+                fig.add_trace(go.Scatter(
+                    x=centres, y=rates, line_shape='hvh',
+                    name=str(group) if group is not None else 'rate'),
+                    row=row, col=1)
+            fig.update_yaxes(title_text='Firing rate (Hz)', row=row, col=1)
+        else:
+            for i, signal in enumerate(analog_signals(seg, name)):
+                fig.add_trace(go.Scatter(
+                    x=signal.times.rescale(pq.ms).magnitude,
+                    y=numpy.ravel(signal.magnitude),
+                    name=_signal_label(signal, i)), row=row, col=1)
+            for epochs in seg.epochs:
+                _, spans = regime_spans(epochs)
+                for i, (label, label_spans) in enumerate(spans.items()):
+                    for start, end in label_spans:
+                        fig.add_vrect(
+                            x0=start, x1=end, opacity=regime_alpha,
+                            fillcolor=palette[(i + 1) % len(palette)],
+                            line_width=0, annotation_text=label,
+                            row=row, col=1)
+    fig.update_xaxes(title_text='Time (ms)', row=len(panels), col=1)
+    fig.update_layout(title_text=title)
+    plotly.offline.plot(fig, filename=save, auto_open=show)
+
+
+def _plot_bokeh(seg, save, panels, bin_width, group_by, title, show,
+                regime_alpha):
+    try:
+        from bokeh.plotting import figure
+        from bokeh.layouts import column
+        from bokeh.models import BoxAnnotation
+        from bokeh.palettes import Category10_10 as palette
+        import bokeh.io
+    except ImportError:
+        raise Pype9ImportError(
+            "The 'bokeh' package needs to be installed to write interactive "
+            "plots with it")
+    figs = []
+    for panel_type, name in panels:
+        kwargs = {'title': _panel_title(panel_type, name, bin_width),
+                  'x_axis_label': 'Time (ms)', 'sizing_mode': 'stretch_width'}
+        if figs:
+            kwargs['x_range'] = figs[0].x_range
+        p = figure(**kwargs)
+        if panel_type == 'raster':
+            p.yaxis.axis_label = 'Cell Indices'
+            for i, (group, spike_times, ids) in enumerate(
+                    raster_data(seg.spiketrains, group_by)):
+                p.scatter(spike_times, ids, size=3,
+                          color=palette[i % len(palette)],
+                          **_bokeh_legend(group))
+        elif panel_type == 'rate':
+            p.yaxis.axis_label = 'Firing rate (Hz)'
+            for i, (group, centres, rates) in enumerate(firing_rates(
+                    seg.spiketrains, bin_width, group_by)):
+                p.step(centres, rates, mode='center',
+                       color=palette[i % len(palette)],
+                       **_bokeh_legend(group))
+        else:
+            for i, signal in enumerate(analog_signals(seg, name)):
+                p.line(signal.times.rescale(pq.ms).magnitude,
+                       numpy.ravel(signal.magnitude),
+                       color=palette[i % len(palette)],
+                       legend_label=_signal_label(signal, i))
+            for epochs in seg.epochs:
+                _, spans = regime_spans(epochs)
+                for i, label_spans in enumerate(spans.values()):
+                    for start, end in label_spans:
+                        p.add_layout(BoxAnnotation(
+                            left=start, right=end, fill_alpha=regime_alpha,
+                            fill_color=palette[(i + 1) % len(palette)]))
+        figs.append(p)
+    layout = column(*figs, sizing_mode='stretch_width')
+    bokeh.io.output_file(save, title=title)
+    bokeh.io.save(layout)
+    if show:
+        bokeh.io.show(layout)
+
+
+def _bokeh_legend(group):
+    return {'legend_label': str(group)} if group is not None else {}
@@ -0,0 +1,588 @@
+"""
+  Structured experiment protocols, which describe the stimuli played into the
+  receive ports of a single cell over a sequence of epochs, repeated over a
+  number of trials, and which epochs are recorded. Protocols can describe
+  standard electrophysiology protocols (e.g. F-I curves, chirps and paired
+  pulses) without writing Python and are specified in YAML or JSON files of
+  the form::
+
+      repeats: 2  # the number of times the trials are repeated
+      inter_trial_interval: 200.0  # ms, unrecorded and unstimulated
+      seed: 12345  # seeds the noisy and Poisson stimuli
+      epochs:
+        - name: baseline
+          duration: 100.0  # ms
+          record: false
+        - name: step
+          duration: 500.0
+          stimuli:
+            i_ext:
+              type: step
+              amplitude: 0.5
+              units: nA
+        - name: paired_pulses
+          duration: 100.0
+          stimuli:
+            i_ext: {type: pulses, amplitude: 1.0, width: 2.0,
+                    onsets: [10.0, 60.0], units: nA}
+            spike_in: {type: poisson, rate: 20.0}  # Hz
+      trials:  # varies a stimulus parameter between trials
+        epoch: step
+        port: i_ext
+        parameter: amplitude
+        values: [0.1, 0.2, 0.3, 0.4]
+
+  All times are in ms and frequencies in Hz, and the times of 'pulses' and
+  'spikes' stimuli are relative to the start of the epoch. The supported
+  stimulus types are:
+
+    * step - constant 'amplitude'
+    * ramp - linear ramp from 'start' to 'stop'
+    * sine - 'amplitude' * sin(2 * pi * 'frequency' * t + 'phase') + 'offset'
+    * chirp - sinusoid of 'amplitude' (plus 'offset') with a frequency that
+      increases linearly from 'f_start' to 'f_stop'
+    * noise - Gaussian white noise with 'mean' and 'std', or
+      Ornstein-Uhlenbeck noise if a correlation time 'tau' is provided
+    * pulses - square pulses of 'amplitude' and 'width' at the given 'onsets'
+      or at regular 'interval's
+    * spikes - events at the given 'times' (event ports only)
+    * poisson - Poisson process of events with the given 'rate' (event ports
+      only)
+
+  The analog stimuli of each port are concatenated into a single signal that
+  spans the whole protocol (zero outside the epochs it is stimulated in).
+  Simulators record the whole protocol, and the recordings are split into the
+  recorded epochs of each trial afterwards.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+from builtins import object, range, next
+from collections import namedtuple, OrderedDict
+import json
+import yaml
+import numpy
+import quantities as pq
+import neo
+from pype9.exceptions import Pype9UsageError
+from pype9.utils.logging import logger
+
+
+ANALOG_STIMULI = ('step', 'ramp', 'sine', 'chirp', 'noise', 'pulses')
+EVENT_STIMULI = ('spikes', 'poisson')
+
+REQUIRED_PARAMETERS = {
+    'step': ('amplitude',),
+    'ramp': ('start', 'stop'),
+    'sine': ('amplitude', 'frequency'),
+    'chirp': ('amplitude', 'f_start', 'f_stop'),
+    'noise': ('mean', 'std'),
+    'pulses': ('amplitude', 'width'),
+    'spikes': ('times',),
+    'poisson': ('rate',)}
+
+# An epoch of a particular trial, starting at 't_start' (ms), with the
+# stimulus parameters overridden by the trial variation (if applicable)
+TrialEpoch = namedtuple('TrialEpoch', 'trial repeat epoch t_start stimuli')
+
+
+class Stimulus(object):
+    """
+    A stimulus played into a receive port of a cell during an epoch
+
+    Parameters
+    ----------
+    stim_type : str
+        The type of the stimulus (see module docstring)
+    parameters : dict(str, float | list(float))
+        The parameters of the stimulus
+    units : str | None
+        The units of the amplitudes of analog stimuli
+    """
+
+    def __init__(self, stim_type, parameters, units=None):
+        if stim_type not in REQUIRED_PARAMETERS:
+            raise Pype9UsageError(
+                "Unrecognised stimulus type '{}' (can be one of '{}')".format(
+                    stim_type, "', '".join(sorted(REQUIRED_PARAMETERS))))
+        missing = [p for p in REQUIRED_PARAMETERS[stim_type]
+                   if p not in parameters]
+        if missing:
+            raise Pype9UsageError(
+                "Parameters '{}' are required for '{}' stimuli".format(
+                    "', '".join(missing), stim_type))
+        if stim_type == 'pulses' and ('onsets' in parameters) == (
+                'interval' in parameters):
+            raise Pype9UsageError(
+                "Either 'onsets' or 'interval' (but not both) need to be "
+                "provided for 'pulses' stimuli")
+        if self.is_analog(stim_type):
+            if units is None:
+                raise Pype9UsageError(
+                    "Units need to be provided for '{}' stimulus"
+                    .format(stim_type))
+            try:
+                units = pq.Quantity(1.0, units).units
+            except (LookupError, ValueError):
+                raise Pype9UsageError(
+                    "Unrecognised units '{}' of '{}' stimulus".format(
+                        units, stim_type))
+        self.type = stim_type
+        self.parameters = parameters
+        self.units = units
+
+    @classmethod
+    def from_dict(cls, dct):
+        dct = dict(dct)
+        try:
+            stim_type = dct.pop('type')
+        except KeyError:
+            raise Pype9UsageError(
+                "Stimulus type not provided ({})".format(dct))
+        units = dct.pop('units', None)
+        return cls(stim_type, dct, units=units)
+
+    @property
+    def analog(self):
+        return self.is_analog(self.type)
+
+    @classmethod
+    def is_analog(cls, stim_type):
+        return stim_type in ANALOG_STIMULI
+
+    def override(self, parameter, value):
+        """
+        Returns a copy of the stimulus with the parameter set to a new value
+        """
+        parameters = dict(self.parameters)
+        parameters[parameter] = value
+        return Stimulus(self.type, parameters,
+                        units=(self.units.dimensionality.string
+                               if self.units is not None else None))
+
+    def values(self, num_samples, dt, rng):
+        """
+        The values of an analog stimulus at each time step of the epoch
+
+        Parameters
+        ----------
+        num_samples : int
+            The number of time steps in the epoch
+        dt : float
+            The time step (ms)
+        rng : numpy.random.RandomState
+            The random number generator used by noisy stimuli
+        """
+        p = self.parameters
+        times = numpy.arange(num_samples) * dt  # ms
+        if self.type == 'step':
+            values = numpy.ones(num_samples) * float(p['amplitude'])
+        elif self.type == 'ramp':
+            values = numpy.linspace(float(p['start']), float(p['stop']),
+                                    num_samples, endpoint=False)
+        elif self.type == 'sine':
+            values = float(p['amplitude']) * numpy.sin(
+                2.0 * numpy.pi * float(p['frequency']) * times / 1000.0 +
+                float(p.get('phase', 0.0))) + float(p.get('offset', 0.0))
+        elif self.type == 'chirp':
+            duration = num_samples * dt / 1000.0  # s
+            t = times / 1000.0
+            f_start = float(p['f_start'])
+            f_stop = float(p['f_stop'])
+            values = float(p['amplitude']) * numpy.sin(
+                2.0 * numpy.pi * (f_start * t + (f_stop - f_start) *
+                                  t ** 2 / (2.0 * duration))) + float(
+                p.get('offset', 0.0))
+        elif self.type == 'noise':
+            mean = float(p['mean'])
+            std = float(p['std'])
+            if 'tau' in p:
+                # Ornstein-Uhlenbeck process with correlation time 'tau'
+                tau = float(p['tau'])
+                values = numpy.empty(num_samples)
+                values[0] = mean
+                noise = rng.normal(size=num_samples)
+                for i in range(1, num_samples):
+                    values[i] = (values[i - 1] +
+                                 (mean - values[i - 1]) * dt / tau +
+                                 std * numpy.sqrt(2.0 * dt / tau) * noise[i])
+            else:
+                values = mean + std * rng.normal(size=num_samples)
+        elif self.type == 'pulses':
+            duration = num_samples * dt
+            if 'onsets' in p:
+                onsets = numpy.asarray(p['onsets'], dtype=float)
+            else:
+                onsets = numpy.arange(float(p.get('delay', 0.0)), duration,
+                                      float(p['interval']))
+                if 'number' in p:
+                    onsets = onsets[:int(p['number'])]
+            values = numpy.zeros(num_samples)
+            for onset in onsets:
+                values[numpy.logical_and(
+                    times >= onset, times < onset + float(p['width']))] = (
+                        float(p['amplitude']))
+        else:
+            raise Pype9UsageError(
+                "'{}' stimuli can only be played into event ports"
+                .format(self.type))
+        return values
+
+    def times(self, duration, rng):
+        """
+        The times of the events of an event stimulus within the epoch (ms)
+
+        Parameters
+        ----------
+        duration : float
+            The duration of the epoch (ms)
+        rng : numpy.random.RandomState
+            The random number generator used by Poisson stimuli
+        """
+        if self.type == 'spikes':
+            times = numpy.asarray(self.parameters['times'], dtype=float)
+        elif self.type == 'poisson':
+            rate = float(self.parameters['rate']) / 1000.0  # per ms
+            num = rng.poisson(rate * duration)
+            times = numpy.sort(rng.uniform(0.0, duration, size=num))
+        else:
+            raise Pype9UsageError(
+                "'{}' stimuli can only be played into analog ports"
+                .format(self.type))
+        return times[times < duration]
+
+
+class Epoch(object):
+    """
+    A period of the protocol with a fixed set of stimuli
+
+    Parameters
+    ----------
+    name : str
+        Name of the epoch
+    duration : float
+        The duration of the epoch (ms)
+    stimuli : dict(str, Stimulus)
+        The stimuli played into each receive port during the epoch
+    record : bool
+        Whether the recordings of the epoch are kept
+    """
+
+    def __init__(self, name, duration, stimuli=None, record=True):
+        if duration <= 0.0:
+            raise Pype9UsageError(
+                "Duration of '{}' epoch must be greater than zero ({})"
+                .format(name, duration))
+        self.name = name
+        self.duration = float(duration)
+        self.stimuli = stimuli if stimuli is not None else {}
+        self.record = record
+
+    @classmethod
+    def from_dict(cls, dct, index):
+        name = dct.get('name', 'epoch{}'.format(index))
+        try:
+            duration = float(dct['duration'])
+        except KeyError:
+            raise Pype9UsageError(
+                "Duration not provided for '{}' epoch".format(name))
+        stimuli = OrderedDict(
+            (port, Stimulus.from_dict(s))
+            for port, s in sorted(dct.get('stimuli', {}).items()))
+        return cls(name, duration, stimuli=stimuli,
+                   record=bool(dct.get('record', True)))
+
+
+class Protocol(object):
+    """
+    A sequence of epochs repeated over a number of trials (see module
+    docstring)
+
+    Parameters
+    ----------
+    epochs : list(Epoch)
+        The epochs of each trial
+    repeats : int
+        The number of times the trials are repeated
+    inter_trial_interval : float
+        The unrecorded and unstimulated time between trials (ms)
+    variation : dict | None
+        The stimulus parameter that is varied between trials, with keys
+        'epoch', 'port', 'parameter' and 'values'. If None there is a single
+        trial per repeat
+    seed : int | None
+        The seed of the random number generator for noisy and Poisson
+        stimuli
+    """
+
+    def __init__(self, epochs, repeats=1, inter_trial_interval=0.0,
+                 variation=None, seed=None):
+        if not epochs:
+            raise Pype9UsageError("No epochs provided to protocol")
+        if len(set(e.name for e in epochs)) != len(epochs):
+            raise Pype9UsageError(
+                "Duplicate epoch names in protocol ('{}')".format(
+                    "', '".join(e.name for e in epochs)))
+        if variation is not None:
+            missing = [k for k in ('epoch', 'port', 'parameter', 'values')
+                       if k not in variation]
+            if missing:
+                raise Pype9UsageError(
+                    "'{}' need to be provided for the trial variation"
+                    .format("', '".join(missing)))
+            try:
+                epoch = next(e for e in epochs
+                             if e.name == variation['epoch'])
+            except StopIteration:
+                raise Pype9UsageError(
+                    "Epoch '{}' of trial variation not found in protocol"
+                    .format(variation['epoch']))
+            if variation['port'] not in epoch.stimuli:
+                raise Pype9UsageError(
+                    "No stimulus played into '{}' during '{}' epoch to vary "
+                    "between trials".format(variation['port'], epoch.name))
+        self.epochs = epochs
+        self.repeats = int(repeats)
+        self.inter_trial_interval = float(inter_trial_interval)
+        self.variation = variation
+        self.seed = seed
+
+    @classmethod
+    def read(cls, path):
+        """
+        Reads a protocol from a YAML or JSON file (see module docstring for
+        the format)
+
+        Parameters
+        ----------
+        path : str
+            Path to the protocol file
+        """
+        with open(path) as f:
+            if path.endswith('.json'):
+                spec = json.load(f)
+            else:
+                spec = yaml.safe_load(f)
+        try:
+            epochs = spec['epochs']
+        except (KeyError, TypeError):
+            raise Pype9UsageError(
+                "No 'epochs' section found in protocol '{}'".format(path))
+        return cls([Epoch.from_dict(e, i) for i, e in enumerate(epochs)],
+                   repeats=spec.get('repeats', 1),
+                   inter_trial_interval=spec.get('inter_trial_interval', 0.0),
+                   variation=spec.get('trials', None),
+                   seed=spec.get('seed', None))
+
+    @property
+    def num_trials(self):
+        "The number of trials, including repeats"
+        num_values = (len(self.variation['values'])
+                      if self.variation is not None else 1)
+        return self.repeats * num_values
+
+    @property
+    def trial_duration(self):
+        "The duration of each trial (ms)"
+        return sum(e.duration for e in self.epochs)
+
+    @property
+    def duration(self):
+        "The total duration of the protocol (ms)"
+        return (self.num_trials * self.trial_duration +
+                (self.num_trials - 1) * self.inter_trial_interval)
+
+    @property
+    def port_names(self):
+        "The names of the ports stimuli are played into"
+        return sorted(set(p for e in self.epochs for p in e.stimuli))
+
+    @property
+    def analog_port_names(self):
+        "The names of the ports analog stimuli are played into"
+        return sorted(set(p for e in self.epochs
+                          for p, s in e.stimuli.items() if s.analog))
+
+    def timeline(self):
+        """
+        The epochs of every trial, in the order they are run
+
+        Returns
+        -------
+        timeline : list(TrialEpoch)
+            The epochs of every trial with their start times and stimuli
+        """
+        if self.variation is not None:
+            values = self.variation['values']
+        else:
+            values = [None]
+        timeline = []
+        t = 0.0
+        trial = 0
+        for repeat in range(self.repeats):
+            for value in values:
+                if trial:
+                    t += self.inter_trial_interval
+                for epoch in self.epochs:
+                    stimuli = dict(epoch.stimuli)
+                    if (value is not None and
+                            epoch.name == self.variation['epoch']):
+                        port = self.variation['port']
+                        stimuli[port] = stimuli[port].override(
+                            self.variation['parameter'], value)
+                    timeline.append(TrialEpoch(trial, repeat, epoch, t,
+                                               stimuli))
+                    t += epoch.duration
+                trial += 1
+        return timeline
+
+    def stimuli(self, dt):
+        """
+        Generates the signals played into each port over the whole protocol
+
+        Parameters
+        ----------
+        dt : float
+            The sampling period of the generated analog signals (ms)
+
+        Returns
+        -------
+        stimuli : dict(str, neo.AnalogSignal | neo.SpikeTrain)
+            The signals to play into each port
+        """
+        rng = numpy.random.RandomState(self.seed)
+        num_samples = int(round(self.duration / dt))
+        values = {}
+        units = {}
+        spikes = {}
+        for trial_epoch in self.timeline():
+            start = int(round(trial_epoch.t_start / dt))
+            epoch_samples = int(round(trial_epoch.epoch.duration / dt))
+            for port_name, stim in sorted(trial_epoch.stimuli.items()):
+                if stim.analog:
+                    if port_name not in values:
+                        values[port_name] = numpy.zeros(num_samples)
+                        units[port_name] = stim.units
+                    if port_name in spikes:
+                        raise Pype9UsageError(
+                            "Both analog and event stimuli played into '{}'"
+                            .format(port_name))
+                    # Convert the values into the units of the first stimulus
+                    # of the port
+                    scale = float(pq.Quantity(1.0, stim.units).rescale(
+                        units[port_name]))
+                    values[port_name][start:start + epoch_samples] = (
+                        stim.values(epoch_samples, dt, rng) * scale)
+                else:
+                    if port_name in values:
+                        raise Pype9UsageError(
+                            "Both analog and event stimuli played into '{}'"
+                            .format(port_name))
+                    spikes.setdefault(port_name, []).append(
+                        stim.times(trial_epoch.epoch.duration, rng) +
+                        trial_epoch.t_start)
+        signals = {}
+        for port_name, vals in values.items():
+            signals[port_name] = neo.AnalogSignal(
+                vals, units=units[port_name], sampling_period=dt * pq.ms,
+                t_start=0.0 * pq.ms, name=port_name)
+        for port_name, times in spikes.items():
+            times = numpy.concatenate(times)
+            signals[port_name] = neo.SpikeTrain(
+                times, units='ms',
+                t_start=(times.min() if len(times) else 0.0) * pq.ms,
+                t_stop=self.duration * pq.ms, name=port_name)
+        return signals
+
+    def play(self, cell, dt):
+        """
+        Plays the stimuli of the protocol into the ports of the cell
+
+        Parameters
+        ----------
+        cell : Cell
+            The cell to play the stimuli into
+        dt : float
+            The sampling period of the generated analog signals (ms)
+        """
+        for port_name, signal in sorted(self.stimuli(dt).items()):
+            if isinstance(signal, neo.SpikeTrain) and not len(signal):
+                logger.warning("No events generated for '{}' port"
+                               .format(port_name))
+                continue
+            cell.play(port_name, signal)
+
+    def split(self, segment):
+        """
+        Splits the recordings of the whole protocol into the recorded epochs
+        of each trial
+
+        Parameters
+        ----------
+        segment : neo.Segment
+            The recordings of the whole protocol
+
+        Returns
+        -------
+        block : neo.Block
+            A block containing a segment for each recorded epoch of each
+            trial, annotated with the trial, repeat, epoch name and the value
+            of the varied stimulus parameter (if applicable)
+        """
+        block = neo.Block(
+            name=segment.name,
+            description="Recordings of protocol split into trials and epochs")
+        for trial_epoch in self.timeline():
+            if not trial_epoch.epoch.record:
+                continue
+            t_start = trial_epoch.t_start * pq.ms
+            t_stop = (trial_epoch.t_start + trial_epoch.epoch.duration) * pq.ms
+            seg = neo.Segment(
+                name='trial{}_{}'.format(trial_epoch.trial,
+                                         trial_epoch.epoch.name),
+                description=segment.description)
+            seg.annotate(trial=trial_epoch.trial, repeat=trial_epoch.repeat,
+                         epoch=trial_epoch.epoch.name)
+            if self.variation is not None:
+                seg.annotate(**{self.variation['parameter']:
+                                self.variation['values'][
+                                    trial_epoch.trial % len(
+                                        self.variation['values'])]})
+            for signal in segment.analogsignals:
+                seg.analogsignals.append(_slice_signal(signal, t_start,
+                                                       t_stop))
+            for spiketrain in segment.spiketrains:
+                seg.spiketrains.append(spiketrain.time_slice(t_start, t_stop))
+            for epoch in segment.epochs:
+                seg.epochs.append(epoch.time_slice(t_start, t_stop))
+            block.segments.append(seg)
+        return block
+
+    def epochs_annotation(self):
+        """
+        The recorded epochs of each trial as a neo.Epoch, for formats that
+        store continuous recordings (e.g. NWB)
+        """
+        recorded = [te for te in self.timeline() if te.epoch.record]
+        return neo.Epoch(
+            times=numpy.array([te.t_start for te in recorded]) * pq.ms,
+            durations=numpy.array([te.epoch.duration
+                                   for te in recorded]) * pq.ms,
+            labels=numpy.array(['trial{}_{}'.format(te.trial, te.epoch.name)
+                                for te in recorded]),
+            name='protocol')
+
+
+def _slice_signal(signal, t_start, t_stop):
+    """
+    Slices the signal by sample index to avoid rounding errors in the times
+    """
+    start, end = (
+        int(round(float(((t - signal.t_start) /
+                         signal.sampling_period).simplified)))
+        for t in (t_start, t_stop))
+    return signal[max(start, 0):end]
@@ -0,0 +1,387 @@
+"""
+Reproducibility manifests, which record everything required to replay a
+simulation: the hash of the model, its parameter values, all the RNG seeds
+used by each process/thread, the versions of the simulator and supporting
+packages, the hash of the code-generation templates, the time step and the
+ODE solver. They are saved in JSON format, e.g.::
+
+    {"model": {"url": "...", "name": "Izhikevich", "hash": "3f2a..."},
+     "simulation": {"simulator": "neuron", "dt_ms": 0.01, ...},
+     "seeds": {"seed": 1497413487, "dynamics_seeds": [...], ...},
+     "versions": {"pype9": "0.2", "nineml": "1.0", ...},
+     "command": {"argv": [...], "cwd": "..."}, ...}
+
+Manifests are written by 'pype9 simulate' along with the recordings, and can
+be replayed with 'pype9 simulate --reproduce'. Replays are bit-for-bit
+identical where the backend allows, which requires the same number of MPI
+processes and threads, as well as the same simulator version.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from builtins import object
+import os.path
+import json
+import hashlib
+import platform
+from datetime import datetime
+from importlib import import_module
+import nineml
+from nineml import units as un
+from pype9 import __version__
+from pype9.simulate.common.code_gen.cache import update_with_paths
+from pype9.exceptions import Pype9UsageError
+from pype9.utils.logging import logger
+
+MANIFEST_VERSION = 1
+
+MANIFEST_EXTENSION = '.manifest.json'
+
+# Packages the versions of which are recorded in manifests (in addition
+# to Python, Pype9 and the simulator)
+PACKAGES = ('nineml', 'numpy', 'neo', 'quantities', 'pyNN')
+
+# Options of 'pype9 simulate' that are set by the manifest when it is
+# replayed and the options which write to output files
+SEED_OPTIONS = ('--seed', '--properties_seed')
+OUTPUT_OPTIONS = ('--record', '--save_state', '--manifest')
+
+
+def model_hash(model):
+    "The SHA1 hash of the serialized model"
+    return hashlib.sha1(model.serialize(
+        format='xml', version=2, to_str=True).encode('utf-8')).hexdigest()
+
+
+def code_generator_hash(code_generator):
+    """
+    The SHA1 hash of the code generation templates/modules and compiler flags
+    of a code generator
+    """
+    sha = hashlib.sha1()
+    update_with_paths(sha, code_generator.cache_dependencies())
+    for flag in code_generator.cache_flags():
+        sha.update(str(flag).encode('utf-8'))
+    return sha.hexdigest()
+
+
+def software_versions():
+    """
+    The versions of Python, Pype9 and the packages that can affect the result
+    of a simulation (None for packages that aren't installed)
+    """
+    versions = {'python': platform.python_version(),
+                'pype9': __version__}
+    for package in PACKAGES:
+        try:
+            versions[package] = str(
+                getattr(import_module(package), '__version__', None))
+        except ImportError:
+            versions[package] = None
+    return versions
+
+
+class Manifest(object):
+    """
+    A record of a simulation that is sufficient to replay it
+
+    Parameters
+    ----------
+    model : dict(str, str)
+        The URL, name and hash of the simulated model
+    simulation : dict(str, object)
+        The simulator, its version, the time step and stop time (ms), the
+        ODE solver, the hash of the code-generation templates and the number
+        of processes and threads
+    seeds : dict(str, object)
+        The base seed (including generated ones), the base properties seed
+        and the seeds of each process/thread
+    versions : dict(str, str)
+        The versions of Python, Pype9 and supporting packages
+    properties : dict(str, object) | None
+        The properties of the model (single cells only) as (value, units)
+        pairs
+    initial_values : dict(str, object) | None
+        The initial values of the model (single cells only) as (value, units)
+        pairs
+    initial_regime : str | None
+        The initial regime of the model (single cells only)
+    command : dict(str, object) | None
+        The arguments passed to 'pype9 simulate' and the directory it was run
+        from
+    created : str | None
+        The time the manifest was created (ISO format)
+    """
+
+    def __init__(self, model, simulation, seeds, versions, properties=None,
+                 initial_values=None, initial_regime=None, command=None,
+                 created=None):
+        self.model = model
+        self.simulation = simulation
+        self.seeds = seeds
+        self.versions = versions
+        self.properties = properties
+        self.initial_values = initial_values
+        self.initial_regime = initial_regime
+        self.command = command
+        if created is None:
+            created = datetime.now().isoformat()
+        self.created = created
+
+    def __repr__(self):
+        return "Manifest(model='{}', simulator='{}', seed={})".format(
+            self.model['name'], self.simulation['simulator'],
+            self.seeds['seed'])
+
+    @classmethod
+    def create(cls, sim, model, properties=None, initial_values=None,
+               initial_regime=None, argv=None):
+        """
+        Creates a manifest for a simulation. Should be called after the
+        simulation has been run (but can be outside its context).
+
+        Parameters
+        ----------
+        sim : Simulation
+            The simulation to create the manifest for
+        model : nineml.DynamicsProperties | nineml.Dynamics | nineml.Network
+            The simulated model
+        properties : nineml.DynamicsProperties | None
+            The properties of the simulated cell (if they differ from the
+            model)
+        initial_values : dict(str, nineml.Quantity) | None
+            The initial values of the simulated cell
+        initial_regime : str | None
+            The initial regime of the simulated cell
+        argv : list(str) | None
+            The arguments passed to 'pype9 simulate'
+        """
+        code_generator = sim.code_generator
+        if properties is None and isinstance(model,
+                                             nineml.DynamicsProperties):
+            properties = model
+        if properties is not None:
+            props_dict = dict((p.name, cls._to_json(p.quantity))
+                              for p in properties.properties)
+            if initial_values is None:
+                initial_values = dict((iv.name, iv.quantity)
+                                      for iv in properties.initial_values)
+        else:
+            props_dict = None
+        if initial_values is not None:
+            initial_values = dict((n, cls._to_json(q))
+                                  for n, q in initial_values.items())
+        return cls(
+            model={'url': model.url, 'name': model.name,
+                   'hash': model_hash(model)},
+            simulation={
+                'simulator': sim.name,
+                'simulator_version': code_generator.SIMULATOR_VERSION,
+                'dt_ms': float(sim.dt.in_units(un.ms)),
+                't_stop_ms': float(sim.t.in_units(un.ms)),
+                'solver': getattr(code_generator, 'ODE_SOLVER_DEFAULT', None),
+                'code_generator_hash': code_generator_hash(code_generator),
+                'num_processes': int(sim.num_processes()),
+                'num_threads': int(sim.num_threads())},
+            seeds={
+                'seed': int(sim.seed),
+                'properties_seed': sim.base_properties_seed,
+                'dynamics_seeds': [int(s) for s in sim.all_dynamics_seeds],
+                'properties_seeds': [int(s)
+                                     for s in sim.all_properties_seeds],
+                'global_seed': int(sim.global_seed)},
+            versions=software_versions(),
+            properties=props_dict,
+            initial_values=initial_values,
+            initial_regime=initial_regime,
+            command=({'argv': list(argv), 'cwd': os.getcwd()}
+                     if argv is not None else None))
+
+    @classmethod
+    def read(cls, path):
+        """
+        Reads a manifest from a JSON file
+
+        Parameters
+        ----------
+        path : str
+            Path to the manifest file
+        """
+        with open(path) as f:
+            try:
+                dct = json.load(f)
+            except ValueError as e:
+                raise Pype9UsageError(
+                    "Could not read manifest file '{}': {}".format(path, e))
+        return cls.from_dict(dct, path=path)
+
+    @classmethod
+    def from_dict(cls, dct, path=None):
+        dct = dict(dct)
+        version = dct.pop('pype9_manifest', None)
+        if version is None:
+            raise Pype9UsageError(
+                "'{}' is not a Pype9 manifest".format(path))
+        elif version > MANIFEST_VERSION:
+            raise Pype9UsageError(
+                "Manifest '{}' was written by a newer version of Pype9 "
+                "(manifest version {} > {})".format(path, version,
+                                                    MANIFEST_VERSION))
+        try:
+            return cls(**dct)
+        except TypeError as e:
+            raise Pype9UsageError(
+                "Invalid manifest '{}': {}".format(path, e))
+
+    def to_dict(self):
+        return {'pype9_manifest': MANIFEST_VERSION,
+                'created': self.created,
+                'model': self.model,
+                'simulation': self.simulation,
+                'seeds': self.seeds,
+                'versions': self.versions,
+                'properties': self.properties,
+                'initial_values': self.initial_values,
+                'initial_regime': self.initial_regime,
+                'command': self.command}
+
+    def write(self, path):
+        """
+        Writes the manifest to file in JSON format
+
+        Parameters
+        ----------
+        path : str
+            Path of the file to write the manifest to
+        """
+        with open(path, 'w') as f:
+            json.dump(self.to_dict(), f, indent=2, sort_keys=True)
+        logger.info("Wrote reproducibility manifest to '{}'".format(path))
+
+    def differences(self, other):
+        """
+        Lists the differences between the manifests that would prevent the
+        simulations being identical
+
+        Parameters
+        ----------
+        other : Manifest
+            The manifest to compare with
+        """
+        diffs = []
+        for section in ('model', 'simulation', 'seeds', 'versions'):
+            this_dct = getattr(self, section)
+            other_dct = getattr(other, section)
+            for key in sorted(set(this_dct) | set(other_dct)):
+                if key in ('url', 't_stop_ms'):
+                    continue
+                if this_dct.get(key) != other_dct.get(key):
+                    diffs.append("{}.{}: {} != {}".format(
+                        section, key, this_dct.get(key), other_dct.get(key)))
+        for section in ('properties', 'initial_values', 'initial_regime'):
+            if getattr(self, section) != getattr(other, section):
+                diffs.append("{}: {} != {}".format(
+                    section, getattr(self, section), getattr(other, section)))
+        return diffs
+
+    def environment_differences(self, num_processes=None, model=None):
+        """
+        Lists the differences between the environment the manifest was
+        created in and the current environment
+
+        Parameters
+        ----------
+        num_processes : int | None
+            The number of MPI processes the replay will be run on
+        model : nineml.DocumentLevelObject | None
+            The model that will be simulated in the replay
+        """
+        diffs = []
+        versions = software_versions()
+        for package in sorted(set(self.versions) | set(versions)):
+            if self.versions.get(package) != versions.get(package):
+                diffs.append("{} version: {} != {}".format(
+                    package, self.versions.get(package),
+                    versions.get(package)))
+        if (num_processes is not None and
+                num_processes != self.simulation['num_processes']):
+            diffs.append("number of processes: {} != {}".format(
+                self.simulation['num_processes'], num_processes))
+        if model is not None and model_hash(model) != self.model['hash']:
+            diffs.append("model '{}' has changed since the manifest was "
+                         "created".format(self.model['name']))
+        return diffs
+
+    def reproduce_argv(self, output_dir):
+        """
+        The arguments to pass to 'pype9 simulate' to replay the simulation,
+        with the seeds set to the ones recorded in the manifest and the
+        output files redirected into the output directory
+
+        Parameters
+        ----------
+        output_dir : str
+            The directory to write the recordings, saved state and manifest
+            of the replay to
+        """
+        if self.command is None:
+            raise Pype9UsageError(
+                "Cannot reproduce {} as it doesn't record the command it was "
+                "created by".format(self))
+        orig_argv = self.command['argv']
+        cwd = self.command['cwd']
+        argv = []
+        i = 0
+        while i < len(orig_argv):
+            arg = orig_argv[i]
+            option = arg.split('=')[0]
+            if option in SEED_OPTIONS:
+                # Skip the option and its value (if not joined with '=')
+                i += 1 if '=' in arg else 2
+                continue
+            argv.append(arg)
+            i += 1
+            if option in OUTPUT_OPTIONS and '=' not in arg:
+                # The filename is the second argument of --record
+                fname_index = i + 1 if option == '--record' else i
+                argv.extend(orig_argv[i:fname_index])
+                if fname_index < len(orig_argv):
+                    argv.append(os.path.join(
+                        output_dir,
+                        os.path.basename(orig_argv[fname_index])))
+                i = fname_index + 1
+            elif not arg.startswith('-'):
+                argv[-1] = self._absolute_path(arg, cwd)
+        argv.extend(('--seed', str(self.seeds['seed'])))
+        if self.seeds['properties_seed'] is not None:
+            argv.extend(('--properties_seed',
+                         str(self.seeds['properties_seed'])))
+        return argv
+
+    @classmethod
+    def _absolute_path(cls, arg, cwd):
+        """
+        Converts arguments that are paths relative to the original working
+        directory (optionally with a '#' component name) to absolute paths
+        """
+        path = arg.split('#')[0]
+        if (path and not os.path.isabs(path) and
+                os.path.isfile(os.path.join(cwd, path))):
+            arg = os.path.join(cwd, arg)
+        return arg
+
+    @classmethod
+    def _to_json(cls, quantity):
+        try:
+            return [float(quantity.value), quantity.units.name]
+        except TypeError:
+            # Array or random distribution values
+            return str(quantity.value)
+
+
+def default_manifest_path(record_path):
+    "The default path of the manifest written along with a recording"
+    return os.path.splitext(record_path)[0] + MANIFEST_EXTENSION
@@ -0,0 +1,48 @@
+"""
+  The simulator backends of Pype9, each of which is a sub-package that
+  provides the CellMetaClass, Network, Simulation and CodeGenerator classes of
+  the simulator.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from importlib import import_module
+from pype9.exceptions import Pype9UsageError
+
+# The names of the simulator backends (i.e. the sub-packages they are
+# implemented in), new backends only need to be added here to be available
+# from the command line and batch interfaces
+SIMULATORS = ('neuron', 'nest', 'arbor', 'genn')
+
+
+def load_backend(simulator, module=None):
+    """
+    Imports the package of a simulator backend (or one of its modules)
+
+    Parameters
+    ----------
+    simulator : str
+        The name of the simulator, one of SIMULATORS (case-insensitive)
+    module : str | None
+        The name of the module of the backend to import, e.g. 'code_gen' to
+        import the code generator without importing the simulator itself. If
+        None the backend package is imported
+
+    Returns
+    -------
+    backend : module
+        The imported package (or module) of the backend, e.g. with
+        CellMetaClass and Simulation attributes
+    """
+    name = simulator.lower()
+    if name not in SIMULATORS:
+        raise Pype9UsageError(
+            "Unrecognised simulator '{}' (can be '{}')"
+            .format(simulator, "', '".join(SIMULATORS)))
+    path = 'pype9.simulate.' + name
+    if module is not None:
+        path += '.' + module
+    return import_module(path)
@@ -0,0 +1,413 @@
+"""
+
+  This package combines the common.ncml with the Arbor Python interface
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2014 Thomas G. Close.
+  License: This file is part of the "NineLine" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+from builtins import next, zip
+from math import pi
+import numpy
+import quantities as pq
+import neo
+import arbor
+from nineml import units as un
+from nineml.abstraction import EventPort
+from nineml.exceptions import NineMLNameError
+from pype9.simulate.common.cells import base
+from pype9.simulate.arbor.code_gen import CodeGenerator
+from pype9.simulate.arbor.simulation import Simulation
+from pype9.annotations import (
+    PYPE9_NS, BUILD_TRANS, MEMBRANE_CAPACITANCE, EXTERNAL_CURRENTS,
+    MEMBRANE_VOLTAGE)
+from pype9.exceptions import (
+    Pype9UsageError, Pype9Unsupported9MLException)
+
+
+class Cell(base.Cell):
+    """
+    Base class for Arbor cell objects. Each cell is a single cylindrical
+    cable cell with the generated point mechanism placed at its midpoint.
+    As Arbor cells are only constructed when the simulation is initialised,
+    all parameters, inputs and recordings need to be specified before the
+    simulation is run.
+
+    Parameters
+    ----------
+    properties : list(nineml.Property)
+        Can accept a single property, which is a dictionary of properties
+        or a list of nineml.Property objects
+    kwargs : dict(str, nineml.Property)
+        A dictionary of properties
+    """
+
+    DEFAULT_CM = 1.0 * un.nF  # Chosen to match point processes
+    # The dimensions of the cylinder are chosen so that the surface area is
+    # 100um^2, which is required to scale distributed currents to the point
+    # process currents (see NEURON implementation)
+    LENGTH = 10.0 * un.um
+    RADIUS = (5.0 / pi) * un.um
+    MECH_LABEL = 'dynamics'
+    DETECTOR_LABEL = 'detector'
+    LOCATION = '"midpoint"'
+
+    def __init__(self, *args, **kwargs):
+        self._flag_created(False)
+        self._values = {}
+        self._gid = None
+        self._connections = []
+        self._event_inputs = []
+        self._current_inputs = []
+        self._probe_tags = []
+        self._cache = None
+        self.cm_param_name = self.build_component_class.annotations.get(
+            (BUILD_TRANS, PYPE9_NS), MEMBRANE_CAPACITANCE)
+        self._values[self.cm_param_name] = float(
+            self.DEFAULT_CM.in_units(un.nF))
+        # Call base init (needs to be after 9ML init)
+        super(Cell, self).__init__(*args, **kwargs)
+        self._flag_created(True)
+
+    @property
+    def surface_area(self):
+        return 2 * pi * self.RADIUS * self.LENGTH
+
+    @property
+    def gid(self):
+        "The global index of the cell in the Arbor recipe"
+        return self._gid
+
+    def _get(self, varname):
+        varname = self._escaped_name(varname)
+        try:
+            return self._values[varname]
+        except KeyError:
+            raise Pype9UsageError(
+                "'{}' doesn't have an attribute '{}'"
+                .format(self.name, varname))
+
+    def _set(self, varname, val):
+        if self._gid is not None:
+            raise Pype9UsageError(
+                "Cannot set '{}' of '{}' cell after the Arbor simulation has "
+                "been initialised".format(varname, self.name))
+        self._values[self._escaped_name(varname)] = val
+
+    def _set_regime(self):
+        self._values[self.code_generator.REGIME_VARNAME + 'init_'] = (
+            self._regime_index)
+
+    def _escaped_name(self, name):
+        if name == self.component_class.annotations.get(
+                (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE):
+            name = self.build_component_class.annotations.get(
+                (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE)
+        elif name in self.build_component_class.state_variable_names:
+            # Initial states are passed to the mechanism as parameters
+            name += '_init_'
+        return name
+
+    def _cable_cell(self, gid):
+        """
+        Constructs the Arbor cable cell from the parameters, inputs and
+        recordings of the cell. Called by the simulation when constructing
+        the Arbor recipe
+        """
+        super(base.Cell, self).__setattr__('_gid', gid)
+        length = float(self.LENGTH.in_units(un.um))
+        radius = float(self.RADIUS.in_units(un.um))
+        tree = arbor.segment_tree()
+        tree.append(arbor.mnpos, arbor.mpoint(0, 0, 0, radius),
+                    arbor.mpoint(length, 0, 0, radius), tag=1)
+        labels = arbor.label_dict({'soma': '(tag 1)',
+                                   'midpoint': '(location 0 0.5)'})
+        decor = arbor.decor()
+        v_name = self.build_component_class.annotations.get(
+            (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE)
+        params = dict((n, v) for n, v in self._values.items() if n != v_name)
+        # Set the specific capacitance of the membrane from the
+        # capacitance of the point process (uF/cm^2 -> F/m^2)
+        specific_cm = (params[self.cm_param_name] * un.nF /
+                       self.surface_area).in_units(un.uF / un.cm ** 2) * 0.01
+        if v_name in self._values:
+            decor.set_property(Vm=self._values[v_name], cm=specific_cm)
+        else:
+            decor.set_property(cm=specific_cm)
+        decor.place(self.LOCATION,
+                    arbor.synapse(arbor.mechanism(self.name, params)),
+                    self.MECH_LABEL)
+        if self.component_class.num_event_send_ports:
+            port_name = next(self.component_class.event_send_port_names)
+            decor.place(self.LOCATION, arbor.threshold_detector(
+                self.get_v_threshold(self._nineml, port_name)),
+                self.DETECTOR_LABEL)
+        for i, (times, amps) in enumerate(self._current_inputs):
+            decor.place(self.LOCATION,
+                        arbor.iclamp(list(zip(times, amps))),
+                        'iclamp{}'.format(i))
+        return arbor.cable_cell(tree, decor, labels)
+
+    def _event_generators(self):
+        return [arbor.event_generator(self.MECH_LABEL, weight,
+                                      arbor.explicit_schedule(times))
+                for times, weight in self._event_inputs]
+
+    def _arbor_connections(self):
+        return [arbor.connection((sender.gid, self.DETECTOR_LABEL),
+                                 self.MECH_LABEL, weight, delay)
+                for sender, weight, delay in self._connections]
+
+    def _probes(self):
+        probes = []
+        v_name = self.component_class.annotations.get(
+            (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE)
+        for tag in self._probe_tags:
+            if tag == v_name:
+                probes.append(arbor.cable_probe_membrane_voltage(
+                    self.LOCATION, tag=tag))
+            else:
+                probes.append(arbor.cable_probe_point_state(
+                    0, self.name, tag, tag=tag))
+        return probes
+
+    def record(self, port_name, callback=None, callback_interval=None,
+               **kwargs):  # @UnusedVariable
+        """
+        Parameters
+        ----------
+        port_name : str
+            Name of the port to record from
+        callback : function | None
+            A function that is passed the recording (neo.AnalogSignal or
+            neo.SpikeTrain) in chunks while the simulation is running
+        callback_interval : Quantity (time) | None
+            The interval between calls to the callback. If None, it is only
+            called at the end of each call to ``Simulation.run``
+        """
+        self._initialize_local_recording()
+        try:
+            port = self.component_class.send_port(port_name)
+        except NineMLNameError:
+            port = self.component_class.state_variable(port_name)
+        if isinstance(port, EventPort):
+            # All cells with event send ports have a threshold detector and
+            # Arbor records the spikes from all sources
+            self._recorders[port_name] = None
+        elif (port_name in self.build_component_class.state_variable_names or
+                port_name == self.component_class.annotations.get(
+                    (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE)):
+            if self._gid is not None:
+                raise Pype9UsageError(
+                    "Cannot record '{}' of '{}' cell after the Arbor "
+                    "simulation has been initialised".format(port_name,
+                                                             self.name))
+            self._recorders[port_name] = port_name
+            self._probe_tags.append(port_name)
+        else:
+            raise Pype9Unsupported9MLException(
+                "Can only record state variables and event send ports from "
+                "Arbor cells, not '{}'".format(port_name))
+        self._register_stream(port_name, callback, callback_interval)
+
+    def record_regime(self):
+        self._initialize_local_recording()
+        regime_varname = self.code_generator.REGIME_VARNAME
+        self._recorders[regime_varname] = regime_varname
+        self._probe_tags.append(regime_varname)
+
+    def recording(self, port_name, t_start=None):
+        """
+        Return recorded data as a dictionary containing one numpy array for
+        each neuron, ids as keys.
+        """
+        if self.is_dead():
+            t_stop = self._t_stop
+        else:
+            t_stop = self.Simulation.active().t
+        if t_start is None:
+            t_start = self.unit_handler.to_pq_quantity(self._t_start)
+        t_start = pq.Quantity(t_start, 'ms')
+        t_stop = self.unit_handler.to_pq_quantity(t_stop)
+        try:
+            port = self.component_class.port(port_name)
+        except NineMLNameError:
+            port = self.component_class.state_variable(port_name)
+        if isinstance(port, EventPort):
+            recording = neo.SpikeTrain(
+                self._trim_spike_train(self._spikes(), t_start),
+                t_start=t_start, t_stop=t_stop, units='ms')
+        else:
+            units_str = self.unit_handler.dimension_to_unit_str(
+                port.dimension, one_as_dimensionless=True)
+            interval = self._sampling_period()
+            recording = neo.AnalogSignal(
+                self._trim_analog_signal(self._samples(port_name), t_start,
+                                         interval),
+                sampling_period=interval, t_start=t_start, units=units_str,
+                name=port_name)
+        return recording
+
+    def _regime_recording(self):
+        regime_varname = self.code_generator.REGIME_VARNAME
+        return neo.AnalogSignal(
+            self._samples(regime_varname),
+            sampling_period=self._sampling_period(),
+            t_start=self.unit_handler.to_pq_quantity(self._t_start),
+            units='dimensionless', name=regime_varname)
+
+    def _spikes(self):
+        if self._cache is not None:
+            return self._cache['spikes']
+        return self.Simulation.active().spikes(self._gid)
+
+    def _samples(self, tag):
+        if self._cache is not None:
+            return self._cache[tag]
+        return self.Simulation.active().samples(self._gid, tag)
+
+    def _sampling_period(self):
+        if self._cache is not None:
+            return self._cache['dt']
+        return float(self.Simulation.active().dt.in_units(un.ms)) * pq.ms
+
+    def reset_recordings(self):
+        raise Pype9UsageError(
+            "Recordings cannot be reset in Arbor simulations")
+
+    def play(self, port_name, signal, properties=[], interpolation='step'):
+        """
+        Injects current into the segment
+
+        Parameters
+        ----------
+        port_name : str
+            The name of the receive port to play the signal into
+        signal : neo.AnalogSignal (current) | neo.SpikeTrain
+            Signal to play into the port
+        properties : list(nineml.Property)
+            The connection properties of the event port
+        interpolation : str
+            How analog signals are interpolated between their sample points,
+            'step' or 'linear'
+        """
+        if self._gid is not None:
+            raise Pype9UsageError(
+                "Cannot play signals into '{}' cell after the Arbor "
+                "simulation has been initialised".format(self.name))
+        ext_is = self.build_component_class.annotations.get(
+            (BUILD_TRANS, PYPE9_NS), EXTERNAL_CURRENTS).split(',')
+        port = self.component_class.port(port_name)
+        if isinstance(port, EventPort):
+            self._check_connection_properties(port_name, properties)
+            if len(properties) > 1:
+                raise NotImplementedError(
+                    "Cannot handle more than one connection property per port")
+            elif properties:
+                weight = self.unit_handler.scale_value(properties[0].quantity)
+            else:
+                weight = 1.0  # The weight var is not used
+            times = numpy.asarray(signal.times.rescale(pq.ms))
+            self._event_inputs.append((times, weight))
+        else:
+            if port_name not in ext_is:
+                raise Pype9Unsupported9MLException(
+                    "Can only play into external current ports ('{}'), not "
+                    "'{}' port.".format("', '".join(ext_is), port_name))
+            self._check_interpolation(interpolation)
+            times = numpy.asarray(signal.times.rescale(pq.ms))
+            amps = numpy.ravel(pq.Quantity(signal, 'nA'))
+            if interpolation == 'step':
+                # Arbor interpolates the envelopes of current clamps linearly
+                # so each amplitude is repeated at the following sample time
+                times = numpy.repeat(times, 2)[1:]
+                amps = numpy.repeat(amps, 2)[:-1]
+            self._current_inputs.append((times, amps))
+
+    def connect(self, sender, send_port_name, receive_port_name,
+                delay=0.0 * un.ms, properties=None):
+        """
+        Connects a port of the cell to a matching port on the 'other' cell
+
+        Parameters
+        ----------
+        sender : pype9.simulator.arbor.cells.Cell
+            The sending cell to connect the from
+        send_port_name : str
+            Name of the port in the sending cell to connect to
+        receive_port_name : str
+            Name of the receive port in the current cell to connect from
+        delay : nineml.Quantity (time)
+            The delay of the connection
+        properties : list(nineml.Property)
+            The connection properties of the event port
+        """
+        send_port = sender.component_class.send_port(send_port_name)
+        receive_port = self.component_class.receive_port(receive_port_name)
+        if properties is None:
+            properties = []
+        if send_port.communicates != receive_port.communicates:
+            raise Pype9UsageError(
+                "Cannot connect {} send port, '{}', to {} receive port, '{}'"
+                .format(send_port.communicates, send_port_name,
+                        receive_port.communicates, receive_port_name))
+        if receive_port.communicates == 'event':
+            self._check_connection_properties(receive_port_name, properties)
+            if len(properties) > 1:
+                raise Pype9Unsupported9MLException(
+                    "Cannot handle more than one connection property per port")
+            elif properties:
+                weight = self.unit_handler.scale_value(properties[0].quantity)
+            else:
+                weight = 1.0  # The weight var is not used
+            self._add_connection(sender, weight,
+                                 float(delay.in_units(un.ms)))
+        elif receive_port.communicates == 'analog':
+            raise Pype9UsageError(
+                "Cannot individually 'connect' analog ports. Simulate the "
+                "sending cell in a separate simulation then play the analog "
+                "signal in the port")
+        else:
+            raise Pype9UsageError(
+                "Unrecognised port communication '{}'".format(
+                    receive_port.communicates))
+
+    def _add_connection(self, sender, weight, delay):
+        """
+        Adds an incoming connection from the sender, with the weight and delay
+        already scaled to Arbor units
+        """
+        if self._gid is not None:
+            raise Pype9UsageError(
+                "Cannot connect to '{}' cell after the Arbor simulation has "
+                "been initialised".format(self.name))
+        # Arbor requires the delay to be strictly positive
+        delay = max(delay, float(self.Simulation.active().dt.in_units(un.ms)))
+        self._connections.append((sender, weight, delay))
+
+    def _kill(self, t_stop):
+        if self._gid is not None and hasattr(self, '_recorders'):
+            cache = {'dt': self._sampling_period()}
+            for port_name, tag in self._recorders.items():
+                if tag is None:
+                    cache['spikes'] = self._spikes()
+                else:
+                    cache[tag] = self._samples(tag)
+            super(base.Cell, self).__setattr__('_cache', cache)
+        super(Cell, self)._kill(t_stop)
+
+
+class CellMetaClass(base.CellMetaClass):
+
+    """
+    Metaclass for building NineMLCellType subclasses Called by
+    nineml_celltype_from_model
+    """
+
+    _built_types = {}  # Stores previously created types for reuse
+    CodeGenerator = CodeGenerator
+    BaseCellClass = Cell
+    Simulation = Simulation
@@ -0,0 +1,169 @@
+"""
+
+  This module contains functions for building and loading Arbor mechanism
+  catalogues
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2014 Thomas G. Close.
+  License: This file is part of the "NineLine" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+import os
+import shutil
+from datetime import datetime
+import arbor
+import nineml.units as un
+from nineml.abstraction import StateVariable, TimeDerivative
+from pype9.simulate.common.code_gen.nmodl import BaseNMODLCodeGenerator
+from pype9.simulate.arbor.units import UnitHandler
+from pype9.exceptions import Pype9BuildError, Pype9Unsupported9MLException
+from pype9.annotations import (
+    PYPE9_NS, BUILD_TRANS, MECH_TYPE, ARTIFICIAL_CELL_MECH, FULL_CELL_MECH)
+import pype9
+from pype9.utils.logging import logger
+
+
+class CodeGenerator(BaseNMODLCodeGenerator):
+    """
+    Generates NMODL mechanisms compatible with Arbor's 'modcc' compiler and
+    compiles them into a mechanism catalogue that can be loaded into the
+    global properties of Arbor cable cells.
+
+    Parameters
+    ----------
+    base_dir : str | None
+        The base directory for the generated code. If None a directory
+        will be created in user's home directory.
+    gpu : bool
+        Whether to compile the catalogue with GPU (CUDA) support
+    """
+
+    SIMULATOR_NAME = 'arbor'
+    SIMULATOR_VERSION = arbor.__version__
+    ODE_SOLVER_DEFAULT = 'sparse'
+    REGIME_VARNAME = 'regime_'
+    # Arbor mechanisms don't have access to the simulation time so it is
+    # integrated as a state variable of the mechanism instead
+    TIME_VARNAME = 't___pype9'
+    BASE_TMPL_PATH = os.path.abspath(os.path.join(os.path.dirname(__file__),
+                                                  'templates'))
+    UnitHandler = UnitHandler
+
+    def __init__(self, gpu=False, **kwargs):
+        super(CodeGenerator, self).__init__(**kwargs)
+        self._gpu = gpu
+        self.build_catalogue_path = self.path_to_utility(
+            'arbor-build-catalogue', env_var='ARBOR_BUILD_CATALOGUE')
+        self._catalogues = {}
+
+    def generate_source_files(self, component_class, src_dir, name=None,
+                              **kwargs):
+        if name is None:
+            name = component_class.name
+        mech_type = component_class.annotations.get(
+            (BUILD_TRANS, PYPE9_NS), MECH_TYPE)
+        if mech_type == ARTIFICIAL_CELL_MECH:
+            raise Pype9Unsupported9MLException(
+                "Cannot generate Arbor mechanism for '{}' as it does not "
+                "have a membrane voltage (artificial cells are not supported "
+                "by the Arbor pipeline)".format(name))
+        elif mech_type != FULL_CELL_MECH:
+            raise Pype9Unsupported9MLException(
+                "Cannot generate Arbor mechanism for '{}' as distributed "
+                "mechanisms are not supported by the Arbor pipeline"
+                .format(name))
+        if component_class.is_random:
+            raise Pype9Unsupported9MLException(
+                "Cannot generate Arbor mechanism for '{}' as random "
+                "distributions in state assignments are not supported by the "
+                "Arbor pipeline".format(name))
+        if component_class.num_event_receive_ports > 1:
+            raise Pype9Unsupported9MLException(
+                "Multiple event receive ports ('{}') are not currently "
+                "supported by the Arbor pipeline".format(
+                    "', '".join(component_class.event_receive_port_names)))
+        for trans in component_class.all_transitions():
+            if ('v' in trans.state_assignment_variables and
+                    'v_clamp___pype9' not in
+                    trans.state_assignment_variables):
+                raise Pype9Unsupported9MLException(
+                    "Cannot generate Arbor mechanism for '{}' as the membrane "
+                    "voltage is reset in a transition to the '{}' regime "
+                    "(Arbor mechanisms cannot write to the membrane voltage "
+                    "so integrate-and-fire models are not supported by the "
+                    "Arbor pipeline, see the 'Unsupported 9ML' page of the "
+                    "documentation)".format(name, trans.target_regime.name))
+        tmpl_args = {
+            'code_gen': self,
+            'component_name': name,
+            'component_class': component_class,
+            'version': pype9.__version__, 'src_dir': src_dir,
+            'timestamp': datetime.now().strftime('%a %d %b %y %I:%M:%S%p'),
+            'unit_handler': UnitHandler(component_class),
+            'ode_solver': kwargs.get('ode_solver', self.ODE_SOLVER_DEFAULT),
+            'regime_varname': self.REGIME_VARNAME,
+            'time_varname': self.TIME_VARNAME}
+        self.render_to_file('main.tmpl', tmpl_args, name + '.mod', src_dir)
+
+    def transform_for_build(self, name, component_class, **kwargs):
+        """
+        Extends the NMODL build transform to replace references to the
+        simulation time, 't', with an integrated state variable
+        """
+        trfrm_with_syn = super(CodeGenerator, self).transform_for_build(
+            name, component_class, **kwargs)
+        trfrm = trfrm_with_syn.dynamics
+        if any('t' in e.rhs_symbol_names for e in trfrm.all_expressions):
+            trfrm.rename_symbol('t', self.TIME_VARNAME)
+            trfrm.add(StateVariable(self.TIME_VARNAME, un.time))
+            for regime in trfrm.regimes:
+                regime.add(TimeDerivative(self.TIME_VARNAME, '1'))
+            trfrm.validate()
+        return trfrm_with_syn
+
+    def compile_source_files(self, compile_dir, name):
+        """
+        Builds the Arbor mechanism catalogue with 'arbor-build-catalogue'
+        and moves it into the install directory
+        """
+        build_dir = os.path.dirname(compile_dir)
+        src_dir = os.path.join(build_dir, self._SRC_DIR)
+        install_dir = os.path.join(build_dir, self._INSTL_DIR)
+        os.chdir(compile_dir)
+        logger.info("Building Arbor mechanism catalogue in '{}' directory."
+                    .format(compile_dir))
+        cmd = [self.build_catalogue_path, name, src_dir]
+        if self._gpu:
+            cmd.extend(['--gpu', 'cuda'])
+        stdout, stderr = self.run_command(cmd, fail_msg=(
+            "Compilation of Arbor catalogue for '{}' failed. See src "
+            "directory '{}':\n\n{{}}".format(name, src_dir)))
+        catalogue_fname = self._catalogue_fname(name)
+        if not os.path.exists(os.path.join(compile_dir, catalogue_fname)):
+            raise Pype9BuildError(
+                "Compilation of Arbor catalogue for '{}' failed:\n{}\n{}"
+                .format(name, stdout, stderr))
+        shutil.move(os.path.join(compile_dir, catalogue_fname),
+                    os.path.join(install_dir, catalogue_fname))
+        logger.info("Compilation of Arbor catalogue for '{}' completed "
+                    "successfully".format(name))
+
+    def load_libraries(self, name, url, **kwargs):  # @UnusedVariable
+        install_dir = self.get_install_dir(name, url)
+        self._catalogues[name] = arbor.load_catalogue(
+            os.path.join(install_dir, self._catalogue_fname(name)))
+
+    def catalogue(self, name):
+        "The mechanism catalogue loaded for the named cell class"
+        return self._catalogues[name]
+
+    def simulator_specific_paths(self):
+        path = []
+        if 'ARBOR_HOME' in os.environ:
+            path.append(os.path.join(os.environ['ARBOR_HOME'], 'bin'))
+        return path
+
+    @classmethod
+    def _catalogue_fname(cls, name):
+        return name + '-catalogue.so'
@@ -0,0 +1 @@
+from .base import Network, ComponentArray, Selection, ConnectionGroup
@@ -0,0 +1,305 @@
+"""
+
+  Network classes for the Arbor backend. As there is no PyNN interface to
+  Arbor, component arrays are constructed from individual Arbor cells and
+  connection groups are sampled directly from the 9ML connectivity.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2014 Thomas G. Close.
+  License: This file is part of the "NineLine" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from builtins import next, zip, range
+from itertools import chain
+import numpy
+import neo
+from nineml.exceptions import NineMLNameError
+from nineml.user import ComponentArray as ComponentArray9ML
+from nineml.user import EventConnectionGroup as EventConnectionGroup9ML
+from nineml.user.connectionrule import Connectivity
+from pype9.simulate.common.network.base import (
+    Network as BaseNetwork, ComponentArray as BaseComponentArray,
+    ConnectionGroup as BaseConnectionGroup, Selection as BaseSelection)
+from pype9.simulate.common.network.values import get_values
+from pype9.simulate.common.network.connection_rules import (
+    connection_rule_plugin)
+from pype9.simulate.common.network.structure import positions
+from pype9.exceptions import (
+    Pype9RuntimeError, Pype9UsageError, Pype9Unsupported9MLException)
+from ..cells import CellMetaClass
+from ..code_gen import CodeGenerator
+from ..units import UnitHandler
+from ..simulation import Simulation
+
+
+class ComponentArray(BaseComponentArray):
+
+    CellMetaClass = CellMetaClass
+    UnitHandler = UnitHandler
+    Simulation = Simulation
+
+    def __init__(self, nineml_model, build_mode='lazy', **kwargs):
+        if not isinstance(nineml_model, ComponentArray9ML):
+            raise Pype9RuntimeError(
+                "Expected a component array, found {}".format(nineml_model))
+        self._nineml = nineml_model
+        dynamics_properties = nineml_model.dynamics_properties
+        self._cell_type = self.CellMetaClass(
+            component_class=dynamics_properties.component_class,
+            build_mode=build_mode, **kwargs)
+        self._cells = []
+        self._positions = None
+        if build_mode != 'build_only':
+            rng = self.Simulation.active().properties_rng
+            # Draw the values of the properties and initial values that
+            # vary between cells
+            varying = dict(
+                (p.name, (p.units.dimension,
+                          get_values(p, self.UnitHandler, rng,
+                                     nineml_model.size)))
+                for p in chain(dynamics_properties.properties,
+                               dynamics_properties.initial_values)
+                if p.value.nineml_type != 'SingleValue')
+            for i in range(nineml_model.size):
+                values = dict(
+                    (n, self.UnitHandler.assign_units(v[i], d))
+                    for n, (d, v) in varying.items())
+                self._cells.append(self._cell_type(
+                    dynamics_properties,
+                    regime_=dynamics_properties.initial_regime, **values))
+            self._positions = positions(nineml_model, rng=rng)
+        self._t_stop = None
+        self.Simulation.active().register_array(self)
+
+    @property
+    def size(self):
+        return self._nineml.size
+
+    @property
+    def positions(self):
+        "The positions of the cells (3xN array in um)"
+        return self._positions
+
+    def __len__(self):
+        return len(self._cells)
+
+    def __iter__(self):
+        return iter(self._cells)
+
+    def __getitem__(self, index):
+        return self._cells[index]
+
+    @property
+    def component_class(self):
+        return self._cell_type.component_class
+
+    def play(self, port_name, signal, properties=[]):
+        """
+        Plays an analog signal or train of events into a port of the dynamics
+        array.
+
+        Parameters
+        ----------
+        port_name : str
+            The name of the port to play the signal into
+        signal : neo.AnalogSignal | neo.SpikeTrain | list(neo.SpikeTrain)
+            The signal to play into the cells. If a list of spike trains is
+            provided there should be one for each cell
+        properties : dict(str, nineml.Quantity)
+            Connection properties when playing into a event receive port
+            with static connection properties
+        """
+        if isinstance(signal, (neo.SpikeTrain, neo.AnalogSignal)):
+            signals = [signal] * len(self)
+        else:
+            signals = list(signal)
+            if len(signals) != len(self):
+                raise Pype9UsageError(
+                    "Number of signals ({}) does not match number of cells in "
+                    "'{}' component array ({})".format(len(signals), self.name,
+                                                       len(self)))
+        for cell, sig in zip(self._cells, signals):
+            cell.play(port_name, sig, properties=properties)
+
+    def record(self, port_name, t_start=None):  # @UnusedVariable
+        """
+        Records the port or state variable
+
+        Parameters
+        ----------
+        port_name : str
+            Name of the port to record
+        """
+        name = self._port_name(port_name)
+        for cell in self._cells:
+            cell.record(name)
+
+    def recording(self, port_name, t_start=None, gather=True):  # @UnusedVariable @IgnorePep8
+        """
+        Returns the recorded data for the given port name
+
+        Parameters
+        ----------
+        port_name : str
+            The name of the port (or state-variable) to retrieve the recorded
+            data for
+        gather : bool
+            Only included for compatibility with the NEURON and NEST backends,
+            as the distribution of cells over MPI processes is handled by the
+            Arbor execution context
+
+        Returns
+        -------
+        recording : neo.Segment
+            The recorded data in a neo.Segment
+        """
+        name = self._port_name(port_name)
+        recording = neo.Segment()
+        for i, cell in enumerate(self._cells):
+            sig = cell.recording(name, t_start=t_start)
+            sig.annotate(source_index=i)
+            if isinstance(sig, neo.SpikeTrain):
+                recording.spiketrains.append(sig)
+            else:
+                recording.analogsignals.append(sig)
+        return recording
+
+
+class Selection(BaseSelection):
+
+    def __init__(self, nineml_model, *component_arrays):
+        self._nineml = nineml_model
+        if not component_arrays:
+            raise Pype9RuntimeError(
+                "No component arrays provided to '{}' selection"
+                .format(nineml_model.name))
+        self._component_arrays = dict(
+            (ca.name, ca) for ca in component_arrays)
+        # Retain the order of the concatenation
+        self._cells = list(chain(*component_arrays))
+        if all(ca.positions is not None for ca in component_arrays):
+            self._positions = numpy.hstack(
+                [ca.positions for ca in component_arrays])
+        else:
+            self._positions = None
+
+    @property
+    def size(self):
+        return len(self._cells)
+
+    @property
+    def positions(self):
+        "The positions of the cells (3xN array in um)"
+        return self._positions
+
+    def __len__(self):
+        return len(self._cells)
+
+    def __iter__(self):
+        return iter(self._cells)
+
+    def __getitem__(self, index):
+        return self._cells[index]
+
+
+class ConnectionGroup(BaseConnectionGroup):
+
+    UnitHandler = UnitHandler
+    Simulation = Simulation
+
+    def __init__(self, nineml_model, source, destination):
+        rng = self.Simulation.active().properties_rng
+        if not isinstance(nineml_model, EventConnectionGroup9ML):
+            raise Pype9RuntimeError(
+                "Expected a connection group model, found {}"
+                .format(nineml_model))
+        self._nineml = nineml_model
+        self._source = source
+        self._destination = destination
+        rule_properties = nineml_model.connectivity.rule_properties
+        plugin = connection_rule_plugin(rule_properties)
+        if plugin is not None:
+            # User-defined connection rules are sampled by their plugin
+            connections = plugin.connections(
+                rule_properties, source.positions, destination.positions, rng)
+        else:
+            connections = list(nineml_model.connectivity.connections())
+        num_conns = len(connections)
+        if destination.plasticity(nineml_model.name) is not None:
+            raise Pype9Unsupported9MLException(
+                "Plasticity with state (as used in '{}') is not supported by "
+                "the Arbor pipeline".format(nineml_model.name))
+        try:
+            (synapse, conns) = destination.synapse(nineml_model.name)
+            if conns is not None:
+                raise NotImplementedError(
+                    "Nonlinear synapses, as used in '{}' are not currently "
+                    "supported".format(nineml_model.name))
+            if synapse.num_local_properties == 1:
+                # Get the only local property that varies with the synapse
+                # (typically the synaptic weight but does not have to be)
+                weights = get_values(next(synapse.local_properties),
+                                     self.UnitHandler, rng, num_conns)
+            elif not synapse.num_local_properties:
+                weights = numpy.zeros(num_conns)
+            else:
+                raise NotImplementedError(
+                    "Currently only supports one property that varies with "
+                    "each synapse")
+        except NineMLNameError:
+            # Synapse dynamics properties didn't have any properties that vary
+            # between synapses so wasn't included
+            weights = numpy.zeros(num_conns)
+        delays = get_values(nineml_model.delay, self.UnitHandler, rng,
+                            num_conns)
+        for (src_i, dest_i), weight, delay in zip(connections, weights,
+                                                  delays):
+            destination[int(dest_i)]._add_connection(
+                source[int(src_i)], float(weight), float(delay))
+        self._num_connections = num_conns
+
+    @property
+    def pre(self):
+        return self._source
+
+    @property
+    def post(self):
+        return self._destination
+
+    @property
+    def connectivity(self):
+        return self._nineml.connectivity
+
+    def __len__(self):
+        return self._num_connections
+
+
+class Network(BaseNetwork):
+
+    ComponentArrayClass = ComponentArray
+    SelectionClass = Selection
+    ConnectionGroupClass = ConnectionGroup
+    ConnectivityClass = Connectivity
+    CodeGenerator = CodeGenerator
+    Simulation = Simulation
+
+    @property
+    def min_delay(self):
+        return self.Simulation.active().min_delay
+
+    @property
+    def time_step(self):
+        return self.Simulation.active().dt
+
+    @property
+    def max_delay(self):
+        return self.Simulation.active().max_delay
+
+    @property
+    def num_processes(self):
+        return self.Simulation.active().num_processes()
+
+    @property
+    def rank(self):
+        return self.Simulation.active().mpi_rank()
@@ -0,0 +1,157 @@
+from __future__ import absolute_import
+import numpy
+import arbor
+from nineml import units as un
+from pype9.simulate.common.simulation import Simulation as BaseSimulation
+from pype9.simulate.arbor.code_gen import CodeGenerator
+from pype9.utils.mpi import mpi_comm
+from pype9.exceptions import Pype9UsageError
+
+
+class _Recipe(arbor.recipe):
+    """
+    Arbor recipe constructed from the cells registered with the simulation.
+    The global index (gid) of each cell is its position in the cell list.
+    """
+
+    def __init__(self, cells, catalogues):
+        arbor.recipe.__init__(self)
+        self._cells = cells
+        self._properties = arbor.neuron_cable_properties()
+        for catalogue in catalogues:
+            self._properties.catalogue.extend(catalogue, '')
+
+    def num_cells(self):
+        return len(self._cells)
+
+    def cell_kind(self, gid):  # @UnusedVariable
+        return arbor.cell_kind.cable
+
+    def cell_description(self, gid):
+        return self._cells[gid]._cable_cell(gid)
+
+    def connections_on(self, gid):
+        return self._cells[gid]._arbor_connections()
+
+    def event_generators(self, gid):
+        return self._cells[gid]._event_generators()
+
+    def probes(self, gid):
+        return self._cells[gid]._probes()
+
+    def global_properties(self, kind):  # @UnusedVariable
+        return self._properties
+
+
+class Simulation(BaseSimulation):
+    """
+    Controls the construction and running of Arbor simulations. As Arbor
+    requires the complete model to be described in a "recipe" before the
+    simulation is constructed, the cells and networks created within the
+    simulation context are collected and the Arbor simulation is only
+    constructed when the simulation is first run.
+
+    Parameters
+    ----------
+    threads_per_proc : int
+        The number of threads used by each MPI process
+    gpu_id : int | None
+        The ID of the GPU to run the simulation on (requires the mechanism
+        catalogues to be built with GPU support)
+    """
+
+    _active = None
+    name = 'Arbor'
+    CodeGenerator = CodeGenerator
+
+    def __init__(self, *args, **kwargs):
+        self._threads_per_proc = kwargs.pop('threads_per_proc', 1)
+        self._gpu_id = kwargs.pop('gpu_id', None)
+        super(Simulation, self).__init__(*args, **kwargs)
+        self._context = None
+        self._arbor_sim = None
+        self._sample_handles = None
+
+    def _run(self, t_stop, **kwargs):  # @UnusedVariable
+        """
+        Run the simulation for a further 't_stop'.
+
+        Parameters
+        ----------
+        t_stop : nineml.Quantity (time)
+            The time to run the simulation for
+        """
+        # Arbor runs until an absolute time
+        self._arbor_sim.run(float(self.t.in_units(un.ms)) +
+                            float(t_stop.in_units(un.ms)),
+                            float(self.dt.in_units(un.ms)))
+
+    def _prepare(self, **kwargs):  # @UnusedVariable
+        "Reset the simulation and prepare it for creating new cells/networks"
+        if mpi_comm.size > 1:
+            self._context = arbor.context(threads=self._threads_per_proc,
+                                          gpu_id=self._gpu_id, mpi=mpi_comm)
+        else:
+            self._context = arbor.context(threads=self._threads_per_proc,
+                                          gpu_id=self._gpu_id)
+        self._arbor_sim = None
+        self._sample_handles = {}
+
+    def _initialize(self):
+        """
+        Constructs the Arbor recipe and simulation from the registered cells
+        once their initial states have been set
+        """
+        super(Simulation, self)._initialize()
+        cells = list(self._registered_cells)
+        # The catalogues are loaded by the code generators of the cell classes,
+        # which may be distinct (but equivalent) objects to the simulation's
+        catalogues = dict((c.name, c.code_generator.catalogue(c.name))
+                          for c in cells)
+        recipe = _Recipe(cells, catalogues.values())
+        self._arbor_sim = arbor.simulation(
+            recipe, self._context,
+            arbor.partition_load_balance(recipe, self._context),
+            seed=int(self.dynamics_seed))
+        self._arbor_sim.record(arbor.spike_recording.all)
+        schedule = arbor.regular_schedule(float(self.dt.in_units(un.ms)))
+        for gid, cell in enumerate(cells):
+            for tag in cell._probe_tags:
+                self._sample_handles[(gid, tag)] = self._arbor_sim.sample(
+                    (gid, tag), schedule)
+
+    def spikes(self, gid):
+        "The spike times (in ms) emitted by the cell with the given gid"
+        if self._arbor_sim is None:
+            return numpy.array([])
+        spikes = self._arbor_sim.spikes()
+        return numpy.sort(spikes['time'][spikes['source']['gid'] == gid])
+
+    def samples(self, gid, tag):
+        "The sampled values of a probe of the cell with the given gid"
+        if self._arbor_sim is None:
+            raise Pype9UsageError(
+                "Simulation has not been run so there are no samples to "
+                "retrieve")
+        samples = self._arbor_sim.samples(self._sample_handles[(gid, tag)])
+        if not samples:
+            return numpy.array([])
+        data, _ = samples[0]
+        return data[:, 1]
+
+    def mpi_rank(self):
+        "The rank of the MPI node the code is running on"
+        return mpi_comm.rank
+
+    def num_processes(self):
+        "The number of MPI processes"
+        return mpi_comm.size
+
+    def num_threads(self):
+        "The total number of threads across all MPI nodes"
+        return self.num_processes() * self._threads_per_proc
+
+    def register_array(self, array):
+        # Arrays consist of individual Arbor cells, which register
+        # themselves with the simulation
+        self._registered_arrays.append(array)
@@ -15,6 +15,7 @@ from builtins import next
 from builtins import object
 from itertools import chain
 import numpy as np
+import sympy
 import quantities as pq
 import neo
 import nineml
@@ -22,13 +23,15 @@ from nineml.abstraction import Dynamics, Regime
 from nineml.user import Property, Initial
 from pype9.utils.mpi import mpi_comm, is_mpi_master
 from nineml.exceptions import NineMLNameError
-from pype9.annotations import PYPE9_NS
+from nineml.visitors import BaseVisitorWithContext
+from pype9.annotations import PYPE9_NS, BUILD_TRANS, MEMBRANE_VOLTAGE
 from pype9.exceptions import (
     Pype9RuntimeError, Pype9AttributeError, Pype9DimensionError,
     Pype9UsageError, Pype9BuildMismatchError, Pype9NoActiveSimulationError,
     Pype9RegimeTransitionsNotRecordedError)
 import logging
 from .with_synapses import WithSynapses
+from .storage import AnalogSignalProxy
 
 
 logger = logging.Logger("Pype9")
@@ -37,6 +40,10 @@ logger = logging.Logger("Pype9")
 # e.g. 'Izhikevich'
 BUILD_NAME_SUFFIX = '9ML'
 
+# Methods used to interpolate analog signals played into the cell between
+# their sample points
+INTERPOLATION_METHODS = ('step', 'linear')
+
 
 class CellMetaClass(type):
     """
@@ -53,6 +60,18 @@ class CellMetaClass(type):
         The name of the cell class, which is used for the generated simulator
         code. If None, the name of the component_class is used. Note, names
         must be unique among classes loaded within the same simulation script.
+    solver : str | None
+        The scheme used to integrate the time derivatives of the cell, one of
+        'exact' (exponential integration of dynamics that are linear in each
+        state variable), 'explicit', 'implicit' (for stiff dynamics),
+        'adaptive' (CVODE in NEURON) or 'auto' to select between the exact and
+        implicit schemes from the form of the dynamics. If None, the default
+        scheme of the simulator is used
+    hooks : list(str) | None
+        The names of the registered code-generation hooks (see
+        ``pype9.simulate.common.code_gen.hooks``) to apply to the generated
+        code of the cell class, e.g. to override templates or link extra
+        libraries
     """
 
     def __new__(cls, component_class, build_url=None, build_version=None,
@@ -128,6 +147,8 @@ class CellMetaClass(type):
                    'build_component_class': build_component_class,
                    'code_generator': code_generator,
                    'unit_handler': code_generator.UnitHandler(component_class),
+                   'solver': code_generator.select_solver(
+                       build_component_class, kwargs.get('solver', None)),
                    'Simulation': cls.Simulation}
             # Create new class using Type.__new__ method
             Cell = super(CellMetaClass, cls).__new__(
@@ -159,6 +180,10 @@ class Cell(object):
         will override properties/initial-values in the prototype
     """
 
+    # Whether recordings can be spooled to a recording store (see the
+    # 'spool_recordings' argument of Simulation)
+    spoolable = False
+
     def __init__(self, *args, **kwargs):
         self._in_array = kwargs.pop('_in_array', False)
         # Flag to determine whether the cell has been initialized or not
@@ -168,6 +193,10 @@ class Cell(object):
         sim = self.Simulation.active()
         self._t_start = sim.t_start
         self._t_stop = None
+        # The store the recordings of the cell are spooled to (see the
+        # 'spool_recordings' argument of Simulation)
+        self._recording_store = None
+        self._spooled = set()
         if self.in_array:
             for k, v in kwargs.items():
                 self._set(k, v)  # Values should be in the right units.
@@ -423,6 +452,20 @@ class Cell(object):
     def reset_recordings(self):
         raise NotImplementedError("Should be implemented by derived class")
 
+    def _save_state(self, group):
+        """
+        Saves the state of the cell and its recording buffers to a HDF5 group
+        (see Simulation.save_state)
+        """
+        raise NotImplementedError("Should be implemented by derived class")
+
+    def _restore_state(self, group):
+        """
+        Restores the state of the cell and its recording buffers from a HDF5
+        group (see Simulation.restore_state)
+        """
+        raise NotImplementedError("Should be implemented by derived class")
+
     def clear_recorders(self):
         """
         Clears all recorders and recordings
@@ -437,10 +480,80 @@ class Cell(object):
     def record(self, port_name, t_start=None):
         """
         Specify the recording of a send port or state-variable before the
-        simulation.
+        simulation. If a 'callback' is provided (along with an optional
+        'callback_interval') the recording is passed to it in chunks while
+        the simulation is running (see ``Simulation.register_stream``).
         """
         raise NotImplementedError("Should be implemented by derived class")
 
+    def _register_stream(self, port_name, callback, interval):
+        """
+        Registers a callback with the active simulation that is passed the
+        recording of the port in chunks while the simulation is running, and
+        spools the recording to the recording store of the simulation if it
+        has one (the spooling is registered first so that the callback is
+        passed the latest samples)
+        """
+        sim = self.Simulation.active()
+        if sim.recording_store is not None:
+            if not self.spoolable:
+                raise Pype9UsageError(
+                    "Spooling of recordings is not supported by {} cells "
+                    "('{}' of '{}')".format(sim.name, port_name, self.name))
+            super(Cell, self).__setattr__('_recording_store',
+                                          sim.recording_store)
+            self._spooled.add(port_name)
+            sim.spool(self, port_name)
+        if callback is not None:
+            sim.register_stream(self, port_name, callback, interval)
+
+    def _spool(self, port_name):
+        """
+        Moves the samples recorded from the port since it was last spooled
+        from the buffers of the simulator to the recording store
+        """
+        values, units, interval = self._pop_recorded(port_name)
+        self._recording_store.append(
+            self._recording_store.key(self), port_name, values, units=units,
+            sampling_period=interval,
+            t_start=float(self.unit_handler.to_pq_quantity(
+                self._t_start).rescale(pq.ms)))
+
+    def _pop_recorded(self, port_name):
+        """
+        Returns the samples recorded from the port and clears them from the
+        buffers of the simulator
+
+        Returns
+        -------
+        values : numpy.array
+            The recorded samples, or spike times (ms) of event ports
+        units : str | None
+            The units of the samples (None for event ports)
+        interval : float | None
+            The sampling interval (ms) of analog ports
+        """
+        raise NotImplementedError("Should be implemented by derived class")
+
+    def _spooled_recording(self, port_name, t_start=None):
+        """
+        Returns a proxy for the spooled recording of the port, which loads it
+        from the recording store on demand
+        """
+        if not self.is_dead():
+            # Spool the samples recorded since the last interval
+            self._spool(port_name)
+            t_stop = self.Simulation.active().t
+        else:
+            t_stop = self._t_stop
+        return self._recording_store.recording(
+            self._recording_store.key(self), port_name, t_start=t_start,
+            t_stop=self.unit_handler.to_pq_quantity(t_stop))
+
+    def _clear_spooled(self):
+        if self._recording_store is not None:
+            self._recording_store.clear(self._recording_store.key(self))
+
     def record_regime(self):
         """
         Returns the current regime at each timestep. Periods spent in each
@@ -461,6 +574,17 @@ class Cell(object):
         raise NotImplementedError("Should be implemented by derived class")
 
     def recordings(self, t_start=None):
+        """
+        Returns the recordings of the cell in a Neo segment. Spooled
+        recordings (see the 'spool_recordings' argument of Simulation) are
+        added to the segment as proxy objects (like the segments of Neo's
+        lazily-read IOs), which are loaded with their ``load`` method
+
+        Parameters
+        ----------
+        t_start : quantities.Quantity (time) | None
+            The start of the recordings, the start of the simulation if None
+        """
         seg = neo.Segment(description="Simulation of '{}' cell".format(
             self._nineml.name,
             ('from {}'.format(t_start) if t_start is not None else '')))
@@ -468,7 +592,7 @@ class Cell(object):
             if port_name == self.code_generator.REGIME_VARNAME:
                 continue
             sig = self.recording(port_name, t_start=t_start)
-            if isinstance(sig, neo.AnalogSignal):
+            if isinstance(sig, (neo.AnalogSignal, AnalogSignalProxy)):
                 seg.analogsignals.append(sig)
             else:
                 seg.spiketrains.append(sig)
@@ -506,7 +630,7 @@ class Cell(object):
             times=times, durations=durations, labels=labels,
             name='{}_regimes'.format(self.name))
 
-    def play(self, port_name, signal, properties=[]):
+    def play(self, port_name, signal, properties=[], interpolation='step'):
         """
         Plays an analog signal or train of events into a port of the
         cell
@@ -516,10 +640,53 @@ class Cell(object):
         port_name : str
             The name of the port to play the signal into
         signal : neo.AnalogSignal | neo.SpikeTrain
-            The signal to play into the cell
+            The signal to play into the cell. Analog signals can be played
+            into any analog receive or reduce port with matching dimension
         properties : dict(str, nineml.Quantity)
             Connection properties when playing into a event receive port
             with static connection properties
+        interpolation : str
+            How analog signals are interpolated between their sample points,
+            either held until the next sample ('step') or interpolated
+            linearly ('linear')
+        """
+        raise NotImplementedError("Should be implemented by derived class")
+
+    def voltage_clamp(self, voltages, series_resistance=1e-3,
+                      interpolation='step'):
+        """
+        Clamps the membrane voltage of the cell to the given voltages via a
+        single-electrode clamp, i.e. injects a current of
+        (V_clamp - V) / series_resistance
+
+        Parameters
+        ----------
+        voltages : neo.AnalogSignal (voltage)
+            The voltages to clamp the cell to
+        series_resistance : nineml.Quantity | quantities.Quantity | float
+            The series resistance of the electrode (floats are interpreted
+            as MOhm)
+        interpolation : str
+            How the voltages are interpolated between their sample points,
+            'step' or 'linear'
+        """
+        raise NotImplementedError("Should be implemented by derived class")
+
+    def clamp_current(self, t_start=None):
+        """
+        Returns the current injected into the cell by the voltage clamp
+        (depolarising currents are positive)
+
+        Parameters
+        ----------
+        t_start : quantities.Quantity (time) | None
+            The time to return the current from, the start of the
+            simulation if None
+
+        Returns
+        -------
+        current : neo.AnalogSignal (current)
+            The clamp current
         """
         raise NotImplementedError("Should be implemented by derived class")
 
@@ -566,6 +733,45 @@ class Cell(object):
                     .format(prop.name, prop.units.dimension,
                             params_dict[prop.name].dimension))
 
+    def _scale_analog_signal(self, port, signal):
+        """
+        Returns the values of an analog signal in the simulator units of the
+        dimension of the port it is played into
+        """
+        units = self.unit_handler.assign_units(1.0, port.dimension).units
+        try:
+            return np.ravel(np.asarray(signal.rescale(units)))
+        except ValueError:
+            raise Pype9UsageError(
+                "Units of signal played into '{}' port ({}) are not "
+                "compatible with its dimension ({})".format(
+                    port.name, signal.units.dimensionality, port.dimension))
+
+    @classmethod
+    def _check_interpolation(cls, interpolation):
+        if interpolation not in INTERPOLATION_METHODS:
+            raise Pype9UsageError(
+                "Unrecognised interpolation method '{}' (can be '{}')".format(
+                    interpolation, "', '".join(INTERPOLATION_METHODS)))
+
+    def _series_resistance_in_mohm(self, series_resistance):
+        if not isinstance(series_resistance, (int, float, pq.Quantity)):
+            # Convert nineml.Quantity objects
+            series_resistance = self.unit_handler.to_pq_quantity(
+                series_resistance)
+        if isinstance(series_resistance, pq.Quantity):
+            try:
+                series_resistance = float(series_resistance.rescale('MOhm'))
+            except ValueError:
+                raise Pype9UsageError(
+                    "Series resistance of voltage clamp must have units of "
+                    "resistance ({})".format(series_resistance.units))
+        if series_resistance <= 0.0:
+            raise Pype9UsageError(
+                "Series resistance of voltage clamp must be positive ({})"
+                .format(series_resistance))
+        return float(series_resistance)
+
     def _kill(self, t_stop):
         """
         Caches recording data and sets all references to the actual
@@ -596,6 +802,107 @@ class Cell(object):
             signal = signal[int(offset_index):]
         return signal
 
+    @classmethod
+    def get_v_threshold(self, dynamics_properties, port_name):
+        """
+        Returns the voltage threshold at which an event is emitted from the
+        given event port
+
+        Parameters
+        ----------
+        component_class : nineml.Dynamics
+            The component class of the cell to find the v-threshold for
+        port_name : str
+            Name of the event send port to threshold
+        """
+        comp_class = (dynamics_properties.component_class.
+                      _dynamics.substitute_aliases())
+        transitions = OuputEventTransitionsFinder(
+            comp_class, comp_class.event_send_port(port_name)).transitions
+        assert transitions
+        try:
+            triggers = set(t.trigger for t in transitions)
+        except AttributeError:
+            raise Pype9UsageError(
+                "Cannot get threshold for event port '{}' in {} as it is "
+                "emitted from at least OnEvent transition ({})".format(
+                    port_name, comp_class,
+                    ', '.join(str(t) for t in transitions)))
+        if len(triggers) > 1:
+            raise Pype9UsageError(
+                "Cannot get threshold for event port '{}' in {} as it is the "
+                "condition from at least OnEvent transition ({})".format(
+                    port_name, comp_class, ', '.join(transitions)))
+        expr = next(iter(triggers)).rhs
+        v = sympy.Symbol(self.component_class.annotations.get(
+            (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE))
+        if v not in expr.free_symbols:
+            raise Pype9UsageError(
+                "Trigger expression for '{}' port in {} is not an expression "
+                "of membrane voltage '{}'".format(port_name, comp_class, v))
+        solution = None
+        if isinstance(expr, (sympy.StrictGreaterThan,
+                             sympy.StrictLessThan)):
+            # Get the equation for the transition between true and false
+            equality = sympy.Eq(*expr.args)
+            solutions = sympy.solvers.solve(equality, v)
+            if len(solutions) == 1:
+                solution = solutions[0]
+        if solution is None:
+            raise Pype9UsageError(
+                "Cannot solve threshold equation for trigger expression '{}' "
+                "for '{}' (to find condition where spikes are emitted from "
+                "'{}' event send port) in {} as it is not a simple inequality"
+                .format(expr, v, port_name, comp_class))
+        values = {}
+        for sym in solution.free_symbols:
+            sym_str = str(sym)
+            try:
+                prop = dynamics_properties.property(sym_str)
+            except NineMLNameError:
+                try:
+                    prop = comp_class.constant(sym_str)
+                except NineMLNameError:
+                    raise Pype9UsageError(
+                        "Cannot calculated fixed value for voltage threshold "
+                        "as it contains reference to {}".format(
+                            comp_class.element(sym_str)))
+            values[sym] = self.unit_handler.scale_value(prop.quantity)
+        threshold = solution.subs(values)
+        return float(threshold)
+
     # This has to go last to avoid clobbering the property decorators
     def property(self, name):
         return self._nineml.property(name)
+
+
+class OuputEventTransitionsFinder(BaseVisitorWithContext):
+    """
+    Finds the transitions which emit an output event
+
+    Parameters
+    ----------
+    component_class : Dynamics
+        The component class to find the transitions from
+    port : EventSendPort
+        The event send port over which the events are emitted.
+    """
+
+    as_class = Dynamics
+
+    def __init__(self, component_class, port):
+        super(OuputEventTransitionsFinder, self).__init__()
+        self._port = port
+        self._transitions = []
+        self.visit(component_class)
+
+    @property
+    def transitions(self):
+        return self._transitions
+
+    def action_outputevent(self, outputevent, **kwargs):  # @UnusedVariable @IgnorePep8
+        if outputevent.port == self._port:
+            self._transitions.append(self.context.parent)
+
+    def default_action(self, obj, nineml_cls, **kwargs):
+        pass
@@ -0,0 +1,310 @@
+"""
+
+  Simulator-independent representation of neuron morphologies, which can be
+  read from SWC or NeuroML (MorphML) files and are used to construct
+  multi-compartmental cells.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2014 Thomas G. Close.
+  License: This file is part of the "NineLine" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from builtins import object, next
+from collections import defaultdict, OrderedDict
+import os.path
+from xml.etree import ElementTree
+import numpy
+from pype9.exceptions import Pype9UsageError
+
+
+# Standard SWC structure identifiers
+SWC_TYPES = {0: 'undefined', 1: 'soma', 2: 'axon', 3: 'dendrite',
+             4: 'apical', 5: 'custom'}
+
+# The name of the group that contains every section
+ALL_GROUP = 'all'
+
+
+class Section(object):
+    """
+    An unbranched section of a morphology
+
+    Parameters
+    ----------
+    name : str
+        Name of the section
+    points : numpy.ndarray
+        N x 4 array of the 3D points (x, y, z, diameter) along the section
+        (um)
+    groups : set(str)
+        The groups (e.g. 'soma', 'dendrite') the section belongs to
+    parent : Section | None
+        The parent section
+    parent_loc : float
+        The location along the parent the section is connected to
+    """
+
+    def __init__(self, name, points, groups, parent=None, parent_loc=1.0):
+        self.name = name
+        self.points = numpy.asarray(points, dtype=float)
+        self.groups = set(groups)
+        self.parent = parent
+        self.parent_loc = parent_loc
+
+    @property
+    def length(self):
+        return numpy.sum(numpy.sqrt(numpy.sum(
+            numpy.diff(self.points[:, :3], axis=0) ** 2, axis=1)))
+
+    def __repr__(self):
+        return "Section('{}', num_points={}, groups=('{}'))".format(
+            self.name, len(self.points), "', '".join(sorted(self.groups)))
+
+
+class Morphology(object):
+    """
+    A tree of unbranched sections
+
+    Parameters
+    ----------
+    name : str
+        Name of the morphology
+    sections : list(Section)
+        The sections of the morphology, in an order where parent sections
+        appear before their children
+    """
+
+    def __init__(self, name, sections):
+        self.name = name
+        self._sections = OrderedDict((s.name, s) for s in sections)
+
+    @property
+    def sections(self):
+        return iter(self._sections.values())
+
+    @property
+    def section_names(self):
+        return iter(self._sections.keys())
+
+    @property
+    def num_sections(self):
+        return len(self._sections)
+
+    def section(self, name):
+        try:
+            return self._sections[name]
+        except KeyError:
+            raise Pype9UsageError(
+                "No section named '{}' in '{}' morphology".format(name,
+                                                                  self.name))
+
+    @property
+    def group_names(self):
+        return set([ALL_GROUP]).union(*(s.groups for s in self.sections))
+
+    def group(self, name):
+        """
+        Returns the sections in the named group ('all' returns every section)
+        """
+        if name == ALL_GROUP:
+            return list(self.sections)
+        sections = [s for s in self.sections if name in s.groups]
+        if not sections:
+            raise Pype9UsageError(
+                "No sections in '{}' group of '{}' morphology (available "
+                "groups: '{}')".format(name, self.name,
+                                       "', '".join(sorted(self.group_names))))
+        return sections
+
+    @property
+    def soma(self):
+        """
+        The section the soma (or the root section if no section belongs to the
+        'soma' group)
+        """
+        try:
+            return next(s for s in self.sections if 'soma' in s.groups)
+        except StopIteration:
+            return next(self.sections)
+
+    def __repr__(self):
+        return "Morphology('{}', num_sections={})".format(
+            self.name, self.num_sections)
+
+    @classmethod
+    def read(cls, path):
+        """
+        Reads a morphology from a SWC (.swc) or NeuroML (.xml/.nml) file
+        """
+        ext = os.path.splitext(path)[1].lower()
+        if ext == '.swc':
+            return cls.from_swc(path)
+        elif ext in ('.xml', '.nml'):
+            return cls.from_morphml(path)
+        else:
+            raise Pype9UsageError(
+                "Unrecognised morphology file extension '{}' ({}), can be "
+                "either '.swc' or '.xml'/'.nml' (NeuroML)".format(ext, path))
+
+    @classmethod
+    def from_swc(cls, path):
+        """
+        Reads a morphology from a SWC file
+        """
+        points = []
+        with open(path) as f:
+            for line in f:
+                line = line.split('#')[0].strip()
+                if not line:
+                    continue
+                try:
+                    id_, type_, x, y, z, r, parent = line.split()[:7]
+                    points.append((int(id_),
+                                   SWC_TYPES.get(int(type_), 'custom'),
+                                   float(x), float(y), float(z),
+                                   2.0 * float(r), int(parent)))
+                except ValueError:
+                    raise Pype9UsageError(
+                        "Could not parse line '{}' of SWC file '{}'"
+                        .format(line, path))
+        return cls._from_points(os.path.splitext(os.path.basename(path))[0],
+                                points)
+
+    @classmethod
+    def from_morphml(cls, path):
+        """
+        Reads the first morphology from a NeuroML (v2) file
+        """
+        try:
+            root = ElementTree.parse(path).getroot()
+        except ElementTree.ParseError as e:
+            raise Pype9UsageError(
+                "Could not parse NeuroML file '{}': {}".format(path, e))
+        morph_elem = next((e for e in root.iter()
+                           if cls._strip_ns(e.tag) == 'morphology'), None)
+        if morph_elem is None:
+            raise Pype9UsageError(
+                "Did not find morphology in NeuroML file '{}'".format(path))
+        # Resolve the segment groups (including nested groups)
+        members = {}
+        includes = {}
+        for group in morph_elem:
+            if cls._strip_ns(group.tag) != 'segmentGroup':
+                continue
+            members[group.get('id')] = set(
+                int(m.get('segment')) for m in group
+                if cls._strip_ns(m.tag) == 'member')
+            includes[group.get('id')] = [
+                i.get('segmentGroup') for i in group
+                if cls._strip_ns(i.tag) == 'include']
+
+        def resolve(group_id, visited=()):
+            segs = set(members.get(group_id, ()))
+            for incl in includes.get(group_id, ()):
+                if incl not in visited:
+                    segs |= resolve(incl, visited + (group_id,))
+            return segs
+
+        seg_groups = defaultdict(set)
+        for group_id in members:
+            if group_id == ALL_GROUP:
+                continue
+            for seg_id in resolve(group_id):
+                seg_groups[seg_id].add(group_id)
+        # Convert segments into a list of points
+        points = []
+        for seg in morph_elem:
+            if cls._strip_ns(seg.tag) != 'segment':
+                continue
+            seg_id = int(seg.get('id'))
+            children = dict((cls._strip_ns(c.tag), c) for c in seg)
+            distal = children['distal']
+            groups = seg_groups[seg_id] or set(['undefined'])
+            groups = '|'.join(sorted(groups))
+            if 'parent' in children:
+                parent = int(children['parent'].get('segment'))
+                if float(children['parent'].get('fractionAlong',
+                                                1.0)) != 1.0:
+                    raise Pype9UsageError(
+                        "Segments connected part way along their parent "
+                        "segment are not supported ('{}' in '{}')"
+                        .format(seg_id, path))
+            else:
+                parent = -1
+            # Add a point for the proximal end of root segments and segments
+            # with explicit proximal points (i.e. with a change in diameter)
+            if 'proximal' in children:
+                prox = children['proximal']
+                prox_id = -(seg_id + 2)  # Unique negative id for the point
+                points.append((prox_id, groups, float(prox.get('x')),
+                               float(prox.get('y')), float(prox.get('z')),
+                               float(prox.get('diameter')), parent))
+                parent = prox_id
+            points.append((seg_id, groups, float(distal.get('x')),
+                           float(distal.get('y')), float(distal.get('z')),
+                           float(distal.get('diameter')), parent))
+        return cls._from_points(morph_elem.get('id', os.path.splitext(
+            os.path.basename(path))[0]), points, group_sep='|')
+
+    @classmethod
+    def _from_points(cls, name, points, group_sep=None):
+        """
+        Converts a list of points, (id, group, x, y, z, diameter, parent_id),
+        into a tree of unbranched sections. Sections are split at branch
+        points and where the group of the points changes.
+        """
+        by_id = OrderedDict((p[0], p) for p in points)
+        children = defaultdict(list)
+        for p in points:
+            children[p[6]].append(p[0])
+        sections = []
+        group_counts = defaultdict(int)
+        roots = [p[0] for p in points if p[6] not in by_id]
+        if not roots:
+            raise Pype9UsageError(
+                "No root point found in '{}' morphology".format(name))
+        # Depth-first traversal so that parents are created before children
+        stack = [(r, None) for r in reversed(roots)]
+        while stack:
+            start_id, parent_sec = stack.pop()
+            start = by_id[start_id]
+            group = start[1]
+            chain = [start]
+            # Extend the section while it is unbranched and in the same group
+            while (len(children[chain[-1][0]]) == 1 and
+                   by_id[children[chain[-1][0]][0]][1] == group):
+                chain.append(by_id[children[chain[-1][0]][0]])
+            sec_points = [c[2:6] for c in chain]
+            parent_loc = 1.0
+            if parent_sec is None:
+                if len(sec_points) == 1:
+                    # Single point (spherical) soma, converted to a cylinder
+                    # with the same surface area
+                    x, y, z, diam = sec_points[0]
+                    sec_points = [(x - diam / 2.0, y, z, diam),
+                                  (x + diam / 2.0, y, z, diam)]
+            elif 'soma' in parent_sec.groups:
+                # Sections are connected to the centre of the soma but don't
+                # extend into it
+                parent_loc = 0.5
+                if len(sec_points) == 1:
+                    sec_points.insert(0, tuple(by_id[start[6]][2:5]) +
+                                      (sec_points[0][3],))
+            else:
+                # Start the section from the end of the parent
+                sec_points.insert(0, by_id[start[6]][2:6])
+            groups = set(group.split(group_sep) if group_sep else [group])
+            label = '_'.join(sorted(groups))
+            sec = Section('{}_{}'.format(label, group_counts[label]),
+                          sec_points, groups, parent=parent_sec,
+                          parent_loc=parent_loc)
+            group_counts[label] += 1
+            sections.append(sec)
+            for child_id in reversed(children[chain[-1][0]]):
+                stack.append((child_id, sec))
+        return cls(name, sections)
+
+    @classmethod
+    def _strip_ns(cls, tag):
+        return tag.split('}')[-1]
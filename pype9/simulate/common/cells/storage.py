@@ -0,0 +1,398 @@
+"""
+  Disk-backed storage for recordings of long simulations. Samples are spooled
+  from the simulator buffers into chunked HDF5 datasets at regular intervals
+  while the simulation runs, and read back lazily (i.e. only the requested
+  time slices are loaded into memory) through proxy objects derived from
+  Neo's proxy objects.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "NineLine" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+from builtins import object
+import os
+import tempfile
+import numpy
+import h5py
+import neo
+from neo.io.proxyobjects import (
+    BaseProxy, AnalogSignalProxy as NeoAnalogSignalProxy,
+    SpikeTrainProxy as NeoSpikeTrainProxy)
+import quantities as pq
+from pype9.exceptions import Pype9UsageError
+
+# The number of samples in each chunk of the HDF5 datasets
+DEFAULT_CHUNK_SIZE = 2 ** 16
+
+
+class RecordingStore(object):
+    """
+    Spools the samples of the recordings of cells to a HDF5 file in chunks
+    as the simulation runs
+
+    Parameters
+    ----------
+    path : str | None
+        Path of the HDF5 file to store the recordings in. If None, a temporary
+        file is created, which is deleted when the store is closed
+    chunk_size : int
+        The number of samples in each chunk of the HDF5 datasets
+    """
+
+    def __init__(self, path=None, chunk_size=DEFAULT_CHUNK_SIZE):
+        self._temporary = path is None
+        if self._temporary:
+            fd, path = tempfile.mkstemp(prefix='pype9-recordings-',
+                                        suffix='.h5')
+            os.close(fd)
+        self.path = path
+        self.chunk_size = chunk_size
+        self._file = h5py.File(path, 'w')
+        self._keys = {}
+
+    def __repr__(self):
+        return "RecordingStore(path='{}')".format(self.path)
+
+    def key(self, cell):
+        """
+        The name of the group the recordings of the cell are stored in
+        """
+        try:
+            return self._keys[id(cell)]
+        except KeyError:
+            key = '{}_{}'.format(cell.__class__.name, len(self._keys))
+            self._keys[id(cell)] = key
+            return key
+
+    def __contains__(self, key_and_port):
+        key, port_name = key_and_port
+        return key in self._file and port_name in self._file[key]
+
+    def append(self, key, port_name, values, units=None,
+               sampling_period=None, t_start=None):
+        """
+        Appends samples (or spike times) to the dataset of the recording,
+        creating it on the first call
+
+        Parameters
+        ----------
+        key : str
+            The key of the recorded cell (see ``RecordingStore.key``)
+        port_name : str
+            The name of the recorded port
+        values : numpy.array
+            The samples of analog recordings or the spike times (ms) of event
+            recordings
+        units : str | None
+            The units of the samples of analog recordings, None for spike
+            times
+        sampling_period : float | None
+            The interval between samples of analog recordings (ms)
+        t_start : float | None
+            The time of the first sample of analog recordings (ms)
+        """
+        self._check_open()
+        group = self._file.require_group(key)
+        try:
+            dataset = group[port_name]
+        except KeyError:
+            dataset = group.create_dataset(
+                port_name, shape=(0,), maxshape=(None,), dtype=float,
+                chunks=(self.chunk_size,))
+            dataset.attrs['name'] = port_name
+            if units is None:
+                dataset.attrs['type'] = 'spikes'
+            else:
+                dataset.attrs['type'] = 'analog'
+                dataset.attrs['units'] = units
+                dataset.attrs['sampling_period'] = sampling_period
+                dataset.attrs['t_start'] = t_start
+        values = numpy.ravel(numpy.asarray(values, dtype=float))
+        if len(values):
+            end = dataset.shape[0]
+            dataset.resize((end + len(values),))
+            dataset[end:] = values
+            self._file.flush()
+
+    def recording(self, key, port_name, t_start=None, t_stop=None):
+        """
+        Returns a proxy object that lazily loads the stored recording
+
+        Parameters
+        ----------
+        key : str
+            The key of the recorded cell (see ``RecordingStore.key``)
+        port_name : str
+            The name of the recorded port
+        t_start : quantities.Quantity (time) | None
+            The start of the recording, the first sample if None
+        t_stop : quantities.Quantity (time)
+            The end of the recording (i.e. the time the simulation was run
+            until)
+
+        Returns
+        -------
+        recording : AnalogSignalProxy | SpikeTrainProxy
+            A proxy for the recording, which is loaded into memory with its
+            ``load`` method
+        """
+        self._check_open()
+        try:
+            dataset = self._file[key][port_name]
+        except KeyError:
+            raise Pype9UsageError(
+                "No recording of '{}' port of '{}' has been stored in {}"
+                .format(port_name, key, self))
+        if dataset.attrs['type'] == 'spikes':
+            return SpikeTrainProxy(dataset, t_start, t_stop)
+        else:
+            return AnalogSignalProxy(dataset, t_start, t_stop)
+
+    def clear(self, key):
+        """
+        Deletes the stored recordings of a cell
+        """
+        self._check_open()
+        if key in self._file:
+            del self._file[key]
+
+    def close(self):
+        """
+        Closes the HDF5 file, after which the stored recordings can't be
+        loaded, deleting it if it was a temporary file
+        """
+        if self._file is not None:
+            self._file.close()
+            self._file = None
+            if self._temporary:
+                os.remove(self.path)
+
+    def _check_open(self):
+        if self._file is None:
+            raise Pype9UsageError("{} has been closed".format(self))
+
+
+class AnalogSignalProxy(NeoAnalogSignalProxy):
+    """
+    Lazily loads an analog signal from a RecordingStore, loading only the
+    requested time slice into memory when ``load`` is called. Derives from
+    Neo's AnalogSignalProxy (used by Neo's IOs when reading lazily) so it
+    has the same attributes as the loaded signal (e.g. 'units', 't_start',
+    'sampling_period') and can be held in neo.Segment objects
+
+    Parameters
+    ----------
+    dataset : h5py.Dataset
+        The dataset holding the samples of the signal
+    t_start : quantities.Quantity (time) | None
+        The start of the signal, the first stored sample if None
+    t_stop : quantities.Quantity (time) | None
+        The end of the signal, the last stored sample if None
+    """
+
+    def __init__(self, dataset, t_start=None, t_stop=None):
+        self._dataset = dataset
+        self.units = pq.Quantity(1.0, dataset.attrs['units']).units
+        self.dtype = dataset.dtype
+        self._sampling_period = dataset.attrs['sampling_period'] * pq.ms
+        self.sampling_rate = (1.0 / self._sampling_period).rescale(pq.Hz)
+        data_start = dataset.attrs['t_start'] * pq.ms
+        if t_start is None:
+            t_start = data_start
+        self.t_start = pq.Quantity(t_start, 'ms')
+        self._offset = self._index(self.t_start - data_start)
+        if self._offset < 0:
+            raise Pype9UsageError(
+                "Start time of '{}' recording ({}) is before the start of "
+                "the simulation ({})".format(dataset.attrs['name'], t_start,
+                                             data_start))
+        num_samples = dataset.shape[0] - self._offset
+        if t_stop is not None:
+            # The simulator can record a sample at the stop time, which
+            # belongs to the next run
+            num_samples = min(num_samples, self._index(
+                pq.Quantity(t_stop, 'ms') - self.t_start))
+        self._num_samples = max(num_samples, 0)
+        # Skip the initialisation of Neo's proxy, which reads the signal
+        # properties from a RawIO object
+        BaseProxy.__init__(self, name=dataset.attrs['name'],
+                           file_origin=dataset.file.filename)
+
+    def __len__(self):
+        return self._num_samples
+
+    def __repr__(self):
+        return "<AnalogSignalProxy({}, {} samples, {}-{})>".format(
+            self.name, len(self), self.t_start, self.t_stop)
+
+    @property
+    def shape(self):
+        return (self._num_samples, 1)
+
+    @property
+    def sampling_period(self):
+        return self._sampling_period
+
+    @property
+    def t_stop(self):
+        return self.t_start + self._num_samples * self.sampling_period
+
+    @property
+    def duration(self):
+        return self.t_stop - self.t_start
+
+    @property
+    def times(self):
+        "The times of the samples (doesn't load the samples themselves)"
+        return (self.t_start +
+                numpy.arange(self._num_samples) * self.sampling_period)
+
+    def load(self, time_slice=None, strict_slicing=False,
+             **kwargs):  # @UnusedVariable
+        """
+        Loads the signal (or a time slice of it) into a neo.AnalogSignal
+
+        Parameters
+        ----------
+        time_slice : tuple(quantities.Quantity (time)) | None
+            The start and stop times of the slice to load (either may be
+            None), the whole signal if None
+        strict_slicing : bool
+            Whether to raise an error if the time slice extends outside the
+            signal instead of clipping it to the signal (Neo's default)
+        """
+        start, stop = 0, self._num_samples
+        if time_slice is not None:
+            slice_start, slice_stop = time_slice
+            if slice_start is not None:
+                start = self._index(slice_start - self.t_start)
+            if slice_stop is not None:
+                stop = self._index(slice_stop - self.t_start)
+            if strict_slicing and (start < 0 or stop > self._num_samples):
+                raise Pype9UsageError(
+                    "Time slice ({}, {}) extends outside '{}' recording "
+                    "({}-{})".format(slice_start, slice_stop, self.name,
+                                     self.t_start, self.t_stop))
+            start = max(start, 0)
+            stop = min(stop, self._num_samples)
+        stop = max(start, stop)
+        values = self._dataset[self._offset + start:self._offset + stop]
+        return neo.AnalogSignal(
+            values, units=self.units, sampling_period=self.sampling_period,
+            t_start=self.t_start + start * self.sampling_period,
+            name=self.name)
+
+    def _index(self, offset):
+        # Round to avoid rounding errors in the times
+        return int(round(float((offset / self.sampling_period).simplified)))
+
+
+class SpikeTrainProxy(NeoSpikeTrainProxy):
+    """
+    Lazily loads a spike train from a RecordingStore. Derives from Neo's
+    SpikeTrainProxy so it can be held in neo.Segment objects
+
+    Parameters
+    ----------
+    dataset : h5py.Dataset
+        The dataset holding the spike times of the train (ms)
+    t_start : quantities.Quantity (time) | None
+        The start of the spike train, 0 ms if None
+    t_stop : quantities.Quantity (time) | None
+        The end of the spike train, the last spike if None
+    """
+
+    def __init__(self, dataset, t_start=None, t_stop=None):
+        self._dataset = dataset
+        self.units = pq.ms
+        self.dtype = dataset.dtype
+        self.t_start = pq.Quantity(t_start if t_start is not None else 0.0,
+                                   'ms')
+        if t_stop is None:
+            t_stop = (dataset[-1] if dataset.shape[0] else 0.0) * pq.ms
+        self.t_stop = pq.Quantity(t_stop, 'ms')
+        # Skip the initialisation of Neo's proxy, which reads the spike
+        # train properties from a RawIO object
+        BaseProxy.__init__(self, name=dataset.attrs['name'],
+                           file_origin=dataset.file.filename)
+
+    def __repr__(self):
+        return "<SpikeTrainProxy({}, {}-{})>".format(self.name, self.t_start,
+                                                     self.t_stop)
+
+    def __len__(self):
+        return len(self._slice(self.t_start, self.t_stop))
+
+    @property
+    def shape(self):
+        return (len(self),)
+
+    @property
+    def duration(self):
+        return self.t_stop - self.t_start
+
+    @property
+    def times(self):
+        "The spike times (loads the spike train)"
+        return self.load().times
+
+    def load(self, time_slice=None, strict_slicing=False,
+             **kwargs):  # @UnusedVariable
+        """
+        Loads the spike train (or a time slice of it) into a neo.SpikeTrain
+
+        Parameters
+        ----------
+        time_slice : tuple(quantities.Quantity (time)) | None
+            The start and stop times of the slice to load (either may be
+            None), the whole spike train if None
+        strict_slicing : bool
+            Whether to raise an error if the time slice extends outside the
+            spike train instead of clipping it to the spike train (Neo's
+            default)
+        """
+        t_start, t_stop = self.t_start, self.t_stop
+        if time_slice is not None:
+            slice_start, slice_stop = (
+                pq.Quantity(t, 'ms') if t is not None else None
+                for t in time_slice)
+            if strict_slicing and (
+                    (slice_start is not None and slice_start < t_start) or
+                    (slice_stop is not None and slice_stop > t_stop)):
+                raise Pype9UsageError(
+                    "Time slice ({}, {}) extends outside '{}' spike train "
+                    "({}-{})".format(slice_start, slice_stop, self.name,
+                                     self.t_start, self.t_stop))
+            if slice_start is not None:
+                t_start = max(t_start, slice_start)
+            if slice_stop is not None:
+                t_stop = min(t_stop, slice_stop)
+        return neo.SpikeTrain(self._slice(t_start, t_stop), units='ms',
+                              t_start=t_start, t_stop=max(t_start, t_stop),
+                              name=self.name)
+
+    def _slice(self, t_start, t_stop):
+        # Spike times are appended in order so the slice can be found with a
+        # binary search of the dataset
+        times = self._dataset
+        start = self._search(times, float(t_start.rescale(pq.ms)))
+        stop = self._search(times, float(t_stop.rescale(pq.ms)))
+        return times[start:max(start, stop)]
+
+    @classmethod
+    def _search(cls, times, t):
+        """
+        Returns the index of the first spike at or after time 't', reading
+        only the elements of the dataset required by the binary search
+        """
+        lo, hi = 0, times.shape[0]
+        while lo < hi:
+            mid = (lo + hi) // 2
+            if times[mid] < t:
+                lo = mid + 1
+            else:
+                hi = mid
+        return lo
@@ -11,6 +11,7 @@
 ##########################################################################
 from __future__ import absolute_import
 from builtins import object
+from past.builtins import basestring
 from future.utils import PY3
 import platform
 import os
@@ -28,7 +29,7 @@ from nineml import units
 from nineml.exceptions import NineMLNameError, NineMLSerializationError
 from pype9.exceptions import (
     Pype9BuildError, Pype9CommandNotFoundError, Pype9RuntimeError)
-from ..cells.with_synapses import read
+from ..cells.with_synapses import read, WithSynapses
 import pype9.annotations
 from pype9.annotations import PYPE9_NS, BUILD_PROPS
 from os.path import expanduser
@@ -38,6 +39,8 @@ import sysconfig
 from pype9 import __version__
 from pype9.utils.paths import remove_ignore_missing
 from pype9.utils.logging import logger
+from .cache import BuildCache, source_file
+from .hooks import code_gen_hooks
 
 BASE_BUILD_DIR = os.path.join(
     expanduser("~"),
@@ -54,6 +57,15 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
         base_dir : str | None
             The base directory for the generated code. If None a directory
             will be created in user's home directory.
+        use_cache : bool
+            Whether to store compiled libraries in, and restore them from, the
+            persistent build cache so that unchanged models aren't rebuilt
+            (only applies to the 'lazy', 'force', 'build_only' and 'purge'
+            build modes)
+        cache_dir : str | None
+            The directory of the build cache. If None it is read from the
+            PYPE9_CACHE_DIR environment variable, falling back to
+            '~/.pype9/cache'
     """
 
     BUILD_MODE_OPTIONS = ['lazy',  # Build iff source has been updated
@@ -84,11 +96,24 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
     # units
     DEFAULT_UNITS = {}
 
-    def __init__(self, base_dir=None, **kwargs):  # @UnusedVariable
+    # The integration schemes that can be selected with the 'solver' build
+    # option (see select_solver)
+    SOLVER_OPTIONS = ['auto',  # Select from the form of the time derivatives
+                      'exact',  # Exact (exponential) integration
+                      'explicit',  # Fixed-step explicit integration
+                      'implicit',  # Implicit integration for stiff dynamics
+                      'adaptive'  # Adaptive time-stepping
+                      ]
+
+    def __init__(self, base_dir=None, use_cache=True, cache_dir=None,
+                 **kwargs):  # @UnusedVariable
         if base_dir is None:
             base_dir = BASE_BUILD_DIR
         self._base_dir = os.path.join(
             base_dir, self.SIMULATOR_NAME + self.SIMULATOR_VERSION)
+        self._cache = BuildCache(cache_dir) if use_cache else None
+        # The code-generation hooks applied to the class being generated
+        self._hooks = []
 
     def __repr__(self):
         return "{}CodeGenerator(base_dir='{}')".format(
@@ -108,6 +133,39 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
     def base_dir(self):
         return self._base_dir
 
+    @property
+    def cache(self):
+        return self._cache
+
+    @property
+    def hooks(self):
+        "The code-generation hooks applied to the class being generated"
+        return self._hooks
+
+    def cache_dependencies(self):
+        """
+        Paths of the files (or directories of files) the generated code
+        depends on, which are included in the hashes of the build cache
+        (extended in derived classes if required)
+        """
+        return ([self.BASE_TMPL_PATH, source_file(type(self)),
+                 source_file(BaseCodeGenerator)] +
+                list(chain(*(h.cache_dependencies(self)
+                             for h in self._hooks))))
+
+    def cache_flags(self):
+        """
+        Compiler flags that are included in the hashes of the build cache
+        (extended in derived classes if required)
+        """
+        return self.hook_link_flags()
+
+    def hook_link_flags(self):
+        """
+        The additional linker flags required by the code-generation hooks
+        """
+        return list(chain(*(h.link_flags(self) for h in self._hooks)))
+
     @abstractmethod
     def generate_source_files(self, dynamics, src_dir, name, **kwargs):
         """
@@ -155,10 +213,22 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
         url : str
             The URL where the component class is stored (used to form the
             build path)
+        hooks : list(str) | None
+            The names of the registered code-generation hooks to apply to the
+            generated code (see pype9.simulate.common.code_gen.hooks)
         kwargs : dict
             A dictionary of (potentially simulator- specific) template
             arguments
         """
+        self._hooks = code_gen_hooks(kwargs.get('hooks', None),
+                                     simulator=self.SIMULATOR_NAME)
+        try:
+            return self._generate(component_class, build_mode=build_mode,
+                                  url=url, **kwargs)
+        finally:
+            self._hooks = []
+
+    def _generate(self, component_class, build_mode, url, **kwargs):
         # Save original working directory to reinstate it afterwards (just to
         # be polite)
         name = component_class.name
@@ -171,6 +241,20 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
         install_dir = self.get_install_dir(name, url)
         # Path of the build component class
         built_comp_class_pth = os.path.join(src_dir, self._BUILT_COMP_CLASS)
+        # Check the persistent build cache for an identical build
+        cache_key = None
+        if self._cache is not None and build_mode in ('lazy', 'force',
+                                                      'build_only', 'purge'):
+            cache_key = self._cache.key(component_class, self, **kwargs)
+            if build_mode == 'lazy':
+                if self._cache.read_stamp(install_dir) == cache_key:
+                    logger.info("Found up-to-date build of '{}' in '{}', code "
+                                "generation and compilation skipped"
+                                .format(name, install_dir))
+                    return install_dir
+                elif self._cache.entry(cache_key) is not None:
+                    self._cache.restore(cache_key, install_dir)
+                    return install_dir
         # Determine whether the installation needs rebuilding or whether there
         # is an existing library module to use.
         if build_mode == 'purge':
@@ -230,6 +314,8 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
                 compile_dir=compile_dir,
                 install_dir=install_dir,
                 **kwargs)
+            for hook in self._hooks:
+                hook.post_generate(self, component_class, src_dir, **kwargs)
             component_class.write(built_comp_class_pth,
                                   preserve_order=True, version=2.0)
         if compile_source:
@@ -242,6 +328,9 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
                     install_dir=install_dir, **kwargs)
                 self.clean_install_dir(install_dir)
             self.compile_source_files(compile_dir, name)
+            if cache_key is not None:
+                self._cache.store(cache_key, install_dir, name, url,
+                                  self.SIMULATOR_NAME)
         # Switch back to original dir
         os.chdir(orig_dir)
         # Cache any dimension maps that were calculated during the generation
@@ -298,10 +387,14 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
 
     def render_to_file(self, template, args, filename, directory, switches={},
                        post_hoc_subs={}):
-        # Initialise the template loader to include the flag directories
-        template_paths = [
+        # Initialise the template loader to include the flag directories,
+        # after the directories of the code-generation hooks so they can
+        # override the templates
+        template_paths = list(chain(*(h.template_dirs(self)
+                                      for h in self._hooks)))
+        template_paths.extend([
             self.BASE_TMPL_PATH,
-            os.path.join(self.BASE_TMPL_PATH, 'includes')]
+            os.path.join(self.BASE_TMPL_PATH, 'includes')])
         # Add include paths for various switches (e.g. solver type)
         for name, value in list(switches.items()):
             if value is not None:
@@ -316,10 +409,17 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
                                 undefined=StrictUndefined)
         # Add some globals used by the template code
         jinja_env.globals.update(**self._globals)
+        # Add the template arguments provided by the code-generation hooks
+        if self._hooks:
+            args = dict(args)
+            for hook in self._hooks:
+                args.update(hook.template_args(self, template, args))
         # Actually render the contents
         contents = jinja_env.get_template(template).render(**args)
         for old, new in list(post_hoc_subs.items()):
             contents = contents.replace(old, new)
+        for hook in self._hooks:
+            contents = hook.post_render(self, template, filename, contents)
         # Write the contents to file
         with open(os.path.join(directory, filename), 'w') as f:
             f.write(contents)
@@ -405,6 +505,81 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
         self._set_build_props(component_class, **kwargs)
         return component_class
 
+    def select_solver(self, component_class, solver=None):
+        """
+        Selects the integration scheme used for the time derivatives of the
+        component class from the 'solver' build option. If 'auto', exact
+        (exponential) integration is selected if each time derivative is
+        linear in its state variable (e.g. subthreshold or Hodgkin-Huxley
+        dynamics), otherwise the nonlinearity is taken as a hint that the
+        dynamics are stiff and an implicit scheme is selected.
+
+        Parameters
+        ----------
+        component_class : Dynamics | MultiDynamics | WithSynapses
+            The (build) component class to integrate
+        solver : str | None
+            One of the SOLVER_OPTIONS or None for the default scheme of the
+            simulator
+
+        Returns
+        -------
+        solver : str | None
+            The selected integration scheme (None for the default scheme of
+            the simulator)
+        """
+        if solver is None:
+            return None
+        if solver not in self.SOLVER_OPTIONS:
+            raise Pype9BuildError(
+                "Unrecognised solver '{}', can be one of '{}'"
+                .format(solver, "', '".join(self.SOLVER_OPTIONS)))
+        if solver in ('auto', 'exact'):
+            nonlinear = self.nonlinear_state_variables(component_class)
+            if solver == 'exact' and nonlinear:
+                raise Pype9BuildError(
+                    "Cannot integrate '{}' exactly as the time derivatives of "
+                    "'{}' are not linear in their state variables".format(
+                        component_class.name, "', '".join(nonlinear)))
+            elif nonlinear:
+                logger.info(
+                    "Selecting implicit solver for '{}' as the time "
+                    "derivatives of '{}' are not linear in their state "
+                    "variables".format(component_class.name,
+                                       "', '".join(nonlinear)))
+                solver = 'implicit'
+            else:
+                solver = 'exact'
+        return solver
+
+    @classmethod
+    def nonlinear_state_variables(cls, component_class):
+        """
+        Returns the names of the state variables that have a time derivative
+        (in any regime) that is not linear in the state variable, after the
+        aliases have been substituted into it
+
+        Parameters
+        ----------
+        component_class : Dynamics | MultiDynamics | WithSynapses
+            The component class to check the time derivatives of
+        """
+        if isinstance(component_class, WithSynapses):
+            component_class = component_class.dynamics
+        component_class = component_class.flatten()
+        aliases = dict((sympy.Symbol(a.lhs), sympy.sympify(a.rhs))
+                       for a in component_class.aliases)
+        nonlinear = set()
+        for regime in component_class.regimes:
+            for td in regime.time_derivatives:
+                rhs = sympy.sympify(td.rhs)
+                while rhs.free_symbols & set(aliases):
+                    rhs = rhs.xreplace(aliases)
+                if sympy.simplify(sympy.diff(
+                        rhs, sympy.Symbol(td.variable), 2)) != 0:
+                    nonlinear.add(td.variable)
+        return sorted(nonlinear)
+
     def _set_build_props(self, component_class, **build_props):
         """
         Sets the build properties in the component class annotations
@@ -417,6 +592,16 @@ class BaseCodeGenerator(with_metaclass(ABCMeta, object)):
             Build properties to save into the annotations of the build
             component class
         """
+        # The solver and hooks are always saved (even when not provided) so
+        # that classes built with different solvers or hooks, which generate
+        # different code, don't compare equal when the built classes are
+        # checked for name clashes
+        solver = build_props.pop('solver', None)
+        hooks = build_props.pop('hooks', None)
+        if isinstance(hooks, basestring):
+            hooks = [hooks]
+        build_props['solver'] = solver if solver is not None else 'default'
+        build_props['hooks'] = ','.join(hooks) if hooks else 'none'
         for k, v in list(build_props.items()) + [
                 ('version', pype9.__version__)]:
             component_class.annotations.set((BUILD_PROPS, PYPE9_NS), k, v)
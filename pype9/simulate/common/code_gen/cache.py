@@ -0,0 +1,290 @@
+"""
+  A persistent, content-addressed cache of compiled simulator libraries, which
+  is shared between sessions so that unchanged models can skip code
+  generation and compilation entirely.
+
+  Entries are keyed by a hash of the serialized (build) component class, the
+  code-generation templates and module of the simulator backend, the
+  simulator and Pype9 versions, and the build options/compiler flags.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from builtins import object
+import os
+import time
+import json
+import shutil
+import hashlib
+import inspect
+import sysconfig
+from os.path import expanduser
+from pype9 import __version__
+from pype9.exceptions import Pype9BuildError
+from pype9.utils.paths import remove_ignore_missing
+from pype9.utils.logging import logger
+
+BASE_CACHE_DIR = os.path.join(expanduser("~"), '.pype9', 'cache')
+
+
+class BuildCacheEntry(object):
+    """
+    A compiled library stored in the build cache
+
+    Parameters
+    ----------
+    key : str
+        The content hash the entry is stored under
+    path : str
+        The path of the entry directory
+    meta : dict(str, object)
+        Metadata describing the entry (name, url, simulator and time it was
+        created)
+    """
+
+    def __init__(self, key, path, meta):
+        self.key = key
+        self.path = path
+        self.name = meta.get('name')
+        self.url = meta.get('url')
+        self.simulator = meta.get('simulator')
+        self.created = meta.get('created', 0.0)
+        self.last_used = meta.get('last_used', self.created)
+
+    @property
+    def install_dir(self):
+        return os.path.join(self.path, BuildCache._INSTALL_DIR)
+
+    @property
+    def size(self):
+        "The size of the entry on disk in bytes"
+        size = 0
+        for dpath, _, fnames in os.walk(self.path):
+            for fname in fnames:
+                fpath = os.path.join(dpath, fname)
+                if not os.path.islink(fpath):
+                    size += os.path.getsize(fpath)
+        return size
+
+    def __repr__(self):
+        return "BuildCacheEntry(key='{}', name='{}', simulator='{}')".format(
+            self.key, self.name, self.simulator)
+
+
+class BuildCache(object):
+    """
+    Content-addressed cache of compiled simulator libraries
+
+    Parameters
+    ----------
+    root : str | None
+        The directory the cache is stored in. If None it is read from the
+        PYPE9_CACHE_DIR environment variable, falling back to
+        '~/.pype9/cache'
+    """
+
+    _INSTALL_DIR = 'install'
+    _META_FNAME = 'meta.json'
+    # Written to install directories to record the key they were built from
+    STAMP_FNAME = '.pype9_build_key'
+
+    def __init__(self, root=None):
+        if root is None:
+            root = os.environ.get('PYPE9_CACHE_DIR', BASE_CACHE_DIR)
+        self._root = root
+
+    def __repr__(self):
+        return "BuildCache(root='{}')".format(self.root)
+
+    def __eq__(self, other):
+        try:
+            return self.root == other.root
+        except AttributeError:
+            return False
+
+    def __ne__(self, other):
+        return not self.__eq__(other)
+
+    @property
+    def root(self):
+        return self._root
+
+    def key(self, component_class, code_generator, **build_kwargs):
+        """
+        Calculates the content hash of a build
+
+        Parameters
+        ----------
+        component_class : nineml.Dynamics
+            The build component class
+        code_generator : BaseCodeGenerator
+            The code generator used to build the component class
+        build_kwargs : dict(str, object)
+            The template arguments passed to the code generator
+        """
+        sha = hashlib.sha1()
+        sha.update(component_class.serialize(
+            format='xml', version=2, to_str=True).encode('utf-8'))
+        update_with_paths(sha, code_generator.cache_dependencies())
+        for item in ([code_generator.SIMULATOR_NAME,
+                      code_generator.SIMULATOR_VERSION, __version__,
+                      sysconfig.get_config_var('py_version')] +
+                     list(code_generator.cache_flags()) +
+                     ['{}={}'.format(k, repr(v))
+                      for k, v in sorted(build_kwargs.items())]):
+            sha.update(str(item).encode('utf-8'))
+        return sha.hexdigest()
+
+    def entry(self, key):
+        """
+        Returns the cache entry stored under the key or None if it isn't
+        present
+        """
+        path = os.path.join(self.root, key)
+        meta_path = os.path.join(path, self._META_FNAME)
+        if not os.path.exists(meta_path):
+            return None
+        with open(meta_path) as f:
+            meta = json.load(f)
+        return BuildCacheEntry(key, path, meta)
+
+    def entries(self):
+        "Returns all entries in the cache sorted by their creation time"
+        if not os.path.exists(self.root):
+            return []
+        entries = (self.entry(k) for k in os.listdir(self.root))
+        return sorted((e for e in entries if e is not None),
+                      key=lambda e: e.created)
+
+    def store(self, key, install_dir, name, url, simulator):
+        """
+        Copies a freshly compiled install directory into the cache
+
+        Parameters
+        ----------
+        key : str
+            The content hash of the build
+        install_dir : str
+            The install directory to copy into the cache
+        name : str
+            The name of the built component class
+        url : str
+            The URL of the built component class
+        simulator : str
+            The name of the simulator the library was built for
+        """
+        path = os.path.join(self.root, key)
+        tmp_path = path + '.tmp{}'.format(os.getpid())
+        remove_ignore_missing(tmp_path)
+        try:
+            shutil.copytree(install_dir,
+                            os.path.join(tmp_path, self._INSTALL_DIR),
+                            symlinks=True)
+            now = time.time()
+            with open(os.path.join(tmp_path, self._META_FNAME), 'w') as f:
+                json.dump({'name': name, 'url': url, 'simulator': simulator,
+                           'created': now, 'last_used': now}, f)
+            remove_ignore_missing(path)
+            os.rename(tmp_path, path)
+        except (OSError, IOError, shutil.Error) as e:
+            remove_ignore_missing(tmp_path)
+            # Failing to cache a build shouldn't stop the build
+            logger.warning("Could not store '{}' build in cache at '{}': {}"
+                           .format(name, path, e))
+            return
+        self.stamp(install_dir, key)
+        logger.debug("Stored '{}' build in cache at '{}'".format(name, path))
+
+    def restore(self, key, install_dir):
+        """
+        Copies a cached build into the install directory
+
+        Parameters
+        ----------
+        key : str
+            The content hash of the build
+        install_dir : str
+            The install directory to copy the cached build into
+        """
+        entry = self.entry(key)
+        if entry is None:
+            raise Pype9BuildError(
+                "No entry for '{}' in build cache at '{}'"
+                .format(key, self.root))
+        remove_ignore_missing(install_dir)
+        shutil.copytree(entry.install_dir, install_dir, symlinks=True)
+        self.stamp(install_dir, key)
+        self._touch(entry)
+        logger.info("Restored '{}' build from cache entry '{}'"
+                    .format(entry.name, entry.path))
+
+    def purge(self, entries=None):
+        """
+        Removes entries from the cache
+
+        Parameters
+        ----------
+        entries : list(BuildCacheEntry) | None
+            The entries to remove. If None all entries are removed
+        """
+        if entries is None:
+            entries = self.entries()
+        for entry in entries:
+            remove_ignore_missing(entry.path)
+        return entries
+
+    @classmethod
+    def stamp(cls, install_dir, key):
+        "Records the key an install directory was built from"
+        with open(os.path.join(install_dir, cls.STAMP_FNAME), 'w') as f:
+            f.write(key)
+
+    @classmethod
+    def read_stamp(cls, install_dir):
+        "Reads the key an install directory was built from (if present)"
+        try:
+            with open(os.path.join(install_dir, cls.STAMP_FNAME)) as f:
+                return f.read().strip()
+        except (OSError, IOError):
+            return None
+
+    def _touch(self, entry):
+        meta_path = os.path.join(entry.path, self._META_FNAME)
+        with open(meta_path) as f:
+            meta = json.load(f)
+        meta['last_used'] = time.time()
+        with open(meta_path, 'w') as f:
+            json.dump(meta, f)
+
+
+def update_with_paths(sha, paths):
+    """
+    Updates a hash with the relative paths and contents of the files in the
+    given paths (directories are walked recursively)
+
+    Parameters
+    ----------
+    sha : hashlib hash
+        The hash to update
+    paths : list(str)
+        Paths of the files and directories to add to the hash
+    """
+    for path in paths:
+        if os.path.isdir(path):
+            fpaths = sorted(
+                os.path.join(d, f) for d, _, fnames in os.walk(path)
+                for f in fnames)
+        else:
+            fpaths = [path]
+        for fpath in fpaths:
+            sha.update(os.path.relpath(fpath, path).encode('utf-8'))
+            with open(fpath, 'rb') as f:
+                sha.update(f.read())
+
+
+def source_file(cls):
+    "The path of the source file a class is defined in"
+    return inspect.getsourcefile(cls)
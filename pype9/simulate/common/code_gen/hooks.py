@@ -0,0 +1,267 @@
+"""
+  Plugin mechanism for extending the Jinja2-based code generators without
+  modifying Pype9, e.g. to override templates, inject custom NMODL VERBATIM
+  blocks, add metadata to NEST models or link extra libraries.
+
+  Hooks are registered by decorating the hooks class, e.g.::
+
+      @register_code_gen_hooks
+      class Profiling(CodeGenHooks):
+
+          name = 'profiling'
+          simulators = ('neuron',)
+
+          def post_render(self, code_generator, template, filename,
+                          contents):
+              if filename.endswith('.mod'):
+                  contents = contents.replace('INITIAL {',
+                                              VERBATIM_BLOCK + 'INITIAL {')
+              return contents
+
+  or by installed packages, which list the hooks classes under the
+  'pype9.code_gen_hooks' entry-point group in their setup.py, e.g.::
+
+      entry_points={
+          'pype9.code_gen_hooks': ['profiling = my_package:Profiling']}
+
+  and are selected per component class by passing their names to the 'hooks'
+  argument of the CellMetaClass (or the code generator's 'generate' method).
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from builtins import object
+from past.builtins import basestring
+from pype9.exceptions import Pype9UsageError
+from pype9.utils.logging import logger
+from .cache import source_file
+
+# The entry-point group installed packages register hooks classes under
+ENTRY_POINT_GROUP = 'pype9.code_gen_hooks'
+
+_HOOKS = {}
+_entry_points_loaded = False
+
+
+def register_code_gen_hooks(hooks_cls):
+    """
+    Registers a code-generation hooks class (can be used as a decorator)
+
+    Parameters
+    ----------
+    hooks_cls : type
+        A subclass of CodeGenHooks
+    """
+    if not (isinstance(hooks_cls, type) and
+            issubclass(hooks_cls, CodeGenHooks)):
+        raise Pype9UsageError(
+            "Code-generation hooks must derive from CodeGenHooks ({})"
+            .format(hooks_cls))
+    if hooks_cls.name is None:
+        raise Pype9UsageError(
+            "Code-generation hooks {} don't define a name".format(hooks_cls))
+    _HOOKS[hooks_cls.name] = hooks_cls()
+    return hooks_cls
+
+
+def unregister_code_gen_hooks(name):
+    "Removes code-generation hooks from the registry"
+    try:
+        del _HOOKS[name]
+    except KeyError:
+        raise Pype9UsageError(
+            "No code-generation hooks named '{}' are registered".format(name))
+
+
+def registered_code_gen_hooks():
+    """
+    The names of the registered code-generation hooks (including those
+    provided by the entry points of installed packages)
+    """
+    _load_entry_points()
+    return sorted(_HOOKS)
+
+
+def code_gen_hooks(names, simulator=None):
+    """
+    Returns the registered hooks with the given names
+
+    Parameters
+    ----------
+    names : list(str) | str | None
+        The names of the hooks to return (in the order they are applied)
+    simulator : str | None
+        The name of the simulator the code is generated for, which is
+        checked against the simulators the hooks support
+    """
+    if not names:
+        return []
+    if isinstance(names, basestring):
+        names = [names]
+    _load_entry_points()
+    hooks = []
+    for name in names:
+        try:
+            hook = _HOOKS[name]
+        except KeyError:
+            raise Pype9UsageError(
+                "No code-generation hooks named '{}' are registered "
+                "(registered hooks '{}')".format(
+                    name, "', '".join(sorted(_HOOKS))))
+        if (simulator is not None and hook.simulators is not None and
+                simulator not in hook.simulators):
+            raise Pype9UsageError(
+                "'{}' code-generation hooks don't support {} (only '{}')"
+                .format(name, simulator, "', '".join(hook.simulators)))
+        hooks.append(hook)
+    return hooks
+
+
+def _load_entry_points():
+    """
+    Registers the hooks classes listed under the 'pype9.code_gen_hooks'
+    entry-point group of installed packages (only loaded once)
+    """
+    global _entry_points_loaded
+    if _entry_points_loaded:
+        return
+    _entry_points_loaded = True
+    try:
+        from pkg_resources import iter_entry_points
+    except ImportError:
+        return
+    for entry_point in iter_entry_points(ENTRY_POINT_GROUP):
+        try:
+            hooks_cls = entry_point.load()
+            if hooks_cls.name is None:
+                hooks_cls.name = entry_point.name
+            if hooks_cls.name not in _HOOKS:
+                register_code_gen_hooks(hooks_cls)
+        except Exception as e:
+            # A broken plugin shouldn't stop models being built without it
+            logger.warning("Could not load '{}' code-generation hooks from "
+                           "'{}': {}".format(entry_point.name,
+                                             entry_point.module_name, e))
+
+
+class CodeGenHooks(object):
+    """
+    Base class of plugins that extend the code generators, all of the methods
+    of which are optional and can be overridden as required
+
+    Derived classes must define the 'name' class attribute, which the hooks
+    are selected with, and can restrict the simulators they support with the
+    'simulators' attribute (None for all simulators)
+    """
+
+    name = None
+    simulators = None
+
+    def __repr__(self):
+        return "{}(name='{}')".format(type(self).__name__, self.name)
+
+    def template_dirs(self, code_generator):  # @UnusedVariable
+        """
+        Directories that are searched for templates before the directories of
+        the code generator, which can be used to override any of its
+        templates or the templates included by them (e.g. 'main.tmpl' or
+        'solver_update.tmpl')
+
+        Parameters
+        ----------
+        code_generator : BaseCodeGenerator
+            The code generator rendering the templates
+        """
+        return []
+
+    def template_args(self, code_generator, template, args):  # @UnusedVariable @IgnorePep8
+        """
+        Additional arguments (or replacements of the existing arguments) that
+        are passed to the template, e.g. for use in overridden templates
+
+        Parameters
+        ----------
+        code_generator : BaseCodeGenerator
+            The code generator rendering the template
+        template : str
+            The name of the template being rendered
+        args : dict(str, object)
+            The arguments the template is rendered with
+        """
+        return {}
+
+    def post_render(self, code_generator, template, filename, contents):  # @UnusedVariable @IgnorePep8
+        """
+        Post-processes the rendered contents of a generated file before it
+        is written
+
+        Parameters
+        ----------
+        code_generator : BaseCodeGenerator
+            The code generator that rendered the template
+        template : str
+            The name of the rendered template
+        filename : str
+            The name of the file the contents are written to
+        contents : str
+            The rendered contents
+
+        Returns
+        -------
+        contents : str
+            The post-processed contents
+        """
+        return contents
+
+    def post_generate(self, code_generator, component_class, src_dir,
+                      **kwargs):
+        """
+        Called after the source files have been generated and before they are
+        compiled, e.g. to write additional source or metadata files into the
+        source directory
+
+        Parameters
+        ----------
+        code_generator : BaseCodeGenerator
+            The code generator that generated the source files
+        component_class : Dynamics | MultiDynamics | WithSynapses
+            The build component class the source files were generated for
+        src_dir : str
+            The directory the source files were generated in
+        kwargs : dict(str, object)
+            The build options
+        """
+        pass
+
+    def link_flags(self, code_generator):  # @UnusedVariable
+        """
+        Additional flags passed to the linker when the generated code is
+        compiled, e.g. ['-L/opt/mylib/lib', '-lmylib']
+
+        Parameters
+        ----------
+        code_generator : BaseCodeGenerator
+            The code generator compiling the generated code
+        """
+        return []
+
+    def cache_dependencies(self, code_generator):
+        """
+        Paths of the files (or directories of files) the code generated with
+        the hooks depends on, which are included in the hashes of the build
+        cache
+
+        Parameters
+        ----------
+        code_generator : BaseCodeGenerator
+            The code generator the hooks are applied to
+        """
+        try:
+            dependencies = [source_file(type(self))]
+        except TypeError:
+            # Hooks defined interactively don't have a source file
+            dependencies = []
+        return dependencies + list(self.template_dirs(code_generator))
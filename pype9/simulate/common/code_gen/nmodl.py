@@ -0,0 +1,386 @@
+"""
+  Simulator-agnostic parts of the NMODL code generation, which are shared
+  between the backends that compile NMODL mechanisms (i.e. NEURON and Arbor).
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2014 Thomas G. Close.
+  License: This file is part of the "NineLine" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import unicode_literals
+from builtins import next
+from itertools import chain
+from collections import defaultdict
+import sympy
+import nineml.units as un
+from nineml.abstraction import Alias, AnalogSendPort, Dynamics
+from nineml.abstraction import (StateAssignment, Parameter, StateVariable,
+                                Constant, Expression)
+from nineml.abstraction.dynamics.visitors.queriers import (
+    DynamicsInterfaceInferer)
+from sympy.printing import ccode
+from pype9.simulate.common.cells import (
+    WithSynapses, DynamicsWithSynapses)
+from pype9.exceptions import (
+    Pype9BuildError, Pype9RuntimeError, Pype9Unsupported9MLException)
+from pype9.annotations import (
+    PYPE9_NS, ION_SPECIES, MEMBRANE_VOLTAGE, MEMBRANE_CAPACITANCE,
+    TRANSFORM_SRC, NONSPECIFIC_CURRENT, BUILD_TRANS,
+    EXTERNAL_CURRENTS, NO_TIME_DERIVS,
+    NUM_TIME_DERIVS, MECH_TYPE, FULL_CELL_MECH, SUB_COMPONENT_MECH,
+    ARTIFICIAL_CELL_MECH)
+from .base import BaseCodeGenerator
+from .cache import source_file
+from pype9.utils.logging import logger
+
+
+class BaseNMODLCodeGenerator(BaseCodeGenerator):
+    """
+    Base class for code generators that translate 9ML Dynamics into NMODL
+    mechanisms. The build transform maps the membrane voltage onto NMODL's
+    hard-coded 'v' and replaces its time derivative with a membrane current.
+    """
+
+    def cache_dependencies(self):
+        return (super(BaseNMODLCodeGenerator, self).cache_dependencies() +
+                [source_file(BaseNMODLCodeGenerator)])
+
+    def transform_for_build(self, name, component_class, **kwargs):
+        """
+        Copies and transforms the component class to match the format of the
+        simulator (overridden in derived class)
+
+        Parameters
+        ----------
+        name : str
+            The name of the transformed component class
+        component_class : nineml.Dynamics
+            The component class to be transformed
+        """
+        self._set_build_props(component_class, **kwargs)
+        if not isinstance(component_class, WithSynapses):
+            raise Pype9RuntimeError(
+                "'component_class' must be a DynamicsWithSynapses object")
+        # ---------------------------------------------------------------------
+        # Clone original component class
+        # ---------------------------------------------------------------------
+        trfrm = component_class.dynamics.flatten()
+        # ---------------------------------------------------------------------
+        # Get the membrane voltage and convert it to 'v'
+        # ---------------------------------------------------------------------
+        try:
+            name = kwargs['membrane_voltage']
+            try:
+                orig_v = component_class.element(
+                    name, nineml_children=Dynamics.nineml_children)
+            except KeyError:
+                raise Pype9BuildError(
+                    "Could not find specified membrane voltage '{}'"
+                    .format(name))
+        except KeyError:  # Guess voltage from its dimension if not supplied
+            candidate_vs = [cv for cv in component_class.state_variables
+                            if cv.dimension == un.voltage]
+            if len(candidate_vs) == 0:
+                candidate_vs = [
+                    cv for cv in component_class.analog_receive_ports
+                    if cv.dimension == un.voltage]
+            if len(candidate_vs) == 1:
+                orig_v = candidate_vs[0]
+                logger.info("Guessing that '{}' is the membrane voltage"
+                            .format(orig_v))
+            elif len(candidate_vs) > 1:
+                try:
+                    orig_v = next(c for c in candidate_vs if c.name == 'v')
+                    logger.info("Guessing that '{}' is the membrane voltage"
+                                .format(orig_v))
+                except StopIteration:
+                    raise Pype9BuildError(
+                        "Could not guess the membrane voltage, candidates: "
+                        "'{}'" .format("', '".join(v.name
+                                                   for v in candidate_vs)))
+            else:
+                orig_v = None
+                logger.info(
+                    "Can't find candidate for the membrane voltage in "
+                    "state_variables '{}' or analog_receive_ports '{}', "
+                    "treating '{}' as an \"artificial cell\"".format(
+                        "', '".join(
+                            sv.name for sv in component_class.state_variables),
+                        "', '".join(
+                            p.name
+                            for p in component_class.analog_receive_ports),
+                        component_class.name))
+        if orig_v is not None:
+            # Map voltage to hard-coded 'v' symbol
+            if orig_v.name != 'v':
+                trfrm.rename_symbol(orig_v.name, 'v')
+            if isinstance(orig_v, StateVariable):
+                v = trfrm.state_variable('v')
+            else:
+                v = trfrm.analog_receive_port('v')
+            if orig_v.name != 'v':
+                v.annotations.set((BUILD_TRANS, PYPE9_NS),
+                                  TRANSFORM_SRC, orig_v)
+            # Add annotations to the original and build models
+            component_class.annotations.set((BUILD_TRANS, PYPE9_NS),
+                                            MEMBRANE_VOLTAGE, orig_v.name)  # @IgnorePep8
+            trfrm.annotations.set((BUILD_TRANS, PYPE9_NS),
+                                  MEMBRANE_VOLTAGE, 'v')
+            # Remove associated analog send port if present
+            try:
+                trfrm.remove(trfrm.analog_send_port('v'))
+            except KeyError:
+                pass
+            # Need to convert to AnalogReceivePort if v is a StateVariable
+            if isinstance(v, StateVariable):
+                self._transform_full_component(trfrm, component_class, v,
+                                               **kwargs)
+                trfrm.annotations.set((BUILD_TRANS, PYPE9_NS),
+                                      MECH_TYPE, FULL_CELL_MECH)
+            else:
+                # The voltage is received from the section the mechanism is
+                # inserted into (e.g. ion channels distributed over the
+                # sections of a multi-compartmental cell)
+                self._transform_sub_component(trfrm, component_class)
+                trfrm.annotations.set((BUILD_TRANS, PYPE9_NS),
+                                      MECH_TYPE, SUB_COMPONENT_MECH)
+        else:
+            trfrm.annotations.set((BUILD_TRANS, PYPE9_NS), MECH_TYPE,
+                                  ARTIFICIAL_CELL_MECH)
+
+        # -----------------------------------------------------------------
+        # Insert dummy aliases for parameters (such as capacitance) that
+        # now do not show up in the inferred interface for the transformed
+        # class (i.e. that were only # present in the voltage time derivative)
+        # -----------------------------------------------------------------
+
+        # Infer required parameters
+        inferred = DynamicsInterfaceInferer(trfrm)
+
+        for parameter in list(trfrm.parameters):
+            if parameter.name not in inferred.parameter_names:
+                trfrm.add(Alias(parameter.name + '___dummy', parameter.name))
+
+        # -----------------------------------------------------------------
+        # Validate the transformed component class and construct prototype
+        # -----------------------------------------------------------------
+
+        trfrm.validate()
+        trfrm_with_syn = DynamicsWithSynapses(
+            name, trfrm, component_class.synapses,
+            component_class.connection_parameter_sets)
+        # Retun a prototype of the transformed class
+        return trfrm_with_syn
+
+    def _transform_full_component(self, trfrm, component_class, v, **kwargs):
+        # -----------------------------------------------------------------
+        # Remove all analog send ports with 'current' dimension so they
+        # don't get confused with the converted voltage time derivative
+        # expression
+        # -----------------------------------------------------------------
+        for port in list(trfrm.analog_send_ports):
+            if port.dimension == un.current:
+                trfrm.remove(port)
+        # -----------------------------------------------------------------
+        # Insert membrane capacitance if not present
+        # -----------------------------------------------------------------
+        # Get or guess the location of the membrane capacitance
+        try:
+            name = kwargs['membrane_capacitance']
+            try:
+                orig_cm = component_class.parameter(name)
+            except KeyError:
+                raise Pype9BuildError(
+                    "Could not find specified membrane capacitance '{}'"
+                    .format(name))
+            cm = trfrm.parameter(orig_cm.name)
+        except KeyError:  # 'membrane_capacitance' was not specified
+            candidate_cms = [ccm for ccm in component_class.parameters
+                             if ccm.dimension == un.capacitance]
+            if len(candidate_cms) == 1:
+                orig_cm = candidate_cms[0]
+                cm = trfrm.parameter(orig_cm.name)
+                logger.info("Guessing that '{}' is the membrane capacitance"
+                            .format(orig_cm))
+            elif len(candidate_cms) > 1:
+                raise Pype9BuildError(
+                    "Could not guess the membrane capacitance, candidates:"
+                    " '{}'".format("', '".join(candidate_cms)))
+            else:
+                cm = Parameter("cm___pype9", dimension=un.capacitance)
+                trfrm.add(cm)
+            cm.annotations.set((BUILD_TRANS, PYPE9_NS), TRANSFORM_SRC, None)
+        trfrm.annotations.set((BUILD_TRANS, PYPE9_NS),
+                              MEMBRANE_CAPACITANCE, cm.name)
+        # -----------------------------------------------------------------
+        # Replace membrane voltage equation with membrane current
+        # -----------------------------------------------------------------
+        # Determine the regimes in which each state variables has a time
+        # derivative in
+        has_td = defaultdict(list)
+        # List which regimes need to be clamped to their last voltage
+        # (as it has no time derivative)
+        clamped_regimes = []
+        # The voltage clamp equation where v_clamp is the last voltage
+        # value and g_clamp_ is a large conductance
+        clamp_i = sympy.sympify('g_clamp___pype9 * (v - v_clamp___pype9)')
+        memb_is = []
+        for regime in trfrm.regimes:
+            # Add an appropriate membrane current
+            try:
+                # Convert the voltage time derivative into a membrane
+                # current
+                dvdt = regime.time_derivative(v.name)
+                regime.remove(dvdt)
+                i = -dvdt.rhs * cm
+                memb_is.append(i)
+            except KeyError:
+                i = clamp_i
+                clamped_regimes.append(regime)
+            regime.add(Alias('i___pype9', i))
+            # Record state vars that have a time deriv. in this regime
+            for var in regime.time_derivative_variables:
+                if var != 'v':
+                    has_td[var].append(regime)
+        # Pick the most popular membrane current to be the alias in
+        # the global scope
+        assert memb_is, "No regimes contain voltage time derivatives"
+        memb_i = Alias('i___pype9', max(memb_is, key=memb_is.count))
+        # Add membrane current along with a analog send port
+        trfrm.add(memb_i)
+        i_port = AnalogSendPort('i___pype9', dimension=un.current)
+        i_port.annotations.set((BUILD_TRANS, PYPE9_NS), ION_SPECIES,
+                               NONSPECIFIC_CURRENT)
+        trfrm.add(i_port)
+        # Remove membrane currents that match the membrane current in the
+        # outer scope
+        for regime in trfrm.regimes:
+            if regime.alias('i___pype9') == memb_i:
+                regime.remove(regime.alias('i___pype9'))
+        # If there are clamped regimes add extra parameters and set the
+        # voltage to clamp to in the regimes that trfrmition to them
+        if clamped_regimes:
+            trfrm.add(StateVariable('v_clamp___pype9', un.voltage))
+            trfrm.add(Constant('g_clamp___pype9', 1e8, un.uS))
+            for trans in trfrm.transitions:
+                if trans.target_regime in clamped_regimes:
+                    # Assign v_clamp_ to the value
+                    try:
+                        v_clamp_rhs = trans.state_assignment('v').rhs
+                    except KeyError:
+                        v_clamp_rhs = 'v'
+                    trans.add(StateAssignment('v_clamp___pype9',
+                                              v_clamp_rhs))
+        # -----------------------------------------------------------------
+        trfrm.annotations.set(
+            (BUILD_TRANS, PYPE9_NS), NO_TIME_DERIVS,
+            ','.join(['v'] + [sv for sv in trfrm.state_variable_names
+                              if sv not in has_td]))
+        trfrm.annotations.set((BUILD_TRANS, PYPE9_NS), NUM_TIME_DERIVS,
+                              len(has_td))
+        # -----------------------------------------------------------------
+        # Remove the external input currents
+        # -----------------------------------------------------------------
+        # Analog receive or reduce ports that are of dimension current and
+        # are purely additive to the membrane current and nothing else
+        # (actually subtractive as it is outward current)
+        try:
+            ext_is = []
+            for i_name in kwargs['external_currents']:
+                try:
+                    ext_i = trfrm.analog_receive_port(i_name)
+                except KeyError:
+                    try:
+                        ext_i = trfrm.analog_reduce_port(i_name)
+                    except KeyError:
+                        raise Pype9BuildError(
+                            "Did not find specified external current port "
+                            "'{}'".format(i_name))
+                if ext_i.dimension != un.current:
+                    raise Pype9BuildError(
+                        "Analog receive port matching specified external "
+                        "current '{}' does not have 'current' dimension "
+                        "({})".format(ext_i.name, ext_i.dimension))
+                ext_is.append(ext_i)
+        except KeyError:
+            ext_is = []
+            for port in chain(component_class.analog_receive_ports,
+                              component_class.analog_reduce_ports):
+                # Check to see if the receive/reduce port has current dimension
+                if port.dimension != un.current:
+                    continue
+                # Check to see if the current appears in the membrane current
+                # expression
+                # FIXME: This test should check to to see if the port is
+                #        additive to the membrane current and substitute all
+                #        aliases.
+                if port.name not in memb_i.rhs_symbol_names:
+                    continue
+                # Get the number of expressions the receive port appears in
+                # an expression
+                if len([e for e in component_class.all_expressions
+                        if port.symbol in e.free_symbols]) > 1:
+                    continue
+                # If all those conditions are met guess that port is a external
+                # current that can be removed (ports that don't meet these
+                # conditions will have to be specified separately)
+                ext_is.append(port)
+            if ext_is:
+                logger.info("Guessing '{}' are external currents to be removed"
+                            .format(ext_is))
+        trfrm.annotations.set((BUILD_TRANS, PYPE9_NS), EXTERNAL_CURRENTS,
+                              ','.join(p.name for p in ext_is))
+        # Remove external input current ports (as NEURON handles them)
+        for ext_i in ext_is:
+            trfrm.remove(ext_i)
+            for expr in chain(trfrm.aliases, trfrm.all_time_derivatives()):
+                expr.subs(ext_i, 0)
+                expr.simplify()
+
+    def _transform_sub_component(self, trfrm, component_class):
+        """
+        Checks that the component class can be converted into a distributed
+        (density) mechanism, which only supplies current densities to the
+        section it is inserted into
+        """
+        if (trfrm.num_regimes > 1 or list(trfrm.all_on_conditions()) or
+                list(trfrm.all_on_events())):
+            raise Pype9Unsupported9MLException(
+                "Distributed mechanisms ('{}') cannot contain regime "
+                "transitions".format(component_class.name))
+        if trfrm.num_event_send_ports or trfrm.num_event_receive_ports:
+            raise Pype9Unsupported9MLException(
+                "Distributed mechanisms ('{}') cannot have event ports"
+                .format(component_class.name))
+        other_rcv_ports = [p.name for p in chain(trfrm.analog_receive_ports,
+                                                 trfrm.analog_reduce_ports)
+                           if p.name != 'v']
+        if other_rcv_ports:
+            raise Pype9Unsupported9MLException(
+                "Distributed mechanisms ('{}') can only receive the membrane "
+                "voltage (found '{}')".format(component_class.name,
+                                              "', '".join(other_rcv_ports)))
+        if not any(p.dimension == un.currentDensity
+                   for p in trfrm.analog_send_ports):
+            raise Pype9BuildError(
+                "Distributed mechanism '{}' does not have any analog send "
+                "ports with current density dimension"
+                .format(component_class.name))
+        has_td = set(chain(*(r.time_derivative_variables
+                             for r in trfrm.regimes)))
+        trfrm.annotations.set(
+            (BUILD_TRANS, PYPE9_NS), NO_TIME_DERIVS,
+            ','.join(['v'] + [sv for sv in trfrm.state_variable_names
+                              if sv not in has_td]))
+        trfrm.annotations.set((BUILD_TRANS, PYPE9_NS), NUM_TIME_DERIVS,
+                              len(has_td))
+        trfrm.annotations.set((BUILD_TRANS, PYPE9_NS), EXTERNAL_CURRENTS, '')
+
+    def assign_str(self, lhs, rhs):
+        rhs = Expression.expand_integer_powers(rhs)
+        nmodl_str = ccode(rhs, user_functions=Expression._cfunc_map,
+                          assign_to=lhs)
+        nmodl_str = Expression.strip_L_from_rationals(nmodl_str)
+        nmodl_str = nmodl_str.replace(';', '')
+        return nmodl_str
@@ -9,13 +9,15 @@ from builtins import next
 from builtins import str
 from past.builtins import basestring
 from builtins import object
+import numpy
 from collections import namedtuple, defaultdict
 from itertools import chain
 import quantities as pq
 import neo
 from nineml.user import Property
+from nineml.values import RandomDistributionValue
 from pype9.exceptions import Pype9RuntimeError
-from .values import get_pyNN_value
+from .values import get_pyNN_value, get_values
 import os.path
 import nineml
 from nineml import units as un
@@ -32,12 +34,17 @@ from nineml.user import (
     AnalogConnectionGroup as AnalogConnectionGroup9ML,
     Selection as Selection9ML,
     Concatenate as Concatenate9ML)
-from pype9.exceptions import Pype9UnflattenableSynapseException
+from pype9.exceptions import (
+    Pype9UnflattenableSynapseException, Pype9Unsupported9MLException)
 from .connectivity import InversePyNNConnectivity
+from .plasticity import (
+    EventDrivenPlasticity, EventDrivenSynapse, has_state, is_event_driven)
+from .structure import copy_structure, pyNN_structure
 from ..cells import (
     MultiDynamicsWithSynapsesProperties, ConnectionPropertySet,
     SynapseProperties)
 from pype9.exceptions import Pype9UsageError, Pype9NameError
+from pype9.utils.mpi import gather_segment
 
 
 _REQUIRED_SIM_PARAMS = ['timestep', 'min_delay', 'max_delay', 'temperature']
@@ -62,6 +69,8 @@ class Network(object):
     # Name given to the "cell" component of the cell dynamics + linear synapse
     # dynamics multi-dynamics
     CELL_COMP_NAME = 'cell'
+    # Name given to the response component of the flattened synapse dynamics
+    RESPONSE_COMP_NAME = 'psr'
 
     def __init__(self, nineml_model, build_mode='lazy', **kwargs):
         if isinstance(nineml_model, basestring):
@@ -269,10 +278,19 @@ class Network(object):
         element (will be 9MLv2 format) and updates the port connections
         to match the changed object.
         """
-        role2name = {'response': 'psr', 'plasticity': 'pls'}
-        syn_comps = {
-            role2name['response']: projection_model.response,
-            role2name['plasticity']: projection_model.plasticity}
+        role2name = {'response': cls.RESPONSE_COMP_NAME, 'plasticity': 'pls'}
+        if has_state(projection_model):
+            # Plasticity with state is simulated separately for each
+            # connection so only the response is included in the synapse
+            syn_roles = ('response',)
+            syn_comps = {
+                role2name['response']: EventDrivenPlasticity(
+                    projection_model).response}
+        else:
+            syn_roles = ('plasticity', 'response')
+            syn_comps = {
+                role2name['response']: projection_model.response,
+                role2name['plasticity']: projection_model.plasticity}
         # Get all projection port connections that don't project to/from
         # the "pre" population and convert them into local MultiDynamics
         # port connections of the synapse
@@ -283,13 +301,13 @@ class Network(object):
                 send_port_name=pc.send_port_name,
                 receive_port_name=pc.receive_port_name)
             for pc in projection_model.port_connections
-            if (pc.sender_role in ('plasticity', 'response') and
-                pc.receiver_role in ('plasticity', 'response')))
+            if (pc.sender_role in syn_roles and
+                pc.receiver_role in syn_roles))
         receive_conns = [pc for pc in projection_model.port_connections
                          if (pc.sender_role in ('pre', 'post') and
-                             pc.receiver_role in ('plasticity', 'response'))]
+                             pc.receiver_role in syn_roles)]
         send_conns = [pc for pc in projection_model.port_connections
-                      if (pc.sender_role in ('plasticity', 'response') and
+                      if (pc.sender_role in syn_roles and
                           pc.receiver_role in ('pre', 'post'))]
         syn_exps = chain(
             (BasePortExposure.from_port(pc.send_port,
@@ -399,6 +417,9 @@ class Network(object):
                     connection_property_sets.extend(
                         cls._extract_connection_property_sets(synapse,
                                                               proj.name))
+                    if has_state(proj):
+                        cls._add_event_driven_plasticity(
+                            proj, connection_property_sets, synapses)
                     # Add the flattened synapse to the multi-dynamics sub
                     # components
                     sub_components[proj.name] = synapse.clone()
@@ -410,6 +431,13 @@ class Network(object):
                     # Expose ports that are needed for the pre-synaptic
                     # connections
                 except Pype9UnflattenableSynapseException:
+                    if has_state(proj):
+                        raise Pype9Unsupported9MLException(
+                            "The response of '{}' projection needs to be "
+                            "linear with properties that don't vary between "
+                            "connections for its plasticity (which has state) "
+                            "to be simulated for each connection"
+                            .format(proj.name))
                     # All synapses (of this type) connected to a single post-
                     # synaptic cell cannot be flattened into a single component
                     # of a multi- dynamics object so an individual synapses
@@ -462,6 +490,7 @@ class Network(object):
             array_name = pop.name
             component_arrays[array_name] = ComponentArray9ML(
                 array_name, pop.size, component)
+            copy_structure(pop, component_arrays[array_name])
         selections = {}
         for sel in network_model.selections:
             selections[sel.name] = Selection9ML(
@@ -520,6 +549,35 @@ class Network(object):
                 connection_groups[conn_group.name] = conn_group
         return component_arrays, connection_groups, selections
 
+    @classmethod
+    def _add_event_driven_plasticity(cls, projection_model,
+                                     connection_property_sets, synapses):
+        """
+        Adds the event-driven form of a plasticity with state as a synapse of
+        the cell, which sets the weight received by the response (converted
+        into a connection parameter) at each pre-synaptic event
+        """
+        plasticity = EventDrivenPlasticity(projection_model)
+        receive_port = append_namespace(
+            append_namespace(plasticity.response_event_port,
+                             cls.RESPONSE_COMP_NAME), projection_model.name)
+        weight_param = append_namespace(
+            append_namespace(plasticity.response_port,
+                             cls.RESPONSE_COMP_NAME), projection_model.name)
+        if any(cps.port == receive_port for cps in connection_property_sets):
+            raise Pype9Unsupported9MLException(
+                "The properties of the response of '{}' projection cannot "
+                "vary between connections as the weight sent by its "
+                "plasticity (which has state) is assigned to the connection "
+                "parameter of the '{}' port".format(projection_model.name,
+                                                    receive_port))
+        weight = plasticity.response.property(plasticity.response_port)
+        connection_property_sets.append(ConnectionPropertySet(
+            receive_port, [Property(weight_param, weight.quantity)]))
+        synapses.append(SynapseProperties(
+            projection_model.name,
+            plasticity.properties(receive_port, weight_param)))
+
     @classmethod
     def _extract_connection_property_sets(cls, dynamics_properties, namespace):
         """
@@ -601,12 +659,21 @@ class ComponentArray(object):
             build_mode=build_mode, **kwargs)
         if build_mode != 'build_only':
             rng = self.Simulation.active().properties_rng
+            # Properties and initial values with random distribution values
+            # are drawn by the simulator-specific derived classes once the
+            # cells have been created (see '_set_random_values')
+            random_props = [p for p in dynamics_properties.properties
+                            if isinstance(p.value, RandomDistributionValue)]
+            random_inits = [i for i in dynamics_properties.initial_values
+                            if isinstance(i.value, RandomDistributionValue)]
             cellparams = dict(
                 (p.name, get_pyNN_value(p, self.UnitHandler, rng))
-                for p in dynamics_properties.properties)
+                for p in dynamics_properties.properties
+                if not isinstance(p.value, RandomDistributionValue))
             initial_values = dict(
                 (i.name, get_pyNN_value(i, self.UnitHandler, rng))
-                for i in dynamics_properties.initial_values)
+                for i in dynamics_properties.initial_values
+                if not isinstance(i.value, RandomDistributionValue))
             initial_values['_regime'] = celltype.model.regime_index(
                 dynamics_properties.initial_regime)
             # NB: Simulator-specific derived classes extend the corresponding
@@ -614,7 +681,10 @@ class ComponentArray(object):
             self.PyNNPopulationClass.__init__(
                 self, nineml_model.size, celltype, cellparams=cellparams,
                 initial_values=initial_values,
+                structure=pyNN_structure(nineml_model, rng=rng),
                 label=nineml_model.name)
+            if random_props or random_inits:
+                self._set_random_values(random_props, random_inits, rng)
             self._inputs = {}
         self._t_stop = None
         self.Simulation.active().register_array(self)
@@ -634,6 +704,25 @@ class ComponentArray(object):
     def synapse(self, name):
         return self.nineml.dynamics_properties.synapse(name)
 
+    def plasticity(self, name):
+        """
+        Returns the properties of the event-driven form of the plasticity of
+        the named projection if it has state (see EventDrivenPlasticity),
+        otherwise None
+
+        Parameters
+        ----------
+        name : str
+            Name of the projection
+        """
+        try:
+            synapse = self.nineml.dynamics_properties.synapse_properties(name)
+        except NineMLNameError:
+            return None
+        if not is_event_driven(synapse.dynamics_properties.component_class):
+            return None
+        return synapse.dynamics_properties
+
     def __repr__(self):
         return "ComponentArray('{}', size={})".format(self.name, self.size)
 
@@ -719,6 +808,22 @@ class ComponentArray(object):
             raise Pype9RuntimeError(
                 "Unrecognised port type '{}' to play signal into".format(port))
 
+    def _port_name(self, port_name):
+        """
+        Returns the name of the port or state variable fully qualified in the
+        joint cell-synapse namespace if required
+        """
+        for name in (port_name, port_name + '__cell'):
+            if name in chain(self.component_class.send_port_names,
+                             self.component_class.state_variable_names):
+                return name
+        raise Pype9UsageError(
+            "Unknown port or state-variable '{}' for '{}' component array "
+            "(available '{}').".format(
+                port_name, self.name, "', '".join(chain(
+                    self.component_class.send_port_names,
+                    self.component_class.state_variable_names))))
+
     def _get_port_details(self, port_name):
         """
         Return the communication type of the corresponding port and its fully
@@ -774,7 +879,7 @@ class ComponentArray(object):
             Name of the port to record
         """
 
-    def recording(self, port_name, t_start=None):
+    def recording(self, port_name, t_start=None, gather=True):
         """
         Returns the recorded data for the given port name
 
@@ -783,6 +888,11 @@ class ComponentArray(object):
         port_name : str
             The name of the port (or state-variable) to retrieve the recorded
             data for
+        gather : bool
+            Whether to gather the data recorded on every MPI process to the
+            master process. If False, only the data recorded from cells local
+            to the process is returned. NB: when gathered the complete data is
+            only returned on the master process
 
         Returns
         -------
@@ -790,7 +900,7 @@ class ComponentArray(object):
             The recorded data in a neo.Segment
         """
 
-        pyNN_data = self.get_data().segments[0]
+        pyNN_data = self.get_data(gather=False).segments[0]
         recording = neo.Segment()
         communicates, _ = self._get_port_details(port_name)
         if communicates == 'event':
@@ -806,8 +916,53 @@ class ComponentArray(object):
                 # FIXME: Not sure if this will work
                 if asig.annotations['name'] == port_name:
                     recording.analogsignals.append(asig)
+        if gather:
+            recording = gather_segment(recording)
         return recording
 
+    def _set_random_values(self, properties, initial_values, rng):
+        """
+        Sets the properties and initial values of the cells in the array
+        that have random distribution values. The values of the whole array
+        are drawn at once from the properties RNG for each property (so they
+        don't depend on the distribution of the cells over the processes) and
+        passed to PyNN in a single call. Derived classes can override this to
+        set the drawn values in the simulator more efficiently
+
+        Parameters
+        ----------
+        properties : list(nineml.Property)
+            The properties with random distribution values
+        initial_values : list(nineml.Initial)
+            The initial values with random distribution values
+        rng : pyNN.random.NumpyRNG
+            The properties RNG of the simulation
+        """
+        if properties:
+            self.set(**dict(
+                (p.name, get_values(p, self.UnitHandler, rng, self.size))
+                for p in properties))
+        if initial_values:
+            # Initial values are set through PyNN so that they are restored
+            # when the simulation is reset
+            self.initialize(**dict(
+                (i.name, get_values(i, self.UnitHandler, rng, self.size))
+                for i in initial_values))
+
+    def _save_state(self, group):
+        """
+        Saves the states of the cells in the array and its recording buffers
+        to a HDF5 group (see Simulation.save_state)
+        """
+        raise NotImplementedError("Should be implemented by derived class")
+
+    def _restore_state(self, group):
+        """
+        Restores the states of the cells in the array and its recording
+        buffers from a HDF5 group (see Simulation.restore_state)
+        """
+        raise NotImplementedError("Should be implemented by derived class")
+
     def _kill(self, t_stop):
         """
         Caches all recording data and sets all references to the actual
@@ -888,6 +1043,14 @@ class Selection(object):
         except:
             raise
 
+    def plasticity(self, name):
+        if any(ca.plasticity(name) is not None
+               for ca in self.component_arrays):
+            raise Pype9Unsupported9MLException(
+                "Projections to selections ('{}') cannot have plasticity with "
+                "state ('{}')".format(self.name, name))
+        return None
+
     def __repr__(self):
         return "Selection('{}', component_arrays=('{}')".format(
             self.name, "', '".join(self.component_array_names))
@@ -916,33 +1079,50 @@ class ConnectionGroup(object):
             raise Pype9RuntimeError(
                 "Expected a connection group model, found {}"
                 .format(nineml_model))
-        try:
-            (synapse, conns) = destination.synapse(nineml_model.name)
-            if conns is not None:
-                raise NotImplementedError(
-                    "Nonlinear synapses, as used in '{}' are not currently "
-                    "supported".format(nineml_model.name))
-            if synapse.num_local_properties == 1:
-                # Get the only local property that varies with the synapse
-                # (typically the synaptic weight but does not have to be)
-                weight = get_pyNN_value(next(synapse.local_properties),
-                                        self.UnitHandler, rng)
-            elif not synapse.num_local_properties:
-                weight = 0.0
-            else:
-                raise NotImplementedError(
-                    "Currently only supports one property that varies with "
-                    "each synapse")
-        except NineMLNameError:
-            # FIXME: Should refactor "WithSynapses" code to "CellAndSynapses"
-            #        class which inherits most of its functionality from
-            #        MultiDynamics to ensure that every connection has a
-            #        "synapse" even if it is just a simple port exposure
-            # Synapse dynamics properties didn't have any properties that vary
-            # between synapses so wasn't included
+        plasticity = destination.plasticity(nineml_model.name)
+        if plasticity is not None:
+            # The weight of each connection is set by its plasticity at each
+            # pre-synaptic event
             weight = 0.0
+        else:
+            try:
+                (synapse, conns) = destination.synapse(nineml_model.name)
+                if conns is not None:
+                    raise NotImplementedError(
+                        "Nonlinear synapses, as used in '{}' are not "
+                        "currently supported".format(nineml_model.name))
+                if synapse.num_local_properties == 1:
+                    # Get the only local property that varies with the
+                    # synapse (typically the synaptic weight but does not
+                    # have to be)
+                    weight = get_pyNN_value(next(synapse.local_properties),
+                                            self.UnitHandler, rng)
+                elif not synapse.num_local_properties:
+                    weight = 0.0
+                else:
+                    raise NotImplementedError(
+                        "Currently only supports one property that varies "
+                        "with each synapse")
+            except NineMLNameError:
+                # FIXME: Should refactor "WithSynapses" code to
+                #        "CellAndSynapses" class which inherits most of its
+                #        functionality from MultiDynamics to ensure that every
+                #        connection has a "synapse" even if it is just a
+                #        simple port exposure
+                # Synapse dynamics properties didn't have any properties that
+                # vary between synapses so wasn't included
+                weight = 0.0
         self._nineml = nineml_model
+        self._plasticity = None
+        self._plastic_recordings = {}
         delay = get_pyNN_value(nineml_model.delay, self.UnitHandler, rng)
+        if plasticity is not None:
+            self._plasticity = EventDrivenSynapse(
+                plasticity.component_class)
+            synapse_type = self._plastic_synapse_type(
+                plasticity, destination, weight, delay, rng)
+        else:
+            synapse_type = self.SynapseClass(weight=weight, delay=delay)
         # FIXME: Ignores send_port, assumes there is only one...
         # NB: Simulator-specific derived classes extend the corresponding
         # PyNN population class
@@ -951,9 +1131,11 @@ class ConnectionGroup(object):
             presynaptic_population=source,
             postsynaptic_population=destination,
             connector=nineml_model.connectivity,
-            synapse_type=self.SynapseClass(weight=weight, delay=delay),
+            synapse_type=synapse_type,
             receptor_type=nineml_model.destination_port,
             label=nineml_model.name)
+        if plasticity is not None:
+            self._initialize_plasticity(plasticity, destination, rng)
 
     @property
     def name(self):
@@ -963,6 +1145,110 @@ class ConnectionGroup(object):
     def connectivity(self):
         return self._connector
 
+    @property
+    def is_plastic(self):
+        """
+        Whether the connections have plasticity with state (which is
+        simulated for each connection)
+        """
+        return self._plasticity is not None
+
+    def record(self, state_variable, interval=None):
+        """
+        Records a state variable of the plasticity of each (local) connection
+        in the group at regular intervals. The recorded values are the values
+        of the state variables after the last pre- or post-synaptic event of
+        the connection, as the plasticity is only updated when events are
+        received.
+
+        Parameters
+        ----------
+        state_variable : str
+            Name of the state variable of the plasticity to record
+        interval : nineml.Quantity (time) | None
+            The interval between samples. Must be a multiple of the time step.
+            If None, the time step of the simulation is used
+        """
+        if self._plasticity is None:
+            raise Pype9UsageError(
+                "Cannot record '{}' from '{}' connection group as its "
+                "connections don't have plasticity with state".format(
+                    state_variable, self.name))
+        try:
+            varname = self._plasticity.state_variable(state_variable).name
+        except NineMLNameError as e:
+            raise Pype9UsageError(str(e))
+        simulation = self.Simulation.active()
+        if interval is None:
+            interval = simulation.dt
+        samples = []
+        simulation.register_sampler(
+            lambda t: samples.append(self._plastic_values(varname)),
+            interval)
+        self._plastic_recordings[state_variable] = (
+            samples, float(interval.in_units(un.ms)),
+            float(simulation.t.in_units(un.ms)))
+
+    def recording(self, state_variable):
+        """
+        Returns the values of a state variable of the plasticity recorded
+        from each (local) connection in the group (see ``record``)
+
+        Parameters
+        ----------
+        state_variable : str
+            Name of the recorded state variable of the plasticity
+
+        Returns
+        -------
+        recording : neo.AnalogSignal
+            The recorded values with a channel for each connection
+        """
+        try:
+            samples, interval, t_start = self._plastic_recordings[
+                state_variable]
+        except KeyError:
+            raise Pype9UsageError(
+                "'{}' has not been recorded from '{}' connection group"
+                .format(state_variable, self.name))
+        sv = self._plasticity.state_variable(state_variable)
+        if samples:
+            values = numpy.array(samples)
+        else:
+            values = numpy.zeros((0, len(self)))
+        return neo.AnalogSignal(
+            values, sampling_period=interval * pq.ms,
+            t_start=(t_start + interval) * pq.ms,
+            units=self.UnitHandler.dimension_to_unit_str(
+                sv.dimension, one_as_dimensionless=True),
+            name=state_variable)
+
+    def _plastic_synapse_type(self, plasticity, destination, weight, delay,
+                              rng):  # @UnusedVariable
+        """
+        Returns the PyNN synapse type of the event-driven plasticity of the
+        connections (overridden by simulators that support plasticity with
+        state)
+        """
+        raise Pype9Unsupported9MLException(
+            "Plasticity with state (as used in '{}') is not supported by {}"
+            .format(self.name, self.Simulation.name))
+
+    def _initialize_plasticity(self, plasticity, destination,
+                               rng):  # @UnusedVariable
+        """
+        Sets the initial states of the plasticity of each connection once the
+        PyNN projection has been created (if required by the simulator)
+        """
+        pass
+
+    def _plastic_values(self, varname):
+        """
+        Returns the current values of a state variable of the plasticity of
+        each (local) connection in the group
+        """
+        raise NotImplementedError("Should be implemented by derived class")
+
     def __repr__(self):
         return ("ConnectionGroup('{}', source='{}', destination='{}', "
                 "connectivity='{}')".format(self.name, self.pre.name,
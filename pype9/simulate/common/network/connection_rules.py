@@ -0,0 +1,268 @@
+"""
+  Plugin mechanism for 9ML ConnectionRule classes beyond the standard library
+  (AllToAll, OneToOne, Explicit, Probabilistic, RandomFanIn and RandomFanOut).
+
+  Plugins are matched to connection rules by the last part of the rule's
+  standard-library URL (e.g. 'GaussianDistanceProbability' for
+  'http://pype9.org/connectionrules/GaussianDistanceProbability'), and are
+  registered by decorating the plugin class, e.g.::
+
+      @register_connection_rule
+      class Ring(ConnectionRulePlugin):
+
+          name = 'Ring'
+
+          def connection_map(self, properties, source_positions,
+                             destination_positions, rng):
+              ...
+
+  Plugins provide a lazily-evaluated boolean connection map, which PyNN
+  evaluates for the local post-synaptic cells one column at a time, and can
+  optionally provide a connector from the backend's PyNN module (e.g. a native
+  NEST connector) to be used in its place.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from builtins import object, range
+from abc import ABCMeta, abstractmethod
+from future.utils import with_metaclass
+import numpy
+from nineml import units as un
+from pyNN.parameters import LazyArray
+from pyNN.random import RandomDistribution
+from pype9.exceptions import Pype9UsageError
+
+_PLUGINS = {}
+
+
+def register_connection_rule(plugin_cls):
+    """
+    Registers a connection-rule plugin class (can be used as a decorator)
+
+    Parameters
+    ----------
+    plugin_cls : type
+        A subclass of ConnectionRulePlugin
+    """
+    if not issubclass(plugin_cls, ConnectionRulePlugin):
+        raise Pype9UsageError(
+            "Connection rule plugins must derive from ConnectionRulePlugin "
+            "({})".format(plugin_cls))
+    if plugin_cls.name is None:
+        raise Pype9UsageError(
+            "Connection rule plugin {} doesn't define a name"
+            .format(plugin_cls))
+    _PLUGINS[plugin_cls.name] = plugin_cls()
+    return plugin_cls
+
+
+def unregister_connection_rule(name):
+    "Removes a connection-rule plugin from the registry"
+    try:
+        del _PLUGINS[name]
+    except KeyError:
+        raise Pype9UsageError(
+            "No connection rule plugin named '{}' is registered"
+            .format(name))
+
+
+def registered_connection_rules():
+    "The names of the registered connection-rule plugins"
+    return sorted(_PLUGINS)
+
+
+def rule_name(rule_properties):
+    """
+    The name a connection rule is matched to plugins with, i.e. the last part
+    of its standard-library URL
+    """
+    return rule_properties.component_class.standard_library.rstrip(
+        '/').split('/')[-1]
+
+
+def connection_rule_plugin(rule_properties):
+    """
+    Returns the plugin registered for the connection rule or None if there is
+    no plugin registered for it
+
+    Parameters
+    ----------
+    rule_properties : nineml.ConnectionRuleProperties
+        The properties of the connection rule
+    """
+    return _PLUGINS.get(rule_name(rule_properties))
+
+
+class ConnectionRulePlugin(with_metaclass(ABCMeta, object)):
+    """
+    Base class of plugins that instantiate user-defined ConnectionRule classes
+
+    Derived classes must define the 'name' class attribute, which matches the
+    last part of the standard-library URL of the rule, and implement
+    'connection_map'
+    """
+
+    name = None
+    # The names of the parameters the ConnectionRule class must have
+    parameter_names = ()
+
+    def check_properties(self, properties):
+        "Checks that the connection rule properties match the plugin"
+        missing = set(self.parameter_names) - set(properties.property_names)
+        if missing:
+            raise Pype9UsageError(
+                "'{}' connection rule properties are missing '{}' properties "
+                "required by the '{}' plugin".format(
+                    properties.name, "', '".join(sorted(missing)), self.name))
+
+    @abstractmethod
+    def connection_map(self, properties, source_positions,
+                       destination_positions, rng):
+        """
+        Returns the map of the connections between the source and destination
+        cells
+
+        Parameters
+        ----------
+        properties : nineml.ConnectionRuleProperties
+            The properties of the connection rule
+        source_positions : numpy.ndarray
+            The positions of the source cells (3xN array in um)
+        destination_positions : numpy.ndarray
+            The positions of the destination cells (3xN array in um)
+        rng : pyNN.random.NumpyRNG
+            The parallel-safe random number generator to sample the
+            connections with
+
+        Returns
+        -------
+        connection_map : pyNN.parameters.LazyArray
+            Lazily-evaluated boolean array of shape (num_sources,
+            num_destinations), which is True where a connection is made
+        """
+
+    def pyNN_connector(self, pyNN_module, properties, rng):  # @UnusedVariable @IgnorePep8
+        """
+        Can be overridden by derived classes to return a connector from the
+        backend's PyNN connectors module (e.g. a native NEST connector),
+        which is used in place of the connection map
+
+        Parameters
+        ----------
+        pyNN_module : module
+            The connectors module of the PyNN backend (e.g.
+            pyNN.nest.connectors)
+        properties : nineml.ConnectionRuleProperties
+            The properties of the connection rule
+        rng : pyNN.random.NumpyRNG
+            The parallel-safe random number generator
+        """
+        return None
+
+    def connections(self, properties, source_positions, destination_positions,
+                    rng):
+        """
+        Returns the (source, destination) index pairs of the connections,
+        for backends without a PyNN interface. Evaluated one destination cell
+        at a time to limit memory usage
+        """
+        connection_map = self.connection_map(
+            properties, source_positions, destination_positions, rng)
+        conns = []
+        for dest_i in range(connection_map.shape[1]):
+            src_inds = numpy.nonzero(connection_map[:, dest_i])[0]
+            conns.extend((int(s), dest_i) for s in src_inds)
+        return conns
+
+
+class DistanceDependentRulePlugin(ConnectionRulePlugin):
+    """
+    Base class of plugins for rules that connect cells with a probability
+    that depends on the distance between them. The probability is zero for
+    pairs outside of the mask (a maximum distance).
+    """
+
+    @abstractmethod
+    def kernel(self, distances, properties):
+        """
+        The connection probabilities for the given distances (um)
+        """
+
+    def mask(self, properties):  # @UnusedVariable
+        """
+        The maximum distance (um) between connected cells (None for no mask)
+        """
+        return None
+
+    def connection_map(self, properties, source_positions,
+                       destination_positions, rng):
+        self.check_properties(properties)
+        shape = (source_positions.shape[1], destination_positions.shape[1])
+        radius = self.mask(properties)
+
+        def probabilities(i, j):
+            dists = numpy.sqrt(numpy.sum(
+                (source_positions[:, i] - destination_positions[:, j]) ** 2,
+                axis=0))
+            probs = self.kernel(dists, properties)
+            if radius is not None:
+                probs = numpy.where(dists <= radius, probs, 0.0)
+            return probs
+
+        probability_map = LazyArray(probabilities, shape=shape)
+        random_map = LazyArray(RandomDistribution('uniform', (0.0, 1.0),
+                                                  rng=rng), shape=shape)
+        return random_map < probability_map
+
+    @classmethod
+    def length(cls, properties, name):
+        "Returns the value of a length property in um"
+        return float(properties.property(name).quantity.in_units(un.um))
+
+    @classmethod
+    def value(cls, properties, name):
+        "Returns the value of a dimensionless property"
+        return float(properties.property(name).value)
+
+
+@register_connection_rule
+class GaussianDistanceProbability(DistanceDependentRulePlugin):
+    """
+    Connects cells with a probability that decays as a Gaussian of the
+    distance between them, p = peak * exp(-d^2 / (2 * sigma^2)), for
+    distances less than the cutoff
+    """
+
+    name = 'GaussianDistanceProbability'
+    parameter_names = ('peak', 'sigma', 'cutoff')
+
+    def kernel(self, distances, properties):
+        sigma = self.length(properties, 'sigma')
+        return self.value(properties, 'peak') * numpy.exp(
+            -distances ** 2 / (2.0 * sigma ** 2))
+
+    def mask(self, properties):
+        return self.length(properties, 'cutoff')
+
+
+@register_connection_rule
+class ExponentialDistanceProbability(DistanceDependentRulePlugin):
+    """
+    Connects cells with a probability that decays exponentially with the
+    distance between them, p = peak * exp(-d / length_constant), for
+    distances less than the cutoff
+    """
+
+    name = 'ExponentialDistanceProbability'
+    parameter_names = ('peak', 'length_constant', 'cutoff')
+
+    def kernel(self, distances, properties):
+        return self.value(properties, 'peak') * numpy.exp(
+            -distances / self.length(properties, 'length_constant'))
+
+    def mask(self, properties):
+        return self.length(properties, 'cutoff')
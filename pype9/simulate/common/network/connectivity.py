@@ -10,7 +10,10 @@ from nineml.user.connectionrule import (
     BaseConnectivity, InverseConnectivity as BaseInverseConnectivity)
 from pyNN.parameters import LazyArray
 import numpy
-from pype9.exceptions import Pype9RuntimeError
+from pype9.exceptions import (
+    Pype9RuntimeError, Pype9Unsupported9MLException)
+from .connection_rules import (
+    connection_rule_plugin, registered_connection_rules)
 
 
 class PyNNConnectivity(BaseConnectivity):
@@ -35,6 +38,9 @@ class PyNNConnectivity(BaseConnectivity):
             # Get connection from previously connected projection
             connector = self._pyNN_module.MapConnector()
             connector._connect_with_map(connection_group, self._connection_map)
+        elif connection_rule_plugin(self.rule_properties) is not None:
+            self._connect_with_plugin(connection_group)
+            self._prev_connected = connection_group
         else:
             if self.rule_properties.lib_type == 'AllToAll':
                 connector_cls = self._pyNN_module.AllToAllConnector
@@ -65,13 +71,37 @@ class PyNNConnectivity(BaseConnectivity):
                           int(self.rule_properties.property('number').value),
                           'rng': None}
             else:
-                assert False
+                raise Pype9Unsupported9MLException(
+                    "No plugin is registered for '{}' connection rule of "
+                    "'{}' (registered plugins '{}')".format(
+                        self.rule_properties.lib_type,
+                        self.rule_properties.name,
+                        "', '".join(registered_connection_rules())))
             if 'rng' in params:
                 params['rng'] = self._rng
             connector = connector_cls(**params)
             connector.connect(connection_group)
             self._prev_connected = connection_group
 
+    def _connect_with_plugin(self, connection_group):
+        """
+        Connects the projection with the plugin registered for the connection
+        rule, using its PyNN connector if it provides one or the connection
+        map generated from the positions of the pre and post-synaptic cells
+        otherwise
+        """
+        plugin = connection_rule_plugin(self.rule_properties)
+        connector = plugin.pyNN_connector(self._pyNN_module,
+                                          self.rule_properties, self._rng)
+        if connector is not None:
+            connector.connect(connection_group)
+        else:
+            connection_map = plugin.connection_map(
+                self.rule_properties, connection_group.pre.positions,
+                connection_group.post.positions, self._rng)
+            connector = self._pyNN_module.MapConnector()
+            connector._connect_with_map(connection_group, connection_map)
+
     def has_been_sampled(self):
         return self._prev_connected is not None
 
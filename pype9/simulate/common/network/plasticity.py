@@ -0,0 +1,539 @@
+"""
+
+  Converts the plasticity dynamics of projections that have their own state
+  variables (e.g. STDP or short-term plasticity) into an "event-driven" form,
+  which is generated as a synapse model of the simulator (i.e. a NEST
+  connection model or an extension of the NET_RECEIVE block of a NEURON point
+  process) so that the state is simulated for each connection.
+
+  In the event-driven form, the state variables of the plasticity are only
+  updated when a pre- or post-synaptic event is received, using the analytic
+  solution of their time derivatives (which are required to be linear with
+  constant coefficients and decoupled from each other) to advance them from
+  the time of the previous event. The weight sent to the response dynamics is
+  the value of the weight port of the plasticity after the pre-synaptic event
+  has been applied.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2014 Thomas G. Close.
+  License: This file is part of the "NineLine" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+from builtins import object
+from itertools import chain
+import sympy
+from nineml import units as un
+from nineml.user import DynamicsProperties, Property, Initial
+from nineml.user.multi import append_namespace
+from nineml.abstraction import (
+    Dynamics, Regime, OnEvent, StateAssignment, StateVariable, Parameter,
+    Constant, Alias, EventReceivePort, AnalogSendPort)
+from nineml.exceptions import NineMLNameError
+from pype9.annotations import (
+    PYPE9_NS, PLASTICITY, PLASTICITY_PROJECTION, PLASTICITY_PRE_PORT,
+    PLASTICITY_POST_PORT, PLASTICITY_WEIGHT, PLASTICITY_RECEIVE_PORT,
+    PLASTICITY_WEIGHT_PARAM)
+from pype9.exceptions import Pype9Unsupported9MLException
+
+
+# Name of the state variable added to hold the time of the previous event
+LAST_EVENT_TIME = 't_last___pype9'
+
+
+def has_state(projection_model):
+    """
+    Whether the plasticity of the projection has state variables, in which
+    case it needs to be simulated separately for each connection
+    """
+    plasticity = projection_model.plasticity
+    return (plasticity is not None and
+            plasticity.component_class.num_state_variables > 0)
+
+
+def is_event_driven(component_class):
+    """
+    Whether the dynamics is the event-driven form of a plasticity (i.e. was
+    created by EventDrivenPlasticity)
+    """
+    return component_class.annotations.get(
+        (PLASTICITY, PYPE9_NS), PLASTICITY_PROJECTION,
+        default=None) is not None
+
+
+def event_driven_synapses(component_class, unit_handler_class=None):
+    """
+    Returns the event-driven plasticities included as synapses of a cell
+    class, sorted by name so they can be referred to consistently by the
+    generated code and the connection groups
+
+    Parameters
+    ----------
+    component_class : WithSynapses
+        The (build) component class of the cell
+    unit_handler_class : UnitHandler | None
+        The unit handler class of the simulator used to scale the expressions
+        of the plasticity in the code-generation templates
+    """
+    return [EventDrivenSynapse(s.dynamics, unit_handler_class)
+            for s in sorted(getattr(component_class, 'synapses', []),
+                            key=lambda s: s.name)
+            if is_event_driven(s.dynamics)]
+
+
+class EventDrivenPlasticity(object):
+    """
+    The event-driven form of the plasticity of a projection that has its own
+    state variables, along with the response dynamics modified to receive the
+    weight sent by the plasticity as a connection parameter (which is set by
+    the plasticity at each pre-synaptic event).
+
+    Parameters
+    ----------
+    projection_model : nineml.Projection
+        The projection with the plasticity that has state
+    """
+
+    def __init__(self, projection_model):
+        self._projection = projection_model
+        self._name = projection_model.name
+        conns = list(projection_model.port_connections)
+        self._pre_port = self._event_port(conns, 'pre')
+        self._post_port = self._event_port(conns, 'post')
+        if self._pre_port is None:
+            raise Pype9Unsupported9MLException(
+                "The plasticity of '{}' projection needs to receive "
+                "pre-synaptic events to be simulated for each connection"
+                .format(self.name))
+        weight_conns = [pc for pc in conns
+                        if (pc.sender_role == 'plasticity' and
+                            pc.receiver_role == 'response')]
+        if len(weight_conns) != 1 or weight_conns[0].communicates != 'analog':
+            raise Pype9Unsupported9MLException(
+                "The plasticity of '{}' projection needs to send exactly one "
+                "analog weight to the response to be simulated for each "
+                "connection".format(self.name))
+        self._weight_port = weight_conns[0].send_port_name
+        self._response_port = weight_conns[0].receive_port_name
+        response_conns = [pc for pc in conns
+                          if (pc.sender_role == 'pre' and
+                              pc.receiver_role == 'response' and
+                              pc.communicates == 'event')]
+        if len(response_conns) != 1:
+            raise Pype9Unsupported9MLException(
+                "The response of '{}' projection needs to receive exactly one "
+                "pre-synaptic event port for its plasticity to be simulated "
+                "for each connection".format(self.name))
+        self._response_event_port = response_conns[0].receive_port_name
+        unsupported = [
+            pc for pc in conns
+            if ('plasticity' in (pc.sender_role, pc.receiver_role) and
+                pc not in weight_conns and
+                not (pc.receiver_role == 'plasticity' and
+                     pc.communicates == 'event'))]
+        if unsupported:
+            raise Pype9Unsupported9MLException(
+                "Only event inputs from the pre- and post-synaptic cells and "
+                "the weight sent to the response are supported for "
+                "plasticity with state ('{}' projection has {})".format(
+                    self.name, ', '.join(
+                        '{}.{}->{}.{}'.format(
+                            pc.sender_role, pc.send_port_name,
+                            pc.receiver_role, pc.receive_port_name)
+                        for pc in unsupported)))
+        self._check_plasticity()
+        self._decayed = self._decay_expressions()
+
+    @property
+    def name(self):
+        return self._name
+
+    @property
+    def pre_port(self):
+        "The event port of the plasticity that receives pre-synaptic events"
+        return self._pre_port
+
+    @property
+    def post_port(self):
+        """
+        The event port of the plasticity that receives post-synaptic events
+        (None if it does not receive them)
+        """
+        return self._post_port
+
+    @property
+    def weight_port(self):
+        "The analog send port of the plasticity that supplies the weight"
+        return self._weight_port
+
+    @property
+    def response_port(self):
+        """
+        The analog receive port of the response the weight is sent to, which
+        is converted into a parameter of the response
+        """
+        return self._response_port
+
+    @property
+    def response_event_port(self):
+        "The event port of the response that receives pre-synaptic events"
+        return self._response_event_port
+
+    @property
+    def response(self):
+        """
+        The properties of the response dynamics with the analog receive port
+        the weight is received on converted into a parameter
+        """
+        props = self._projection.response
+        component_class = props.component_class
+        port = component_class.analog_receive_port(self.response_port)
+        response = component_class.clone()
+        response.name = component_class.name + '_plastic'
+        response.remove(response.analog_receive_port(self.response_port))
+        response.add(Parameter(self.response_port, dimension=port.dimension))
+        # The weight can only be set when pre-synaptic events are received
+        required = [response.required_for(chain(
+            response.all_time_derivatives(), response.all_on_conditions()))]
+        required.extend(response.required_for(oe.state_assignments)
+                        for oe in response.all_on_events()
+                        if oe.src_port_name != self.response_event_port)
+        if any(self.response_port in (p.name for p in r.parameters)
+               for r in required):
+            raise Pype9Unsupported9MLException(
+                "The weight received by '{}' port of the response of '{}' "
+                "projection can only be used in the on-event of its '{}' port "
+                "for its plasticity to be simulated for each connection"
+                .format(self.response_port, self.name,
+                        self.response_event_port))
+        return DynamicsProperties(
+            name=props.name, definition=response,
+            properties=list(chain(props.properties, [
+                Property(self.response_port, _zero(port.dimension))])),
+            initial_values=list(props.initial_values),
+            initial_regime=props.initial_regime)
+
+    def properties(self, receive_port, weight_parameter):
+        """
+        The properties of the event-driven form of the plasticity, with all of
+        its symbols in the namespace of the projection
+
+        Parameters
+        ----------
+        receive_port : str
+            The name of the event receive port of the cell (including the
+            synapse namespaces) that the pre-synaptic events are received on
+        weight_parameter : str
+            The name of the connection parameter of the cell (including the
+            synapse namespaces) that the weight is assigned to
+        """
+        props = self._projection.plasticity
+        return DynamicsProperties(
+            name=self.name + '_plasticity',
+            definition=self.dynamics(receive_port, weight_parameter),
+            properties=[Property(self._ns(p.name), p.quantity)
+                        for p in props.properties],
+            initial_values=list(chain(
+                (Initial(self._ns(i.name), i.quantity)
+                 for i in props.initial_values),
+                [Initial(self._ns(LAST_EVENT_TIME), 0.0 * un.ms)])))
+
+    def dynamics(self, receive_port, weight_parameter):
+        """
+        The event-driven form of the plasticity dynamics, with all of its
+        symbols in the namespace of the projection (see ``properties``)
+        """
+        plasticity = self._projection.plasticity.component_class
+        regime = next(plasticity.regimes)
+        aliases = _alias_map(plasticity)
+        names = list(chain(plasticity.parameter_names,
+                           plasticity.constant_names,
+                           plasticity.alias_names,
+                           plasticity.state_variable_names,
+                           [LAST_EVENT_TIME]))
+        ns = dict((sympy.Symbol(n), sympy.Symbol(self._ns(n))) for n in names)
+        on_events = []
+        for port_name in (self.pre_port, self.post_port):
+            if port_name is None:
+                continue
+            assignments = {}
+            for on_event in regime.on_events:
+                if on_event.src_port_name == port_name:
+                    assignments = dict((sa.variable, sa.rhs)
+                                       for sa in on_event.state_assignments)
+            # The state variables are decayed to the time of the event before
+            # the (simultaneous) state assignments are applied
+            state_assignments = [
+                StateAssignment(
+                    self._ns(sv.name),
+                    _expand(assignments.get(sv.name, sympy.Symbol(sv.name)),
+                            aliases).xreplace(self._decayed).xreplace(ns))
+                for sv in plasticity.state_variables]
+            state_assignments.append(
+                StateAssignment(self._ns(LAST_EVENT_TIME), 't'))
+            on_events.append(OnEvent(port_name,
+                                     state_assignments=state_assignments))
+        weight = plasticity.analog_send_port(self.weight_port)
+        dynamics = Dynamics(
+            name=self.name + '_plasticity',
+            parameters=[Parameter(self._ns(p.name), dimension=p.dimension)
+                        for p in plasticity.parameters],
+            constants=[Constant(self._ns(c.name), c.value, c.units)
+                       for c in plasticity.constants],
+            aliases=[Alias(self._ns(a.lhs), sympy.sympify(a.rhs).xreplace(ns))
+                     for a in plasticity.aliases],
+            state_variables=list(chain(
+                (StateVariable(self._ns(sv.name), dimension=sv.dimension)
+                 for sv in plasticity.state_variables),
+                [StateVariable(self._ns(LAST_EVENT_TIME),
+                               dimension=un.time)])),
+            regimes=[Regime(name=regime.name, transitions=on_events)],
+            event_ports=[EventReceivePort(p)
+                         for p in (self.pre_port, self.post_port)
+                         if p is not None],
+            analog_ports=[AnalogSendPort(self._ns(self.weight_port),
+                                         dimension=weight.dimension)])
+        for key, value in ((PLASTICITY_PROJECTION, self.name),
+                           (PLASTICITY_PRE_PORT, self.pre_port),
+                           (PLASTICITY_POST_PORT, self.post_port or ''),
+                           (PLASTICITY_WEIGHT, self._ns(self.weight_port)),
+                           (PLASTICITY_RECEIVE_PORT, receive_port),
+                           (PLASTICITY_WEIGHT_PARAM, weight_parameter)):
+            dynamics.annotations.set((PLASTICITY, PYPE9_NS), key, value)
+        return dynamics
+
+    def _ns(self, name):
+        return append_namespace(name, self.name)
+
+    def _event_port(self, conns, role):
+        """
+        Returns the event port of the plasticity that receives events from
+        the cell in the given role ('pre' or 'post') or None if there isn't
+        one
+        """
+        ports = [pc.receive_port_name for pc in conns
+                 if (pc.sender_role == role and
+                     pc.receiver_role == 'plasticity' and
+                     pc.communicates == 'event')]
+        if len(ports) > 1:
+            raise Pype9Unsupported9MLException(
+                "The plasticity of '{}' projection can only receive events "
+                "from one port of the {}-synaptic cell ('{}')".format(
+                    self.name, role, "', '".join(ports)))
+        return ports[0] if ports else None
+
+    def _check_plasticity(self):
+        """
+        Checks the plasticity dynamics for features that cannot be converted
+        into the event-driven form
+        """
+        plasticity = self._projection.plasticity.component_class
+        if plasticity.num_regimes != 1:
+            raise Pype9Unsupported9MLException(
+                "Plasticity with state and multiple regimes (as used in '{}' "
+                "projection) is not supported".format(self.name))
+        regime = next(plasticity.regimes)
+        if regime.num_on_conditions:
+            raise Pype9Unsupported9MLException(
+                "Plasticity with state and on-conditions (as used in '{}' "
+                "projection) is not supported".format(self.name))
+        if plasticity.is_random:
+            raise Pype9Unsupported9MLException(
+                "Plasticity with state and random distributions in state "
+                "assignments (as used in '{}' projection) is not supported"
+                .format(self.name))
+        if (plasticity.num_analog_receive_ports +
+                plasticity.num_analog_reduce_ports):
+            raise Pype9Unsupported9MLException(
+                "Plasticity with state that receives analog inputs (as used "
+                "in '{}' projection) is not supported".format(self.name))
+        for on_event in regime.on_events:
+            if on_event.src_port_name not in (self.pre_port, self.post_port):
+                raise Pype9Unsupported9MLException(
+                    "On-event of '{}' port in the plasticity of '{}' "
+                    "projection is not connected to the pre- or post-"
+                    "synaptic cell".format(on_event.src_port_name,
+                                           self.name))
+            if len(list(on_event.output_events)):
+                raise Pype9Unsupported9MLException(
+                    "Plasticity with state that emits output events (as used "
+                    "in '{}' projection) is not supported".format(self.name))
+
+    def _decay_expressions(self):
+        """
+        Returns the expressions for the state variables at time 't' in terms
+        of their values at the time of the previous event (LAST_EVENT_TIME).
+        For dx/dt = a + b * x, where a and b are constant, the state evolves
+        as x(t) = (x(t0) + a / b) * exp(b * (t - t0)) - a / b (or
+        x(t0) + a * (t - t0) when b is zero)
+        """
+        plasticity = self._projection.plasticity.component_class
+        regime = next(plasticity.regimes)
+        aliases = _alias_map(plasticity)
+        t = sympy.Symbol('t')
+        elapsed = t - sympy.Symbol(LAST_EVENT_TIME)
+        not_constant = set(chain(
+            (sympy.Symbol(n) for n in plasticity.state_variable_names), [t]))
+        decayed = {}
+        for td in regime.time_derivatives:
+            x = sympy.Symbol(td.variable)
+            rhs = _expand(td.rhs, aliases)
+            b = sympy.simplify(sympy.diff(rhs, x))
+            a = sympy.simplify(rhs - b * x)
+            if (a.free_symbols | b.free_symbols) & not_constant:
+                raise Pype9Unsupported9MLException(
+                    "The time derivative of '{}' in the plasticity of '{}' "
+                    "projection ({}) needs to be linear with constant "
+                    "coefficients and independent of the other state "
+                    "variables for the plasticity to be simulated for each "
+                    "connection".format(td.variable, self.name, td.rhs))
+            if b == 0:
+                decayed[x] = x + a * elapsed
+            else:
+                decayed[x] = (x + a / b) * sympy.exp(b * elapsed) - a / b
+        return decayed
+
+
+class EventDrivenSynapse(object):
+    """
+    Provides access to the elements of an event-driven plasticity that has
+    been included as a synapse of a cell class (see EventDrivenPlasticity),
+    for use in the code-generation templates and connection groups
+
+    Parameters
+    ----------
+    dynamics : nineml.Dynamics
+        The event-driven form of the plasticity dynamics
+    unit_handler_class : UnitHandler | None
+        The unit handler class of the simulator used to scale the expressions
+        of the plasticity
+    """
+
+    def __init__(self, dynamics, unit_handler_class=None):
+        self._dynamics = dynamics
+        self._unit_handler = (unit_handler_class(dynamics)
+                              if unit_handler_class is not None else None)
+
+    def _annotation(self, key):
+        return self._dynamics.annotations.get((PLASTICITY, PYPE9_NS), key)
+
+    @property
+    def name(self):
+        "The name of the projection the plasticity belongs to"
+        return self._annotation(PLASTICITY_PROJECTION)
+
+    @property
+    def dynamics(self):
+        return self._dynamics
+
+    @property
+    def unit_handler(self):
+        return self._unit_handler
+
+    @property
+    def receive_port(self):
+        """
+        The event receive port of the cell that the pre-synaptic events are
+        received on
+        """
+        return self._annotation(PLASTICITY_RECEIVE_PORT)
+
+    @property
+    def weight_parameter(self):
+        "The connection parameter of the cell the weight is assigned to"
+        return self._annotation(PLASTICITY_WEIGHT_PARAM)
+
+    @property
+    def weight(self):
+        "The name of the alias or state variable that supplies the weight"
+        return self._annotation(PLASTICITY_WEIGHT)
+
+    @property
+    def weight_aliases(self):
+        "The aliases required to calculate the weight"
+        return self._dynamics.required_for(
+            [self._dynamics.analog_send_port(self.weight)]).expressions
+
+    @property
+    def last_event_time(self):
+        "The state variable that holds the time of the previous event"
+        return self.varname(LAST_EVENT_TIME)
+
+    @property
+    def parameters(self):
+        return sorted(self._dynamics.parameters, key=lambda p: p.name)
+
+    @property
+    def constants(self):
+        return sorted(self._dynamics.constants, key=lambda c: c.name)
+
+    @property
+    def state_variables(self):
+        return sorted(self._dynamics.state_variables, key=lambda s: s.name)
+
+    @property
+    def state_variable_names(self):
+        return [sv.name for sv in self.state_variables]
+
+    @property
+    def pre_on_event(self):
+        return self._on_event(self._annotation(PLASTICITY_PRE_PORT))
+
+    @property
+    def post_on_event(self):
+        "The on-event of post-synaptic events (None if there isn't one)"
+        return self._on_event(self._annotation(PLASTICITY_POST_PORT))
+
+    def _on_event(self, port_name):
+        if not port_name:
+            return None
+        regime = next(self._dynamics.regimes)
+        return next(oe for oe in regime.on_events
+                    if oe.src_port_name == port_name)
+
+    def varname(self, name):
+        """
+        Returns the name of a parameter or state variable of the original
+        plasticity in the namespace of the projection
+        """
+        return append_namespace(name, self.name)
+
+    def state_variable(self, name):
+        """
+        Returns the state variable of the original plasticity with the given
+        name (in the namespace of the projection)
+        """
+        try:
+            return self._dynamics.state_variable(self.varname(name))
+        except NineMLNameError:
+            suffix = '__' + self.name
+            raise NineMLNameError(
+                "'{}' is not a state variable of the plasticity of '{}' "
+                "projection (available '{}')".format(
+                    name, self.name, "', '".join(
+                        n[:-len(suffix)] for n in self.state_variable_names
+                        if n != self.last_event_time)))
+
+
+def _alias_map(component_class):
+    return dict((sympy.Symbol(a.lhs), sympy.sympify(a.rhs))
+                for a in component_class.aliases)
+
+
+def _expand(expr, aliases):
+    "Substitutes the aliases into an expression (recursively)"
+    expr = sympy.sympify(expr)
+    while expr.free_symbols & set(aliases):
+        expr = expr.xreplace(aliases)
+    return expr
+
+
+def _zero(dimension):
+    """
+    A zero quantity of the given dimension, used as the placeholder for the
+    weight parameter of the response (zero has the same value in all units)
+    """
+    if dimension == un.dimensionless:
+        return 0.0 * un.unitless
+    return 0.0 * un.Unit(dimension.name + '_SI', dimension=dimension, power=0)
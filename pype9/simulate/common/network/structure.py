@@ -0,0 +1,124 @@
+"""
+  The spatial structure of populations, which is used by distance-dependent
+  connection rules (see connection_rules.py). As 9ML v1 doesn't describe the
+  positions of cells, the structure is stored in Pype9 annotations of the
+  population, e.g.::
+
+      set_structure(exc_pop, 'Grid2D', dx=20.0, dy=20.0)
+
+  The structure types correspond to the PyNN space classes (all lengths are
+  in um) and the positions are generated identically on every MPI process.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+import pyNN.space
+from pype9.annotations import (
+    PYPE9_NS, STRUCTURE, STRUCTURE_TYPE, STRUCTURE_PARAMS)
+from pype9.exceptions import Pype9UsageError
+
+# The structure types and the PyNN space classes (or factory functions for
+# random structures, which take the boundary parameters) they map onto
+STRUCTURE_TYPES = {
+    'Line': pyNN.space.Line,
+    'Grid2D': pyNN.space.Grid2D,
+    'Grid3D': pyNN.space.Grid3D,
+    'RandomCuboid': (
+        lambda width, height, depth, rng=None, **kwargs:
+        pyNN.space.RandomStructure(
+            pyNN.space.Cuboid(width, height, depth), rng=rng, **kwargs)),
+    'RandomSphere': (
+        lambda radius, rng=None, **kwargs:
+        pyNN.space.RandomStructure(
+            pyNN.space.Sphere(radius), rng=rng, **kwargs))}
+
+RANDOM_STRUCTURE_TYPES = ('RandomCuboid', 'RandomSphere')
+
+
+def set_structure(population, structure_type, **params):
+    """
+    Sets the spatial structure of a population (or component array)
+
+    Parameters
+    ----------
+    population : nineml.Population | nineml.ComponentArray
+        The population to set the structure of
+    structure_type : str
+        The type of the structure, one of 'Line', 'Grid2D', 'Grid3D',
+        'RandomCuboid' or 'RandomSphere'
+    params : dict(str, float)
+        The parameters of the structure (see the corresponding PyNN space
+        classes)
+    """
+    if structure_type not in STRUCTURE_TYPES:
+        raise Pype9UsageError(
+            "Unrecognised structure type '{}' (can be '{}')"
+            .format(structure_type, "', '".join(sorted(STRUCTURE_TYPES))))
+    population.annotations.set((STRUCTURE, PYPE9_NS), STRUCTURE_TYPE,
+                               structure_type)
+    population.annotations.set(
+        (STRUCTURE, PYPE9_NS), STRUCTURE_PARAMS,
+        ','.join('{}={}'.format(k, v) for k, v in sorted(params.items())))
+
+
+def copy_structure(source, destination):
+    "Copies the structure annotations from one 9ML object to another"
+    structure_type = source.annotations.get((STRUCTURE, PYPE9_NS),
+                                            STRUCTURE_TYPE, default=None)
+    if structure_type is not None:
+        for key in (STRUCTURE_TYPE, STRUCTURE_PARAMS):
+            destination.annotations.set(
+                (STRUCTURE, PYPE9_NS), key,
+                source.annotations.get((STRUCTURE, PYPE9_NS), key))
+
+
+def pyNN_structure(nineml_model, rng=None):
+    """
+    Returns the PyNN structure of the population/component array if it has
+    one, otherwise None
+
+    Parameters
+    ----------
+    nineml_model : nineml.Population | nineml.ComponentArray
+        The population to return the structure of
+    rng : pyNN.random.NumpyRNG
+        The (parallel-safe) random number generator used to position the cells
+        of random structures
+    """
+    structure_type = nineml_model.annotations.get(
+        (STRUCTURE, PYPE9_NS), STRUCTURE_TYPE, default=None)
+    if structure_type is None:
+        return None
+    params_str = nineml_model.annotations.get(
+        (STRUCTURE, PYPE9_NS), STRUCTURE_PARAMS, default='')
+    params = {}
+    for param in (p for p in params_str.split(',') if p):
+        name, value = param.split('=')
+        params[name] = (value if name == 'fill_order' else float(value))
+    if structure_type in RANDOM_STRUCTURE_TYPES:
+        params['rng'] = rng
+    try:
+        return STRUCTURE_TYPES[structure_type](**params)
+    except KeyError:
+        raise Pype9UsageError(
+            "Unrecognised structure type '{}' of '{}'"
+            .format(structure_type, nineml_model.name))
+    except TypeError as e:
+        raise Pype9UsageError(
+            "Invalid parameters for '{}' structure of '{}' ({}): {}"
+            .format(structure_type, nineml_model.name, params_str, e))
+
+
+def positions(nineml_model, rng=None):
+    """
+    Returns the positions of the cells in the population/component array as
+    a 3xN array. Populations without a structure are arranged on a line with
+    unit spacing (as in PyNN)
+    """
+    structure = pyNN_structure(nineml_model, rng=rng)
+    if structure is None:
+        structure = pyNN.space.Line()
+    return structure.generate_positions(nineml_model.size)
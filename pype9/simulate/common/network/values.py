@@ -1,8 +1,10 @@
 from __future__ import division
+import numpy
 from past.utils import old_div
 from pyNN.parameters import Sequence
 from pyNN.random import RandomDistribution
 from nineml.values import SingleValue, ArrayValue, RandomDistributionValue
+from pype9.exceptions import Pype9UsageError
 
 random_value_map = {
     'http://www.uncertml.org/distributions/uniform':
@@ -26,25 +28,102 @@ def get_pyNN_value(qty, unit_handler, rng):
         scalar = unit_handler.scalar(qty.units)
         val = Sequence(v * scalar for v in qty.value)
     elif isinstance(qty.value, RandomDistributionValue):
-        if unit_handler.scalar(qty.units) != 1.0:
-            raise NotImplementedError(
-                "Cannot currently scale random distributions as required to "
-                "get {} into the correct units".format(qty))
-        try:
-            rv_name, rv_param_names = random_value_map[
-                qty.value.distribution.standard_library]
-        except KeyError:
-            raise NotImplementedError(
-                "Sorry, '{}' random distributions are not currently supported"
-                .format(qty.value.distribution.standard_libary))
-        rv_params = [
-            qty.value.distribution.property(n).value for n in rv_param_names]
-        # UncertML uses 'rate' parameter whereas PyNN uses 'beta' parameter
-        # (1/rate) to define exponential random distributions.
-        if rv_name == 'exponential':
-            rv_params[0] = 1.0 / rv_params[0]
-        # FIXME: Need to scale random distribution to correct units. Should
-        #        probably derive PyNN RandomDistribution class to multiply by
-        #        when a value is drawn
-        val = RandomDistribution(rv_name, rv_params, rng=rng)
+        val = get_random_distribution(qty, unit_handler, rng)
+    return val
+
+
+def get_random_distribution(qty, unit_handler, rng):
+    """
+    Converts a quantity with a random distribution value into a PyNN random
+    distribution, which draws values in the units of the simulator from the
+    provided RNG (so that the values of a whole array can be drawn at once)
+
+    Parameters
+    ----------
+    qty : nineml.Quantity
+        A quantity with a RandomDistributionValue value
+    unit_handler : UnitHandler
+        The unit handler of the simulator
+    rng : pyNN.random.NumpyRNG
+        The RNG to draw values from
+    """
+    rv_name, rv_params = random_distribution_params(qty, unit_handler)
+    return RandomDistribution(rv_name, rv_params, rng=rng)
+
+
+def random_distribution_params(qty, unit_handler):
+    """
+    Returns the name and parameters of the random distribution of a quantity
+    in the form used by PyNN (and the native distributions of the
+    simulators), scaled so that the drawn values are in the units of the
+    simulator
+
+    Parameters
+    ----------
+    qty : nineml.Quantity
+        A quantity with a RandomDistributionValue value
+    unit_handler : UnitHandler
+        The unit handler of the simulator
+
+    Returns
+    -------
+    rv_name : str
+        The PyNN name of the distribution, e.g. 'normal'
+    rv_params : list(float)
+        The parameters of the distribution, e.g. the mean and standard
+        deviation (not the variance) of normal distributions
+    """
+    distribution = qty.value.distribution
+    try:
+        rv_name, rv_param_names = random_value_map[
+            distribution.standard_library]
+    except KeyError:
+        raise NotImplementedError(
+            "Sorry, '{}' random distributions are not currently supported"
+            .format(distribution.standard_library))
+    rv_params = [float(distribution.property(n).value)
+                 for n in rv_param_names]
+    # UncertML uses 'rate' and 'variance' parameters whereas PyNN uses
+    # 'beta' (1/rate) and 'sigma' (the standard deviation) parameters to
+    # define exponential and normal random distributions.
+    if rv_name == 'exponential':
+        rv_params[0] = 1.0 / rv_params[0]
+    elif rv_name == 'normal':
+        rv_params[1] = numpy.sqrt(rv_params[1])
+    # Scale the parameters of the distribution so that the drawn values are
+    # in the units of the simulator
+    scalar = unit_handler.scalar(qty.units)
+    if scalar != 1.0:
+        if rv_name in ('uniform', 'normal'):
+            rv_params = [p * scalar for p in rv_params]
+        elif rv_name == 'exponential':
+            rv_params[0] *= scalar
+        elif rv_name == 'gamma':
+            rv_params[1] *= scalar
+        elif rv_name == 'lognormal':
+            rv_params[0] += numpy.log(scalar)
+        else:
+            raise Pype9UsageError(
+                "Cannot scale {} random distribution ({}) into the units of "
+                "the simulator".format(rv_name, qty))
+    return rv_name, rv_params
+
+
+def get_values(qty, unit_handler, rng, size):
+    """
+    Returns an array of values for the quantity scaled to the units of the
+    simulator, drawing them from the random distribution if required (used by
+    the backends without a PyNN interface)
+    """
+    val = get_pyNN_value(qty, unit_handler, rng)
+    if isinstance(val, Sequence):
+        val = numpy.asarray(val.value)
+        if len(val) != size:
+            raise Pype9UsageError(
+                "Length of array value ({}) does not match required size "
+                "({})".format(len(val), size))
+    elif isinstance(val, RandomDistribution):
+        val = numpy.asarray(val.next(size), dtype=float).reshape(size)
+    else:
+        val = numpy.ones(size) * val
     return val
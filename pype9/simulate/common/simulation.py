@@ -1,12 +1,24 @@
 from builtins import object
 from abc import ABCMeta, abstractmethod
+import os.path
 from nineml import units as un
 import numpy
 import time
-from pype9.exceptions import Pype9UsageError, Pype9NoActiveSimulationError
+import h5py
+import neo
+import quantities as pq
+from pype9.exceptions import (
+    Pype9UsageError, Pype9NoActiveSimulationError, Pype9RuntimeError)
 from pyNN.random import NumpyRNG
 from future.utils import with_metaclass
-from pype9.utils.logging import logger
+from pype9.utils.logging import get_logger
+from pype9.utils.mpi import MPI_ROOT, rank_path
+from .cells.storage import RecordingStore
+
+logger = get_logger(__name__)
+
+# The number of progress reports made over each run if no interval is given
+NUM_PROGRESS_REPORTS = 100
 
 
 class Simulation(with_metaclass(ABCMeta, object)):
@@ -28,6 +40,44 @@ class Simulation(with_metaclass(ABCMeta, object)):
             # Create simulator objects here
             sim.run(100.0 * un.ms)
 
+    The state of a running simulation can be saved to file with
+    ``save_state`` and restored into an equivalent simulation (i.e. one in
+    which the same cells and networks have been created in the same order)
+    with ``restore_state``
+
+    .. code-block:: python
+
+       with Simulation(dt=0.1 * un.ms, seed=12345) as sim:
+            # Create simulator objects here
+            sim.restore_state('checkpoint.h5')
+            sim.run(50.0 * un.ms)
+
+    Recordings of long simulations of many cells can be spooled to a HDF5
+    file at regular intervals while the simulation runs, instead of being held
+    in memory until it completes, by providing the 'spool_recordings'
+    argument, in which case ``Cell.recording`` returns proxy objects that
+    only load the recordings (or the requested time slices of them) when
+    their ``load`` method is called
+
+    .. code-block:: python
+
+       with Simulation(dt=0.1 * un.ms, spool_recordings='recs.h5') as sim:
+            # Create and record from cells here
+            sim.run(60.0 * un.s)
+       v = cell.recording('v').load(time_slice=(1.0 * pq.s, 2.0 * pq.s))
+
+    The progress of long runs can be reported with ``register_progress`` and
+    a run can be cancelled cleanly with ``cancel`` (e.g. from another thread
+    or a signal handler), after which the recordings up to the time it was
+    cancelled at can be accessed as for a completed run
+
+    .. code-block:: python
+
+       with Simulation(dt=0.1 * un.ms) as sim:
+            # Create and record from cells here
+            sim.register_progress(lambda p: print(p))
+            sim.run(60.0 * un.s)
+
     After the simulation context exits all objects in the simulator backend are
     destroyed (unless an exception is thrown) and only recordings can be
     reliably accessed from the "dead" Pype9 objects.
@@ -45,9 +95,9 @@ class Simulation(with_metaclass(ABCMeta, object)):
     properties_seed : int | None
         The seed used for random number generator used to set properties and
         generate connectivity. If not provided it will be derived from the
-        'seed' argument.
-        NB: This seed will only reproduce constant results if the number
-        of MPI nodes is constant
+        'seed' argument. The same properties seed is used on every MPI
+        process so that the properties and connectivity of networks do not
+        depend on the number of processes they are distributed over
     min_delay : nineml.Quantity (time) | None
         The minimum delay in the network. If None the min delay will be
         calculated from the first network to be created (if a single cell
@@ -56,6 +106,14 @@ class Simulation(with_metaclass(ABCMeta, object)):
         The maximum delay in the network. If None the max delay will be
         calculated from the first network to be created (if a single cell
         then it will be the same as the timestep)
+    spool_recordings : str | bool | None
+        Path of a HDF5 file to spool the recordings of cells to while the
+        simulation runs (the rank of the process is appended to the file name
+        if there is more than one MPI process). If True, a temporary file is
+        used, which is deleted when ``recording_store.close()`` is called.
+    spool_interval : nineml.Quantity (time)
+        The interval at which recorded samples are moved from the buffers of
+        the simulator to the spool file. Must be a multiple of the time step
     options : dict(str, object)
         Options passed to the simulator-specific methods
     """
@@ -64,7 +122,9 @@ class Simulation(with_metaclass(ABCMeta, object)):
 
     def __init__(self, dt, t_start=0.0 * un.s, seed=None, properties_seed=None,
                  min_delay=1 * un.ms, max_delay=10 * un.ms,
-                 code_generator=None, build_base_dir=None, **options):
+                 code_generator=None, build_base_dir=None,
+                 spool_recordings=None, spool_interval=100.0 * un.ms,
+                 **options):
         self._check_units('dt', dt, un.time)
         self._check_units('t_start', dt, un.time)
         self._check_units('min_delay', dt, un.time, allow_none=True)
@@ -95,6 +155,11 @@ class Simulation(with_metaclass(ABCMeta, object)):
                 "Cannot provide both code generator and 'build_base_dir' "
                 "options to Simulation __init__")
         self._code_generator = code_generator
+        self._check_units('spool_interval', spool_interval, un.time)
+        self._spool_path = spool_recordings
+        self._spool_interval = spool_interval
+        self._recording_store = None
+        self._cancelled = False
 
     @property
     def code_generator(self):
@@ -117,6 +182,12 @@ class Simulation(with_metaclass(ABCMeta, object)):
         self._prepare()
         self._registered_cells = []
         self._registered_arrays = []
+        self._streams = []
+        self._stop_requested = False
+        if self._spool_path and self._recording_store is None:
+            self._recording_store = RecordingStore(
+                None if self._spool_path is True else
+                self._state_path(self._spool_path))
         self.__class__._active = self
 
     def deactivate(self, kill_cells=True):
@@ -132,6 +203,7 @@ class Simulation(with_metaclass(ABCMeta, object)):
                 "Not killing cells as an uncaught exception was thrown")
         self._registered_cells = None
         self._registered_arrays = None
+        self._streams = None
 
     @property
     def dt(self):
@@ -166,9 +238,9 @@ class Simulation(with_metaclass(ABCMeta, object)):
     def properties_seed(self):
         """
         The seed used to by random dynamic processes (typically in state
-        assignments).
+        assignments). It is shared by all MPI processes.
         """
-        return self._properties_seeds[self.mpi_rank()]
+        return self._properties_seeds[MPI_ROOT]
 
     @property
     def all_properties_seeds(self):
@@ -189,6 +261,14 @@ class Simulation(with_metaclass(ABCMeta, object)):
         """
         return self._base_seed
 
+    @property
+    def seed(self):
+        """
+        The base seed the process/thread seeds were generated from, i.e. the
+        provided base seed or the one generated from the time if it was None
+        """
+        return self._seed
+
     @property
     def base_properties_seed(self):
         return self._base_properties_seed
@@ -207,6 +287,7 @@ class Simulation(with_metaclass(ABCMeta, object)):
         Generate seeds for each process/thread
         """
         seed = self.gen_seed() if self._base_seed is None else self._base_seed
+        self._seed = seed
         seed_gen_rng = numpy.random.RandomState(seed)
         if self._base_properties_seed is None:
             logger.info("Using {} as seed for both properties and dynamics of "
@@ -227,7 +308,12 @@ class Simulation(with_metaclass(ABCMeta, object)):
                                  size=self.num_threads()), dtype=int)
         self._global_seed = int(seed_gen_rng.uniform(low=0, high=self.max_seed,
                                                      size=1,))
-        self._properties_rng = NumpyRNG(int(self.properties_seed))
+        # All processes share the properties seed of the master process and
+        # draw parallel-safe values for the complete network (keeping only
+        # the values for their local cells) so that the network is constructed
+        # identically regardless of how it is distributed
+        self._properties_rng = NumpyRNG(int(self.properties_seed),
+                                        parallel_safe=True)
 
     @property
     def derived_properties_seed(self):
@@ -236,30 +322,389 @@ class Simulation(with_metaclass(ABCMeta, object)):
 
     def run(self, t_stop, **kwargs):
         """
-        Run the simulation until time ``t_stop``.
+        Run the simulation for a further ``t_stop``. If callbacks have been
+        registered with recordings (see ``Cell.record``) the simulation is
+        paused at their intervals to pass them the latest recorded data, and
+        can be stopped early by calling ``stop`` from within a callback.
 
         Parameters
         ----------
         t_stop : nineml.Quantity (time)
-            The time to run the simulation until
+            The time to run the simulation for
         """
         self._check_units('t_stop', t_stop, un.time)
         if not self._running:
             self._initialize()
             self._running = True
-        self._run(t_stop, **kwargs)
-        self._t = t_stop
+        self._stop_requested = False
+        self._cancelled = False
+        t_run_start = t = float(self._t.in_units(un.ms))
+        t_end = t + float(t_stop.in_units(un.ms))
+        # Tolerance for rounding errors when comparing times
+        tol = float(self.dt.in_units(un.ms)) / 2.0
+        logger.debug("Running {} simulation from {} ms to {} ms"
+                     .format(self.name, t, t_end))
+        for stream in self._streams:
+            if isinstance(stream, ProgressStream):
+                stream.start(t, t_end)
+        while t < t_end - tol and not self._stop_requested:
+            t_next = min([t_end] + [s.next_t for s in self._streams
+                                    if s.next_t is not None])
+            if t_next == t_end and t == t_run_start:
+                duration = t_stop  # Avoid rounding errors in uninterrupted runs
+            else:
+                duration = (t_next - t) * un.ms
+            self._run(duration, **kwargs)
+            # Like the PyNN backends, each call to run advances the simulation
+            # from the current time
+            self._t = t_next * un.ms
+            t = t_next
+            for stream in self._streams:
+                if stream.next_t is not None and stream.next_t <= t + tol:
+                    stream.flush(t)
+            # Pass any remaining data to the callbacks at the end of the run
+            if self._stop_requested or t >= t_end - tol:
+                for stream in self._streams:
+                    if stream.t < t - tol:
+                        stream.flush(t)
+        if self._cancelled:
+            logger.info("Cancelled {} simulation at {} ms (of {} ms)"
+                        .format(self.name, t, t_end))
+
+    def run_stream(self, t_stop, chunk, **kwargs):
+        """
+        Runs the simulation for a further ``t_stop`` in chunks, yielding the
+        simulation time after each chunk so that recordings can be accessed
+        (e.g. with ``recording(port_name, t_start=...)``) while the simulation
+        is running. The simulation can be stopped early by breaking out of the
+        loop (or calling ``stop``) and resumed with ``run``, e.g.::
+
+            for t in sim.run_stream(1000.0 * un.ms, chunk=100.0 * un.ms):
+                t_start = float(t.in_units(un.ms)) - 100.0
+                v = cell.recording('v', t_start=t_start * pq.ms)
+                if v.max() > 0.0 * pq.mV:
+                    break
+
+        Parameters
+        ----------
+        t_stop : nineml.Quantity (time)
+            The time to run the simulation for
+        chunk : nineml.Quantity (time)
+            The length of each chunk of the simulation
+        """
+        self._check_units('t_stop', t_stop, un.time)
+        self._check_units('chunk', chunk, un.time)
+        chunk = float(chunk.in_units(un.ms))
+        if chunk <= 0.0:
+            raise Pype9UsageError(
+                "Chunk length must be greater than zero ({} ms)".format(chunk))
+        t_end = float(self.t.in_units(un.ms)) + float(t_stop.in_units(un.ms))
+        tol = float(self.dt.in_units(un.ms)) / 2.0
+        while float(self.t.in_units(un.ms)) < t_end - tol:
+            self.run(min(chunk, t_end - float(self.t.in_units(un.ms))) *
+                     un.ms, **kwargs)
+            yield self.t
+            if self._stop_requested:
+                return
+
+    def stop(self):
+        """
+        Stops the simulation at the end of the current callback interval or
+        chunk of ``run_stream`` (typically called from within a recording
+        callback to implement early stopping). The simulation can be resumed
+        with ``run``.
+        """
+        self._stop_requested = True
+
+    def cancel(self):
+        """
+        Cancels the current run cooperatively, i.e. the backend is stopped
+        cleanly at the end of the current interval of the registered
+        callbacks, samplers or progress reports (so progress should be
+        reported at a suitable interval for long runs to be cancelled
+        promptly). Unlike ``stop`` it can be called from another thread or a
+        signal handler. ``run`` then returns normally, so the recordings up
+        to the time the run was cancelled at can be accessed as usual, and
+        ``cancelled`` is set until the next call to ``run``.
+        """
+        self._cancelled = True
+        self._stop_requested = True
+
+    @property
+    def cancelled(self):
+        "Whether the last run was cancelled before it completed"
+        return self._cancelled
+
+    def register_progress(self, callback=None, interval=None):
+        """
+        Registers a callback that is passed a ``Progress`` report (the
+        fraction of the run that is complete, the estimated wall-clock time
+        remaining and the wall-clock time per biological second) at regular
+        intervals during each call to ``run`` and at its end.
+
+        Parameters
+        ----------
+        callback : function | None
+            The function to pass each Progress report to. If None, the
+            reports are logged by the simulation's logger
+        interval : nineml.Quantity (time) | None
+            The interval (of simulation time) between reports. Must be a
+            multiple of the time step. If None, NUM_PROGRESS_REPORTS (100)
+            reports are made over each run
+        """
+        self._check_units('interval', interval, un.time, allow_none=True)
+        dt = float(self.dt.in_units(un.ms))
+        if interval is not None:
+            interval = float(interval.in_units(un.ms))
+            num_steps = interval / dt
+            if interval <= 0.0 or abs(num_steps - round(num_steps)) > 1e-6:
+                raise Pype9UsageError(
+                    "Progress interval ({} ms) must be a positive multiple of "
+                    "the time step ({})".format(interval, self.dt))
+        if callback is None:
+            callback = log_progress
+        self._streams.append(ProgressStream(
+            callback, interval, float(self.t.in_units(un.ms)), dt))
+
+    def register_stream(self, recorder, port_name, callback, interval=None):
+        """
+        Registers a callback that is passed the data recorded from a port
+        since the callback was last called, at regular intervals during the
+        simulation and at the end of each call to ``run``. Typically called
+        via the 'callback' argument of ``Cell.record``.
+
+        Parameters
+        ----------
+        recorder : Cell
+            The object the port is recorded from, which needs to have a
+            ``recording(port_name)`` method
+        port_name : str
+            The name of the recorded port
+        callback : function
+            The function to pass each chunk of the recording (a
+            neo.AnalogSignal or neo.SpikeTrain) to
+        interval : nineml.Quantity (time) | None
+            The interval between calls to the callback. Must be a multiple of
+            the time step. If None, the callback is only called at the end of
+            each call to ``run``
+        """
+        self._check_units('interval', interval, un.time, allow_none=True)
+        if interval is not None:
+            interval = float(interval.in_units(un.ms))
+            num_steps = interval / float(self.dt.in_units(un.ms))
+            if interval <= 0.0 or abs(num_steps - round(num_steps)) > 1e-6:
+                raise Pype9UsageError(
+                    "Callback interval ({} ms) must be a positive multiple of "
+                    "the time step ({})".format(interval, self.dt))
+        self._streams.append(RecordingStream(
+            recorder, port_name, callback, interval,
+            float(self.t.in_units(un.ms))))
+
+    @property
+    def recording_store(self):
+        "The store recordings are spooled to (None if they are not spooled)"
+        return self._recording_store
+
+    def spool(self, recorder, port_name):
+        """
+        Registers a recorded port, the samples of which are moved from the
+        buffers of the simulator to the recording store at regular intervals
+        during the simulation (see the 'spool_recordings' argument). Typically
+        called via ``Cell.record``.
+
+        Parameters
+        ----------
+        recorder : Cell
+            The object the port is recorded from, which needs to have a
+            ``_spool(port_name)`` method
+        port_name : str
+            The name of the recorded port
+        """
+        if self._recording_store is None:
+            raise Pype9UsageError(
+                "Cannot spool the recording of '{}' as the {} simulation was "
+                "not created with the 'spool_recordings' argument"
+                .format(port_name, self.name))
+        interval = float(self._spool_interval.in_units(un.ms))
+        num_steps = interval / float(self.dt.in_units(un.ms))
+        if interval <= 0.0 or abs(num_steps - round(num_steps)) > 1e-6:
+            raise Pype9UsageError(
+                "Spool interval ({} ms) must be a positive multiple of the "
+                "time step ({})".format(interval, self.dt))
+        self._streams.append(SpoolingStream(
+            recorder, port_name, interval, float(self.t.in_units(un.ms))))
+
+    def register_sampler(self, sampler, interval):
+        """
+        Registers a function that samples values that aren't recorded by the
+        simulator (e.g. the states of plastic connections), which is called
+        with the simulation time at regular intervals during the simulation.
+        Typically called via ``ConnectionGroup.record``.
+
+        Parameters
+        ----------
+        sampler : function
+            The function to call at each sampling time, which is passed the
+            simulation time (ms)
+        interval : nineml.Quantity (time)
+            The interval between samples. Must be a multiple of the time step
+        """
+        self._check_units('interval', interval, un.time)
+        interval = float(interval.in_units(un.ms))
+        num_steps = interval / float(self.dt.in_units(un.ms))
+        if interval <= 0.0 or abs(num_steps - round(num_steps)) > 1e-6:
+            raise Pype9UsageError(
+                "Sampling interval ({} ms) must be a positive multiple of the "
+                "time step ({})".format(interval, self.dt))
+        self._streams.append(SamplingStream(
+            sampler, interval, float(self.t.in_units(un.ms)),
+            float(self.dt.in_units(un.ms)) / 2.0))
+
+    def save_state(self, path):
+        """
+        Saves the full state of the simulation (simulator kernel, cell and
+        network states, recording buffers and properties RNG) to file so that
+        it can be resumed later with ``restore_state``.
+
+        Parameters
+        ----------
+        path : str
+            Path of the HDF5 file to save the state to. If there is more than
+            one MPI process the rank of the process is appended to the file
+            name
+        """
+        if not self._running:
+            raise Pype9UsageError(
+                "Cannot save the state of {} simulation before it has been "
+                "run".format(self.name))
+        if self._recording_store is not None:
+            raise Pype9UsageError(
+                "Cannot save the state of {} simulation while recordings are "
+                "spooled to '{}'".format(self.name,
+                                         self._recording_store.path))
+        with h5py.File(self._state_path(path), 'w') as f:
+            f.attrs['simulator'] = self.name
+            f.attrs['t'] = float(self.t.in_units(un.ms))
+            f.attrs['dt'] = float(self.dt.in_units(un.ms))
+            f.attrs['num_processes'] = self.num_processes()
+            rng_state = self.properties_rng.rng.get_state()
+            rng = f.create_group('properties_rng')
+            rng.attrs['algorithm'] = rng_state[0]
+            rng.create_dataset('keys', data=rng_state[1])
+            rng.attrs['pos'] = rng_state[2]
+            rng.attrs['has_gauss'] = rng_state[3]
+            rng.attrs['cached_gaussian'] = rng_state[4]
+            self._save_kernel_state(f.create_group('kernel'))
+            cells = f.create_group('cells')
+            for i, cell in enumerate(self._registered_cells):
+                cell._save_state(cells.create_group(str(i)))
+            arrays = f.create_group('arrays')
+            for i, array in enumerate(self._registered_arrays):
+                array._save_state(arrays.create_group(str(i)))
+        logger.info("Saved state of {} simulation at {} to '{}'"
+                    .format(self.name, self.t, path))
+
+    def restore_state(self, path):
+        """
+        Restores the state of the simulation from a file previously written by
+        ``save_state``. The same cells and networks need to have been created
+        (in the same order) before the state is restored, after which the
+        simulation can be resumed with ``run``.
+
+        Parameters
+        ----------
+        path : str
+            Path of the HDF5 file to restore the state from
+        """
+        path = self._state_path(path)
+        if not os.path.exists(path):
+            raise Pype9UsageError(
+                "Could not find saved simulation state at '{}'".format(path))
+        with h5py.File(path, 'r') as f:
+            if f.attrs['simulator'] != self.name:
+                raise Pype9UsageError(
+                    "Cannot restore state saved by {} simulation in {} "
+                    "simulation".format(f.attrs['simulator'], self.name))
+            if f.attrs['dt'] != float(self.dt.in_units(un.ms)):
+                raise Pype9UsageError(
+                    "Time step of saved state ({} ms) does not match that of "
+                    "the simulation ({})".format(f.attrs['dt'], self.dt))
+            if f.attrs['num_processes'] != self.num_processes():
+                raise Pype9UsageError(
+                    "Number of processes of saved state ({}) does not match "
+                    "that of the simulation ({})"
+                    .format(f.attrs['num_processes'], self.num_processes()))
+            if (len(f['cells']) != len(self._registered_cells) or
+                    len(f['arrays']) != len(self._registered_arrays)):
+                raise Pype9UsageError(
+                    "Saved state contains {} cells and {} arrays but {} cells "
+                    "and {} arrays have been created in the simulation"
+                    .format(len(f['cells']), len(f['arrays']),
+                            len(self._registered_cells),
+                            len(self._registered_arrays)))
+            if not self._running:
+                self._initialize()
+                self._running = True
+            t = f.attrs['t'] * un.ms
+            self._restore_kernel_state(f['kernel'], t)
+            self._t = t
+            rng = f['properties_rng']
+            self.properties_rng.rng.set_state((
+                rng.attrs['algorithm'], rng['keys'][...], rng.attrs['pos'],
+                rng.attrs['has_gauss'], rng.attrs['cached_gaussian']))
+            for i, cell in enumerate(self._registered_cells):
+                cell._restore_state(f['cells'][str(i)])
+            for i, array in enumerate(self._registered_arrays):
+                array._restore_state(f['arrays'][str(i)])
+        logger.info("Restored state of {} simulation at {} from '{}'"
+                    .format(self.name, self.t, path))
+
+    def _state_path(self, path):
+        """
+        Each MPI process saves its own state to a separate file
+        """
+        if self.num_processes() > 1:
+            path = rank_path(path, self.mpi_rank())
+        return path
+
+    def _save_kernel_state(self, group):  # @UnusedVariable
+        """
+        Saves the state of the simulator kernel to the HDF5 group
+
+        Parameters
+        ----------
+        group : h5py.Group
+            The group to save the kernel state to
+        """
+        raise Pype9RuntimeError(
+            "Saving the state of {} simulations is not supported"
+            .format(self.name))
+
+    def _restore_kernel_state(self, group, t):  # @UnusedVariable
+        """
+        Restores the state of the simulator kernel from the HDF5 group
+
+        Parameters
+        ----------
+        group : h5py.Group
+            The group to restore the kernel state from
+        t : nineml.Quantity (time)
+            The time the state was saved at
+        """
+        raise Pype9RuntimeError(
+            "Restoring the state of {} simulations is not supported"
+            .format(self.name))
 
     @abstractmethod
     def _run(self, t_stop, **kwargs):  # @UnusedVariable
         """
         Calls the simulator-specific functions to advance the simulation
-        kernel until time t_stop
+        kernel by t_stop
 
         Parameters
         ----------
         t_stop : nineml.Quantity (time)
-            The time to run the simulation until
+            The time to run the simulation for
         """
 
     @abstractmethod
@@ -327,3 +772,264 @@ class Simulation(with_metaclass(ABCMeta, object)):
                 raise Pype9UsageError(
                     "Provided value to {} ({}) is not a valid '{}' "
                     "quantity".format(varname, val, dimension.name))
+
+
+class RecordingStream(object):
+    """
+    Passes the data recorded from a port to a callback in chunks as the
+    simulation runs (see Simulation.register_stream)
+
+    Parameters
+    ----------
+    recorder : Cell
+        The object the port is recorded from
+    port_name : str
+        The name of the recorded port
+    callback : function
+        The function to pass each chunk of the recording to
+    interval : float | None
+        The interval between calls to the callback (ms)
+    t : float
+        The time the stream starts from (ms)
+    """
+
+    def __init__(self, recorder, port_name, callback, interval, t):
+        self.recorder = recorder
+        self.port_name = port_name
+        self.callback = callback
+        self.interval = interval
+        self.t = t
+
+    @property
+    def next_t(self):
+        "The time the callback is next due to be called (ms)"
+        return self.t + self.interval if self.interval is not None else None
+
+    def flush(self, t):
+        """
+        Passes the data recorded since the callback was last called (up to
+        but not including time 't') to the callback
+        """
+        recording = self.recorder.recording(self.port_name)
+        if hasattr(recording, 'load'):
+            # Only load the chunk of spooled recordings
+            chunk = recording.load(time_slice=(self.t * pq.ms, t * pq.ms))
+        elif isinstance(recording, neo.SpikeTrain):
+            times = numpy.asarray(recording.rescale(pq.ms))
+            chunk = recording[numpy.logical_and(times >= self.t, times < t)]
+        else:
+            # Slice by sample index to avoid rounding errors in the times
+            start, end = (
+                int(round(float(((x * pq.ms - recording.t_start) /
+                                 recording.sampling_period).simplified)))
+                for x in (self.t, t))
+            chunk = recording[max(start, 0):end]
+        self.t = t
+        self.callback(chunk)
+
+
+class SpoolingStream(object):
+    """
+    Moves the samples recorded from a port from the buffers of the simulator
+    to the recording store as the simulation runs (see Simulation.spool)
+
+    Parameters
+    ----------
+    recorder : Cell
+        The object the port is recorded from
+    port_name : str
+        The name of the recorded port
+    interval : float
+        The interval between moves (ms)
+    t : float
+        The time the stream starts from (ms)
+    """
+
+    def __init__(self, recorder, port_name, interval, t):
+        self.recorder = recorder
+        self.port_name = port_name
+        self.interval = interval
+        self.t = t
+
+    @property
+    def next_t(self):
+        "The time the samples are next due to be moved (ms)"
+        return self.t + self.interval
+
+    def flush(self, t):
+        """
+        Moves the samples recorded up to time 't' to the recording store
+        """
+        self.recorder._spool(self.port_name)
+        self.t = t
+
+
+class SamplingStream(object):
+    """
+    Calls a sampling function at regular intervals as the simulation runs
+    (see Simulation.register_sampler)
+
+    Parameters
+    ----------
+    sampler : function
+        The function to call at each sampling time
+    interval : float
+        The interval between samples (ms)
+    t : float
+        The time the stream starts from (ms)
+    tol : float
+        Tolerance for rounding errors when comparing times (ms)
+    """
+
+    def __init__(self, sampler, interval, t, tol):
+        self.sampler = sampler
+        self.interval = interval
+        self.t = t
+        self.tol = tol
+
+    @property
+    def next_t(self):
+        "The time the next sample is due (ms)"
+        return self.t + self.interval
+
+    def flush(self, t):
+        """
+        Takes the samples that are due at or before time 't' (the final
+        flush at the end of each run is ignored if no sample is due)
+        """
+        while self.next_t <= t + self.tol:
+            self.t = self.next_t
+            self.sampler(self.t)
+
+
+class ProgressStream(object):
+    """
+    Passes Progress reports to a callback at regular intervals as the
+    simulation runs (see Simulation.register_progress)
+
+    Parameters
+    ----------
+    callback : function
+        The function to pass each Progress report to
+    interval : float | None
+        The interval between reports (ms). If None, NUM_PROGRESS_REPORTS
+        reports are made over each run
+    t : float
+        The time the stream starts from (ms)
+    dt : float
+        The time step of the simulation (ms)
+    """
+
+    def __init__(self, callback, interval, t, dt):
+        self.callback = callback
+        self.interval = interval
+        self.t = t
+        self.dt = dt
+        self._t_start = None
+        self._t_stop = None
+        self._step = interval
+        self._wall_start = None
+
+    def start(self, t, t_stop):
+        """
+        Starts the reports of a run from 't' to 't_stop' (ms)
+        """
+        self.t = self._t_start = t
+        self._t_stop = t_stop
+        self._wall_start = time.time()
+        if self.interval is None:
+            # Round to a multiple of the time step
+            num_steps = round((t_stop - t) / (NUM_PROGRESS_REPORTS * self.dt))
+            self._step = max(num_steps, 1) * self.dt
+
+    @property
+    def next_t(self):
+        "The time the next report is due (ms)"
+        if self._t_stop is None:
+            return None
+        return min(self.t + self._step, self._t_stop)
+
+    def flush(self, t):
+        """
+        Passes a report of the progress up to time 't' to the callback
+        """
+        self.t = t
+        if self._t_stop is not None:
+            self.callback(Progress(t, self._t_start, self._t_stop,
+                                   time.time() - self._wall_start))
+
+
+class Progress(object):
+    """
+    A report of the progress of a call to Simulation.run
+
+    Parameters
+    ----------
+    t : float
+        The current time of the simulation (ms)
+    t_start : float
+        The time the run started from (ms)
+    t_stop : float
+        The time the run will stop at (ms)
+    wall_time : float
+        The wall-clock time elapsed since the run started (s)
+    """
+
+    def __init__(self, t, t_start, t_stop, wall_time):
+        self.t = t
+        self.t_start = t_start
+        self.t_stop = t_stop
+        self.wall_time = wall_time
+
+    def __repr__(self):
+        return ("Progress({:.1f}%, {} of {} ms, {:.1f} s elapsed, ETA {})"
+                .format(self.percent, self.t - self.t_start,
+                        self.t_stop - self.t_start, self.wall_time,
+                        ('{:.1f} s'.format(self.eta)
+                         if self.eta is not None else 'unknown')))
+
+    @property
+    def fraction(self):
+        "The fraction of the run that is complete"
+        duration = self.t_stop - self.t_start
+        if duration <= 0.0:
+            return 1.0
+        return min(max((self.t - self.t_start) / duration, 0.0), 1.0)
+
+    @property
+    def percent(self):
+        "The percentage of the run that is complete"
+        return 100.0 * self.fraction
+
+    @property
+    def wall_time_per_second(self):
+        """
+        The wall-clock time taken to simulate each biological second (s),
+        None if no time has been simulated yet
+        """
+        simulated = (self.t - self.t_start) / 1000.0
+        if simulated <= 0.0:
+            return None
+        return self.wall_time / simulated
+
+    @property
+    def eta(self):
+        """
+        The estimated wall-clock time remaining (s), None if no time has been
+        simulated yet
+        """
+        per_second = self.wall_time_per_second
+        if per_second is None:
+            return None
+        return per_second * max(self.t_stop - self.t, 0.0) / 1000.0
+
+
+def log_progress(progress):
+    "Logs a Progress report (the default progress callback)"
+    logger.info(
+        "{:.1f}% complete ({:.1f} of {:.1f} ms), {:.1f} s elapsed, {} "
+        "remaining".format(
+            progress.percent, progress.t - progress.t_start,
+            progress.t_stop - progress.t_start, progress.wall_time,
+            ('{:.1f} s'.format(progress.eta)
+             if progress.eta is not None else 'unknown time')))
@@ -0,0 +1,322 @@
+"""
+
+  This package combines the common.ncml with the GeNN Python interface
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2014 Thomas G. Close.
+  License: This file is part of the "NineLine" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from __future__ import division
+import numpy
+import quantities as pq
+import neo
+from nineml import units as un
+from nineml.abstraction import EventPort
+from nineml.exceptions import NineMLNameError
+from pype9.simulate.common.cells import base
+from pype9.simulate.genn.code_gen import CodeGenerator
+from pype9.simulate.genn.simulation import Simulation
+from pype9.exceptions import (
+    Pype9UsageError, Pype9Unsupported9MLException)
+
+
+class Cell(base.Cell):
+    """
+    Base class for GeNN cell objects. The cells of each cell class are merged
+    into a single GeNN neuron population when the simulation is initialised,
+    so all inputs and recordings need to be specified before the simulation
+    is run. Parameters and state variables can be read (but not set) after
+    the simulation has been initialised.
+
+    Parameters
+    ----------
+    properties : list(nineml.Property)
+        Can accept a single property, which is a dictionary of properties
+        or a list of nineml.Property objects
+    kwargs : dict(str, nineml.Property)
+        A dictionary of properties
+    """
+
+    def __init__(self, *args, **kwargs):
+        self._flag_created(False)
+        self._values = {}
+        self._simulation = None
+        self._population = None
+        self._index = None
+        self._connections = []
+        self._event_inputs = []
+        self._current_inputs = []
+        self._recorded_vars = []
+        self._records_spikes = False
+        self._cache = None
+        # Call base init (needs to be after 9ML init)
+        super(Cell, self).__init__(*args, **kwargs)
+        self._flag_created(True)
+
+    def _attach(self, simulation, population, index):
+        """
+        Called by the simulation when the GeNN neuron population the cell is
+        merged into is constructed (a reference to the simulation is kept so
+        the recordings can be cached after it is deactivated)
+        """
+        super(base.Cell, self).__setattr__('_simulation', simulation)
+        super(base.Cell, self).__setattr__('_population', population)
+        super(base.Cell, self).__setattr__('_index', index)
+
+    def _get(self, varname):
+        if self._population is not None:
+            self._population.pull_var_from_device(varname)
+            return float(self._population.vars[varname].view[self._index])
+        try:
+            return self._values[varname]
+        except KeyError:
+            raise Pype9UsageError(
+                "'{}' doesn't have an attribute '{}'"
+                .format(self.name, varname))
+
+    def _set(self, varname, val):
+        if self._population is not None:
+            raise Pype9UsageError(
+                "Cannot set '{}' of '{}' cell after the GeNN simulation has "
+                "been initialised".format(varname, self.name))
+        self._values[varname] = val
+
+    def _set_regime(self):
+        self._values[self.code_generator.REGIME_VARNAME] = self._regime_index
+
+    def _check_not_initialised(self, action):
+        if self._population is not None:
+            raise Pype9UsageError(
+                "Cannot {} '{}' cell after the GeNN simulation has been "
+                "initialised".format(action, self.name))
+
+    def record(self, port_name, callback=None, callback_interval=None,
+               **kwargs):  # @UnusedVariable
+        """
+        Parameters
+        ----------
+        port_name : str
+            Name of the port to record from
+        callback : function | None
+            A function that is passed the recording (neo.AnalogSignal or
+            neo.SpikeTrain) in chunks while the simulation is running
+        callback_interval : Quantity (time) | None
+            The interval between calls to the callback. If None, it is only
+            called at the end of each call to ``Simulation.run``
+        """
+        self._check_not_initialised('record from')
+        self._initialize_local_recording()
+        try:
+            port = self.component_class.send_port(port_name)
+        except NineMLNameError:
+            port = self.component_class.state_variable(port_name)
+        if isinstance(port, EventPort):
+            self._recorders[port_name] = None
+            self._records_spikes = True
+        elif port_name in self.code_generator.var_names(self.name):
+            self._recorders[port_name] = port_name
+            self._recorded_vars.append(port_name)
+        else:
+            raise Pype9Unsupported9MLException(
+                "Can only record state variables, analog send ports mapped "
+                "to aliases and event send ports from GeNN cells, not '{}'"
+                .format(port_name))
+        self._register_stream(port_name, callback, callback_interval)
+
+    def record_regime(self):
+        self._check_not_initialised('record from')
+        self._initialize_local_recording()
+        regime_varname = self.code_generator.REGIME_VARNAME
+        self._recorders[regime_varname] = regime_varname
+        self._recorded_vars.append(regime_varname)
+
+    def recording(self, port_name, t_start=None):
+        """
+        Return recorded data as a dictionary containing one numpy array for
+        each neuron, ids as keys.
+        """
+        if self.is_dead():
+            t_stop = self._t_stop
+        else:
+            t_stop = self.Simulation.active().t
+        if t_start is None:
+            t_start = self.unit_handler.to_pq_quantity(self._t_start)
+        t_start = pq.Quantity(t_start, 'ms')
+        t_stop = self.unit_handler.to_pq_quantity(t_stop)
+        try:
+            port = self.component_class.port(port_name)
+        except NineMLNameError:
+            port = self.component_class.state_variable(port_name)
+        if isinstance(port, EventPort):
+            recording = neo.SpikeTrain(
+                self._trim_spike_train(self._spikes(), t_start),
+                t_start=t_start, t_stop=t_stop, units='ms')
+        else:
+            units_str = self.unit_handler.dimension_to_unit_str(
+                port.dimension, one_as_dimensionless=True)
+            interval = self._sampling_period()
+            recording = neo.AnalogSignal(
+                self._trim_analog_signal(self._samples(port_name), t_start,
+                                         interval),
+                sampling_period=interval, t_start=t_start, units=units_str,
+                name=port_name)
+        return recording
+
+    def _regime_recording(self):
+        regime_varname = self.code_generator.REGIME_VARNAME
+        return neo.AnalogSignal(
+            self._samples(regime_varname),
+            sampling_period=self._sampling_period(),
+            t_start=self.unit_handler.to_pq_quantity(self._t_start),
+            units='dimensionless', name=regime_varname)
+
+    def _spikes(self):
+        if self._cache is not None:
+            return self._cache['spikes']
+        if self._population is None:
+            return numpy.array([])
+        return self._simulation.spikes(self._population.name, self._index)
+
+    def _samples(self, var_name):
+        if self._cache is not None:
+            return self._cache[var_name]
+        if self._population is None:
+            raise Pype9UsageError(
+                "Simulation has not been run so there are no samples to "
+                "retrieve")
+        return self._simulation.samples(self._population.name, self._index,
+                                        var_name)
+
+    def _sampling_period(self):
+        if self._cache is not None:
+            return self._cache['dt']
+        if self._simulation is None:
+            return float(self.Simulation.active().dt.in_units(un.ms)) * pq.ms
+        return float(self._simulation.dt.in_units(un.ms)) * pq.ms
+
+    def reset_recordings(self):
+        raise Pype9UsageError(
+            "Recordings cannot be reset in GeNN simulations")
+
+    def play(self, port_name, signal, properties=[], interpolation='step'):
+        """
+        Injects current or plays a train of events into the cell
+
+        Parameters
+        ----------
+        port_name : str
+            The name of the receive port to play the signal into
+        signal : neo.AnalogSignal (current) | neo.SpikeTrain
+            Signal to play into the port
+        properties : list(nineml.Property)
+            The connection properties of the event port
+        interpolation : str
+            How analog signals are interpolated between their sample points,
+            'step' or 'linear'
+        """
+        self._check_not_initialised('play signals into')
+        port = self.component_class.port(port_name)
+        if isinstance(port, EventPort):
+            self._check_connection_properties(port_name, properties)
+            if len(properties) > 1:
+                raise NotImplementedError(
+                    "Cannot handle more than one connection property per port")
+            elif properties:
+                weight = self.unit_handler.scale_value(properties[0].quantity)
+            else:
+                weight = 1.0  # The weight var is not used
+            times = numpy.asarray(signal.times.rescale(pq.ms))
+            self._event_inputs.append((times, weight, port_name))
+        else:
+            # Currents are injected into the 'Isyn' input of the neuron,
+            # which the only analog receive port is mapped onto
+            if port.dimension != un.current:
+                raise Pype9Unsupported9MLException(
+                    "Can only play currents into GeNN cells, not '{}' into "
+                    "'{}' port".format(port.dimension, port_name))
+            self._check_interpolation(interpolation)
+            self._current_inputs.append((
+                numpy.asarray(signal.times.rescale(pq.ms)),
+                numpy.ravel(pq.Quantity(signal, 'nA')), interpolation))
+
+    def connect(self, sender, send_port_name, receive_port_name,
+                delay=0.0 * un.ms, properties=None):
+        """
+        Connects a port of the cell to a matching port on the 'other' cell
+
+        Parameters
+        ----------
+        sender : pype9.simulator.genn.cells.Cell
+            The sending cell to connect the from
+        send_port_name : str
+            Name of the port in the sending cell to connect to
+        receive_port_name : str
+            Name of the receive port in the current cell to connect from
+        delay : nineml.Quantity (time)
+            The delay of the connection
+        properties : list(nineml.Property)
+            The connection properties of the event port
+        """
+        send_port = sender.component_class.send_port(send_port_name)
+        receive_port = self.component_class.receive_port(receive_port_name)
+        if properties is None:
+            properties = []
+        if send_port.communicates != receive_port.communicates:
+            raise Pype9UsageError(
+                "Cannot connect {} send port, '{}', to {} receive port, '{}'"
+                .format(send_port.communicates, send_port_name,
+                        receive_port.communicates, receive_port_name))
+        if receive_port.communicates == 'event':
+            self._check_connection_properties(receive_port_name, properties)
+            if len(properties) > 1:
+                raise Pype9Unsupported9MLException(
+                    "Cannot handle more than one connection property per port")
+            elif properties:
+                weight = self.unit_handler.scale_value(properties[0].quantity)
+            else:
+                weight = 1.0  # The weight var is not used
+            self._add_connection(sender, weight, float(delay.in_units(un.ms)),
+                                 receive_port_name)
+        elif receive_port.communicates == 'analog':
+            raise Pype9UsageError(
+                "Cannot individually 'connect' analog ports. Simulate the "
+                "sending cell in a separate simulation then play the analog "
+                "signal in the port")
+        else:
+            raise Pype9UsageError(
+                "Unrecognised port communication '{}'".format(
+                    receive_port.communicates))
+
+    def _add_connection(self, sender, weight, delay, port_name):
+        """
+        Adds an incoming connection from the sender to the given port, with
+        the weight and delay already scaled to GeNN units
+        """
+        self._check_not_initialised('connect to')
+        self._connections.append((sender, weight, delay, port_name))
+
+    def _kill(self, t_stop):
+        if self._population is not None and hasattr(self, '_recorders'):
+            cache = {'dt': self._sampling_period()}
+            for tag in self._recorders.values():
+                if tag is None:
+                    cache['spikes'] = self._spikes()
+                else:
+                    cache[tag] = self._samples(tag)
+            super(base.Cell, self).__setattr__('_cache', cache)
+        super(Cell, self)._kill(t_stop)
+
+
+class CellMetaClass(base.CellMetaClass):
+
+    """
+    Metaclass for building NineMLCellType subclasses Called by
+    nineml_celltype_from_model
+    """
+
+    _built_types = {}  # Stores previously created types for reuse
+    CodeGenerator = CodeGenerator
+    BaseCellClass = Cell
+    Simulation = Simulation
@@ -0,0 +1,235 @@
+"""
+
+  This module contains functions for generating and loading GeNN neuron models
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2014 Thomas G. Close.
+  License: This file is part of the "NineLine" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+import os
+import json
+import shutil
+from datetime import datetime
+import pygenn
+from pygenn.genn_model import create_custom_neuron_class
+from pype9.simulate.common.code_gen import BaseCodeGenerator
+from pype9.simulate.common.network.plasticity import event_driven_synapses
+from pype9.simulate.genn.units import UnitHandler
+from pype9.exceptions import Pype9BuildError, Pype9Unsupported9MLException
+import pype9
+from pype9.utils.logging import logger
+
+
+class CodeGenerator(BaseCodeGenerator):
+    """
+    Generates the simulation code of GeNN neuron models from 9ML dynamics.
+    Unlike the other backends, only the code snippets of the neuron models are
+    generated by Pype9, and the CUDA (or C++) code of the complete model is
+    generated and compiled by GeNN when the simulation is initialised, as
+    GeNN compiles all of the neuron and synapse populations of a model
+    together.
+
+    Parameters
+    ----------
+    base_dir : str | None
+        The base directory for the generated code. If None a directory
+        will be created in user's home directory.
+    """
+
+    SIMULATOR_NAME = 'genn'
+    SIMULATOR_VERSION = pygenn.__version__
+    ODE_SOLVER_DEFAULT = 'euler'
+    REGIME_VARNAME = 'regime___pype9'
+    SPIKE_VARNAME = 'spike___pype9'
+    # The prefix of the additional input variables that the weights of the
+    # events received by each event port are accumulated into
+    EVENT_INPUT_PREFIX = 'Isyn_'
+    # The prefix of the extra global parameters the recorded variables are
+    # written into, which hold the samples of each neuron for the number of
+    # time steps in the extra global parameter named by RECORDING_STEPS_EGP
+    RECORDING_PREFIX = 'rec___pype9_'
+    RECORDING_STEPS_EGP = 'rec_steps___pype9'
+    BASE_TMPL_PATH = os.path.abspath(os.path.join(os.path.dirname(__file__),
+                                                  'templates'))
+    UnitHandler = UnitHandler
+
+    def __init__(self, **kwargs):
+        super(CodeGenerator, self).__init__(**kwargs)
+        self._neuron_models = {}
+        self._sim_codes = {}
+        self._metadata = {}
+        self._var_names = {}
+
+    def generate_source_files(self, component_class, src_dir, name=None,
+                              **kwargs):
+        if name is None:
+            name = component_class.name
+        if component_class.is_random:
+            raise Pype9Unsupported9MLException(
+                "Cannot generate GeNN neuron model for '{}' as random "
+                "distributions in state assignments are not supported by the "
+                "GeNN pipeline".format(name))
+        plastic = event_driven_synapses(component_class)
+        if plastic:
+            raise Pype9Unsupported9MLException(
+                "Cannot generate GeNN neuron model for '{}' as plasticity "
+                "with state ('{}') is not translated into GeNN weight-update "
+                "models by the GeNN pipeline (see the restrictions of the "
+                "GeNN pipeline in the 'Unsupported 9ML' page of the "
+                "documentation)"
+                .format(name, "', '".join(s.name for s in plastic)))
+        if component_class.num_event_send_ports > 1:
+            raise Pype9Unsupported9MLException(
+                "Multiple event send ports ('{}') are not supported by the "
+                "GeNN pipeline".format(
+                    "', '".join(component_class.event_send_port_names)))
+        if (component_class.num_analog_receive_ports +
+                component_class.num_analog_reduce_ports) > 1:
+            raise Pype9Unsupported9MLException(
+                "Cannot generate GeNN neuron model for '{}' as only one "
+                "analog receive port is supported by the GeNN pipeline (which "
+                "is mapped onto the 'Isyn' input of the neuron)".format(name))
+        ode_solver = kwargs.get('ode_solver', self.ODE_SOLVER_DEFAULT)
+        if ode_solver != 'euler':
+            raise Pype9BuildError(
+                "Unsupported ODE solver '{}' for GeNN pipeline (only 'euler' "
+                "is supported)".format(ode_solver))
+        tmpl_args = {
+            'code_gen': self,
+            'component_name': name,
+            'component_class': component_class,
+            'version': pype9.__version__, 'src_dir': src_dir,
+            'timestamp': datetime.now().strftime('%a %d %b %y %I:%M:%S%p'),
+            'unit_handler': UnitHandler(component_class),
+            'regime_varname': self.REGIME_VARNAME,
+            'spike_varname': self.SPIKE_VARNAME,
+            'event_input_prefix': self.EVENT_INPUT_PREFIX}
+        self.render_to_file('main.tmpl', tmpl_args,
+                            self._sim_code_fname(name), src_dir)
+        # Save the variables of the neuron model alongside of the simulation
+        # code so the model class can be created when it is loaded
+        metadata = {
+            'parameters': list(component_class.parameter_names),
+            'state_variables': list(component_class.state_variable_names),
+            'analog_send_ports': [
+                p.name for p in component_class.analog_send_ports
+                if p.name in component_class.alias_names],
+            'event_inputs': [self.EVENT_INPUT_PREFIX + n for n in
+                             component_class.event_receive_port_names]}
+        with open(os.path.join(src_dir, self._metadata_fname(name)), 'w') as f:
+            json.dump(metadata, f, indent=2)
+
+    def compile_source_files(self, compile_dir, name):
+        """
+        Copies the generated code snippets into the install directory. The
+        snippets are compiled by GeNN along with rest of the network when the
+        simulation is initialised
+        """
+        build_dir = os.path.dirname(compile_dir)
+        src_dir = os.path.join(build_dir, self._SRC_DIR)
+        install_dir = os.path.join(build_dir, self._INSTL_DIR)
+        for fname in (self._sim_code_fname(name), self._metadata_fname(name)):
+            try:
+                shutil.copy(os.path.join(src_dir, fname),
+                            os.path.join(install_dir, fname))
+            except IOError as e:
+                raise Pype9BuildError(
+                    "Could not install GeNN neuron model '{}' from source "
+                    "directory '{}': {}".format(name, src_dir, e))
+        logger.info("Installed GeNN neuron model for '{}' in '{}'"
+                    .format(name, install_dir))
+
+    def load_libraries(self, name, url, **kwargs):  # @UnusedVariable
+        install_dir = self.get_install_dir(name, url)
+        try:
+            with open(os.path.join(install_dir,
+                                   self._sim_code_fname(name))) as f:
+                sim_code = f.read()
+            with open(os.path.join(install_dir,
+                                   self._metadata_fname(name))) as f:
+                metadata = json.load(f)
+        except IOError as e:
+            raise Pype9BuildError(
+                "Could not load GeNN neuron model '{}' from '{}' (it may need "
+                "to be rebuilt): {}".format(name, install_dir, e))
+        # All parameters are stored as variables so they can vary between
+        # the neurons of a population
+        self._var_names[name] = (metadata['parameters'] +
+                                 metadata['state_variables'] +
+                                 metadata['analog_send_ports'])
+        self._sim_codes[name] = sim_code
+        self._metadata[name] = metadata
+
+    def neuron_model(self, name, recorded_vars=()):
+        """
+        The GeNN neuron model loaded for the named cell class
+
+        Parameters
+        ----------
+        name : str
+            The name of the cell class
+        recorded_vars : list(str)
+            The variables that are recorded from the neurons of the
+            population. Their values at the start of each time step are
+            written into the extra global parameters prefixed by
+            RECORDING_PREFIX on the device, so they can be copied from it in
+            batches
+        """
+        key = (name, tuple(recorded_vars))
+        try:
+            return self._neuron_models[key]
+        except KeyError:
+            pass
+        sim_code = self._sim_codes[name]
+        egps = []
+        if recorded_vars:
+            # The number of steps is only set when the model is loaded
+            egps.append((self.RECORDING_STEPS_EGP, 'unsigned int'))
+            egps.extend((self.RECORDING_PREFIX + v, 'scalar*')
+                        for v in recorded_vars)
+            rec_step = '(unsigned int)round($(t) / DT) % $({steps})'.format(
+                steps=self.RECORDING_STEPS_EGP)
+            sim_code = ''.join(
+                '$({prefix}{var})[$(id) * $({steps}) + {step}] = $({var});\n'
+                .format(prefix=self.RECORDING_PREFIX, var=v,
+                        steps=self.RECORDING_STEPS_EGP, step=rec_step)
+                for v in recorded_vars) + sim_code
+        model = create_custom_neuron_class(
+            name if not recorded_vars else name + '_recorded',
+            var_name_types=(
+                [(n, 'scalar') for n in self._var_names[name]] +
+                [(self.REGIME_VARNAME, 'unsigned int'),
+                 (self.SPIKE_VARNAME, 'unsigned int')]),
+            sim_code=sim_code,
+            threshold_condition_code='$({}) != 0'.format(self.SPIKE_VARNAME),
+            reset_code='',
+            extra_global_params=egps,
+            additional_input_vars=[
+                (n, 'scalar', 0.0)
+                for n in self._metadata[name]['event_inputs']],
+            is_auto_refractory_required=False)
+        self._neuron_models[key] = model
+        return model
+
+    def var_names(self, name):
+        """
+        The names of the (scalar) variables of the GeNN neuron model loaded
+        for the named cell class
+        """
+        return self._var_names[name]
+
+    def simulator_specific_paths(self):
+        path = []
+        if 'CUDA_PATH' in os.environ:
+            path.append(os.path.join(os.environ['CUDA_PATH'], 'bin'))
+        return path
+
+    @classmethod
+    def _sim_code_fname(cls, name):
+        return name + '_sim_code.cc'
+
+    @classmethod
+    def _metadata_fname(cls, name):
+        return name + '.json'
@@ -0,0 +1,375 @@
+from __future__ import absolute_import, division
+from builtins import zip
+import os
+from collections import defaultdict
+import numpy
+from pygenn.genn_model import (
+    GeNNModel, create_custom_postsynaptic_class,
+    create_custom_current_source_class)
+from nineml import units as un
+from pype9.simulate.common.simulation import Simulation as BaseSimulation
+from pype9.simulate.genn.code_gen import CodeGenerator
+from pype9.utils.mpi import mpi_comm
+
+
+# Accumulates the weights of the events received in each time step into the
+# additional input variable of the event port the synapses target
+event_input_model = create_custom_postsynaptic_class(
+    'EventInput___pype9',
+    apply_input_code='$(Isyn) += $(inSyn);',
+    decay_code='$(inSyn) = 0;')
+
+# Injects the currents played into the cells of a population, which are
+# resampled at the time step of the simulation from its start
+current_playback_model = create_custom_current_source_class(
+    'CurrentPlayback___pype9',
+    param_names=['size', 'num_steps'],
+    injection_code=(
+        'const unsigned int step = min((unsigned int)round($(t) / DT), '
+        '(unsigned int)$(num_steps) - 1);\n'
+        '$(injectCurrent, $(amplitudes)[step * (unsigned int)$(size) + '
+        '$(id)]);'),
+    extra_global_params=[('amplitudes', 'scalar*')])
+
+
+class Simulation(BaseSimulation):
+    """
+    Controls the construction and running of GeNN simulations. As GeNN
+    generates and compiles the code for the complete model (on the GPU by
+    default), the cells and networks created within the simulation context
+    are collected, and the cells of each cell class are merged into a single
+    GeNN neuron population when the simulation is first run.
+
+    Parameters
+    ----------
+    precision : str
+        The precision of the 'scalar' type in the generated code ('float' or
+        'double')
+    backend : str | None
+        The GeNN backend to generate the model code for ('CUDA',
+        'SingleThreadedCPU', etc...). If None GeNN selects the CUDA backend if
+        it is available
+    recording_interval : nineml.Quantity (time)
+        The interval at which the spikes and samples recorded on the device
+        are copied from it, which sets the size of the recording buffers (or
+        the length of the first run if it is shorter)
+    """
+
+    _active = None
+    name = 'GeNN'
+    CodeGenerator = CodeGenerator
+    MODEL_NAME = 'pype9'
+
+    def __init__(self, *args, **kwargs):
+        self._precision = kwargs.pop('precision', 'float')
+        self._backend = kwargs.pop('backend', None)
+        recording_interval = kwargs.pop('recording_interval', 10.0 * un.ms)
+        super(Simulation, self).__init__(*args, **kwargs)
+        self._check_units('recording_interval', recording_interval, un.time)
+        self._recording_steps = max(int(round(
+            float(recording_interval.in_units(un.ms)) /
+            float(self.dt.in_units(un.ms)))), 1)
+        self._genn_model = None
+        self._build_dir = None
+        self._num_recording_steps = None
+        self._populations = None
+        self._samples = None
+        self._spikes = None
+        self._pulled_step = 0
+
+    def _run(self, t_stop, **kwargs):  # @UnusedVariable
+        """
+        Run the simulation for a further 't_stop'. The spikes and samples are
+        recorded on the device and copied from it each time the recording
+        buffers fill up and at the end of the run
+
+        Parameters
+        ----------
+        t_stop : nineml.Quantity (time)
+            The time to run the simulation for
+        """
+        num_steps = int(round(float(t_stop.in_units(un.ms)) /
+                              float(self.dt.in_units(un.ms))))
+        if self._num_recording_steps is None:
+            self._load(num_steps)
+        rec_steps = self._num_recording_steps
+        end_step = self._genn_model.timestep + num_steps
+        while self._genn_model.timestep < end_step:
+            next_pull = min(end_step, (self._genn_model.timestep //
+                                       rec_steps + 1) * rec_steps)
+            while self._genn_model.timestep < next_pull:
+                self._genn_model.step_time()
+            self._pull_recordings()
+
+    def _pull_recordings(self):
+        """
+        Copies the spikes and samples recorded since the last time they were
+        pulled from the recording buffers on the device, which are indexed
+        by the time step modulo the number of steps they hold
+        """
+        start = self._pulled_step
+        stop = self._genn_model.timestep
+        if stop == start:
+            return
+        rec_steps = self._num_recording_steps
+        # The rows of the buffers written since the last pull (which are
+        # always within the same cycle through the buffers)
+        first = start % rec_steps
+        last = first + stop - start
+        dt = float(self.dt.in_units(un.ms))
+        t_offset = float(self.t_start.in_units(un.ms))
+        if any(pop.spike_recording_enabled
+               for pop, _ in self._populations.values()):
+            self._genn_model.pull_recording_buffers_from_device()
+        for pop, cells in self._populations.values():
+            for var_name in self._recorded_var_names(cells):
+                egp_name = CodeGenerator.RECORDING_PREFIX + var_name
+                pop.pull_extra_global_param_from_device(egp_name)
+                buff = numpy.reshape(pop.extra_global_params[egp_name].view,
+                                     (len(cells), rec_steps))
+                self._samples[(pop.name, var_name)].append(
+                    numpy.array(buff[:, first:last].T))
+            if pop.spike_recording_enabled:
+                # PyGeNN times the rows of the buffer as if they were the
+                # steps preceding the current one, so the rows are recovered
+                # from the times and mapped onto the steps they were written
+                times, indices = pop.spike_recording_data
+                rows = (numpy.round(numpy.asarray(times) / dt).astype(int) -
+                        (stop - rec_steps))
+                written = (rows >= first) & (rows < last)
+                # Spikes are timed at the end of the step they are emitted in
+                for row, index in zip(rows[written],
+                                      numpy.asarray(indices)[written]):
+                    self._spikes[(pop.name, int(index))].append(
+                        (start - first + row + 1) * dt + t_offset)
+        self._pulled_step = stop
+
+    def _prepare(self, **kwargs):  # @UnusedVariable
+        "Reset the simulation and prepare it for creating new cells/networks"
+        self._genn_model = None
+        self._build_dir = None
+        self._num_recording_steps = None
+        self._populations = {}
+        self._samples = defaultdict(list)
+        self._spikes = defaultdict(list)
+        self._pulled_step = 0
+
+    def _initialize(self):
+        """
+        Constructs the GeNN model from the registered cells once their initial
+        states have been set, then builds it (it is loaded when it is first
+        run, see _load)
+        """
+        super(Simulation, self)._initialize()
+        if self._backend is not None:
+            model = GeNNModel(self._precision, self.MODEL_NAME,
+                              backend=self._backend)
+        else:
+            model = GeNNModel(self._precision, self.MODEL_NAME)
+        model.dT = float(self.dt.in_units(un.ms))
+        # Merge the cells of each class into a single neuron population
+        cell_classes = defaultdict(list)
+        for cell in self._registered_cells:
+            cell_classes[cell.name].append(cell)
+        num_steps = None
+        for i, (name, cells) in enumerate(sorted(cell_classes.items())):
+            cell_type = type(cells[0])
+            var_names = (cell_type.code_generator.var_names(name) +
+                         [CodeGenerator.REGIME_VARNAME,
+                          CodeGenerator.SPIKE_VARNAME])
+            var_init = dict(
+                (n, numpy.array([c._values.get(n, 0.0) for c in cells]))
+                for n in var_names)
+            pop = model.add_neuron_population(
+                'pop{}'.format(i), len(cells),
+                cell_type.code_generator.neuron_model(
+                    name, self._recorded_var_names(cells)), {}, var_init)
+            pop.spike_recording_enabled = any(c._records_spikes
+                                              for c in cells)
+            for index, cell in enumerate(cells):
+                cell._attach(self, pop, index)
+            self._populations[pop.name] = (pop, cells)
+            # Inject the currents played into the cells of the population
+            if any(c._current_inputs for c in cells):
+                if num_steps is None:
+                    num_steps = self._num_playback_steps()
+                amplitudes = numpy.zeros((num_steps, len(cells)))
+                times = (float(self.t_start.in_units(un.ms)) +
+                         numpy.arange(num_steps) *
+                         float(self.dt.in_units(un.ms)))
+                for index, cell in enumerate(cells):
+                    for sig_times, amps, interp in cell._current_inputs:
+                        amplitudes[:, index] += self._resample(
+                            times, sig_times, amps, interp)
+                source = model.add_current_source(
+                    pop.name + '_current', current_playback_model, pop.name,
+                    {'size': len(cells), 'num_steps': num_steps}, {})
+                source.set_extra_global_param('amplitudes',
+                                              amplitudes.ravel())
+        self._add_event_inputs(model)
+        self._add_connections(model)
+        build_dir = os.path.join(self.code_generator.base_dir, 'model')
+        if not os.path.exists(build_dir):
+            os.makedirs(build_dir)
+        model.build(build_dir)
+        self._genn_model = model
+        self._build_dir = build_dir
+
+    def _load(self, num_steps):
+        """
+        Loads the built model before it is first run, with recording buffers
+        that hold the steps of the recording interval or of the first run if
+        it is shorter. PyGeNN can only read the spike recordings once the
+        buffers have been filled, which they are by the end of the first run
+
+        Parameters
+        ----------
+        num_steps : int
+            The number of steps of the first run
+        """
+        rec_steps = max(min(self._recording_steps, num_steps), 1)
+        for pop, cells in self._populations.values():
+            recorded = self._recorded_var_names(cells)
+            if recorded:
+                pop.set_extra_global_param(CodeGenerator.RECORDING_STEPS_EGP,
+                                           rec_steps)
+            for var_name in recorded:
+                pop.set_extra_global_param(
+                    CodeGenerator.RECORDING_PREFIX + var_name,
+                    numpy.zeros(len(cells) * rec_steps))
+        self._genn_model.load(path_to_model=self._build_dir,
+                              num_recording_timesteps=rec_steps)
+        self._num_recording_steps = rec_steps
+
+    def _add_event_inputs(self, model):
+        """
+        Adds spike source arrays for the spike trains played into the event
+        ports of the cells, one for each population and port
+        """
+        for pop, cells in list(self._populations.values()):
+            inputs = defaultdict(list)
+            for index, cell in enumerate(cells):
+                for times, weight, port_name in cell._event_inputs:
+                    inputs[port_name].append((index, times, weight))
+            for port_name, port_inputs in sorted(inputs.items()):
+                label = '{}_{}_input'.format(pop.name, port_name)
+                ends = numpy.cumsum([len(t) for _, t, _ in port_inputs])
+                source = model.add_neuron_population(
+                    label, len(port_inputs), 'SpikeSourceArray', {},
+                    {'startSpike': numpy.concatenate(([0], ends[:-1])),
+                     'endSpike': ends})
+                source.set_extra_global_param(
+                    'spikeTimes', numpy.concatenate(
+                        [numpy.sort(t) - float(self.t_start.in_units(un.ms))
+                         for _, t, _ in port_inputs]))
+                self._add_synapses(
+                    model, label + '_syn', source.name, pop.name, port_name,
+                    numpy.arange(len(port_inputs)),
+                    numpy.array([i for i, _, _ in port_inputs]),
+                    numpy.array([w for _, _, w in port_inputs]), 0)
+
+    def _add_connections(self, model):
+        """
+        Adds the connections between the cells, grouped into a synapse
+        population for each source, target, port and delay
+        """
+        groups = defaultdict(list)
+        for pop, cells in list(self._populations.values()):
+            for index, cell in enumerate(cells):
+                for sender, weight, delay, port_name in cell._connections:
+                    groups[(sender._population.name, pop.name, port_name,
+                            self.delay_steps(delay))].append(
+                                (sender._index, index, weight))
+        for i, ((source, target, port_name, delay_steps),
+                conns) in enumerate(sorted(groups.items())):
+            pre_inds, post_inds, weights = (numpy.array(a)
+                                            for a in zip(*conns))
+            self._add_synapses(model, 'syn{}'.format(i), source, target,
+                               port_name, pre_inds, post_inds, weights,
+                               delay_steps)
+
+    @classmethod
+    def _add_synapses(cls, model, label, source, target, port_name, pre_inds,
+                      post_inds, weights, delay_steps):
+        # The synapse dynamics are part of the neuron models (plasticity with
+        # state is rejected by the connection groups) so the events only need
+        # to deliver their weights
+        syn = model.add_synapse_population(
+            label, 'SPARSE_INDIVIDUALG', delay_steps, source, target,
+            'StaticPulse', {}, {'g': weights}, {}, {},
+            event_input_model, {}, {})
+        syn.set_sparse_connections(pre_inds, post_inds)
+        # Accumulate the weights into the input variable of the port
+        syn.ps_target_var = CodeGenerator.EVENT_INPUT_PREFIX + port_name
+
+    def _num_playback_steps(self):
+        """
+        The number of steps to resample the played currents over, which
+        covers the longest signal played into any of the cells
+        """
+        t_end = max(t[-1] for _, cells in self._populations.values()
+                    for c in cells for t, _, _ in c._current_inputs)
+        return max(int(numpy.ceil(
+            (t_end - float(self.t_start.in_units(un.ms))) /
+            float(self.dt.in_units(un.ms)))) + 1, 1)
+
+    @classmethod
+    def _resample(cls, times, sig_times, amps, interpolation):
+        """
+        Resamples a played signal at the given times, holding each amplitude
+        until the next sample time unless interpolating linearly
+        """
+        if interpolation == 'linear':
+            return numpy.interp(times, sig_times, amps, left=0.0)
+        indices = numpy.searchsorted(sig_times, times, side='right') - 1
+        return numpy.where(indices >= 0,
+                           amps[numpy.clip(indices, 0, len(amps) - 1)], 0.0)
+
+    def delay_steps(self, delay):
+        """
+        The number of time steps to delay the delivery of the events by
+        (GeNN delivers events in the time step after they are emitted)
+
+        Parameters
+        ----------
+        delay : float
+            The delay of the connection in ms
+        """
+        return max(int(round(delay / float(self.dt.in_units(un.ms)))) - 1,
+                   0)
+
+    @classmethod
+    def _recorded_var_names(cls, cells):
+        "The names of the variables recorded from any of the cells"
+        var_names = set()
+        for cell in cells:
+            var_names.update(cell._recorded_vars)
+        return sorted(var_names)
+
+    def spikes(self, population, index):
+        "The spike times (in ms) emitted by the cell in the given population"
+        return numpy.array(self._spikes[(population, index)])
+
+    def samples(self, population, index, var_name):
+        "The sampled values of a variable of the cell in the given population"
+        samples = self._samples[(population, var_name)]
+        if not samples:
+            return numpy.array([])
+        return numpy.concatenate(samples)[:, index]
+
+    def mpi_rank(self):
+        "The rank of the MPI node the code is running on"
+        return mpi_comm.rank
+
+    def num_processes(self):
+        "The number of MPI processes"
+        return mpi_comm.size
+
+    def num_threads(self):
+        "The total number of threads across all MPI nodes"
+        return 1
+
+    def register_array(self, array):
+        # Arrays consist of individual GeNN cells, which register themselves
+        # with the simulation
+        self._registered_arrays.append(array)
@@ -0,0 +1,20 @@
+from nineml import units as un
+from pype9.simulate.common.units import UnitHandler as BaseUnitHandler
+
+
+class UnitHandler(BaseUnitHandler):
+
+    # GeNN doesn't have units, so the units of the NEURON point processes are
+    # used (which match the built-in GeNN neuron models)
+    basis = [un.ms, un.mV, un.nA, un.mM, un.nF, un.um, un.uS, un.K, un.cd]
+    compounds = []
+    unit_name_map = {un.ms: 'ms', un.mV: 'mV', un.nA: 'nA', un.mM: 'mM',
+                     un.nF: 'nF', un.um: 'um', un.uS: 'uS', un.K: 'K',
+                     un.cd: 'cd'}
+
+    (A, cache, si_lengths) = BaseUnitHandler._init_matrices_and_cache(
+        basis, compounds)
+
+    def _units_for_code_gen(self, units):
+        return self.compound_to_units_str(
+            units, mult_symbol='*', pow_symbol='^', use_parentheses=False)
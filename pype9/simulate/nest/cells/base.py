@@ -28,6 +28,8 @@ basic_nineml_translations = {
 
 class Cell(base.Cell):
 
+    spoolable = True
+
     def __init__(self, *properties, **kwprops):
         self._flag_created(False)
         self._cell = nest.Create(self.__class__.name)
@@ -35,6 +37,11 @@ class Cell(base.Cell):
         self._receive_ports = nest.GetDefaults(
             self.__class__.name)['receptor_types']
         self._inputs = {}
+        # Recorded events from before the simulation state was restored
+        self._restored_events = {}
+        # The voltages, series resistance and interpolation of the voltage
+        # clamp (if the cell is clamped)
+        self._clamp = None
         self._flag_created(True)
 
     def _get(self, varname):
@@ -47,7 +54,23 @@ class Cell(base.Cell):
         nest.SetStatus(self._cell, self.code_generator.REGIME_VARNAME,
                        self._regime_index)
 
-    def record(self, port_name, interval=None, **kwargs):  # @UnusedVariable @IgnorePep8
+    def record(self, port_name, interval=None, callback=None,
+               callback_interval=None, **kwargs):  # @UnusedVariable
+        """
+        Parameters
+        ----------
+        port_name : str
+            Name of the port to record from
+        interval : Quantity (time) | None
+            The sampling interval of analog recordings. Defaults to the time
+            step of the simulation
+        callback : function | None
+            A function that is passed the recording (neo.AnalogSignal or
+            neo.SpikeTrain) in chunks while the simulation is running
+        callback_interval : Quantity (time) | None
+            The interval between calls to the callback. If None, it is only
+            called at the end of each call to ``Simulation.run``
+        """
         # Create dictionaries for storing local recordings. These are not
         # created initially to save memory if recordings are not required or
         # handled externally
@@ -80,6 +103,7 @@ class Cell(base.Cell):
             nest.Connect(
                 recorder, self._cell,
                 syn_spec={'delay': self.device_delay_ms})
+        self._register_stream(port_name, callback, callback_interval)
 
     def record_regime(self, interval=None):
         self._initialize_local_recording()
@@ -100,6 +124,8 @@ class Cell(base.Cell):
         Return recorded data as a dictionary containing one numpy array for
         each neuron, ids as keys.
         """
+        if port_name in self._spooled:
+            return self._spooled_recording(port_name, t_start=t_start)
         # NB: Port could also be a state variable
         try:
             port = self.component_class.send_port(port_name)
@@ -115,15 +141,16 @@ class Cell(base.Cell):
         t_start = pq.Quantity(t_start, 'ms')
         t_stop = self.unit_handler.to_pq_quantity(t_stop)
         if port.nineml_type in ('EventSendPort', 'EventSendPortExposure'):
-            spikes = nest.GetStatus(
-                self._recorders[port_name], 'events')[0]['times']
+            spikes = self._events(port_name)['times']
             data = neo.SpikeTrain(
                 self._trim_spike_train(spikes * pq.ms, t_start),
                 t_start=t_start, t_stop=t_stop, name=port_name)
         else:
-            port_name = self.build_name(port_name)
-            events, interval = nest.GetStatus(self._recorders[port_name],
-                                              ('events', 'interval'))[0]
+            # The recorders are keyed by the port name (as in ``record``),
+            # the build name is only used for the recorded NEST variable
+            events = self._events(port_name)
+            interval = nest.GetStatus(self._recorders[port_name],
+                                      'interval')[0]
             try:
                 port = self._nineml.component_class.port(port_name)
             except NineMLNameError:
@@ -138,10 +165,31 @@ class Cell(base.Cell):
                 t_start=t_start, units=unit_str, name=port_name)
         return data
 
+    def _pop_recorded(self, port_name):
+        try:
+            port = self.component_class.send_port(port_name)
+        except NineMLNameError:
+            port = self.component_class.state_variable(port_name)
+        recorder = self._recorders[port_name]
+        events = self._events(port_name)
+        if port.nineml_type in ('EventSendPort', 'EventSendPortExposure'):
+            recorded = (events['times'], None, None)
+        else:
+            recorded = (
+                events[self.build_name(port_name)],
+                self.unit_handler.dimension_to_unit_str(
+                    port.dimension, one_as_dimensionless=True),
+                nest.GetStatus(recorder, 'interval')[0])
+        # Clear the events from the recorder
+        nest.SetStatus(recorder, {'n_events': 0})
+        self._restored_events.pop(port_name, None)
+        return recorded
+
     def _regime_recording(self):
-        events, interval = nest.GetStatus(
+        events = self._events(self.code_generator.REGIME_VARNAME)
+        interval = nest.GetStatus(
             self._recorders[self.code_generator.REGIME_VARNAME],
-            ('events', 'interval'))[0]
+            'interval')[0]
         return neo.AnalogSignal(
             events[self.code_generator.REGIME_VARNAME],
             sampling_period=interval * pq.ms, units='dimensionless',
@@ -156,11 +204,59 @@ class Cell(base.Cell):
                 (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE)
         return varname
 
+    def _events(self, recorder_name):
+        """
+        Returns the events recorded by the recorder, including those recorded
+        before the simulation state was restored
+        """
+        events = nest.GetStatus(self._recorders[recorder_name], 'events')[0]
+        restored = self._restored_events.get(recorder_name, None)
+        if restored is not None:
+            events = dict((k, numpy.concatenate((restored[k], v)))
+                          for k, v in events.items())
+        return events
+
     def reset_recordings(self):
         logger.warning("Haven't worked out how to implement reset recordings "
                        "for NEST yet")
 
-    def play(self, port_name, signal, properties=[]):
+    def _save_state(self, group):
+        """
+        Saves the state variables and regime of the NEST node along with the
+        events recorded so far
+        """
+        states = group.create_group('states')
+        for name in self._state_names():
+            states.attrs[name] = self._get(name)
+        recorders = group.create_group('recorders')
+        for name in self._recorders:
+            events = recorders.create_group(name)
+            for key, values in self._events(name).items():
+                events.create_dataset(key, data=numpy.asarray(values))
+
+    def _restore_state(self, group):
+        """
+        Sets the state variables and regime of the NEST node and buffers the
+        events recorded before the state was saved
+        """
+        nest.SetStatus(self._cell, dict(
+            (name, group['states'].attrs[name])
+            for name in self._state_names()))
+        if set(group['recorders'].keys()) != set(self._recorders.keys()):
+            raise Pype9UsageError(
+                "Recordings in saved state ('{}') do not match those of the "
+                "restored cell ('{}')".format(
+                    "', '".join(sorted(group['recorders'])),
+                    "', '".join(sorted(self._recorders))))
+        super(base.Cell, self).__setattr__('_restored_events', dict(
+            (name, dict((k, v[...]) for k, v in events.items()))
+            for name, events in group['recorders'].items()))
+
+    def _state_names(self):
+        return (list(self.build_component_class.state_variable_names) +
+                [self.code_generator.REGIME_VARNAME])
+
+    def play(self, port_name, signal, properties=[], interpolation='step'):
         """
         Injects current into the segment
 
@@ -168,10 +264,13 @@ class Cell(base.Cell):
         ----------
         port_name : str
             The name of the receive port to play the signal into
-        signal : neo.AnalogSignal (current) | neo.SpikeTrain
+        signal : neo.AnalogSignal | neo.SpikeTrain
             Signal to play into the port
         properties : list(nineml.Property)
             The connection properties of the event port
+        interpolation : str
+            How analog signals are interpolated between their sample points,
+            'step' or 'linear'
         """
         port = self.component_class.receive_port(port_name)
         if port.nineml_type in ('EventReceivePort',
@@ -202,32 +301,48 @@ class Cell(base.Cell):
         elif port.nineml_type in ('AnalogReceivePort', 'AnalogReducePort',
                                   'AnalogReceivePortExposure',
                                   'AnalogReducePortExposure'):
-            # Signals are played into NEST cells include a delay (set to be the
-            # minimum), which is is subtracted from the start of the signal so
-            # that the effect of the signal aligns with other simulators
-            t_start = (float(signal.t_start.rescale(pq.ms)) -
-                       self.device_delay_ms)
-            if t_start <= 0.0:
-                raise Pype9UsageError(
-                    "Start time of signal played into port '{}' ({}) must "
-                    "be greater than device delay ({})".format(
-                        port_name, signal.t_start, self.device_delay))
-            step_current_params = {
-                 'amplitude_values': list(
-                    numpy.ravel(pq.Quantity(signal, 'pA'))),
-                 'amplitude_times': list(numpy.ravel(numpy.asarray(
-                     signal.times.rescale(pq.ms))) - self.device_delay_ms),
-                 'start': t_start,
-                 'stop': float(signal.t_stop.rescale(pq.ms))}
-            self._inputs[port_name] = nest.Create(
-                'step_current_generator', 1, step_current_params)
-            nest.Connect(self._inputs[port_name], self._cell, syn_spec={
-                "receptor_type": self._receive_ports[port_name],
-                'delay': self.device_delay_ms})
+            self._play_analog(port, signal, interpolation)
         else:
             raise Pype9UsageError(
                 "Unrecognised port type '{}' to play signal into".format(port))
 
+    def _play_analog(self, port, signal, interpolation):
+        """
+        Plays an analog signal into a receive port via a step current
+        generator. Analog receive ports of any dimension receive the values
+        of the generator (in NEST units), not just currents.
+        """
+        self._check_interpolation(interpolation)
+        amplitudes = self._scale_analog_signal(port, signal)
+        times = numpy.ravel(numpy.asarray(signal.times.rescale(pq.ms)))
+        if interpolation == 'linear':
+            # Step current generators hold their amplitude until the next
+            # update so the signal is resampled at the simulation time step
+            dt = float(Simulation.active().dt.in_units(un.ms))
+            resampled = numpy.arange(times[0], times[-1] + dt / 2.0, dt)
+            amplitudes = numpy.interp(resampled, times, amplitudes)
+            times = resampled
+        # Signals are played into NEST cells include a delay (set to be the
+        # minimum), which is is subtracted from the start of the signal so
+        # that the effect of the signal aligns with other simulators
+        t_start = (float(signal.t_start.rescale(pq.ms)) -
+                   self.device_delay_ms)
+        if t_start <= 0.0:
+            raise Pype9UsageError(
+                "Start time of signal played into port '{}' ({}) must "
+                "be greater than device delay ({})".format(
+                    port.name, signal.t_start, self.device_delay))
+        step_current_params = {
+             'amplitude_values': list(amplitudes),
+             'amplitude_times': list(times - self.device_delay_ms),
+             'start': t_start,
+             'stop': float(signal.t_stop.rescale(pq.ms))}
+        self._inputs[port.name] = nest.Create(
+            'step_current_generator', 1, step_current_params)
+        nest.Connect(self._inputs[port.name], self._cell, syn_spec={
+            "receptor_type": self._receive_ports[port.name],
+            'delay': self.device_delay_ms})
+
     def connect(self, sender, send_port_name, receive_port_name, delay=None,
                 properties=None):
         """
@@ -287,9 +402,77 @@ class Cell(base.Cell):
                 "Unrecognised port communication '{}'".format(
                     receive_port.communicates))
 
-    def voltage_clamp(self, voltages, series_resistance=1e-3):
-        raise NotImplementedError("voltage clamps are not supported for "
-                                  "Pype9->NEST at this stage.")
+    def voltage_clamp(self, voltages, series_resistance=1e-3,
+                      interpolation='step'):
+        """
+        Clamps the membrane voltage of the cell with a single-electrode
+        clamp. As NEST doesn't provide a generic voltage-clamp device, the
+        cell class needs to be built with the 'voltage_clamp' option, which
+        adds the clamp current to the time derivative of the membrane voltage
+
+        Parameters
+        ----------
+        voltages : neo.AnalogSignal (voltage)
+            The voltages to clamp the cell to
+        series_resistance : nineml.Quantity | quantities.Quantity | float
+            The series resistance of the voltage clamp (floats are
+            interpreted as MOhm)
+        interpolation : str
+            How the voltages are interpolated between their sample points,
+            'step' or 'linear'
+        """
+        cc = self.build_component_class
+        if (self.code_generator.CLAMP_VOLTAGE_PORT not in
+                cc.analog_receive_port_names):
+            raise Pype9UsageError(
+                "'{}' cell class needs to be built with the 'voltage_clamp' "
+                "option to be voltage clamped in NEST".format(
+                    self.__class__.name))
+        series_resistance = self._series_resistance_in_mohm(
+            series_resistance)
+        # Switch the clamp on for the duration of the voltage signal by
+        # playing its conductance alongside it
+        conductance = neo.AnalogSignal(
+            numpy.ones(len(voltages)) / series_resistance, units='uS',
+            t_start=voltages.t_start,
+            sampling_period=voltages.sampling_period)
+        self._play_analog(
+            cc.analog_receive_port(self.code_generator.CLAMP_VOLTAGE_PORT),
+            voltages, interpolation)
+        self._play_analog(
+            cc.analog_receive_port(self.code_generator.CLAMP_CONDUCTANCE_PORT),
+            conductance, 'step')
+        v_name = cc.annotations.get((BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE)
+        # The membrane voltage is required to calculate the clamp current
+        self._initialize_local_recording()
+        if v_name not in self._recorders:
+            self.record(v_name)
+        super(base.Cell, self).__setattr__(
+            '_clamp', (voltages, series_resistance, interpolation, v_name))
+
+    def clamp_current(self, t_start=None):
+        if self._clamp is None:
+            raise Pype9UsageError(
+                "'{}' cell has not been voltage clamped".format(self.name))
+        voltages, series_resistance, interpolation, v_name = self._clamp
+        v = self.recording(v_name, t_start=t_start)
+        times = numpy.asarray(v.times.rescale(pq.ms))
+        clamp_times = numpy.asarray(voltages.times.rescale(pq.ms))
+        clamp_vs = numpy.ravel(numpy.asarray(voltages.rescale(pq.mV)))
+        if interpolation == 'linear':
+            v_clamp = numpy.interp(times, clamp_times, clamp_vs)
+        else:
+            indices = numpy.searchsorted(clamp_times, times, side='right') - 1
+            v_clamp = clamp_vs[numpy.clip(indices, 0, len(clamp_vs) - 1)]
+        # The clamp is only switched on for the duration of the signal
+        clamped = ((times >= clamp_times[0]) &
+                   (times < float(voltages.t_stop.rescale(pq.ms))))
+        current = numpy.where(
+            clamped, (v_clamp - numpy.ravel(numpy.asarray(v.rescale(pq.mV))))
+            / series_resistance, 0.0)
+        return neo.AnalogSignal(current, units='nA', t_start=v.t_start,
+                                sampling_period=v.sampling_period,
+                                name='clamp_current')
 
     @property
     def device_delay(self):
@@ -17,11 +17,18 @@ import re
 import shutil
 from datetime import datetime
 import errno
+import sympy
 import nest
+import nineml.units as un
+from nineml.abstraction import AnalogReceivePort, TimeDerivative
 from pype9.simulate.nest.units import UnitHandler
 from pype9.simulate.common.code_gen import BaseCodeGenerator
+from pype9.simulate.common.cells import DynamicsWithSynapses
+from pype9.simulate.common.network.plasticity import event_driven_synapses
 from pype9.utils.paths import remove_ignore_missing, add_lib_path
 from pype9.exceptions import Pype9BuildError
+from pype9.annotations import (
+    PYPE9_NS, BUILD_TRANS, MEMBRANE_VOLTAGE, MEMBRANE_CAPACITANCE)
 import pype9
 from pype9.utils.logging import logger
 
@@ -39,8 +46,19 @@ class CodeGenerator(BaseCodeGenerator):
     ABS_TOLERANCE_DEFAULT = 1e-3
     REL_TOLERANCE_DEFAULT = 0.0
     GSL_JACOBIAN_APPROX_STEP_DEFAULT = 0.01
+    GSL_STEPPER_DEFAULT = 'rk2'
+    # GSL steppers used for each of the 'solver' build options, where
+    # 'exponential' is an exponential-Euler step (exact for dynamics that are
+    # linear in each state variable) that doesn't use a GSL stepper
+    SOLVER_STEPPERS = {'exact': 'exponential',
+                       'explicit': 'rk2',
+                       'implicit': 'msbdf',
+                       'adaptive': 'rkf45'}
     V_THRESHOLD_DEFAULT = 0.0
     MAX_SIMULTANEOUS_TRANSITIONS = 1000
+    # Receive ports added to the build class by the 'voltage_clamp' option
+    CLAMP_VOLTAGE_PORT = 'v_clamp___pype9'
+    CLAMP_CONDUCTANCE_PORT = 'g_clamp___pype9'
     BASE_TMPL_PATH = path.abspath(path.join(path.dirname(__file__),
                                             'templates'))
     UnitHandler = UnitHandler
@@ -58,6 +76,98 @@ class CodeGenerator(BaseCodeGenerator):
                       .format(self.nest_config)))
         self._compiler = compiler.strip()  # strip trailing \n
 
+    def transform_for_build(self, name, component_class, **kwargs):
+        """
+        Copies the component class and, if the 'voltage_clamp' build option
+        is set, adds a single-electrode voltage clamp to it (as NEST doesn't
+        provide a generic voltage-clamp device)
+
+        Parameters
+        ----------
+        name : str
+            The name of the transformed component class
+        component_class : nineml.Dynamics
+            The component class to be transformed
+        """
+        trfrm = super(CodeGenerator, self).transform_for_build(
+            name, component_class, **kwargs)
+        if kwargs.get('voltage_clamp', False):
+            trfrm = self._add_voltage_clamp(name, trfrm, component_class,
+                                            **kwargs)
+        return trfrm
+
+    def _add_voltage_clamp(self, name, trfrm, component_class,
+                           membrane_voltage=None, membrane_capacitance=None,
+                           **kwargs):
+        """
+        Adds analog receive ports for the clamped voltage and the conductance
+        of the clamp (i.e. 1 / series resistance), and adds the clamp current,
+        g_clamp * (v_clamp - V), to the time derivative of the membrane
+        voltage. The conductance is zero unless a signal is played into it so
+        the dynamics are unchanged when the cell isn't clamped.
+        """
+        dynamics = trfrm.dynamics.flatten()
+        v = self._membrane_element(
+            dynamics.state_variables, membrane_voltage, un.voltage,
+            'membrane voltage', 'membrane_voltage')
+        cm = self._membrane_element(
+            dynamics.parameters, membrane_capacitance, un.capacitance,
+            'membrane capacitance', 'membrane_capacitance')
+        dynamics.add(AnalogReceivePort(self.CLAMP_VOLTAGE_PORT,
+                                       dimension=un.voltage))
+        dynamics.add(AnalogReceivePort(self.CLAMP_CONDUCTANCE_PORT,
+                                       dimension=un.conductance))
+        clamp_i = (sympy.Symbol(self.CLAMP_CONDUCTANCE_PORT) *
+                   (sympy.Symbol(self.CLAMP_VOLTAGE_PORT) -
+                    sympy.Symbol(v.name)))
+        for regime in dynamics.regimes:
+            try:
+                dvdt = regime.time_derivative(v.name)
+            except KeyError:
+                # The voltage is held fixed in regimes without a time
+                # derivative (e.g. refractory periods)
+                continue
+            regime.remove(dvdt)
+            regime.add(TimeDerivative(
+                v.name, dvdt.rhs + clamp_i / sympy.Symbol(cm.name)))
+        dynamics.validate()
+        clamped = DynamicsWithSynapses(
+            name, dynamics, trfrm.synapses, trfrm.connection_parameter_sets)
+        self._set_build_props(clamped, **kwargs)
+        component_class.annotations.set((BUILD_TRANS, PYPE9_NS),
+                                        MEMBRANE_VOLTAGE, v.name)
+        clamped.annotations.set((BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE,
+                                v.name)
+        clamped.annotations.set((BUILD_TRANS, PYPE9_NS),
+                                MEMBRANE_CAPACITANCE, cm.name)
+        return clamped
+
+    @classmethod
+    def _membrane_element(cls, elements, name, dimension, description,
+                          option):
+        """
+        Returns the element with the given name or, if it is None, guesses
+        it from the elements with matching dimension
+        """
+        elements = list(elements)
+        if name is not None:
+            try:
+                return next(e for e in elements if e.name == name)
+            except StopIteration:
+                raise Pype9BuildError(
+                    "Could not find specified {} '{}'".format(description,
+                                                              name))
+        candidates = [e for e in elements if e.dimension == dimension]
+        if len(candidates) != 1:
+            raise Pype9BuildError(
+                "Could not guess the {} to voltage clamp (candidates: '{}'), "
+                "please specify it with the '{}' build option".format(
+                    description, "', '".join(c.name for c in candidates),
+                    option))
+        logger.info("Guessing that '{}' is the {}".format(candidates[0].name,
+                                                          description))
+        return candidates[0]
+
     def generate_source_files(self, component_class, src_dir, name=None,
                               debug_print=None, **kwargs):
         if name is None:
@@ -77,9 +187,9 @@ class CodeGenerator(BaseCodeGenerator):
                 'jacobian_approx_step', self.GSL_JACOBIAN_APPROX_STEP_DEFAULT),
             'max_step_size': kwargs.get('max_step_size',
                                         self.MAX_STEP_SIZE_DEFAULT),
-            'abs_tolerance': kwargs.get('max_step_size',
+            'abs_tolerance': kwargs.get('abs_tolerance',
                                         self.ABS_TOLERANCE_DEFAULT),
-            'rel_tolerance': kwargs.get('max_step_size',
+            'rel_tolerance': kwargs.get('rel_tolerance',
                                         self.REL_TOLERANCE_DEFAULT),
             'max_simultaneous_transitions': kwargs.get(
                 'max_simultaneous_transitions',
@@ -87,11 +197,25 @@ class CodeGenerator(BaseCodeGenerator):
             'parameter_scales': [],
             'v_threshold': kwargs.get('v_threshold', self.V_THRESHOLD_DEFAULT),
             'regime_varname': self.REGIME_VARNAME,
+            'code_gen': self,
+            'plastic_synapses': event_driven_synapses(component_class,
+                                                      UnitHandler),
             'debug_print': [] if debug_print is None else debug_print}
         ode_solver = kwargs.get('ode_solver', self.ODE_SOLVER_DEFAULT)
         ss_solver = kwargs.get('ss_solver', self.SS_SOLVER_DEFAULT)
         if ode_solver is None:
             raise Pype9BuildError("'ode_solver' cannot be None")
+        solver = self.select_solver(component_class, kwargs.get('solver'))
+        if solver is not None:
+            if ode_solver != 'gsl':
+                raise Pype9BuildError(
+                    "The 'solver' option ('{}') can only be used with the "
+                    "'gsl' ODE solver templates ('{}')".format(solver,
+                                                               ode_solver))
+            tmpl_args['gsl_stepper'] = self.SOLVER_STEPPERS[solver]
+        else:
+            tmpl_args['gsl_stepper'] = kwargs.get('gsl_stepper',
+                                                  self.GSL_STEPPER_DEFAULT)
         switches = {'ode_solver': ode_solver, 'ss_solver': ss_solver}
         # Render C++ header file
         self.render_to_file('header.tmpl', tmpl_args,
@@ -100,6 +224,10 @@ class CodeGenerator(BaseCodeGenerator):
         self.render_to_file('main.tmpl', tmpl_args, name + '.cpp',
                              src_dir, switches=switches,
                              post_hoc_subs=self._inline_random_implementations)
+        # Render C++ header file of the event-driven plasticity of the
+        # projections to the cell
+        self.render_to_file('synapses.tmpl', tmpl_args,
+                             name + 'Synapses.h', src_dir)
         # Render Loader header file
         self.render_to_file('module-header.tmpl', tmpl_args,
                              name + 'Module.h', src_dir)
@@ -125,7 +253,8 @@ class CodeGenerator(BaseCodeGenerator):
                            # 'ode_solver': kwargs.get('ode_solver',
                            #                          self.ODE_SOLVER_DEFAULT),
                            'version': pype9.__version__,
-                           'executable': sys.executable}
+                           'executable': sys.executable,
+                           'link_flags': ' '.join(self.hook_link_flags())}
             self.render_to_file('CMakeLists.txt.tmpl', config_args,
                                  'CMakeLists.txt', src_dir)
             os.chdir(compile_dir)
@@ -182,6 +311,7 @@ class CodeGenerator(BaseCodeGenerator):
         if path.exists(src_dir):
             remove_ignore_missing(prefix + '.h')
             remove_ignore_missing(prefix + '.cpp')
+            remove_ignore_missing(prefix + 'Synapses.h')
             remove_ignore_missing(prefix + 'Module.h')
             remove_ignore_missing(prefix + 'Module.cpp')
             remove_ignore_missing(
@@ -243,6 +373,14 @@ class CodeGenerator(BaseCodeGenerator):
         # Install nest module
         nest.Install(name + 'Module')
 
+    @classmethod
+    def synapse_model_name(cls, component_name, projection_name):
+        """
+        The name the NEST connection model generated for the event-driven
+        plasticity of a projection to the cell class is registered under
+        """
+        return '{}_{}_synapse'.format(component_name, projection_name)
+
     @classmethod
     def get_nest_install_prefix(cls):
         # Make doubly sure that the loaded nest install appears first on the
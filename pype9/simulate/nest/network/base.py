@@ -9,18 +9,26 @@
 """
 from __future__ import absolute_import
 import sys
+import pickle
+from itertools import chain
+import numpy
+import neo
 from pype9.exceptions import Pype9RuntimeError
+from pype9.utils.mpi import gather_segment
 # Remove any system arguments that may conflict with
 if '--debug' in sys.argv:
     raise Pype9RuntimeError(
         "'--debug' argument passed to script conflicts with an argument to "
         "nest, causing the import to stop at the NEST prompt")
+import nest  # @IgnorePep8
 import pyNN.nest  # @IgnorePep8
 from pyNN.common.control import build_state_queries  # @IgnorePep8
 from pyNN.nest.standardmodels.synapses import StaticSynapse  # @IgnorePep8
 from pype9.simulate.common.network.base import (  # @IgnorePep8
     Network as BaseNetwork, ComponentArray as BaseComponentArray,
     ConnectionGroup as BaseConnectionGroup, Selection as BaseSelection)
+from pype9.simulate.common.network.values import (  # @IgnorePep8
+    get_pyNN_value, get_values)
 import pyNN.nest.simulator as simulator  # @IgnorePep8
 from .cell_wrapper import PyNNCellWrapperMetaClass  # @IgnorePep8
 from .connectivity import PyNNConnectivity  # @IgnorePep8
@@ -48,6 +56,8 @@ class ComponentArray(BaseComponentArray, pyNN.nest.Population):
 
     def __init__(self, *args, **kwargs):
         super(ComponentArray, self).__init__(*args, **kwargs)
+        # Data recorded before the simulation state was restored
+        self._restored_data = None
 
     @property
     def _min_delay(self):
@@ -59,6 +69,70 @@ class ComponentArray(BaseComponentArray, pyNN.nest.Population):
             to_record = 'spikes'  # FIXME: Need a way of differentiating event send ports @IgnorePep8
         pyNN.nest.Population.record(self, to_record)
 
+    def get_data(self, variables='all', gather=True, clear=False,
+                 annotations=None):
+        """
+        Extends the PyNN method to prepend data recorded before the simulation
+        state was restored. As the restored data is local to each MPI process
+        it is prepended before the data is gathered to the master process
+        """
+        block = pyNN.nest.Population.get_data(
+            self, variables=variables, gather=False, clear=clear,
+            annotations=annotations)
+        if self._restored_data is not None:
+            block.segments[0] = concatenate_segments(
+                self._restored_data.segments[0], block.segments[0])
+        if gather:
+            block.segments[0] = gather_segment(block.segments[0])
+        return block
+
+    def _set_random_values(self, properties, initial_values, rng):
+        if properties:
+            # Draw the values of the whole array at once from the properties
+            # RNG and set the values of all the local cells in a single call
+            # to the NEST kernel
+            values = [
+                get_values(p, self.UnitHandler, rng, self.size)[
+                    self._mask_local] for p in properties]
+            nest.SetStatus(
+                [int(c) for c in self.local_cells],
+                [dict((p.name, float(v)) for p, v in zip(properties, vals))
+                 for vals in zip(*values)])
+        if initial_values:
+            # Initial values are set through PyNN so that they are restored
+            # when the simulation is reset
+            self.initialize(**dict(
+                (i.name, get_values(i, self.UnitHandler, rng, self.size))
+                for i in initial_values))
+
+    def _save_state(self, group):
+        states = group.create_group('states')
+        local_ids = [int(c) for c in self.local_cells]
+        for name in self._state_names():
+            states.create_dataset(name, data=numpy.asarray(
+                nest.GetStatus(local_ids, name)))
+        group.attrs['recorded_data'] = numpy.void(
+            pickle.dumps(self.get_data(gather=False)))
+
+    def _restore_state(self, group):
+        states = group['states']
+        local_ids = [int(c) for c in self.local_cells]
+        for name in self._state_names():
+            values = states[name][...]
+            if len(values) != len(local_ids):
+                raise Pype9RuntimeError(
+                    "Number of cells in saved state of '{}' ({}) does not "
+                    "match the number of local cells ({})"
+                    .format(self.name, len(values), len(local_ids)))
+            nest.SetStatus(local_ids, name, list(values))
+        self._restored_data = pickle.loads(
+            group.attrs['recorded_data'].tobytes())
+
+    def _state_names(self):
+        cell_cls = self.celltype.model
+        return (list(cell_cls.build_component_class.state_variable_names) +
+                [cell_cls.code_generator.REGIME_VARNAME])
+
 
 class Selection(BaseSelection, pyNN.nest.Assembly):
 
@@ -76,6 +150,22 @@ class ConnectionGroup(BaseConnectionGroup, pyNN.nest.Projection):
     def get_min_delay(self):
         return get_min_delay()
 
+    def _plastic_synapse_type(self, plasticity, destination, weight, delay,
+                              rng):
+        # The event-driven plasticity is generated as a NEST connection model
+        # alongside the cell class it projects to
+        model_name = CodeGenerator.synapse_model_name(
+            destination.celltype.model.name, self.name)
+        params = dict(
+            (p.name, get_pyNN_value(p, self.UnitHandler, rng))
+            for p in chain(plasticity.properties,
+                           plasticity.initial_values))
+        return pyNN.nest.native_synapse_type(model_name)(
+            weight=weight, delay=delay, **params)
+
+    def _plastic_values(self, varname):
+        return numpy.array(nest.GetStatus(self.nest_connections, varname))
+
 
 class Network(BaseNetwork):
 
@@ -109,3 +199,29 @@ class Network(BaseNetwork):
     @property
     def current_time(self):
         return get_current_time()
+
+
+def concatenate_segments(before, after):
+    """
+    Joins the recordings in two segments of contiguous simulation periods
+    into a single segment
+    """
+    segment = neo.Segment(name=after.name)
+    for st_before, st_after in zip(before.spiketrains, after.spiketrains):
+        st = neo.SpikeTrain(
+            numpy.concatenate((st_before.rescale(st_after.units).magnitude,
+                               st_after.magnitude)),
+            units=st_after.units, t_start=st_before.t_start,
+            t_stop=st_after.t_stop)
+        st.annotate(**st_after.annotations)
+        segment.spiketrains.append(st)
+    for sig_before, sig_after in zip(before.analogsignals,
+                                     after.analogsignals):
+        sig = neo.AnalogSignal(
+            numpy.concatenate((sig_before.magnitude,
+                               sig_after.rescale(sig_before.units).magnitude)),
+            units=sig_before.units, t_start=sig_before.t_start,
+            sampling_period=sig_before.sampling_period, name=sig_before.name)
+        sig.annotate(**sig_before.annotations)
+        segment.analogsignals.append(sig)
+    return segment
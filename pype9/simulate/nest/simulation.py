@@ -1,9 +1,13 @@
 import nineml.units as un
+import nest
 from pype9.simulate.common.simulation import Simulation as BaseSimulation
 from pyNN.nest import (
     setup as pyNN_setup, run as pyNN_run, state as pyNN_state, end as pyNN_end)
 from pype9.exceptions import Pype9UsageError
 from .code_gen import CodeGenerator
+from pype9.utils.logging import get_logger
+
+logger = get_logger(__name__)
 
 
 class Simulation(BaseSimulation):
@@ -50,6 +54,46 @@ class Simulation(BaseSimulation):
         """
         pyNN_run(float(t_stop.in_units(un.ms)), callbacks=callbacks)
 
+    def _save_kernel_state(self, group):
+        """
+        The NEST kernel state is restored by setting the kernel time, the node
+        states are saved by the cells and arrays
+        """
+        group.attrs['time'] = nest.GetKernelStatus('time')
+
+    def _restore_kernel_state(self, group, t):  # @UnusedVariable
+        """
+        Sets the kernel time of NEST to the time the state was saved at. NB:
+        the NEST API doesn't provide access to the states of the random number
+        generators or the events in the ring buffers of the nodes (i.e. spikes
+        that had been sent but not yet delivered), so the states of
+        simulations containing random processes or connections between cells
+        cannot be restored
+        """
+        random = [o.component_class.name for o in (self._registered_cells +
+                                                   self._registered_arrays)
+                  if o.component_class.is_random]
+        if random:
+            raise Pype9UsageError(
+                "Cannot restore the state of NEST simulation containing cells "
+                "with random processes ('{}') as the states of the NEST "
+                "random number generators cannot be restored"
+                .format("', '".join(sorted(set(random)))))
+        all_ids = [int(c) for a in self._registered_arrays
+                   for c in a.all_cells]
+        local_ids = [int(c) for a in self._registered_arrays
+                     for c in a.local_cells]
+        if local_ids and nest.GetConnections(source=all_ids,
+                                             target=local_ids):
+            raise Pype9UsageError(
+                "Cannot restore the state of NEST simulation containing "
+                "connections between cells as the spikes that were in transit "
+                "when the state was saved (i.e. in the ring buffers of the "
+                "nodes) cannot be restored")
+        nest.SetKernelStatus({'time': float(t.in_units(un.ms))})
+        # Avoids PyNN adding an extra time step to the first run
+        pyNN_state.running = True
+
     def _prepare(self, **kwargs):
         "Reset the simulation and prepare it for creating new cells/networks"
         if self._min_delay is None:
@@ -9,27 +9,28 @@
 """
 from __future__ import absolute_import
 from __future__ import division
-from builtins import zip
+from builtins import zip, object
+from past.builtins import basestring
 import collections
 from itertools import chain
 import operator
 import numpy
 import quantities as pq
-import sympy
 import neo
 from ..code_gen import CodeGenerator
 from neuron import h
+import nineml
 from nineml import units as un
-from nineml.abstraction import EventPort, Dynamics
+from nineml.abstraction import EventPort
 from nineml.exceptions import NineMLNameError
-from nineml.visitors import BaseVisitorWithContext
 from math import pi
 from pype9.simulate.common.cells import base
+from pype9.simulate.common.cells.morphology import Morphology
 from pype9.simulate.neuron.units import UnitHandler
 from pype9.simulate.neuron.simulation import Simulation
 from pype9.annotations import (
     PYPE9_NS, BUILD_TRANS, MEMBRANE_CAPACITANCE, EXTERNAL_CURRENTS,
-    MEMBRANE_VOLTAGE, MECH_TYPE, ARTIFICIAL_CELL_MECH)
+    MEMBRANE_VOLTAGE, MECH_TYPE, ARTIFICIAL_CELL_MECH, SUB_COMPONENT_MECH)
 from pype9.exceptions import (
     Pype9RuntimeError, Pype9UsageError, Pype9Unsupported9MLException)
 
@@ -52,11 +53,21 @@ class Cell(base.Cell):
     """
 
     DEFAULT_CM = 1.0 * un.nF  # Chosen to match point processes (...I think).
+    # Set by the CellMetaClass when a morphology is provided
+    morphology = None
+    distributed_mechanisms = ()
+    max_segment_length = 20.0 * un.um
+    spoolable = True
 
     def __init__(self, *args, **kwargs):
         self._flag_created(False)
         # Construct all the NEURON structures
-        self._sec = h.Section()  # @UndefinedVariable
+        if self.morphology is not None:
+            self._create_sections()
+        else:
+            self._sec = h.Section()  # @UndefinedVariable
+            self._sections = {}
+        self._segment_recorders = {}
         # Insert dynamics mechanism (the built component class)
         HocClass = getattr(h, self.__class__.name)
         self._hoc = HocClass(0.5, sec=self._sec)
@@ -84,8 +95,9 @@ class Cell(base.Cell):
             # to be 100um. mA/cm^2 = -3-(-2^2) = 10^1, 100um^2 = 2 + -6^2 =
             # 10^(-10), nA = 10^(-9). 1 - 10 = - 9. (see PyNN Izhikevich neuron
             # implementation)
-            self._sec.L = 10.0
-            self._sec.diam = 10.0 / pi
+            if self.morphology is None:
+                self._sec.L = 10.0
+                self._sec.diam = 10.0 / pi
             self.cm_param_name = self.build_component_class.annotations.get(
                 (BUILD_TRANS, PYPE9_NS), MEMBRANE_CAPACITANCE)
             if self.cm_param_name not in self.component_class.parameter_names:
@@ -108,6 +120,7 @@ class Cell(base.Cell):
         self.rec = h.NetCon(self.source, None, sec=self._sec)
         self._inputs = {}
         self._input_auxs = []
+        self._clamp_recording = None
         # Get a mapping of receptor names to NMODL indices for PyNN projection
         # connection
         assert (set(self.build_component_class.event_receive_port_names) ==
@@ -137,6 +150,52 @@ class Cell(base.Cell):
     def name(self):
         return self.prototype.name
 
+    def _create_sections(self):
+        """
+        Creates the NEURON sections from the morphology of the cell class and
+        inserts the distributed mechanisms into them. The point process of the
+        cell dynamics is inserted into the soma.
+        """
+        self._sections = collections.OrderedDict()
+        max_length = float(self.max_segment_length.in_units(un.um))
+        for section in self.morphology.sections:
+            sec = h.Section(name=section.name)  # @UndefinedVariable
+            h.pt3dclear(sec=sec)
+            for x, y, z, diam in section.points:
+                h.pt3dadd(x, y, z, diam, sec=sec)
+            if section.parent is not None:
+                sec.connect(
+                    self._sections[section.parent.name](section.parent_loc),
+                    0)
+            # Use an odd number of segments so there is always a node at 0.5
+            sec.nseg = 1 + 2 * int(sec.L / (2 * max_length))
+            self._sections[section.name] = sec
+        for group, mechanisms in self.distributed_mechanisms:
+            for section in self.morphology.group(group):
+                for mechanism in mechanisms:
+                    mechanism.insert(self._sections[section.name])
+        self._sec = self._sections[self.morphology.soma.name]
+
+    @property
+    def section_names(self):
+        return iter(self._sections.keys())
+
+    def section(self, name):
+        """
+        Returns the NEURON section of a multi-compartmental cell
+
+        Parameters
+        ----------
+        name : str
+            Name of the section in the morphology
+        """
+        try:
+            return self._sections[name]
+        except KeyError:
+            raise Pype9UsageError(
+                "No section named '{}' in '{}' cell (available '{}')"
+                .format(name, self.name, "', '".join(self.section_names)))
+
     @property
     def source_section(self):
         """
@@ -201,6 +260,8 @@ class Cell(base.Cell):
 
     @property
     def surface_area(self):
+        if self.morphology is not None:
+            return sum(seg.area() for seg in self._sec) * un.um ** 2
         return (self._sec.L * un.um) * (self._sec.diam * pi * un.um)
 
     def _get(self, varname):
@@ -240,17 +301,39 @@ class Cell(base.Cell):
     def _set_regime(self):
         setattr(self._hoc, self.code_generator.REGIME_VARNAME, self._regime_index)
 
-    def record(self, port_name, **kwargs):  # @UnusedVariable
+    def record(self, port_name, section=None, location=0.5, callback=None,
+               callback_interval=None, **kwargs):  # @UnusedVariable
         """
         Parameters
         ----------
         port_name : str
             Name of the port to record from
+        section : str | None
+            Name of the section to record from (multi-compartmental cells
+            only). If provided, port_name can be either the membrane voltage
+            or a state variable of a distributed mechanism inserted into the
+            section
+        location : float
+            The location along the section to record from
         v_thresh_tol : Quantity (voltage)
             A small voltage added to the threshold for determining emitted
             spikes. Used when there is a voltage reset after the time crossing
             that may cause the threshold to be missed.
+        callback : function | None
+            A function that is passed the recording (neo.AnalogSignal or
+            neo.SpikeTrain) in chunks while the simulation is running (not
+            supported for recordings from sections)
+        callback_interval : Quantity (time) | None
+            The interval between calls to the callback. If None, it is only
+            called at the end of each call to ``Simulation.run``
         """
+        if section is not None:
+            if callback is not None:
+                raise Pype9UsageError(
+                    "Callbacks are not supported for recordings from "
+                    "sections ('{}' of '{}')".format(port_name, section))
+            self._record_segment(port_name, section, location)
+            return
         self._initialize_local_recording()
         # Get the port or state variable to record
         try:
@@ -279,7 +362,52 @@ class Cell(base.Cell):
             except AttributeError:
                 self._recorders[port_name] = recorder = getattr(
                     self._sec(0.5), '_ref_' + escaped_port_name)
-            recording.record(recorder)
+            if self.Simulation.active().cvode:
+                # Sample at the time step as the steps of CVODE are variable
+                recording.record(recorder, h.dt)
+            else:
+                recording.record(recorder)
+        self._register_stream(port_name, callback, callback_interval)
+
+    def _record_segment(self, port_name, section, location):
+        seg = self.section(section)(location)
+        if port_name in ('v', self.component_class.annotations.get(
+                (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE)):
+            ref = seg._ref_v
+            dimension = un.voltage
+        else:
+            matches = [
+                m for m in self._mechanisms_in(section)
+                if port_name in chain(
+                    m.component_class.state_variable_names,
+                    m.component_class.alias_names)]
+            if len(matches) != 1:
+                raise Pype9UsageError(
+                    "Could not find a unique distributed mechanism in '{}' "
+                    "section with a state variable or alias named '{}' "
+                    "(found {})".format(section, port_name, len(matches)))
+            mech = matches[0]
+            ref = getattr(seg, '_ref_{}_{}'.format(port_name, mech.name))
+            dimension = mech.component_class.element(
+                port_name, child_types=nineml.Dynamics.nineml_children
+            ).dimension
+        recording = h.Vector()
+        recording.record(ref)
+        self._segment_recorders[
+            self._segment_key(port_name, section, location)] = (
+                ref, recording, dimension)
+
+    def _mechanisms_in(self, section):
+        """
+        The distributed mechanisms inserted into the given section
+        """
+        groups = self.morphology.section(section).groups
+        return [m for group, mechs in self.distributed_mechanisms
+                for m in mechs if group == 'all' or group in groups]
+
+    @classmethod
+    def _segment_key(cls, port_name, section, location):
+        return '{}@{}({})'.format(port_name, section, location)
 
     def record_regime(self):
         self._initialize_local_recording()
@@ -288,11 +416,16 @@ class Cell(base.Cell):
         recording.record(getattr(self._hoc, '_ref_{}'
                                  .format(self.code_generator.REGIME_VARNAME)))
 
-    def recording(self, port_name, t_start=None):
+    def recording(self, port_name, t_start=None, section=None, location=0.5):
         """
         Return recorded data as a dictionary containing one numpy array for
         each neuron, ids as keys.
         """
+        if section is not None:
+            return self._segment_recording(
+                self._segment_key(port_name, section, location), t_start)
+        if port_name in self._spooled:
+            return self._spooled_recording(port_name, t_start=t_start)
         if self.is_dead():
             t_stop = self._t_stop
         else:
@@ -322,6 +455,42 @@ class Cell(base.Cell):
             recording = recording[:-1]  # Drop final timepoint
         return recording
 
+    def _pop_recorded(self, port_name):
+        try:
+            port = self.component_class.port(port_name)
+        except NineMLNameError:
+            port = self.component_class.state_variable(port_name)
+        vector = self._recordings[port_name]
+        values = numpy.array(vector)
+        vector.resize(0)
+        if isinstance(port, EventPort):
+            return values, None, None
+        return values, self.unit_handler.dimension_to_unit_str(
+            port.dimension, one_as_dimensionless=True), h.dt
+
+    def _segment_recording(self, key, t_start=None):
+        try:
+            _, recording, dimension = self._segment_recorders[key]
+        except KeyError:
+            raise Pype9UsageError(
+                "'{}' was not recorded from '{}' cell".format(key, self.name))
+        if t_start is None:
+            t_start = UnitHandler.to_pq_quantity(self._t_start)
+        t_start = pq.Quantity(t_start, 'ms')
+        interval = h.dt * pq.ms
+        signal = numpy.asarray(recording)
+        return neo.AnalogSignal(
+            self._trim_analog_signal(signal, t_start, interval)[:-1],
+            sampling_period=interval, t_start=t_start,
+            units=self.unit_handler.dimension_to_unit_str(
+                dimension, one_as_dimensionless=True), name=key)
+
+    def recordings(self, t_start=None):
+        seg = super(Cell, self).recordings(t_start=t_start)
+        for key in self._segment_recorders:
+            seg.analogsignals.append(self._segment_recording(key, t_start))
+        return seg
+
     def _regime_recording(self):
         t_start = self.unit_handler.to_pq_quantity(self._t_start)
         return neo.AnalogSignal(
@@ -337,6 +506,11 @@ class Cell(base.Cell):
         """
         for rec in self._recordings.values():
             rec.resize(0)
+        for _, rec, _ in self._segment_recorders.values():
+            rec.resize(0)
+        if self._clamp_recording is not None:
+            self._clamp_recording.resize(0)
+        self._clear_spooled()
 
     def clear_recorders(self):
         """
@@ -344,19 +518,74 @@ class Cell(base.Cell):
         """
         super(Cell, self).clear_recorders()
         super(base.Cell, self).__setattr__('_recordings', {})
+        super(base.Cell, self).__setattr__('_segment_recorders', {})
 
-    def play(self, port_name, signal, properties=[]):
+    def _save_state(self, group):
+        """
+        Saves the recording buffers of the cell (the states of the NEURON
+        mechanisms are saved along with the kernel by SaveState)
+        """
+        self._save_vectors(group.create_group('recordings'),
+                           self._recordings)
+        self._save_vectors(
+            group.create_group('segment_recordings'),
+            dict((k, v[1]) for k, v in self._segment_recorders.items()))
+        # Buffers used by PyNN
+        self._save_vectors(group.create_group('traces'), self.traces)
+        group.create_dataset('spike_times', data=numpy.asarray(
+            self.spike_times))
+
+    def _restore_state(self, group):
         """
-        Injects current into the segment
+        Restores the recording buffers of the cell
+        """
+        self._restore_vectors(group['recordings'], self._recordings)
+        self._restore_vectors(
+            group['segment_recordings'],
+            dict((k, v[1]) for k, v in self._segment_recorders.items()))
+        self._restore_vectors(group['traces'], self.traces)
+        self.spike_times.from_python(group['spike_times'][...])
+
+    @classmethod
+    def _save_vectors(cls, group, vectors):
+        for name, vector in vectors.items():
+            group.create_dataset(name, data=numpy.asarray(vector))
+
+    @classmethod
+    def _restore_vectors(cls, group, vectors):
+        if set(group.keys()) != set(vectors.keys()):
+            raise Pype9UsageError(
+                "Recordings in saved state ('{}') do not match those of the "
+                "restored cell ('{}')".format("', '".join(sorted(group)),
+                                              "', '".join(sorted(vectors))))
+        for name, vector in vectors.items():
+            vector.from_python(group[name][...])
+
+    def play(self, port_name, signal, properties=[], section=None,
+             location=0.5, interpolation='step'):
+        """
+        Plays an analog signal or train of events into a port of the cell.
+        Signals played into external current ports are injected into the
+        segment via an IClamp, while signals played into other analog receive
+        ports set the value of the port in the mechanism directly
 
         Parameters
         ----------
         port_name : str
             The name of the receive port to play the signal into
-        signal : neo.AnalogSignal (current) | neo.SpikeTrain
+        signal : neo.AnalogSignal | neo.SpikeTrain
             Signal to play into the port
         properties : list(nineml.Property)
             The connection properties of the event port
+        section : str | None
+            The name of the section to inject an external current into
+            (multi-compartmental cells only). If None the current is
+            injected into the soma
+        location : float
+            The location along the section to inject the current
+        interpolation : str
+            How analog signals are interpolated between their sample points,
+            'step' or 'linear'
         """
         ext_is = self.build_component_class.annotations.get(
             (BUILD_TRANS, PYPE9_NS), EXTERNAL_CURRENTS).split(',')
@@ -387,19 +616,43 @@ class Cell(base.Cell):
             self._inputs['vstim'] = vstim
             self._input_auxs.extend((vstim_times, vstim_con))
         else:
-            if port_name not in ext_is:
-                raise Pype9Unsupported9MLException(
-                    "Can only play into external current ports ('{}'), not "
-                    "'{}' port.".format("', '".join(ext_is), port_name))
-            iclamp = h.IClamp(0.5, sec=self._sec)
-            iclamp.delay = 0.0
-            iclamp.dur = 1e12
-            iclamp.amp = 0.0
-            iclamp_amps = h.Vector(pq.Quantity(signal, 'nA'))
-            iclamp_times = h.Vector(signal.times.rescale(pq.ms))
-            iclamp_amps.play(iclamp._ref_amp, iclamp_times)
-            self._inputs['iclamp'] = iclamp
-            self._input_auxs.extend((iclamp_amps, iclamp_times))
+            self._check_interpolation(interpolation)
+            # Vector.play holds each value until the next sample point unless
+            # the 'continuous' flag is set
+            continuous = int(interpolation == 'linear')
+            times = h.Vector(signal.times.rescale(pq.ms))
+            if port_name in ext_is:
+                if section is None:
+                    iclamp = h.IClamp(0.5, sec=self._sec)
+                    input_key = 'iclamp'
+                else:
+                    iclamp = h.IClamp(location, sec=self.section(section))
+                    input_key = self._segment_key('iclamp', section, location)
+                iclamp.delay = 0.0
+                iclamp.dur = 1e12
+                iclamp.amp = 0.0
+                amps = h.Vector(pq.Quantity(signal, 'nA'))
+                amps.play(iclamp._ref_amp, times, continuous)
+                self._inputs[input_key] = iclamp
+                self._input_auxs.extend((amps, times))
+            else:
+                if section is not None:
+                    raise Pype9UsageError(
+                        "Only external currents ('{}') can be played into "
+                        "sections of the cell, not '{}'".format(
+                            "', '".join(ext_is), port_name))
+                try:
+                    ref = getattr(self._hoc, '_ref_' +
+                                  self._escaped_name(port_name))
+                except AttributeError:
+                    raise Pype9Unsupported9MLException(
+                        "Cannot play signal into '{}' port as it does not "
+                        "appear in the built '{}' mechanism".format(
+                            port_name, self.__class__.name))
+                values = h.Vector(self._scale_analog_signal(port, signal))
+                values.play(ref, times, continuous)
+                self._inputs[port_name] = values
+                self._input_auxs.append(times)
 
     def connect(self, sender, send_port_name, receive_port_name,
                 delay=0.0 * un.ms, properties=None):
@@ -457,25 +710,58 @@ class Cell(base.Cell):
                 "Unrecognised port communication '{}'".format(
                     receive_port.communicates))
 
-    def voltage_clamp(self, voltages, series_resistance=1e-3):
+    def voltage_clamp(self, voltages, series_resistance=1e-3,
+                      interpolation='step', section=None, location=0.5):
         """
-        Clamps the voltage of a segment
+        Clamps the voltage of a segment with a single-electrode clamp
+        (SEClamp) and records the current it injects
 
         Parameters
         ----------
-        voltage : neo.AnalogSignal (voltage)
+        voltages : neo.AnalogSignal (voltage)
             The voltages to clamp the segment to
-        series_resistance : float (??)
-            The series resistance of the voltage clamp
+        series_resistance : nineml.Quantity | quantities.Quantity | float
+            The series resistance of the voltage clamp (floats are
+            interpreted as MOhm)
+        interpolation : str
+            How the voltages are interpolated between their sample points,
+            'step' or 'linear'
+        section : str | None
+            The name of the section to clamp (multi-compartmental cells
+            only). If None the soma is clamped
+        location : float
+            The location along the section to clamp
         """
-        seclamp = h.SEClamp(0.5, sec=self._sec)
-        seclamp.rs = series_resistance
+        self._check_interpolation(interpolation)
+        if section is None:
+            seclamp = h.SEClamp(0.5, sec=self._sec)
+        else:
+            seclamp = h.SEClamp(location, sec=self.section(section))
+        seclamp.rs = self._series_resistance_in_mohm(series_resistance)
         seclamp.dur1 = 1e12
         seclamp_amps = h.Vector(pq.Quantity(voltages, 'mV'))
         seclamp_times = h.Vector(voltages.times.rescale(pq.ms))
-        seclamp_amps.play(seclamp._ref_amp, seclamp_times)
+        seclamp_amps.play(seclamp._ref_amp1, seclamp_times,
+                          int(interpolation == 'linear'))
+        recording = h.Vector()
+        recording.record(seclamp._ref_i)
         self._inputs['seclamp'] = seclamp
         self._input_auxs.extend((seclamp_amps, seclamp_times))
+        super(base.Cell, self).__setattr__('_clamp_recording', recording)
+
+    def clamp_current(self, t_start=None):
+        if self._clamp_recording is None:
+            raise Pype9UsageError(
+                "'{}' cell has not been voltage clamped".format(self.name))
+        if t_start is None:
+            t_start = UnitHandler.to_pq_quantity(self._t_start)
+        t_start = pq.Quantity(t_start, 'ms')
+        interval = h.dt * pq.ms
+        signal = numpy.asarray(self._clamp_recording)
+        return neo.AnalogSignal(
+            self._trim_analog_signal(signal, t_start, interval)[:-1],
+            sampling_period=interval, t_start=t_start, units='nA',
+            name='clamp_current')
 
     def _escaped_name(self, name):
         if name == self.component_class.annotations.get(
@@ -484,75 +770,6 @@ class Cell(base.Cell):
                 (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE)
         return name
 
-    @classmethod
-    def get_v_threshold(self, dynamics_properties, port_name):
-        """
-        Returns the voltage threshold at which an event is emitted from the
-        given event port
-
-        Parameters
-        ----------
-        component_class : nineml.Dynamics
-            The component class of the cell to find the v-threshold for
-        port_name : str
-            Name of the event send port to threshold
-        """
-        comp_class = (dynamics_properties.component_class.
-                      _dynamics.substitute_aliases())
-        transitions = OuputEventTransitionsFinder(
-            comp_class, comp_class.event_send_port(port_name)).transitions
-        assert transitions
-        try:
-            triggers = set(t.trigger for t in transitions)
-        except AttributeError:
-            raise Pype9UsageError(
-                "Cannot get threshold for event port '{}' in {} as it is "
-                "emitted from at least OnEvent transition ({})".format(
-                    port_name, comp_class,
-                    ', '.join(str(t) for t in transitions)))
-        if len(triggers) > 1:
-            raise Pype9UsageError(
-                "Cannot get threshold for event port '{}' in {} as it is the "
-                "condition from at least OnEvent transition ({})".format(
-                    port_name, comp_class, ', '.join(transitions)))
-        expr = next(iter(triggers)).rhs
-        v = sympy.Symbol(self.component_class.annotations.get(
-            (BUILD_TRANS, PYPE9_NS), MEMBRANE_VOLTAGE))
-        if v not in expr.free_symbols:
-            raise Pype9UsageError(
-                "Trigger expression for '{}' port in {} is not an expression "
-                "of membrane voltage '{}'".format(port_name, comp_class, v))
-        solution = None
-        if isinstance(expr, (sympy.StrictGreaterThan,
-                             sympy.StrictLessThan)):
-            # Get the equation for the transition between true and false
-            equality = sympy.Eq(*expr.args)
-            solutions = sympy.solvers.solve(equality, v)
-            if len(solutions) == 1:
-                solution = solutions[0]
-        if solution is None:
-            raise Pype9UsageError(
-                "Cannot solve threshold equation for trigger expression '{}' "
-                "for '{}' (to find condition where spikes are emitted from "
-                "'{}' event send port) in {} as it is not a simple inequality"
-                .format(expr, v, port_name, comp_class))
-        values = {}
-        for sym in solution.free_symbols:
-            sym_str = str(sym)
-            try:
-                prop = dynamics_properties.property(sym_str)
-            except NineMLNameError:
-                try:
-                    prop = comp_class.constant(sym_str)
-                except NineMLNameError:
-                    raise Pype9UsageError(
-                        "Cannot calculated fixed value for voltage threshold "
-                        "as it contains reference to {}".format(
-                            comp_class.element(sym_str)))
-            values[sym] = self.unit_handler.scale_value(prop.quantity)
-        threshold = solution.subs(values)
-        return float(threshold)
-
 
 class CellMetaClass(base.CellMetaClass):
 
@@ -566,34 +783,97 @@ class CellMetaClass(base.CellMetaClass):
     BaseCellClass = Cell
     Simulation = Simulation
 
-
-class OuputEventTransitionsFinder(BaseVisitorWithContext):
+    def __new__(cls, component_class, morphology=None,
+                distributed_mechanisms=None, max_segment_length=None,
+                **kwargs):
+        """
+        Parameters
+        ----------
+        morphology : Morphology | str | None
+            The morphology (or path to a SWC or NeuroML file containing it) of
+            a multi-compartmental cell. The cell dynamics are inserted as a
+            point process in the soma.
+        distributed_mechanisms : dict(str, list(nineml.DynamicsProperties))
+            Dynamics (e.g. ion channels) to insert into the sections of each
+            group of the morphology ('all' for every section). The dynamics
+            need to receive the membrane voltage and send current densities.
+        max_segment_length : nineml.Quantity (length)
+            The maximum length of the segments the sections are divided into
+        """
+        Cell = super(CellMetaClass, cls).__new__(cls, component_class,
+                                                 **kwargs)
+        if morphology is None:
+            if distributed_mechanisms:
+                raise Pype9UsageError(
+                    "Distributed mechanisms can only be provided along with a "
+                    "morphology")
+            return Cell
+        if isinstance(morphology, basestring):
+            morphology = Morphology.read(morphology)
+        build_kwargs = dict((k, v) for k, v in kwargs.items()
+                            if k in ('build_mode', 'build_base_dir',
+                                     'build_url', 'code_generator'))
+        dist_mechs = []
+        if distributed_mechanisms is not None:
+            for group, props_list in distributed_mechanisms.items():
+                morphology.group(group)  # Check that group exists
+                mechs = []
+                for props in props_list:
+                    mechs.append(DistributedMechanism(
+                        super(CellMetaClass, cls).__new__(
+                            cls, props.component_class, **build_kwargs),
+                        props))
+                dist_mechs.append((group, mechs))
+        dct = {'morphology': morphology,
+               'distributed_mechanisms': dist_mechs}
+        if max_segment_length is not None:
+            dct['max_segment_length'] = max_segment_length
+        # Create a derived class so the built class can be reused with other
+        # morphologies
+        return type.__new__(cls, Cell.__name__, (Cell,), dct)
+
+
+class DistributedMechanism(object):
     """
-    Finds the transitions which emit an output event
+    A distributed (density) mechanism inserted into the sections of a
+    multi-compartmental cell
 
     Parameters
     ----------
-    component_class : Dynamics
-        The component class to find the transitions from
-    port : EventSendPort
-        The event send port over which the events are emitted.
+    mech_class : CellMetaClass
+        The built class of the mechanism
+    properties : nineml.DynamicsProperties
+        The properties of the mechanism
     """
 
-    as_class = Dynamics
-
-    def __init__(self, component_class, port):
-        super(OuputEventTransitionsFinder, self).__init__()
-        self._port = port
-        self._transitions = []
-        self.visit(component_class)
+    def __init__(self, mech_class, properties):
+        if mech_class.build_component_class.annotations.get(
+                (BUILD_TRANS, PYPE9_NS), MECH_TYPE) != SUB_COMPONENT_MECH:
+            raise Pype9UsageError(
+                "'{}' cannot be used as a distributed mechanism as it has "
+                "its own membrane voltage".format(mech_class.name))
+        for prop in properties.properties:
+            if prop.value.nineml_type != 'SingleValue':
+                raise Pype9UsageError(
+                    "Only SingleValue properties can be used in distributed "
+                    "mechanisms ({})".format(prop))
+        self._mech_class = mech_class
+        self._properties = properties
 
     @property
-    def transitions(self):
-        return self._transitions
+    def name(self):
+        return self._mech_class.name
 
-    def action_outputevent(self, outputevent, **kwargs):  # @UnusedVariable @IgnorePep8
-        if outputevent.port == self._port:
-            self._transitions.append(self.context.parent)
+    @property
+    def component_class(self):
+        return self._mech_class.build_component_class
 
-    def default_action(self, obj, nineml_cls, **kwargs):
-        pass
+    def insert(self, sec):
+        """
+        Inserts the mechanism into the given section and sets its properties
+        """
+        sec.insert(self.name)
+        for prop in self._properties.properties:
+            setattr(sec, '{}_{}'.format(prop.name, self.name),
+                    float(self._mech_class.unit_handler.scale_value(
+                        prop.quantity)))
@@ -9,7 +9,7 @@
 """
 from __future__ import absolute_import
 from __future__ import unicode_literals
-from builtins import next, str
+from builtins import str
 import os.path
 import tempfile
 import platform
@@ -17,48 +17,51 @@ import re
 import uuid
 from itertools import chain
 import subprocess as sp
-from collections import defaultdict
-import sympy
 import neuron
 import nineml.units as un
-from nineml.abstraction import Alias, AnalogSendPort, Dynamics
 from neuron import load_mechanisms
-from pype9.simulate.common.code_gen import BaseCodeGenerator
-from pype9.simulate.common.cells import (
-    WithSynapses, DynamicsWithSynapses)
+from pype9.simulate.common.code_gen.nmodl import BaseNMODLCodeGenerator
 from pype9.exceptions import (
-    Pype9BuildError, Pype9RuntimeError, Pype9CommandNotFoundError)
+    Pype9BuildError, Pype9CommandNotFoundError, Pype9Unsupported9MLException)
 import pype9
 from datetime import datetime
-from nineml.abstraction import (StateAssignment, Parameter, StateVariable,
-                                Constant, Expression)
-from nineml.abstraction.dynamics.visitors.queriers import (
-    DynamicsInterfaceInferer)
-from sympy.printing import ccode
 from pype9.utils.mpi import is_mpi_master, mpi_comm
 from pype9.simulate.neuron.units import UnitHandler
+from pype9.simulate.common.network.plasticity import event_driven_synapses
 try:
     from nineml.extensions.kinetics import Kinetics  # @UnusedImport
 except ImportError:
     KineticsClass = type(None)
-from pype9.annotations import (
-    PYPE9_NS, ION_SPECIES, MEMBRANE_VOLTAGE, MEMBRANE_CAPACITANCE,
-    TRANSFORM_SRC, NONSPECIFIC_CURRENT, BUILD_TRANS,
-    EXTERNAL_CURRENTS, NO_TIME_DERIVS,
-    NUM_TIME_DERIVS, MECH_TYPE, FULL_CELL_MECH,
-    ARTIFICIAL_CELL_MECH)
-import logging
+from pype9.utils.logging import get_logger
 
 TRANSFORM_NS = 'NeuronBuildTransform'
 
-logger = logging.getLogger("pype9")
+logger = get_logger(__name__)
 
 
-class CodeGenerator(BaseCodeGenerator):
+class CodeGenerator(BaseNMODLCodeGenerator):
+    """
+    Parameters
+    ----------
+    gsl_path : str | None
+        Path to the GSL library used by random distributions
+    coreneuron : bool
+        Whether to generate and compile mechanisms that are compatible with
+        CoreNEURON (requires NEURON to be installed with CoreNEURON support).
+        CoreNEURON mechanisms are built in a separate base directory to
+        standard NEURON mechanisms
+    """
 
     SIMULATOR_NAME = 'neuron'
     SIMULATOR_VERSION = neuron.h.nrnversion(0)
     ODE_SOLVER_DEFAULT = 'derivimplicit'
+    # NMODL methods used for each of the 'solver' build options. Adaptive
+    # integration is performed by CVODE, which is activated in the simulation
+    # when a cell built with the 'adaptive' option is created
+    SOLVER_METHODS = {'exact': 'cnexp',
+                      'explicit': 'euler',
+                      'implicit': 'derivimplicit',
+                      'adaptive': 'derivimplicit'}
     REGIME_VARNAME = 'regime_'
     SEED_VARNAME = 'seed_'
     BASE_TMPL_PATH = os.path.abspath(os.path.join(os.path.dirname(__file__),
@@ -71,8 +74,13 @@ class CodeGenerator(BaseCodeGenerator):
 
     _inbuilt_ions = ['na', 'k', 'ca']
 
-    def __init__(self, gsl_path=None, **kwargs):
+    CORENEURON_SUFFIX = '-coreneuron'
+
+    def __init__(self, gsl_path=None, coreneuron=False, **kwargs):
         super(CodeGenerator, self).__init__(**kwargs)
+        self._coreneuron = coreneuron
+        if coreneuron:
+            self._base_dir += self.CORENEURON_SUFFIX
         self.nrnivmodl_path = self.get_neuron_util_path('nrnivmodl')
         self.modlunit_path = self.get_neuron_util_path('modlunit',
                                                        default=None)
@@ -93,6 +101,10 @@ class CodeGenerator(BaseCodeGenerator):
         # NMODL files on the current platform
         self.specials_dir = self._get_specials_dir()
 
+    @property
+    def coreneuron(self):
+        return self._coreneuron
+
     def generate_source_files(self, component_class, src_dir, name=None,
                               **kwargs):
         """
@@ -117,9 +129,20 @@ class CodeGenerator(BaseCodeGenerator):
             Whether to use the 'SUFFIX' tag or not.
         ode_solver : str
             specifies the ODE solver to use
+        solver : str | None
+            The integration scheme to use (see ``select_solver``), which sets
+            the NMODL method if 'ode_solver' isn't provided
         """
         if name is None:
             name = component_class.name
+        solver = self.select_solver(component_class, kwargs.get('solver'))
+        if solver is not None and 'ode_solver' not in kwargs:
+            kwargs['ode_solver'] = self.SOLVER_METHODS[solver]
+        if self.coreneuron and component_class.is_random:
+            raise Pype9Unsupported9MLException(
+                "Cannot generate CoreNEURON mechanism for '{}' as random "
+                "distributions in state assignments are not supported by the "
+                "CoreNEURON pipeline".format(name))
         template = 'main.tmpl'
         self.generate_mod_file(template, component_class, src_dir, name,
                                kwargs)
@@ -145,7 +168,10 @@ class CodeGenerator(BaseCodeGenerator):
             'external_ports': [],
             'is_subcomponent': True,
             'regime_varname': self.REGIME_VARNAME,
-            'seed_varname': self.SEED_VARNAME}
+            'seed_varname': self.SEED_VARNAME,
+            'plastic_synapses': event_driven_synapses(component_class,
+                                                      UnitHandler),
+            'coreneuron': self.coreneuron}
 #             # FIXME: weight_vars needs to be removed or implemented properly
 #             'weight_variables': []}
         tmpl_args.update(template_args)
@@ -153,292 +179,6 @@ class CodeGenerator(BaseCodeGenerator):
         self.render_to_file(
             template, tmpl_args, component_class.name + '.mod', src_dir)
 
-    def transform_for_build(self, name, component_class, **kwargs):
-        """
-        Copies and transforms the component class to match the format of the
-        simulator (overridden in derived class)
-
-        Parameters
-        ----------
-        name : str
-            The name of the transformed component class
-        component_class : nineml.Dynamics
-            The component class to be transformed
-        """
-        self._set_build_props(component_class, **kwargs)
-        if not isinstance(component_class, WithSynapses):
-            raise Pype9RuntimeError(
-                "'component_class' must be a DynamicsWithSynapses object")
-        # ---------------------------------------------------------------------
-        # Clone original component class
-        # ---------------------------------------------------------------------
-        trfrm = component_class.dynamics.flatten()
-        # ---------------------------------------------------------------------
-        # Get the membrane voltage and convert it to 'v'
-        # ---------------------------------------------------------------------
-        try:
-            name = kwargs['membrane_voltage']
-            try:
-                orig_v = component_class.element(
-                    name, nineml_children=Dynamics.nineml_children)
-            except KeyError:
-                raise Pype9BuildError(
-                    "Could not find specified membrane voltage '{}'"
-                    .format(name))
-        except KeyError:  # Guess voltage from its dimension if not supplied
-            candidate_vs = [cv for cv in component_class.state_variables
-                            if cv.dimension == un.voltage]
-            if len(candidate_vs) == 0:
-                candidate_vs = [
-                    cv for cv in component_class.analog_receive_ports
-                    if cv.dimension == un.voltage]
-            if len(candidate_vs) == 1:
-                orig_v = candidate_vs[0]
-                logger.info("Guessing that '{}' is the membrane voltage"
-                            .format(orig_v))
-            elif len(candidate_vs) > 1:
-                try:
-                    orig_v = next(c for c in candidate_vs if c.name == 'v')
-                    logger.info("Guessing that '{}' is the membrane voltage"
-                                .format(orig_v))
-                except StopIteration:
-                    raise Pype9BuildError(
-                        "Could not guess the membrane voltage, candidates: "
-                        "'{}'" .format("', '".join(v.name
-                                                   for v in candidate_vs)))
-            else:
-                orig_v = None
-                logger.info(
-                    "Can't find candidate for the membrane voltage in "
-                    "state_variables '{}' or analog_receive_ports '{}', "
-                    "treating '{}' as an \"artificial cell\"".format(
-                        "', '".join(
-                            sv.name for sv in component_class.state_variables),
-                        "', '".join(
-                            p.name
-                            for p in component_class.analog_receive_ports),
-                        component_class.name))
-        if orig_v is not None:
-            # Map voltage to hard-coded 'v' symbol
-            if orig_v.name != 'v':
-                trfrm.rename_symbol(orig_v.name, 'v')
-                v = trfrm.state_variable('v')
-                v.annotations.set((BUILD_TRANS, PYPE9_NS),
-                                  TRANSFORM_SRC, orig_v)
-            else:
-                v = trfrm.state_variable('v')
-            # Add annotations to the original and build models
-            component_class.annotations.set((BUILD_TRANS, PYPE9_NS),
-                                            MEMBRANE_VOLTAGE, orig_v.name)  # @IgnorePep8
-            trfrm.annotations.set((BUILD_TRANS, PYPE9_NS),
-                                  MEMBRANE_VOLTAGE, 'v')
-            # Remove associated analog send port if present
-            try:
-                trfrm.remove(trfrm.analog_send_port('v'))
-            except KeyError:
-                pass
-            # Need to convert to AnalogReceivePort if v is a StateVariable
-            if isinstance(v, StateVariable):
-                self._transform_full_component(trfrm, component_class, v,
-                                               **kwargs)
-                trfrm.annotations.set((BUILD_TRANS, PYPE9_NS),
-                                      MECH_TYPE, FULL_CELL_MECH)
-            else:
-                raise NotImplementedError(
-                    "Build sub-components is not supported in PyPe9 v0.1")
-        else:
-            trfrm.annotations.set((BUILD_TRANS, PYPE9_NS), MECH_TYPE,
-                                  ARTIFICIAL_CELL_MECH)
-
-        # -----------------------------------------------------------------
-        # Insert dummy aliases for parameters (such as capacitance) that
-        # now do not show up in the inferred interface for the transformed
-        # class (i.e. that were only # present in the voltage time derivative)
-        # -----------------------------------------------------------------
-
-        # Infer required parameters
-        inferred = DynamicsInterfaceInferer(trfrm)
-
-        for parameter in list(trfrm.parameters):
-            if parameter.name not in inferred.parameter_names:
-                trfrm.add(Alias(parameter.name + '___dummy', parameter.name))
-
-        # -----------------------------------------------------------------
-        # Validate the transformed component class and construct prototype
-        # -----------------------------------------------------------------
-
-        trfrm.validate()
-        trfrm_with_syn = DynamicsWithSynapses(
-            name, trfrm, component_class.synapses,
-            component_class.connection_parameter_sets)
-        # Retun a prototype of the transformed class
-        return trfrm_with_syn
-
-    def _transform_full_component(self, trfrm, component_class, v, **kwargs):
-        # -----------------------------------------------------------------
-        # Remove all analog send ports with 'current' dimension so they
-        # don't get confused with the converted voltage time derivative
-        # expression
-        # -----------------------------------------------------------------
-        for port in list(trfrm.analog_send_ports):
-            if port.dimension == un.current:
-                trfrm.remove(port)
-        # -----------------------------------------------------------------
-        # Insert membrane capacitance if not present
-        # -----------------------------------------------------------------
-        # Get or guess the location of the membrane capacitance
-        try:
-            name = kwargs['membrane_capacitance']
-            try:
-                orig_cm = component_class.parameter(name)
-            except KeyError:
-                raise Pype9BuildError(
-                    "Could not find specified membrane capacitance '{}'"
-                    .format(name))
-            cm = trfrm.parameter(orig_cm.name)
-        except KeyError:  # 'membrane_capacitance' was not specified
-            candidate_cms = [ccm for ccm in component_class.parameters
-                             if ccm.dimension == un.capacitance]
-            if len(candidate_cms) == 1:
-                orig_cm = candidate_cms[0]
-                cm = trfrm.parameter(orig_cm.name)
-                logger.info("Guessing that '{}' is the membrane capacitance"
-                            .format(orig_cm))
-            elif len(candidate_cms) > 1:
-                raise Pype9BuildError(
-                    "Could not guess the membrane capacitance, candidates:"
-                    " '{}'".format("', '".join(candidate_cms)))
-            else:
-                cm = Parameter("cm___pype9", dimension=un.capacitance)
-                trfrm.add(cm)
-            cm.annotations.set((BUILD_TRANS, PYPE9_NS), TRANSFORM_SRC, None)
-        trfrm.annotations.set((BUILD_TRANS, PYPE9_NS),
-                              MEMBRANE_CAPACITANCE, cm.name)
-        # -----------------------------------------------------------------
-        # Replace membrane voltage equation with membrane current
-        # -----------------------------------------------------------------
-        # Determine the regimes in which each state variables has a time
-        # derivative in
-        has_td = defaultdict(list)
-        # List which regimes need to be clamped to their last voltage
-        # (as it has no time derivative)
-        clamped_regimes = []
-        # The voltage clamp equation where v_clamp is the last voltage
-        # value and g_clamp_ is a large conductance
-        clamp_i = sympy.sympify('g_clamp___pype9 * (v - v_clamp___pype9)')
-        memb_is = []
-        for regime in trfrm.regimes:
-            # Add an appropriate membrane current
-            try:
-                # Convert the voltage time derivative into a membrane
-                # current
-                dvdt = regime.time_derivative(v.name)
-                regime.remove(dvdt)
-                i = -dvdt.rhs * cm
-                memb_is.append(i)
-            except KeyError:
-                i = clamp_i
-                clamped_regimes.append(regime)
-            regime.add(Alias('i___pype9', i))
-            # Record state vars that have a time deriv. in this regime
-            for var in regime.time_derivative_variables:
-                if var != 'v':
-                    has_td[var].append(regime)
-        # Pick the most popular membrane current to be the alias in
-        # the global scope
-        assert memb_is, "No regimes contain voltage time derivatives"
-        memb_i = Alias('i___pype9', max(memb_is, key=memb_is.count))
-        # Add membrane current along with a analog send port
-        trfrm.add(memb_i)
-        i_port = AnalogSendPort('i___pype9', dimension=un.current)
-        i_port.annotations.set((BUILD_TRANS, PYPE9_NS), ION_SPECIES,
-                               NONSPECIFIC_CURRENT)
-        trfrm.add(i_port)
-        # Remove membrane currents that match the membrane current in the
-        # outer scope
-        for regime in trfrm.regimes:
-            if regime.alias('i___pype9') == memb_i:
-                regime.remove(regime.alias('i___pype9'))
-        # If there are clamped regimes add extra parameters and set the
-        # voltage to clamp to in the regimes that trfrmition to them
-        if clamped_regimes:
-            trfrm.add(StateVariable('v_clamp___pype9', un.voltage))
-            trfrm.add(Constant('g_clamp___pype9', 1e8, un.uS))
-            for trans in trfrm.transitions:
-                if trans.target_regime in clamped_regimes:
-                    # Assign v_clamp_ to the value
-                    try:
-                        v_clamp_rhs = trans.state_assignment('v').rhs
-                    except KeyError:
-                        v_clamp_rhs = 'v'
-                    trans.add(StateAssignment('v_clamp___pype9',
-                                              v_clamp_rhs))
-        # -----------------------------------------------------------------
-        trfrm.annotations.set(
-            (BUILD_TRANS, PYPE9_NS), NO_TIME_DERIVS,
-            ','.join(['v'] + [sv for sv in trfrm.state_variable_names
-                              if sv not in has_td]))
-        trfrm.annotations.set((BUILD_TRANS, PYPE9_NS), NUM_TIME_DERIVS,
-                              len(has_td))
-        # -----------------------------------------------------------------
-        # Remove the external input currents
-        # -----------------------------------------------------------------
-        # Analog receive or reduce ports that are of dimension current and
-        # are purely additive to the membrane current and nothing else
-        # (actually subtractive as it is outward current)
-        try:
-            ext_is = []
-            for i_name in kwargs['external_currents']:
-                try:
-                    ext_i = trfrm.analog_receive_port(i_name)
-                except KeyError:
-                    try:
-                        ext_i = trfrm.analog_reduce_port(i_name)
-                    except KeyError:
-                        raise Pype9BuildError(
-                            "Did not find specified external current port "
-                            "'{}'".format(i_name))
-                if ext_i.dimension != un.current:
-                    raise Pype9BuildError(
-                        "Analog receive port matching specified external "
-                        "current '{}' does not have 'current' dimension "
-                        "({})".format(ext_i.name, ext_i.dimension))
-                ext_is.append(ext_i)
-        except KeyError:
-            ext_is = []
-            for port in chain(component_class.analog_receive_ports,
-                              component_class.analog_reduce_ports):
-                # Check to see if the receive/reduce port has current dimension
-                if port.dimension != un.current:
-                    continue
-                # Check to see if the current appears in the membrane current
-                # expression
-                # FIXME: This test should check to to see if the port is
-                #        additive to the membrane current and substitute all
-                #        aliases.
-                if port.name not in memb_i.rhs_symbol_names:
-                    continue
-                # Get the number of expressions the receive port appears in
-                # an expression
-                if len([e for e in component_class.all_expressions
-                        if port.symbol in e.free_symbols]) > 1:
-                    continue
-                # If all those conditions are met guess that port is a external
-                # current that can be removed (ports that don't meet these
-                # conditions will have to be specified separately)
-                ext_is.append(port)
-            if ext_is:
-                logger.info("Guessing '{}' are external currents to be removed"
-                            .format(ext_is))
-        trfrm.annotations.set((BUILD_TRANS, PYPE9_NS), EXTERNAL_CURRENTS,
-                              ','.join(p.name for p in ext_is))
-        # Remove external input current ports (as NEURON handles them)
-        for ext_i in ext_is:
-            trfrm.remove(ext_i)
-            for expr in chain(trfrm.aliases, trfrm.all_time_derivatives()):
-                expr.subs(ext_i, 0)
-                expr.simplify()
-
     def compile_source_files(self, compile_dir, name):
         """
         Builds all NMODL files in a directory
@@ -479,11 +219,15 @@ class CodeGenerator(BaseCodeGenerator):
                             "Could not run 'modlunit' to check dimensions in "
                             "NMODL file: {}\n{}".format(fname, e))
         # Run nrnivmodl command in src directory
-        nrnivmodl_cmd = [self.nrnivmodl_path, '-loadflags',
-                         ' '.join(self.nrnivmodl_flags)]
+        nrnivmodl_cmd = [self.nrnivmodl_path]
+        if self.coreneuron:
+            # Translates the mechanisms for CoreNEURON as well as NEURON
+            nrnivmodl_cmd.append('-coreneuron')
+        nrnivmodl_cmd.extend(['-loadflags', ' '.join(
+            self.nrnivmodl_flags + self.hook_link_flags())])
         logger.debug("Building nrnivmodl in {} with {}".format(
             compile_dir, nrnivmodl_cmd))
-        self.run_command(nrnivmodl_cmd, fail_msg=(
+        stdout, stderr = self.run_command(nrnivmodl_cmd, fail_msg=(
             "Compilation of NMODL files for '{}' model failed. See src "
             "directory '{}':\n\n{{}}".format(name, compile_dir)))
         if stderr.strip().endswith('Error 1'):
@@ -537,6 +281,13 @@ class CodeGenerator(BaseCodeGenerator):
         os.chdir(orig_dir)
         return specials_dir
 
+    def cache_flags(self):
+        flags = (list(self.nrnivmodl_flags) +
+                 super(CodeGenerator, self).cache_flags())
+        if self.coreneuron:
+            flags.append('-coreneuron')
+        return flags
+
     def simulator_specific_paths(self):
         path = []
         try:
@@ -548,14 +299,6 @@ class CodeGenerator(BaseCodeGenerator):
             pass
         return path
 
-    def assign_str(self, lhs, rhs):
-        rhs = Expression.expand_integer_powers(rhs)
-        nmodl_str = ccode(rhs, user_functions=Expression._cfunc_map,
-                          assign_to=lhs)
-        nmodl_str = Expression.strip_L_from_rationals(nmodl_str)
-        nmodl_str = nmodl_str.replace(';', '')
-        return nmodl_str
-
     @property
     def libninemlnrn_dir(self):
         return os.path.join(self.base_dir, 'libninemlnrn')
@@ -608,6 +351,18 @@ class CodeGenerator(BaseCodeGenerator):
             raise Pype9BuildError(
                 "{}:\n{}".format(fail_msg, '  '.join([''] + stdout)))
 
+    @classmethod
+    def net_receive_args(cls, component_class):
+        """
+        The names of the arguments of the NET_RECEIVE block (i.e. the
+        elements of the weight vector of each NetCon) generated for the
+        component class, which are followed by the state variables of the
+        event-driven plasticity of each incoming projection
+        """
+        return ['connection_weight_', 'channel'] + list(chain(*(
+            s.state_variable_names
+            for s in event_driven_synapses(component_class))))
+
     @classmethod
     def get_neuron_bin_path(cls):
         path = neuron.h.neuronhome()
@@ -8,11 +8,16 @@
            the MIT Licence, see LICENSE for details.
 """
 from __future__ import absolute_import
+import numpy
+from neuron import h
 import pyNN.neuron
 from pyNN.common.control import build_state_queries
 import pyNN.neuron.simulator as simulator
 from pyNN.neuron.standardmodels.synapses import StaticSynapse
-import logging
+from nineml.values import SingleValue
+from pype9.exceptions import Pype9Unsupported9MLException
+from pype9.utils.logging import get_logger
+from pype9.simulate.common.network.values import get_values
 from pype9.simulate.common.network.base import (
     Network as BaseNetwork, ComponentArray as BaseComponentArray,
     ConnectionGroup as BaseConnectionGroup, Selection as BaseSelection)
@@ -22,7 +27,7 @@ from ..code_gen import CodeGenerator as CodeGenerator  # @IgnorePep8
 from ..units import UnitHandler  # @IgnorePep8
 from ..simulation import Simulation  # @IgnorePep8
 
-logger = logging.getLogger("pype9")
+logger = get_logger(__name__)
 
 get_current_time, get_time_step, get_min_delay, \
     get_max_delay, num_processes, rank = build_state_queries(simulator)
@@ -53,6 +58,14 @@ class ComponentArray(BaseComponentArray, pyNN.neuron.Population):
             to_record = 'spikes'  # FIXME: Need a way of differentiating event send ports @IgnorePep8
         pyNN.neuron.Population.record(self, to_record)
 
+    def _save_state(self, group):  # @UnusedVariable
+        # The cells of the array are registered with the simulation
+        # individually so their states are saved along with the other cells
+        pass
+
+    def _restore_state(self, group):  # @UnusedVariable
+        pass
+
 
 class Selection(BaseSelection, pyNN.neuron.Assembly):
 
@@ -70,6 +83,42 @@ class ConnectionGroup(BaseConnectionGroup, pyNN.neuron.Projection):
     def get_min_delay(self):
         return get_min_delay()
 
+    def _plastic_synapse_type(self, plasticity, destination, weight, delay,
+                              rng):  # @UnusedVariable
+        # The event-driven plasticity is generated in the NET_RECEIVE block
+        # of the cell mechanism, where its parameters are GLOBAL
+        mech_name = destination.celltype.model.name
+        for prop in plasticity.properties:
+            if not isinstance(prop.value, SingleValue):
+                raise Pype9Unsupported9MLException(
+                    "Parameters of the plasticity of '{}' projection must be "
+                    "single values in NEURON simulations ('{}' is {})"
+                    .format(self.name, prop.name, prop.value))
+            setattr(h, '{}_{}'.format(prop.name, mech_name),
+                    self.UnitHandler.scale_value(prop))
+        return self.SynapseClass(weight=weight, delay=delay)
+
+    def _initialize_plasticity(self, plasticity, destination, rng):
+        # The states of each connection are stored in the elements of the
+        # weight vector of its NetCon after the weight and channel
+        component_class = destination.celltype.model.build_component_class
+        args = CodeGenerator.net_receive_args(component_class)
+        channel = component_class.index_of(component_class.event_receive_port(
+            self._plasticity.receive_port))
+        initial_values = [
+            (args.index(i.name),
+             get_values(i, self.UnitHandler, rng, len(self.connections)))
+            for i in plasticity.initial_values]
+        for j, conn in enumerate(self.connections):
+            conn.nc.weight[args.index('channel')] = channel
+            for index, values in initial_values:
+                conn.nc.weight[index] = values[j]
+
+    def _plastic_values(self, varname):
+        component_class = self.post.celltype.model.build_component_class
+        index = CodeGenerator.net_receive_args(component_class).index(varname)
+        return numpy.array([c.nc.weight[index] for c in self.connections])
+
 
 class Network(BaseNetwork):
 
@@ -1,21 +1,47 @@
 from builtins import object
+import os
+import tempfile
 from nineml import units as un
 import ctypes
+import numpy
+from neuron import h
 from pyNN.neuron import (
     setup as pyNN_setup, run as pyNN_run, end as pyNN_end, state as pyNN_state)
 from pyNN.neuron.simulator import initializer as pyNN_initializer
 from pype9.simulate.common.simulation import Simulation as BaseSimulation
 from pype9.simulate.neuron.code_gen import CodeGenerator
-from pype9.exceptions import Pype9UsageError
+from pype9.exceptions import Pype9UsageError, Pype9ImportError
+from pype9.utils.logging import get_logger
+
+logger = get_logger(__name__)
 
 
 class Simulation(BaseSimulation):
     """
     This is adapted from the code for the simulation controller in PyNN for
     use with individual cell objects
+
+    In addition to the parameters of the base class the following
+    parameters are accepted
+
+    Parameters
+    ----------
+    coreneuron : bool
+        Run the simulation with CoreNEURON instead of NEURON. Requires the
+        cells in the simulation to be built with a CoreNEURON-compatible code
+        generator, which is created by default if a code generator is not
+        provided
+    gpu : bool
+        Run the CoreNEURON simulation on the GPU (requires CoreNEURON to be
+        installed with GPU support)
+    cvode : bool
+        Integrate the simulation with NEURON's adaptive CVODE solver. It is
+        also activated when a cell built with the 'adaptive' solver option is
+        created
     """
 
     _active = None
+    _coreneuron_enabled = False
     name = 'Neuron'
     CodeGenerator = CodeGenerator
 
@@ -27,9 +53,67 @@ class Simulation(BaseSimulation):
     DEFAULT_MAX_DELAY = 10 * un.ms
 
     def __init__(self, *args, **kwargs):
+        coreneuron = kwargs.pop('coreneuron', None)
+        self._gpu = kwargs.pop('gpu', False)
+        self._cvode = kwargs.pop('cvode', False)
+        code_generator = kwargs.get('code_generator', None)
+        if code_generator is None:
+            kwargs['code_generator'] = self.CodeGenerator(
+                base_dir=kwargs.pop('build_base_dir', None),
+                coreneuron=bool(coreneuron))
+        elif coreneuron is None:
+            coreneuron = code_generator.coreneuron
+        elif bool(coreneuron) != code_generator.coreneuron:
+            raise Pype9UsageError(
+                "The 'coreneuron' option ({}) does not match that of the "
+                "provided code generator ({})"
+                .format(coreneuron, code_generator.coreneuron))
+        self._coreneuron = bool(coreneuron)
+        if self._gpu and not self._coreneuron:
+            raise Pype9UsageError(
+                "Simulations can only be run on the GPU with CoreNEURON "
+                "(i.e. 'coreneuron=True')")
+        if self._cvode and self._coreneuron:
+            raise Pype9UsageError(
+                "CVODE is not supported in CoreNEURON simulations")
         super(Simulation, self).__init__(*args, **kwargs)
         self._has_random_processes = False
 
+    @property
+    def coreneuron(self):
+        return self._coreneuron
+
+    @property
+    def gpu(self):
+        return self._gpu
+
+    @property
+    def cvode(self):
+        "Whether the simulation is integrated with CVODE"
+        return self._cvode
+
+    def _enable_cvode(self, cell_class):
+        """
+        Activates CVODE for cells built with the 'adaptive' solver option
+        (CVODE integrates all cells in the simulation)
+        """
+        if getattr(cell_class, 'solver', None) != 'adaptive' or self._cvode:
+            return
+        if self.coreneuron:
+            raise Pype9UsageError(
+                "Cannot simulate '{}' cell, which was built with the "
+                "'adaptive' solver option, with CoreNEURON"
+                .format(cell_class.name))
+        if self._running:
+            raise Pype9UsageError(
+                "Cannot activate CVODE for '{}' cell, which was built with "
+                "the 'adaptive' solver option, after the simulation has "
+                "started".format(cell_class.name))
+        logger.info("Activating CVODE for '{}' cell, which was built with "
+                    "the 'adaptive' solver option".format(cell_class.name))
+        self._cvode = True
+        h.CVode().active(1)
+
     def _run(self, t_stop, callbacks=None, **kwargs):  # @UnusedVariable
         """
         Run the simulation until time 't'. Typically won't be called explicitly
@@ -47,6 +131,59 @@ class Simulation(BaseSimulation):
         """
         pyNN_run(float(t_stop.in_units(un.ms)), callbacks=callbacks)
 
+    def _save_kernel_state(self, group):
+        """
+        Saves the state of the NEURON kernel (including the event queue)
+        using NEURON's SaveState class
+        """
+        if self.coreneuron:
+            raise Pype9UsageError(
+                "Saving the state of CoreNEURON simulations is not supported")
+        fd, path = tempfile.mkstemp(suffix='.dat')
+        os.close(fd)
+        try:
+            state = h.SaveState()
+            state.save()
+            # SaveState needs a NEURON File that is open for writing
+            f = h.File()
+            f.wopen(path)
+            state.fwrite(f)
+            f.close()
+            with open(path, 'rb') as f:
+                group.attrs['save_state'] = numpy.void(f.read())
+        finally:
+            os.remove(path)
+
+    def _restore_kernel_state(self, group, t):
+        """
+        Restores the state of the NEURON kernel saved by _save_kernel_state
+        """
+        if self.coreneuron:
+            raise Pype9UsageError(
+                "Restoring the state of CoreNEURON simulations is not "
+                "supported")
+        # Ensures that PyNN has called finitialize before the state is
+        # restored
+        pyNN_run(0.0)
+        fd, path = tempfile.mkstemp(suffix='.dat')
+        os.close(fd)
+        try:
+            with open(path, 'wb') as f:
+                f.write(group.attrs['save_state'].tobytes())
+            state = h.SaveState()
+            f = h.File()
+            f.ropen(path)
+            state.fread(f)
+            f.close()
+            state.restore()
+        finally:
+            os.remove(path)
+        pyNN_state.tstop = float(t.in_units(un.ms))
+        # NB: The state of the GSL random number generator used by random
+        # processes cannot be saved so it is reseeded from the dynamics seed
+        if self._has_random_processes:
+            self._seed_libninemlnrn()
+
     def _prepare(self, **kwargs):
         "Reset the simulation and prepare it for creating new cells/networks"
         if self._min_delay is None:
@@ -71,6 +208,34 @@ class Simulation(BaseSimulation):
                    min_delay=float(min_delay.in_units(un.ms)),
                    max_delay=float(max_delay.in_units(un.ms)),
                    **kwargs)
+        self._enable_coreneuron(self.coreneuron)
+        h.CVode().active(int(self._cvode))
+
+    def deactivate(self, kill_cells=True):
+        super(Simulation, self).deactivate(kill_cells=kill_cells)
+        if self.coreneuron:
+            self._enable_coreneuron(False)
+        h.CVode().active(0)
+
+    def _enable_coreneuron(self, enable):
+        """
+        Switches the execution of ParallelContext.psolve (which PyNN uses to
+        run the simulation) between NEURON and CoreNEURON. The model is
+        transferred to CoreNEURON in memory when the simulation is run, which
+        requires NEURON's cache-efficient data layout
+        """
+        if not (enable or self.__class__._coreneuron_enabled):
+            return  # Avoids importing CoreNEURON when it isn't required
+        try:
+            from neuron import coreneuron
+        except ImportError:
+            raise Pype9ImportError(
+                "Could not import CoreNEURON, please check that NEURON (>= 8)"
+                " has been installed with CoreNEURON support")
+        h.CVode().cache_efficient(int(enable))
+        coreneuron.enable = enable
+        coreneuron.gpu = enable and self.gpu
+        self.__class__._coreneuron_enabled = enable
 
     def _initialize(self):
         """
@@ -105,11 +270,13 @@ class Simulation(BaseSimulation):
         pyNN_initializer.register(self._DummyID(cell))
         if cell.component_class.is_random:
             self._has_random_processes = True
+        self._enable_cvode(type(cell))
 
     def register_array(self, array):
         super(Simulation, self).register_array(array)
         if array.component_class.is_random:
             self._has_random_processes = True
+        self._enable_cvode(array.celltype.model)
         # The initial states of NMODL mechanism need to be set twice before and
         # after h.finitialize is called in order to set states that may be
         # required in the NET_RECEIVE block before finitialize and to set the
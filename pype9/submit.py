@@ -0,0 +1,740 @@
+"""
+Submission of simulations to the SLURM and PBS schedulers of HPC clusters.
+
+A submitted simulation is packaged into its own job directory (by default
+under '~/.pype9/jobs' or the PYPE9_JOBS_DIR environment variable), which
+contains::
+
+    job.json    the job ID, scheduler, resources and state of the job
+    job.sh      the job script submitted to the scheduler
+    inputs/     copies of the model, protocol, played signals and restored
+                state passed to 'pype9 simulate'
+    build/      the code-generation artifacts (copied from the '--build_dir'
+                of the simulation if it is provided)
+    outputs/    the recordings, saved state and manifest of the simulation
+    job.out/err the output and error streams of the job
+
+The 'pype9 simulate' arguments of the job are rewritten to read from and
+write to the job directory, and the outputs are copied back to the paths
+passed to 'pype9 simulate' once the job has completed (see ``Job.retrieve``).
+Documents referenced from the model by relative URLs are not copied, so
+models spread over multiple documents should refer to them by absolute or
+catalog URLs.
+
+  Author: Thomas G. Close (tclose@oist.jp)
+  Copyright: 2012-2017 Thomas G. Close.
+  License: This file is part of the "Pype9" package, which is released under
+           the MIT Licence, see LICENSE for details.
+"""
+from __future__ import absolute_import
+from builtins import object
+import os
+import re
+import time
+import json
+import shutil
+import subprocess as sp
+from datetime import datetime
+from os.path import expanduser
+from future.utils import PY3
+from pype9.exceptions import Pype9UsageError, Pype9RuntimeError
+from pype9.utils.logging import logger
+try:
+    from shlex import quote
+except ImportError:
+    from pipes import quote  # @UnusedImport
+
+BASE_JOBS_DIR = os.path.join(expanduser("~"), '.pype9', 'jobs')
+
+JOB_FILE = 'job.json'
+SCRIPT_FILE = 'job.sh'
+EXIT_STATUS_FILE = 'exit_status'
+INPUTS_DIR = 'inputs'
+OUTPUTS_DIR = 'outputs'
+BUILD_DIR = 'build'
+
+# The states jobs can be in. The states of the schedulers are mapped onto
+# these
+PENDING = 'pending'
+RUNNING = 'running'
+COMPLETED = 'completed'
+FAILED = 'failed'
+CANCELLED = 'cancelled'
+UNKNOWN = 'unknown'
+FINISHED_STATES = (COMPLETED, FAILED, CANCELLED)
+
+# Options of 'pype9 simulate' that take file arguments, mapped to the number
+# of arguments that precede the filename.
+INPUT_OPTIONS = {'--play': 1, '--protocol': 0, '--restore': 0,
+                 '--voltage_clamp': 0}
+OUTPUT_OPTIONS = {'--record': 1, '--save_state': 0, '--manifest': 0}
+
+
+def jobs_dir():
+    "The directory jobs are packaged into"
+    return os.environ.get('PYPE9_JOBS_DIR', BASE_JOBS_DIR)
+
+
+class BaseScheduler(object):
+    """
+    Writes job scripts for, submits jobs to and queries the state of jobs on
+    an HPC scheduler
+
+    Parameters
+    ----------
+    nodes : int
+        The number of nodes to request
+    tasks_per_node : int
+        The number of (MPI) tasks to run on each node
+    cpus_per_task : int
+        The number of CPUs to allocate to each task (e.g. for threads)
+    walltime : str
+        The maximum time the job can run for (HH:MM:SS)
+    memory : str | None
+        The memory to request per node (e.g. '4G'), scheduler default if None
+    queue : str | None
+        The partition/queue to submit to, scheduler default if None
+    account : str | None
+        The account to charge the job to, scheduler default if None
+    modules : list(str)
+        Environment modules to load before running the simulation
+    setup : list(str)
+        Shell commands to run before running the simulation (e.g. to activate
+        a virtual environment)
+    directives : list(str)
+        Additional directives to add to the header of the job script (without
+        the '#SBATCH'/'#PBS' prefix)
+    """
+
+    name = None
+    # The prefix of the directives in the header of the job script
+    directive_prefix = None
+    # The launcher used to run simulations over MPI processes
+    mpi_launcher = None
+
+    def __init__(self, nodes=1, tasks_per_node=1, cpus_per_task=1,
+                 walltime='01:00:00', memory=None, queue=None, account=None,
+                 modules=(), setup=(), directives=()):
+        self.nodes = nodes
+        self.tasks_per_node = tasks_per_node
+        self.cpus_per_task = cpus_per_task
+        self.walltime = walltime
+        self.memory = memory
+        self.queue = queue
+        self.account = account
+        self.modules = list(modules)
+        self.setup = list(setup)
+        self.directives = list(directives)
+
+    @property
+    def resources(self):
+        "The resources requested from the scheduler (saved in the job file)"
+        return {'nodes': self.nodes, 'tasks_per_node': self.tasks_per_node,
+                'cpus_per_task': self.cpus_per_task,
+                'walltime': self.walltime, 'memory': self.memory,
+                'queue': self.queue, 'account': self.account,
+                'modules': self.modules, 'setup': self.setup,
+                'directives': self.directives}
+
+    def script(self, job, pype9_cmd='pype9', launcher=None):
+        """
+        The job script that runs the simulation of the job
+
+        Parameters
+        ----------
+        job : Job
+            The job to write the script for
+        pype9_cmd : str
+            The command used to run 'pype9' on the compute nodes
+        launcher : str | None
+            The command used to launch the simulation over multiple MPI
+            processes (defaults to the launcher of the scheduler), only used
+            if '--mpi' is passed to 'pype9 simulate'
+        """
+        lines = ['#!/bin/bash']
+        lines.extend('{} {}'.format(self.directive_prefix, d)
+                     for d in self.header(job) + self.directives)
+        lines.append('')
+        lines.extend('module load {}'.format(m) for m in self.modules)
+        lines.extend(self.setup)
+        cmd = [pype9_cmd, 'simulate'] + job.job_argv
+        if '--mpi' in job.job_argv:
+            if launcher is None:
+                launcher = self.mpi_launcher
+            cmd = launcher.split() + cmd
+        lines.extend([
+            'cd {}'.format(quote(job.path)),
+            ' '.join(quote(a) for a in cmd),
+            'status=$?',
+            'echo $status > {}'.format(EXIT_STATUS_FILE),
+            'exit $status', ''])
+        return '\n'.join(lines)
+
+    def header(self, job):
+        "The directives that request the resources of the job"
+        raise NotImplementedError
+
+    @classmethod
+    def stream_path(cls, job, fname):
+        """
+        The path of a file in the job directory that an output stream of the
+        job is written to. The directives are not parsed by the shell, so
+        paths containing whitespace can't be quoted in them
+        """
+        path = os.path.join(job.path, fname)
+        if re.search(r'\s', path):
+            raise Pype9UsageError(
+                "The directory of '{}' job, '{}', contains whitespace, which "
+                "can't be used in the directives of the job script (set "
+                "PYPE9_JOBS_DIR to a path without whitespace)"
+                .format(job.name, job.path))
+        return path
+
+    def submit(self, script_path):
+        """
+        Submits the job script to the scheduler and returns the ID of the job
+        """
+        stdout = self._run(self.submit_cmd(script_path),
+                           cwd=os.path.dirname(script_path))
+        return self.parse_job_id(stdout)
+
+    def state(self, job_id):
+        """
+        Queries the state of the job from the scheduler (one of 'pending',
+        'running', 'completed', 'failed', 'cancelled' or 'unknown')
+        """
+        raise NotImplementedError
+
+    def submit_cmd(self, script_path):
+        raise NotImplementedError
+
+    def parse_job_id(self, stdout):
+        raise NotImplementedError
+
+    def _run(self, cmd, cwd=None):
+        """
+        Runs a command of the scheduler and returns its output, raising a
+        Pype9RuntimeError if it fails
+        """
+        try:
+            process = sp.Popen(cmd, stdout=sp.PIPE, stderr=sp.PIPE, cwd=cwd)
+            stdout, stderr = process.communicate()
+        except OSError as e:
+            raise Pype9RuntimeError(
+                "Could not run '{}' ({}), is {} installed on this host?"
+                .format(cmd[0], e, self.name.upper()))
+        if PY3:
+            stdout = str(stdout.decode('utf-8'))
+            stderr = str(stderr.decode('utf-8'))
+        if process.returncode:
+            raise Pype9RuntimeError(
+                "'{}' failed with exit status {}:\n{}".format(
+                    ' '.join(cmd), process.returncode, stderr))
+        return stdout
+
+
+class SlurmScheduler(BaseScheduler):
+    "The SLURM workload manager"
+
+    name = 'slurm'
+    directive_prefix = '#SBATCH'
+    mpi_launcher = 'srun'
+
+    STATES = {'PENDING': PENDING, 'CONFIGURING': PENDING,
+              'REQUEUED': PENDING, 'SUSPENDED': PENDING,
+              'RUNNING': RUNNING, 'COMPLETING': RUNNING,
+              'COMPLETED': COMPLETED, 'CANCELLED': CANCELLED,
+              'FAILED': FAILED, 'TIMEOUT': FAILED, 'NODE_FAIL': FAILED,
+              'OUT_OF_MEMORY': FAILED, 'PREEMPTED': FAILED,
+              'BOOT_FAIL': FAILED, 'DEADLINE': FAILED}
+
+    def header(self, job):
+        header = [
+            '--job-name={}'.format(job.name),
+            '--output={}'.format(self.stream_path(job, 'job.out')),
+            '--error={}'.format(self.stream_path(job, 'job.err')),
+            '--nodes={}'.format(self.nodes),
+            '--ntasks-per-node={}'.format(self.tasks_per_node),
+            '--cpus-per-task={}'.format(self.cpus_per_task),
+            '--time={}'.format(self.walltime)]
+        if self.memory is not None:
+            header.append('--mem={}'.format(self.memory))
+        if self.queue is not None:
+            header.append('--partition={}'.format(self.queue))
+        if self.account is not None:
+            header.append('--account={}'.format(self.account))
+        return header
+
+    def submit_cmd(self, script_path):
+        return ['sbatch', '--parsable', script_path]
+
+    def parse_job_id(self, stdout):
+        # Output is of the form '<job-id>[;<cluster>]'
+        return stdout.strip().split(';')[0]
+
+    def state(self, job_id):
+        # Jobs are only listed by squeue while they are in the queue, after
+        # which their final state is looked up from the accounting database
+        # (if it is enabled)
+        stdout = self._run(['squeue', '--noheader', '--jobs', job_id,
+                            '--format=%T'])
+        if not stdout.strip():
+            try:
+                stdout = self._run(['sacct', '--noheader', '--allocations',
+                                    '--jobs', job_id, '--format=State'])
+            except Pype9RuntimeError:
+                return UNKNOWN
+        return self.parse_state(stdout)
+
+    def parse_state(self, stdout):
+        try:
+            # e.g. 'CANCELLED by 1234'
+            state = stdout.split()[0].rstrip('+')
+        except IndexError:
+            return UNKNOWN
+        return self.STATES.get(state, UNKNOWN)
+
+
+class PbsScheduler(BaseScheduler):
+    "The PBS Pro/Torque resource managers"
+
+    name = 'pbs'
+    directive_prefix = '#PBS'
+    mpi_launcher = 'mpirun'
+
+    # Maximum length of job names
+    MAX_NAME_LENGTH = 15
+
+    STATES = {'Q': PENDING, 'H': PENDING, 'W': PENDING, 'T': PENDING,
+              'S': PENDING, 'R': RUNNING, 'E': RUNNING, 'B': RUNNING,
+              'C': COMPLETED, 'F': COMPLETED, 'X': COMPLETED}
+
+    def header(self, job):
+        select = 'select={}:ncpus={}:mpiprocs={}'.format(
+            self.nodes, self.tasks_per_node * self.cpus_per_task,
+            self.tasks_per_node)
+        if self.memory is not None:
+            select += ':mem={}'.format(self.memory)
+        header = [
+            '-N {}'.format(job.name[:self.MAX_NAME_LENGTH]),
+            '-o {}'.format(self.stream_path(job, 'job.out')),
+            '-e {}'.format(self.stream_path(job, 'job.err')),
+            '-l {}'.format(select),
+            '-l walltime={}'.format(self.walltime)]
+        if self.queue is not None:
+            header.append('-q {}'.format(self.queue))
+        if self.account is not None:
+            header.append('-A {}'.format(self.account))
+        return header
+
+    def submit_cmd(self, script_path):
+        return ['qsub', script_path]
+
+    def parse_job_id(self, stdout):
+        # Output is of the form '<job-id>.<server>'
+        return stdout.strip()
+
+    def state(self, job_id):
+        try:
+            stdout = self._run(['qstat', '-f', job_id])
+        except Pype9RuntimeError:
+            # Finished jobs are removed from the queue
+            return UNKNOWN
+        return self.parse_state(stdout)
+
+    def parse_state(self, stdout):
+        match = re.search(r'job_state\s*=\s*(\w)', stdout)
+        if match is None:
+            return UNKNOWN
+        return self.STATES.get(match.group(1), UNKNOWN)
+
+
+schedulers = dict((s.name, s) for s in (SlurmScheduler, PbsScheduler))
+
+
+def scheduler_class(name):
+    "Returns the scheduler class of the given name"
+    try:
+        return schedulers[name]
+    except KeyError:
+        raise Pype9UsageError(
+            "Unrecognised scheduler '{}', can be one of '{}'"
+            .format(name, "', '".join(sorted(schedulers))))
+
+
+class Job(object):
+    """
+    A simulation packaged into a job directory and submitted to a scheduler
+
+    Parameters
+    ----------
+    path : str
+        The job directory
+    scheduler : str
+        The name of the scheduler ('slurm' or 'pbs')
+    name : str
+        The name of the job
+    argv : list(str)
+        The arguments passed to 'pype9 simulate'
+    job_argv : list(str)
+        The arguments passed to 'pype9 simulate' rewritten to read from and
+        write to the job directory
+    outputs : list(tuple(str, str))
+        The paths of the outputs in the job directory and the paths they are
+        retrieved to
+    resources : dict(str, object)
+        The resources requested from the scheduler
+    job_id : str | None
+        The ID assigned to the job by the scheduler (None if not submitted)
+    state : str
+        The state of the job when it was last queried
+    submitted : str | None
+        The time the job was submitted
+    retrieved : bool
+        Whether the outputs of the job have been retrieved
+    """
+
+    def __init__(self, path, scheduler, name, argv, job_argv, outputs,
+                 resources, job_id=None, state=UNKNOWN, submitted=None,
+                 retrieved=False):
+        scheduler_class(scheduler)  # Check the scheduler is recognised
+        self.path = path
+        self.scheduler = scheduler
+        self.name = name
+        self.argv = list(argv)
+        self.job_argv = list(job_argv)
+        self.outputs = [tuple(o) for o in outputs]
+        self.resources = resources
+        self.job_id = job_id
+        self.state = state
+        self.submitted = submitted
+        self.retrieved = retrieved
+
+    def __repr__(self):
+        return "Job('{}', scheduler='{}', job_id={}, state='{}')".format(
+            self.name, self.scheduler, self.job_id, self.state)
+
+    @classmethod
+    def create(cls, argv, scheduler, name=None, base_dir=None, cwd=None,
+               **resources):
+        """
+        Packages a simulation into a new job directory
+
+        Parameters
+        ----------
+        argv : list(str)
+            The arguments to pass to 'pype9 simulate'
+        scheduler : str
+            The name of the scheduler ('slurm' or 'pbs')
+        name : str | None
+            The name of the job (defaults to the name of the model file)
+        base_dir : str | None
+            The directory to create the job directory in (defaults to
+            ``jobs_dir()``)
+        cwd : str | None
+            The directory relative paths in the arguments are relative to
+            (defaults to the current working directory)
+        resources : dict(str, object)
+            The resources to request from the scheduler (see
+            ``BaseScheduler``)
+        """
+        if '--reproduce' in argv:
+            raise Pype9UsageError(
+                "Replays of manifests cannot be submitted directly, please "
+                "submit the arguments of the original simulation instead")
+        if cwd is None:
+            cwd = os.getcwd()
+        if base_dir is None:
+            base_dir = jobs_dir()
+        if name is None:
+            name = cls._default_name(argv)
+        path = cls._unique_path(os.path.join(
+            base_dir, '{}-{}'.format(
+                name, datetime.now().strftime('%Y%m%d-%H%M%S'))))
+        # Instantiate the scheduler to check the resources are valid
+        resources = scheduler_class(scheduler)(**resources).resources
+        for dname in (INPUTS_DIR, OUTPUTS_DIR):
+            os.makedirs(os.path.join(path, dname))
+        try:
+            job_argv, outputs = cls._package_argv(argv, path, cwd)
+        except Pype9UsageError:
+            shutil.rmtree(path)
+            raise
+        job = cls(path, scheduler, name, argv, job_argv, outputs, resources)
+        job.save()
+        logger.info("Packaged simulation into job directory '{}'"
+                    .format(path))
+        return job
+
+    @classmethod
+    def load(cls, path):
+        "Loads a job from its job directory"
+        try:
+            with open(os.path.join(path, JOB_FILE)) as f:
+                dct = json.load(f)
+        except IOError:
+            raise Pype9UsageError(
+                "'{}' is not a job directory (no '{}' file found)"
+                .format(path, JOB_FILE))
+        return cls(path=path, **dct)
+
+    @classmethod
+    def find(cls, job_id, base_dir=None):
+        """
+        Finds the job with the given ID (or the path of its job directory)
+        """
+        if os.path.isdir(job_id):
+            return cls.load(job_id)
+        for job in cls.all(base_dir=base_dir):
+            if job.job_id == job_id or job.job_id.split('.')[0] == job_id:
+                return job
+        raise Pype9UsageError(
+            "Could not find job '{}' in '{}'".format(
+                job_id, base_dir if base_dir is not None else jobs_dir()))
+
+    @classmethod
+    def all(cls, base_dir=None):
+        "All submitted jobs in the base directory, sorted by submission time"
+        if base_dir is None:
+            base_dir = jobs_dir()
+        jobs = []
+        if os.path.isdir(base_dir):
+            for dname in sorted(os.listdir(base_dir)):
+                path = os.path.join(base_dir, dname)
+                if os.path.isfile(os.path.join(path, JOB_FILE)):
+                    job = cls.load(path)
+                    if job.job_id is not None:
+                        jobs.append(job)
+        return sorted(jobs, key=lambda j: j.submitted)
+
+    def save(self):
+        with open(os.path.join(self.path, JOB_FILE), 'w') as f:
+            json.dump({'scheduler': self.scheduler, 'name': self.name,
+                       'argv': self.argv, 'job_argv': self.job_argv,
+                       'outputs': self.outputs, 'resources': self.resources,
+                       'job_id': self.job_id, 'state': self.state,
+                       'submitted': self.submitted,
+                       'retrieved': self.retrieved}, f, indent=2,
+                      sort_keys=True)
+
+    @property
+    def script_path(self):
+        return os.path.join(self.path, SCRIPT_FILE)
+
+    @property
+    def exit_status(self):
+        "The exit status of the simulation (None if it hasn't finished)"
+        try:
+            with open(os.path.join(self.path, EXIT_STATUS_FILE)) as f:
+                return int(f.read().strip())
+        except (IOError, ValueError):
+            return None
+
+    def submit(self, pype9_cmd='pype9', launcher=None):
+        """
+        Writes the job script and submits it to the scheduler
+
+        Parameters
+        ----------
+        pype9_cmd : str
+            The command used to run 'pype9' on the compute nodes
+        launcher : str | None
+            The command used to launch simulations over MPI processes
+            (defaults to 'srun' for SLURM and 'mpirun' for PBS)
+        """
+        if self.job_id is not None:
+            raise Pype9UsageError(
+                "{} has already been submitted".format(self))
+        scheduler = scheduler_class(self.scheduler)(**self.resources)
+        with open(self.script_path, 'w') as f:
+            f.write(scheduler.script(self, pype9_cmd=pype9_cmd,
+                                     launcher=launcher))
+        self.job_id = scheduler.submit(self.script_path)
+        self.submitted = datetime.now().isoformat()
+        self.state = PENDING
+        self.save()
+        logger.info("Submitted '{}' to {} as job {}".format(
+            self.name, self.scheduler.upper(), self.job_id))
+        return self.job_id
+
+    def update(self):
+        """
+        Updates the state of the job, from the exit status written by the job
+        script if it has finished and the scheduler otherwise
+        """
+        if self.job_id is None:
+            raise Pype9UsageError("{} has not been submitted".format(self))
+        if self.state not in FINISHED_STATES:
+            exit_status = self.exit_status
+            if exit_status is not None:
+                state = COMPLETED if exit_status == 0 else FAILED
+            else:
+                state = scheduler_class(self.scheduler)().state(self.job_id)
+                if state == COMPLETED:
+                    # The job finished without writing its exit status, e.g.
+                    # if it was killed by the scheduler
+                    state = FAILED
+            if state != self.state:
+                self.state = state
+                self.save()
+        return self.state
+
+    def retrieve(self):
+        """
+        Copies the outputs of the completed job to the paths passed to
+        'pype9 simulate'
+
+        Returns
+        -------
+        retrieved : list(str)
+            The paths the outputs were copied to
+        """
+        if self.state != COMPLETED:
+            raise Pype9UsageError(
+                "Cannot retrieve outputs of {} as it hasn't completed"
+                .format(self))
+        retrieved = []
+        for src, dest in self.outputs:
+            if not os.path.exists(src):
+                logger.warning("Output '{}' of job {} was not written"
+                               .format(os.path.basename(src), self.job_id))
+                continue
+            dest_dir = os.path.dirname(dest)
+            if dest_dir and not os.path.isdir(dest_dir):
+                os.makedirs(dest_dir)
+            shutil.copy(src, dest)
+            retrieved.append(dest)
+        self.retrieved = True
+        self.save()
+        return retrieved
+
+    def wait(self, interval=30.0, timeout=None):
+        """
+        Polls the state of the job until it has finished
+
+        Parameters
+        ----------
+        interval : float
+            The time between polls (s)
+        timeout : float | None
+            The maximum time to wait (s), waits indefinitely if None
+        """
+        start = time.time()
+        while self.update() not in FINISHED_STATES:
+            if timeout is not None and time.time() - start > timeout:
+                raise Pype9RuntimeError(
+                    "Timed out waiting for job {} to finish after {} s"
+                    .format(self.job_id, timeout))
+            time.sleep(interval)
+        return self.state
+
+    @classmethod
+    def _package_argv(cls, argv, path, cwd):
+        """
+        Copies the input files of the simulation into the job directory and
+        rewrites the arguments to read from them and write the outputs into
+        the job directory
+        """
+        # Split options joined to their values with '='
+        argv = [a for arg in argv for a in (
+            arg.split('=', 1) if arg.startswith('--') and '=' in arg
+            else [arg])]
+        job_argv = []
+        outputs = []
+        used_names = set()
+        seen_model = False
+        build_dir = None
+        i = 0
+        while i < len(argv):
+            arg = argv[i]
+            i += 1
+            if arg in INPUT_OPTIONS or arg in OUTPUT_OPTIONS:
+                num_preceding = INPUT_OPTIONS.get(arg, OUTPUT_OPTIONS.get(arg))
+                job_argv.append(arg)
+                job_argv.extend(argv[i:i + num_preceding])
+                i += num_preceding
+                if i >= len(argv):
+                    break
+                fname = os.path.join(cwd, argv[i])
+                i += 1
+                if arg in INPUT_OPTIONS:
+                    job_argv.append(cls._copy_input(fname, path, used_names))
+                else:
+                    job_path = os.path.join(
+                        path, OUTPUTS_DIR,
+                        cls._unique_name(os.path.basename(fname), used_names))
+                    outputs.append((job_path, os.path.normpath(fname)))
+                    job_argv.append(job_path)
+            elif arg == '--build_dir':
+                if i < len(argv):
+                    build_dir = argv[i]
+                    i += 1
+            elif not arg.startswith('-') and not seen_model:
+                seen_model = True
+                job_argv.append(cls._copy_model(arg, path, cwd, used_names))
+            else:
+                job_argv.append(arg)
+        job_build_dir = os.path.join(path, BUILD_DIR)
+        if build_dir is not None and os.path.isdir(os.path.join(cwd,
+                                                                build_dir)):
+            # Ship the code-generation artifacts that have already been
+            # built with the job
+            shutil.copytree(os.path.join(cwd, build_dir), job_build_dir)
+        job_argv.extend(('--build_dir', job_build_dir))
+        return job_argv, outputs
+
+    @classmethod
+    def _copy_model(cls, arg, path, cwd, used_names):
+        "Copies the model document into the job directory (if it is a file)"
+        doc_path, hash_sep, name = arg.partition('#')
+        doc_path = os.path.join(cwd, doc_path)
+        if not os.path.isfile(doc_path) or doc_path.endswith('.json'):
+            # Catalog references and SONATA configurations (which reference
+            # other files relative to their location) aren't copied
+            return (os.path.normpath(doc_path) + hash_sep + name
+                    if os.path.exists(doc_path) else arg)
+        return cls._copy_input(doc_path, path, used_names) + hash_sep + name
+
+    @classmethod
+    def _copy_input(cls, fname, path, used_names):
+        if not os.path.isfile(fname):
+            raise Pype9UsageError(
+                "Input file '{}' of the simulation does not exist"
+                .format(fname))
+        job_path = os.path.join(
+            path, INPUTS_DIR, cls._unique_name(os.path.basename(fname),
+                                               used_names))
+        shutil.copy(fname, job_path)
+        return job_path
+
+    @classmethod
+    def _unique_name(cls, name, used_names):
+        "Prefixes the name with a counter if it has already been used"
+        unique = name
+        count = 1
+        while unique in used_names:
+            unique = '{}_{}'.format(count, name)
+            count += 1
+        used_names.add(unique)
+        return unique
+
+    @classmethod
+    def _unique_path(cls, path):
+        unique = path
+        count = 1
+        while os.path.exists(unique):
+            unique = '{}-{}'.format(path, count)
+            count += 1
+        return unique
+
+    @classmethod
+    def _default_name(cls, argv):
+        "The name of the model file passed to 'pype9 simulate'"
+        for arg in argv:
+            if not arg.startswith('-'):
+                doc_path, _, name = arg.partition('#')
+                if name:
+                    return name
+                return os.path.splitext(os.path.basename(doc_path))[0]
+        raise Pype9UsageError(
+            "No model provided in the arguments to 'pype9 simulate'")
@@ -34,6 +34,10 @@ def nineml_document(doc_path):
 
 
 def nineml_model(model_path):
+    if model_path.endswith('.json'):
+        from pype9.io import sonata
+        if sonata.is_config(model_path):
+            return sonata.read(model_path)
     model = nineml_document(model_path)
     if isinstance(model, nineml.Document):
         model = model.as_network(
@@ -2,3 +2,20 @@ import logging
 
 logger = logging.getLogger('pype9')
 loglevel = logging.INFO
+
+
+def get_logger(name):
+    """
+    Returns the logger of a Pype9 module (e.g. 'pype9.simulate.neuron'),
+    which is a child of the 'pype9' logger so its messages are passed to the
+    handlers of the 'pype9' logger, while its level can be set separately
+
+    Parameters
+    ----------
+    name : str
+        The name of the module (typically __name__), which is prefixed with
+        'pype9.' if it isn't already a Pype9 module
+    """
+    if name != logger.name and not name.startswith(logger.name + '.'):
+        name = logger.name + '.' + name
+    return logging.getLogger(name)
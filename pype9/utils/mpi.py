@@ -1,3 +1,10 @@
+from collections import OrderedDict
+import os.path
+import numpy
+import neo
+from pype9.exceptions import Pype9UsageError
+
+
 class DummyMPICom(object):
 
     rank = 0
@@ -6,6 +13,9 @@ class DummyMPICom(object):
     def barrier(self):
         pass
 
+    def gather(self, obj, root=0):  # @UnusedVariable
+        return [obj]
+
 try:
     from mpi4py import MPI  # @UnusedImport @IgnorePep8 This is imported before NEURON to avoid a bug in NEURON
 except ImportError:
@@ -18,3 +28,104 @@ MPI_ROOT = 0
 
 def is_mpi_master():
     return (mpi_comm.rank == MPI_ROOT)
+
+
+def rank_path(path, rank=None):
+    """
+    Inserts the rank of an MPI process before the extension of a file path,
+    e.g. 'my_recording.pkl' -> 'my_recording.3.pkl', so that each process can
+    write to its own file
+
+    Parameters
+    ----------
+    path : str
+        The path to insert the rank into
+    rank : int | None
+        The rank to insert. If None the rank of the current process is used
+    """
+    if rank is None:
+        rank = mpi_comm.rank
+    root, ext = os.path.splitext(path)
+    return '{}.{}{}'.format(root, rank, ext)
+
+
+def gather_segment(segment, root=MPI_ROOT):
+    """
+    Gathers the data recorded by each MPI process into a single segment on
+    the root process. Other processes receive their local segment unchanged
+
+    Parameters
+    ----------
+    segment : neo.Segment
+        The data recorded by the local process
+    root : int
+        The rank of the process to gather the data to
+    """
+    segments = mpi_comm.gather(segment, root=root)
+    if mpi_comm.rank != root:
+        return segment
+    return merge_segments(segments)
+
+
+def merge_segments(segments):
+    """
+    Merges segments recorded from separate subsets of the cells in a
+    population (e.g. by different MPI processes) into a single segment.
+    Spike trains are ordered by the index of the cell they were recorded from
+    and the channels of analog signals with the same name are combined into
+    a single signal, ordered by the IDs of the cells they were recorded from
+
+    Parameters
+    ----------
+    segments : list(neo.Segment)
+        The segments to merge
+    """
+    segments = list(segments)
+    if not segments:
+        raise Pype9UsageError("No segments provided to merge")
+    if len(segments) == 1:
+        return segments[0]
+    merged = neo.Segment(description=segments[0].description)
+    merged.name = segments[0].name
+    merged.annotate(**segments[0].annotations)
+    merged.spiketrains.extend(sorted(
+        (st for seg in segments for st in seg.spiketrains),
+        key=lambda st: st.annotations.get('source_index', 0)))
+    signals = OrderedDict()
+    for seg in segments:
+        for signal in seg.analogsignals:
+            signals.setdefault(signal.name, []).append(signal)
+        merged.epochs.extend(seg.epochs)
+    for name, sigs in signals.items():
+        merged.analogsignals.append(_merge_signals(name, sigs))
+    return merged
+
+
+def _merge_signals(name, signals):
+    if len(signals) == 1:
+        return signals[0]
+    first = signals[0]
+    for signal in signals[1:]:
+        if (signal.shape[0] != first.shape[0] or
+                signal.t_start != first.t_start or
+                signal.sampling_period != first.sampling_period):
+            raise Pype9UsageError(
+                "Cannot merge '{}' signals with different times (t_start: {} "
+                "and {}, sampling period: {} and {}, length: {} and {})"
+                .format(name, first.t_start, signal.t_start,
+                        first.sampling_period, signal.sampling_period,
+                        first.shape[0], signal.shape[0]))
+    data = numpy.hstack([numpy.asarray(s).reshape(s.shape[0], -1)
+                         for s in signals])
+    annotations = dict(first.annotations)
+    source_ids = [s.annotations.get('source_ids') for s in signals]
+    if all(i is not None for i in source_ids):
+        source_ids = numpy.concatenate([numpy.asarray(i) for i in source_ids])
+        order = numpy.argsort(source_ids, kind='mergesort')
+        data = data[:, order]
+        annotations['source_ids'] = source_ids[order]
+    merged = neo.AnalogSignal(
+        data, units=first.units, t_start=first.t_start,
+        sampling_period=first.sampling_period, name=name)
+    merged.annotate(**annotations)
+    return merged
@@ -1,6 +1,6 @@
 """
 Command that compares a 9ML model with an existing version in NEURON and/or
-NEST
+NEST (and with simulations of the 9ML model in the other backends)
 """
 from __future__ import absolute_import, division
 from __future__ import print_function
@@ -34,6 +34,7 @@ import numpy
 import quantities as pq
 import neo
 from pype9.exceptions import Pype9RuntimeError
+from pype9.simulate import load_backend
 from pype9.utils.logging import logger
 
 
@@ -41,7 +42,9 @@ class Comparer(object):
     """
     The Comparer class is used to compare the dynamics of a 9ML model simulated
     in either NEURON or NEST with a native model in either of those simulators
-    (or both)
+    (or both). The 9ML model can also be simulated in the other backends (e.g.
+    'arbor'), which don't have native reference models, to compare them with
+    the NEURON and NEST simulations
 
     Parameters
     ----------
@@ -67,6 +70,8 @@ class Comparer(object):
     input_train : neo.SpikeTrain
         Tuple containing the event train (in Neo format) and the port to play
         it into
+    build_args : dict(str, dict(str, object))
+        The build arguments of the backends other than NEURON and NEST
     """
 
     specific_params = ('pas.g', 'cm')
@@ -79,7 +84,7 @@ class Comparer(object):
                  nest_build_args=None, min_delay=0.1, device_delay=0.1,
                  max_delay=10.0, extra_mechanisms=None,
                  extra_point_process=None,
-                 auxiliary_states=None):
+                 auxiliary_states=None, build_args=None):
         if nineml_model is not None and not simulators:
             raise Pype9RuntimeError(
                 "No simulators specified to simulate the 9ML model '{}'."
@@ -108,11 +113,12 @@ class Comparer(object):
                                  if auxiliary_states is not None else [])
         self.input_signal = input_signal
         self.input_train = input_train
-        self.build_args = {
+        self.build_args = dict(build_args) if build_args is not None else {}
+        self.build_args.update({
             'nest': (nest_build_args
                      if nest_build_args is not None else {}),
             'neuron': (neuron_build_args
-                       if neuron_build_args is not None else {})}
+                       if neuron_build_args is not None else {})})
         self.nml_cells = {}
         if self.state_variable in self.nest_translations:
             self.nest_state_variable = self.nest_translations[
@@ -128,9 +134,15 @@ class Comparer(object):
         self.device_delay = device_delay
         self.max_delay = max_delay
 
-    def simulate(self, duration, nest_rng_seed=12345, neuron_rng_seed=54321):
+    def simulate(self, duration, nest_rng_seed=12345, neuron_rng_seed=54321,
+                 rng_seeds=None):
         """
         Run and the simulation
+
+        Parameters
+        ----------
+        rng_seeds : dict(str, int)
+            The seeds of the backends other than NEURON and NEST
         """
         if self.simulate_nest:
             with NESTSimulation(dt=self.dt * un.ms, seed=nest_rng_seed,
@@ -153,6 +165,18 @@ class Comparer(object):
                 if self.neuron_ref is not None:
                     self._create_NEURON(self.neuron_ref)
                 sim.run(duration)
+        for simulator in self.simulators:
+            if simulator in ('nest', 'neuron'):
+                continue
+            seed = (rng_seeds.get(simulator, 12345)
+                    if rng_seeds is not None else 12345)
+            with load_backend(simulator).Simulation(
+                    dt=self.dt * un.ms, seed=seed,
+                    min_delay=self.min_delay * un.ms,
+                    max_delay=self.max_delay * un.ms) as sim:
+                self._create_9ML(self.nineml_model, self.properties,
+                                 simulator)
+                sim.run(duration)
         return self  # return self so it can be chained with subsequent methods
 
     def compare(self):
@@ -214,8 +238,8 @@ class Comparer(object):
         elif simulator.lower() == 'nest':
             CellMetaClass = NESTCellMetaClass
         else:
-            assert False
-        Cell = CellMetaClass(model, **self.build_args[simulator])
+            CellMetaClass = load_backend(simulator).CellMetaClass
+        Cell = CellMetaClass(model, **self.build_args.get(simulator, {}))
         self.nml_cells[simulator] = Cell(properties,
                                          regime_=self.initial_regime,
                                          **self.initial_states)
@@ -553,8 +577,8 @@ class ReferenceBrunel2000(object):
          J_ex, J_in, p_rate) = self.parameters(case, order)
 
         if override_input is not None:
-            print("changing poisson rate from {} to {}".format(p_rate,
-                                                               override_input))
+            logger.info("Changing poisson rate from {} to {}".format(
+                p_rate, override_input))
             p_rate = override_input
 
         nest.SetDefaults("iaf_psc_alpha", neuron_params)
@@ -731,6 +755,34 @@ _error_re = re.compile(r"(\w+)Error:")
 test_cache = os.path.join(NESTCodeGenerator().base_dir, '..', 'unittest-cache')
 
 
+class DummyCodeGenerator(object):
+    """
+    A stand-in for a code generator that provides the templates and compiler
+    flags the build cache and the manifests of simulations are hashed from,
+    without requiring a simulator to be installed
+
+    Parameters
+    ----------
+    template_dir : str
+        The directory of the templates the generated code depends on
+    flags : list(str)
+        The compiler flags of the code generator
+    """
+
+    SIMULATOR_NAME = 'dummy'
+    SIMULATOR_VERSION = '1.0'
+
+    def __init__(self, template_dir, flags=()):
+        self.template_dir = template_dir
+        self.flags = list(flags)
+
+    def cache_dependencies(self):
+        return [self.template_dir]
+
+    def cache_flags(self):
+        return self.flags
+
+
 class DummyTestCase(object):
 
     def __init__(self):
@@ -61,7 +61,7 @@ setup(
         'mock>=1.0',
         'numpy>=1.5',
         'quantities>=0.11.1',
-        'neo>=0.5.1',
+        'neo>=0.7.0',
         'mpi4py>=1.3.1',
         'pyNN>=0.9.1',
         'lazyarray>=0.2.7',
@@ -70,7 +70,10 @@ setup(
         'h5py>=2.7.0',
         'future>=0.16'],
      extras_require={
-         'plot': 'matplotlib>=2.0'},
+         'plot': 'matplotlib>=2.0',
+         'html': ['matplotlib>=2.0', 'plotly>=4.9'],
+         'nwb': 'pynwb>=1.0',
+         'progress': 'tqdm>=4.0'},
      tests_require=['nose'],
      python_requires='>=2.7, !=3.0.*, !=3.1.*, !=3.2.*, !=3.3.*, <4'
 )
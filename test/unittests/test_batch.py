@@ -0,0 +1,133 @@
+from __future__ import division
+import os.path
+import shutil
+import tempfile
+import multiprocessing
+import ninemlcatalog
+import yaml
+from nineml import units as un
+from pype9 import batch
+from pype9.exceptions import Pype9UsageError
+import pype9.utils.logging.handlers.sysout  # @UnusedImport
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestBatch(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.izhi_props = ninemlcatalog.load('neuron/Izhikevich',
+                                             'SampleIzhikevich')
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_grid(self):
+        sweep = batch.Sweep.read(self._write_spec({
+            'mode': 'grid',
+            'parameters': {
+                'a': {'values': [0.02, 0.03], 'units': '1/ms'},
+                'd': {'start': 2.0, 'stop': 8.0, 'num': 4,
+                      'units': 'mV/ms'}}}), self.izhi_props)
+        self.assertEqual(len(sweep), 8)
+        self.assertEqual(sweep.parameter_names, ['a', 'd'])
+        self.assertEqual([tuple(v) for v in sweep.values[:4]],
+                         [(0.02, 2.0), (0.02, 4.0), (0.02, 6.0),
+                          (0.02, 8.0)])
+        props, initial_states = sweep.properties(5)
+        self.assertEqual(float(props.property('a').value), 0.03)
+        self.assertEqual(float(props.property('d').value), 4.0)
+        self.assertEqual(float(props.property('b').value),
+                         float(self.izhi_props.property('b').value))
+        self.assertEqual(
+            sorted(initial_states),
+            sorted(iv.name for iv in self.izhi_props.initial_values))
+
+    def test_random(self):
+        spec = {'mode': 'random', 'num_samples': 10, 'seed': 1,
+                'parameters': {
+                    'a': {'low': 0.01, 'high': 0.1, 'units': '1/ms'},
+                    'V': {'values': [-70.0, -65.0], 'units': 'mV'}}}
+        sweep1 = batch.Sweep.read(self._write_spec(spec), self.izhi_props)
+        sweep2 = batch.Sweep.read(self._write_spec(spec), self.izhi_props)
+        self.assertEqual(len(sweep1), 10)
+        self.assertTrue((sweep1.values == sweep2.values).all())
+        # Parameters are ordered by name
+        self.assertEqual(sweep1.parameter_names, ['V', 'a'])
+        for v, a in sweep1.values:
+            self.assertIn(v, (-70.0, -65.0))
+            self.assertTrue(0.01 <= a <= 0.1)
+        _, initial_states = sweep1.properties(0)
+        self.assertEqual(float(initial_states['V'].value), sweep1.values[0, 0])
+        # Random ranges can't be used in grid sweeps
+        spec['mode'] = 'grid'
+        self.assertRaises(Pype9UsageError, batch.Sweep.read,
+                          self._write_spec(spec), self.izhi_props)
+
+    def test_run(self):
+        sweep = batch.Sweep(
+            self.izhi_props,
+            [batch.ParameterRange('d', un.mV / un.ms, values=[2.0, 8.0])],
+            seed=1)
+        store_path = os.path.join(self.tmp_dir, 'store.h5')
+        batch.run(sweep, 'nest', 20.0 * un.ms, 0.1 * un.ms, record=['V'],
+                  store_path=store_path, build_version='BatchTest')
+        runs = batch.read(store_path)
+        self.assertEqual(len(runs), 2)
+        self.assertEqual([p['d'] for p, _ in runs], [2.0, 8.0])
+        for _, seg in runs:
+            self.assertEqual(len(seg.analogsignals), 1)
+            self.assertEqual(seg.analogsignals[0].name, 'V')
+
+    def test_run_processes(self):
+        sweep = batch.Sweep(
+            self.izhi_props,
+            [batch.ParameterRange('d', un.mV / un.ms,
+                                  values=[2.0, 4.0, 6.0, 8.0])],
+            seed=1)
+        serial_path = os.path.join(self.tmp_dir, 'serial.h5')
+        pool_path = os.path.join(self.tmp_dir, 'pool.h5')
+        batch.run(sweep, 'nest', 20.0 * un.ms, 0.1 * un.ms, record=['V'],
+                  store_path=serial_path, build_version='BatchTest')
+        # The batch is passed to the forked worker processes of the pool
+        batch.run(sweep, 'nest', 20.0 * un.ms, 0.1 * un.ms, record=['V'],
+                  store_path=pool_path, processes=2,
+                  build_version='BatchTest')
+        for (serial_point, serial_seg), (pool_point, pool_seg) in zip(
+                batch.read(serial_path), batch.read(pool_path)):
+            self.assertEqual(serial_point, pool_point)
+            self.assertTrue(
+                (serial_seg.analogsignals[0] ==
+                 pool_seg.analogsignals[0]).all())
+        self.assertRaises(Pype9UsageError, batch.run, sweep, 'unknown',
+                          20.0 * un.ms, 0.1 * un.ms, record=['V'],
+                          store_path=pool_path)
+
+    def test_run_processes_spawn(self):
+        # The worker processes are forked even when the default start method
+        # would pickle the batch (which holds the built cell class)
+        if not hasattr(multiprocessing, 'set_start_method'):
+            return  # Python 2 always forks the worker processes
+        sweep = batch.Sweep(
+            self.izhi_props,
+            [batch.ParameterRange('d', un.mV / un.ms, values=[2.0, 8.0])],
+            seed=1)
+        start_method = multiprocessing.get_start_method()
+        multiprocessing.set_start_method('spawn', force=True)
+        try:
+            batch.run(sweep, 'nest', 20.0 * un.ms, 0.1 * un.ms, record=['V'],
+                      store_path=os.path.join(self.tmp_dir, 'spawn.h5'),
+                      processes=2, build_version='BatchTest')
+        finally:
+            multiprocessing.set_start_method(start_method, force=True)
+        self.assertEqual(len(batch.read(os.path.join(self.tmp_dir,
+                                                     'spawn.h5'))), 2)
+
+    def _write_spec(self, spec):
+        path = os.path.join(self.tmp_dir, 'sweep.yml')
+        with open(path, 'w') as f:
+            yaml.dump(spec, f)
+        return path
@@ -1,11 +1,19 @@
 from __future__ import division
 from __future__ import print_function
+import os
+import shutil
+import tempfile
 import ninemlcatalog
 from nineml.abstraction import Parameter, TimeDerivative, StateVariable
 import nineml.units as un
 from pype9.simulate.nest import CellMetaClass
+from pype9.simulate.nest.code_gen import CodeGenerator
+from pype9.simulate.neuron.code_gen import (
+    CodeGenerator as NeuronCodeGenerator)
 from pype9.simulate.common.cells.with_synapses import WithSynapses
-from pype9.exceptions import Pype9BuildMismatchError
+from pype9.simulate.common.code_gen.hooks import (
+    register_code_gen_hooks, unregister_code_gen_hooks, CodeGenHooks)
+from pype9.exceptions import Pype9BuildMismatchError, Pype9BuildError
 from unittest import TestCase  # @Reimport
 import pype9.utils.logging.handlers.sysout  # @UnusedImport
 
@@ -28,3 +36,109 @@ class TestSeeding(TestCase):
             Pype9BuildMismatchError,
             CellMetaClass,
             izhi2_wrap)
+
+
+class TestSolverSelection(TestCase):
+
+    def test_nonlinear_state_variables(self):
+        izhi = ninemlcatalog.load('neuron/Izhikevich.xml#Izhikevich')
+        liaf = ninemlcatalog.load(
+            'neuron/LeakyIntegrateAndFire.xml#LeakyIntegrateAndFire')
+        self.assertEqual(CodeGenerator.nonlinear_state_variables(izhi),
+                         ['V'])
+        self.assertEqual(CodeGenerator.nonlinear_state_variables(liaf), [])
+
+    def test_exact_solver_mismatch(self):
+        izhi = ninemlcatalog.load('neuron/Izhikevich.xml#Izhikevich')
+        self.assertRaises(
+            Pype9BuildError,
+            CellMetaClass,
+            WithSynapses.wrap(izhi), name='IzhikevichExact', solver='exact')
+
+    def test_solver_build_mismatch(self):
+        liaf = ninemlcatalog.load(
+            'neuron/LeakyIntegrateAndFire.xml#LeakyIntegrateAndFire')
+        CellMetaClass(liaf, build_version='SolverMismatch')
+        self.assertRaises(
+            Pype9BuildMismatchError,
+            CellMetaClass,
+            liaf, build_version='SolverMismatch', solver='implicit')
+
+    def test_hooks_build_mismatch(self):
+
+        @register_code_gen_hooks
+        class NoOp(CodeGenHooks):
+
+            name = 'no_op'
+
+        liaf = ninemlcatalog.load(
+            'neuron/LeakyIntegrateAndFire.xml#LeakyIntegrateAndFire')
+        try:
+            CellMetaClass(liaf, build_version='HooksMismatch')
+            self.assertRaises(
+                Pype9BuildMismatchError,
+                CellMetaClass,
+                liaf, build_version='HooksMismatch', hooks=['no_op'])
+        finally:
+            unregister_code_gen_hooks('no_op')
+
+
+class TestGslTemplates(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_tolerances_and_jacobian(self):
+        """
+        Regression test for the GSL tolerances, which were both read from the
+        'max_step_size' option, and the Jacobian approximation, which was
+        written into 'dfdt' instead of 'dfdy'
+        """
+        name = 'IzhikevichGslTemplates'
+        izhi = ninemlcatalog.load('neuron/Izhikevich.xml#Izhikevich')
+        code_gen = CodeGenerator(base_dir=self.tmp_dir)
+        trfrm = code_gen.transform_for_build(name, WithSynapses.wrap(izhi))
+        src_dir = os.path.join(self.tmp_dir, 'src')
+        os.makedirs(os.path.join(src_dir, 'sli'))
+        code_gen.generate_source_files(
+            trfrm, src_dir, name=name, ode_solver='gsl', max_step_size=0.5,
+            abs_tolerance=1e-07, rel_tolerance=1e-05)
+        with open(os.path.join(src_dir, name + '.cpp')) as f:
+            main = f.read()
+        self.assertIn('gsl_odeiv2_control_standard_new (1e-07, 1e-05,', main)
+        self.assertNotIn('(0.5, 0.5,', main)
+        self.assertIn('dfdy[i * N + j] = ', main)
+        self.assertNotIn('dfdt[i*regime.N + i]', main)
+
+
+class TestNeuronCompilation(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.cwd = os.getcwd()
+
+    def tearDown(self):
+        os.chdir(self.cwd)
+        shutil.rmtree(self.tmp_dir)
+
+    def test_compile_without_modlunit(self):
+        """
+        Regression test for the output of nrnivmodl, which was only bound
+        when the units were checked with modlunit
+        """
+        code_gen = NeuronCodeGenerator(base_dir=self.tmp_dir)
+        code_gen.modlunit_path = None
+        commands = []
+
+        def run_command(cmd, fail_msg=None, **kwargs):  # @UnusedVariable
+            commands.append(cmd)
+            return '', 'make: *** [mech] Error 1'
+
+        code_gen.run_command = run_command
+        self.assertRaises(Pype9BuildError, code_gen.compile_source_files,
+                          self.tmp_dir, 'NoModlunit')
+        self.assertEqual(len(commands), 1)
+        self.assertEqual(commands[0][0], code_gen.nrnivmodl_path)
@@ -0,0 +1,100 @@
+import os.path
+import tempfile
+import shutil
+import nineml
+from nineml import units as un
+from pype9.build import DynamicsBuilder
+from pype9.exceptions import Pype9UsageError, Pype9DimensionError
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+def izhikevich_builder():
+    builder = (
+        DynamicsBuilder('Izhikevich')
+        .parameter('a', un.per_ms)
+        .parameter('b', un.per_ms)
+        .parameter('c', un.mV)
+        .parameter('d', un.mV / un.ms)
+        .parameter('theta', un.mV)
+        .parameter('C_m', un.pF)
+        .state_variable('V', un.mV, initial=-65.0 * un.mV)
+        .state_variable('U', un.mV / un.ms, initial=-14.0 * un.mV / un.ms)
+        .analog_reduce_port('Isyn', un.pA)
+        .analog_send_port('V'))
+    (builder.regime('subthreshold_regime')
+     .ode('V', 'alpha * V * V + beta * V + zeta - U + Isyn / C_m',
+          alpha=0.04 * un.per_mV / un.ms, beta=5.0 * un.per_ms,
+          zeta=140.0 * un.mV / un.ms)
+     .ode('U', 'a * (b * V - U)')
+     .on_condition('V > theta', assign={'V': 'c', 'U': 'U + d'},
+                   emit='spike'))
+    return builder
+
+
+class TestDynamicsBuilder(TestCase):
+
+    def setUp(self):
+        self.tmpdir = tempfile.mkdtemp()
+
+    def tearDown(self):
+        shutil.rmtree(self.tmpdir)
+
+    def test_build(self):
+        izhi = izhikevich_builder().build()
+        self.assertEqual(sorted(izhi.parameter_names),
+                         ['C_m', 'a', 'b', 'c', 'd', 'theta'])
+        self.assertEqual(sorted(izhi.constant_names),
+                         ['alpha', 'beta', 'zeta'])
+        self.assertEqual(sorted(izhi.state_variable_names), ['U', 'V'])
+        self.assertEqual(list(izhi.event_send_port_names), ['spike'])
+        self.assertEqual(list(izhi.analog_reduce_port_names), ['Isyn'])
+        self.assertEqual(izhi.analog_send_port('V').dimension, un.voltage)
+        regime = izhi.regime('subthreshold_regime')
+        self.assertEqual(regime.num_time_derivatives, 2)
+        self.assertEqual(regime.num_on_conditions, 1)
+
+    def test_properties(self):
+        props = izhikevich_builder().properties(
+            a=0.02 * un.per_ms, b=0.2 * un.per_ms, c=-65.0 * un.mV,
+            d=2.0 * un.mV / un.ms, theta=30.0 * un.mV, C_m=1.0 * un.pF,
+            V=-70.0 * un.mV)
+        self.assertEqual(props.name, 'IzhikevichProperties')
+        self.assertEqual(props.property('theta').quantity, 30.0 * un.mV)
+        self.assertEqual(props.initial_value('V').quantity, -70.0 * un.mV)
+        self.assertEqual(props.initial_value('U').quantity,
+                         -14.0 * un.mV / un.ms)
+        self.assertEqual(props.initial_regime, 'subthreshold_regime')
+        self.assertRaises(Pype9UsageError, izhikevich_builder().properties,
+                          e=1.0)
+
+    def test_round_trip(self):
+        builder = izhikevich_builder()
+        izhi = builder.build()
+        for ext in ('xml', 'yml'):
+            url = os.path.join(self.tmpdir, 'izhikevich.' + ext)
+            builder.save(url)
+            reread = nineml.read(url)['Izhikevich']
+            self.assertEqual(izhi, reread, izhi.find_mismatch(reread))
+
+    def test_dimension_error(self):
+        builder = (
+            DynamicsBuilder('Bad')
+            .parameter('tau', un.ms)
+            .parameter('R', un.Mohm)
+            .state_variable('v', un.mV)
+            .analog_reduce_port('i_ext', un.nA))
+        builder.regime('default').ode('v', '(R * i_ext - v) / tau + i_ext')
+        self.assertRaises(Pype9DimensionError, builder.build)
+
+    def test_usage_errors(self):
+        builder = DynamicsBuilder('Dup').parameter('a', un.ms)
+        self.assertRaises(Pype9UsageError, builder.state_variable, 'a')
+        self.assertRaises(Pype9UsageError, builder.regime('r').ode, 'x', '1')
+        builder.state_variable('v', un.mV)
+        builder.regime('r').on_condition('v > 0', target='missing')
+        self.assertRaises(Pype9UsageError, builder.build)
+        self.assertRaises(Pype9UsageError, builder.constant, 'a',
+                          0.1 * un.ms)
@@ -0,0 +1,79 @@
+from __future__ import division
+import os.path
+import shutil
+import tempfile
+from nineml import units as un
+from nineml.abstraction import Dynamics, Parameter, Regime, StateVariable
+from pype9.simulate.common.code_gen.cache import BuildCache
+from pype9.utils.testing import DummyCodeGenerator
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestBuildCache(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.cache = BuildCache(os.path.join(self.tmp_dir, 'cache'))
+        self.template_dir = os.path.join(self.tmp_dir, 'templates')
+        os.makedirs(self.template_dir)
+        with open(os.path.join(self.template_dir, 'main.tmpl'), 'w') as f:
+            f.write('template')
+        self.dynamics = Dynamics(
+            name='Leak',
+            state_variables=[StateVariable('v', dimension=un.voltage)],
+            regimes=[Regime('dv/dt = -v / tau', name='default')],
+            parameters=[Parameter('tau', dimension=un.time)])
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_key(self):
+        code_gen = DummyCodeGenerator(self.template_dir)
+        key = self.cache.key(self.dynamics, code_gen, build_version='1')
+        self.assertEqual(
+            key, self.cache.key(self.dynamics, code_gen, build_version='1'))
+        # Changes to the build options, compiler flags, templates or model
+        # should all change the key
+        self.assertNotEqual(
+            key, self.cache.key(self.dynamics, code_gen, build_version='2'))
+        self.assertNotEqual(
+            key, self.cache.key(
+                self.dynamics, DummyCodeGenerator(self.template_dir,
+                                                  flags=['-O3']),
+                build_version='1'))
+        with open(os.path.join(self.template_dir, 'main.tmpl'), 'w') as f:
+            f.write('modified template')
+        self.assertNotEqual(
+            key, self.cache.key(self.dynamics, code_gen, build_version='1'))
+        modified = self.dynamics.clone()
+        modified.name = 'Leak2'
+        self.assertNotEqual(
+            self.cache.key(self.dynamics, code_gen),
+            self.cache.key(modified, code_gen))
+
+    def test_store_restore(self):
+        code_gen = DummyCodeGenerator(self.template_dir)
+        key = self.cache.key(self.dynamics, code_gen)
+        install_dir = os.path.join(self.tmp_dir, 'build', 'install')
+        os.makedirs(os.path.join(install_dir, 'lib'))
+        with open(os.path.join(install_dir, 'lib', 'libLeak.so'), 'w') as f:
+            f.write('library')
+        self.assertIsNone(self.cache.entry(key))
+        self.cache.store(key, install_dir, 'Leak', 'leak.xml', 'dummy')
+        self.assertEqual(BuildCache.read_stamp(install_dir), key)
+        entries = self.cache.entries()
+        self.assertEqual(len(entries), 1)
+        self.assertEqual(entries[0].name, 'Leak')
+        self.assertEqual(entries[0].simulator, 'dummy')
+        self.assertGreater(entries[0].size, 0)
+        # Restore the build into a fresh install directory
+        new_install_dir = os.path.join(self.tmp_dir, 'build2', 'install')
+        self.cache.restore(key, new_install_dir)
+        with open(os.path.join(new_install_dir, 'lib', 'libLeak.so')) as f:
+            self.assertEqual(f.read(), 'library')
+        self.assertEqual(BuildCache.read_stamp(new_install_dir), key)
+        self.cache.purge()
+        self.assertEqual(self.cache.entries(), [])
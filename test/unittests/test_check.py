@@ -0,0 +1,71 @@
+from __future__ import division
+from nineml import units as un
+from nineml.abstraction import (
+    Dynamics, Parameter, Regime, StateVariable, AnalogReceivePort,
+    AnalogSendPort, EventReceivePort, OnEvent, StateAssignment)
+from nineml.user import DynamicsProperties
+from pype9.check import check
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestCheck(TestCase):
+
+    def setUp(self):
+        self.leak = Dynamics(
+            name='Leak',
+            state_variables=[StateVariable('v', dimension=un.voltage),
+                             StateVariable('q', dimension=un.charge)],
+            regimes=[
+                Regime('dv/dt = (v_rest - v) / tau + i_ext / C',
+                       'dq/dt = i_ext',
+                       transitions=[OnEvent('reset',
+                                            state_assignments=[
+                                                StateAssignment('v',
+                                                                'v_rest')])],
+                       name='default')],
+            analog_ports=[AnalogReceivePort('i_ext', dimension=un.current),
+                          AnalogSendPort('v', dimension=un.voltage)],
+            event_ports=[EventReceivePort('reset')],
+            parameters=[Parameter('tau', dimension=un.time),
+                        Parameter('v_rest', dimension=un.voltage),
+                        Parameter('C', dimension=un.capacitance),
+                        Parameter('unused', dimension=un.time)])
+
+    def test_dynamics(self):
+        report = check(self.leak, ignore=['i_ext', 'reset'])
+        self.assertTrue(report.passed)
+        messages = [w.message for w in report.warnings]
+        self.assertEqual(len(messages), 2, '\n'.join(messages))
+        self.assertIn("Parameter 'unused' isn't used", messages)
+        self.assertTrue(any(m.startswith("State variable 'q' may grow")
+                            for m in messages))
+        # Unignored receive ports are reported (as warnings for single cells)
+        report = check(self.leak)
+        self.assertEqual(len(report.warnings), 4)
+
+    def test_inconsistent_dimensions(self):
+        bad = Dynamics(
+            name='Bad',
+            state_variables=[StateVariable('v', dimension=un.voltage)],
+            regimes=[Regime('dv/dt = (v_rest - v) / tau + tau', name='r')],
+            parameters=[Parameter('tau', dimension=un.time),
+                        Parameter('v_rest', dimension=un.voltage)],
+            validate_dimensions=False)
+        report = check(bad)
+        self.assertFalse(report.passed)
+        self.assertEqual(len(report.errors), 1)
+        self.assertIn("time derivative of 'v'", report.errors[0].message)
+
+    def test_properties(self):
+        props = DynamicsProperties(
+            'LeakProps', self.leak,
+            properties={'tau': 20.0 * un.ms, 'v_rest': -65.0 * un.mV,
+                        'C': 1.0 * un.nF, 'unused': 1.0 * un.ms},
+            initial_values={'v': -65.0 * un.mV})
+        report = check(props, ignore=['i_ext', 'reset'])
+        self.assertTrue(report.passed)
+        self.assertTrue(any(w.message.startswith(
+            "Missing initial value for 'q'") for w in report.warnings))
@@ -0,0 +1,115 @@
+from __future__ import division
+import os.path
+import shutil
+import tempfile
+import ninemlcatalog
+import numpy
+from nineml import units as un, Property
+from pype9.simulate.neuron import (
+    CellMetaClass as NeuronCellMetaClass, Simulation as NeuronSimulation)
+from pype9.simulate.nest import (
+    CellMetaClass as NESTCellMetaClass, Network as NESTNetwork,
+    Simulation as NESTSimulation)
+from pype9.exceptions import Pype9UsageError
+import pype9.utils.logging.handlers.sysout  # @UnusedImport
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestCheckpoint(TestCase):
+
+    dt = 0.025 * un.ms
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.izhi = ninemlcatalog.load('neuron/Izhikevich', 'Izhikevich')
+        self.izhi_props = ninemlcatalog.load('neuron/Izhikevich',
+                                             'SampleIzhikevich')
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_restore(self):
+        for CellMetaClass, Simulation in (
+            (NeuronCellMetaClass, NeuronSimulation),
+                (NESTCellMetaClass, NESTSimulation)):
+            Izhikevich = CellMetaClass(self.izhi,
+                                       build_version='CheckpointTest')
+            path = os.path.join(self.tmp_dir,
+                                '{}.h5'.format(Simulation.name))
+            # Uninterrupted simulation
+            with Simulation(dt=self.dt, seed=1) as sim:
+                cell = self._create_cell(Izhikevich)
+                sim.run(100.0 * un.ms)
+            ref_v = cell.recording('V')
+            # Simulation interrupted half-way through
+            with Simulation(dt=self.dt, seed=1) as sim:
+                cell = self._create_cell(Izhikevich)
+                sim.run(50.0 * un.ms)
+                sim.save_state(path)
+            with Simulation(dt=self.dt, seed=1) as sim:
+                cell = self._create_cell(Izhikevich)
+                sim.restore_state(path)
+                self.assertEqual(float(sim.t.in_units(un.ms)), 50.0)
+                sim.run(50.0 * un.ms)
+            v = cell.recording('V')
+            self.assertEqual(len(v), len(ref_v),
+                             "Length of restored recording ({}) does not "
+                             "match uninterrupted recording ({}) for {}"
+                             .format(len(v), len(ref_v), Simulation.name))
+            self.assertTrue(numpy.allclose(numpy.asarray(v),
+                                           numpy.asarray(ref_v)),
+                            "Restored recording does not match uninterrupted "
+                            "recording for {}".format(Simulation.name))
+            # Restoring into a simulation with different objects should fail
+            with Simulation(dt=self.dt, seed=1) as sim:
+                self.assertRaises(Pype9UsageError, sim.restore_state, path)
+
+    def test_nest_random_restore(self):
+        # The states of the NEST RNGs cannot be restored
+        Poisson = NESTCellMetaClass(
+            ninemlcatalog.load('input/Poisson', 'Poisson'),
+            build_version='CheckpointTest')
+        path = os.path.join(self.tmp_dir, 'poisson.h5')
+        with NESTSimulation(dt=self.dt, seed=1) as sim:
+            poisson = Poisson(rate=100.0 * un.Hz, t_next=0.5 * un.ms)
+            poisson.record('spike_output')
+            sim.run(50.0 * un.ms)
+            sim.save_state(path)
+        with NESTSimulation(dt=self.dt, seed=1) as sim:
+            poisson = Poisson(rate=100.0 * un.Hz, t_next=0.5 * un.ms)
+            poisson.record('spike_output')
+            self.assertRaises(Pype9UsageError, sim.restore_state, path)
+
+    def test_nest_network_restore(self):
+        # Neither the spikes in transit between the cells of a network nor
+        # the states of the NEST RNGs (used by the external Poisson cells)
+        # can be restored
+        model = ninemlcatalog.load('network/Brunel2000/AI').as_network(
+            'Brunel_AI').clone()
+        scale = 1 / model.population('Inh').size
+        for pop in model.populations:
+            pop.size = int(numpy.ceil(pop.size * scale))
+        for proj in (model.projection('Excitation'),
+                     model.projection('Inhibition')):
+            props = proj.connectivity.rule_properties
+            number = props.property('number')
+            props.set(Property(
+                number.name,
+                int(numpy.ceil(float(number.value) * scale)) * un.unitless))
+        path = os.path.join(self.tmp_dir, 'network.h5')
+        with NESTSimulation(dt=self.dt, seed=1) as sim:
+            NESTNetwork(model, build_version='CheckpointTest')
+            sim.run(10.0 * un.ms)
+            sim.save_state(path)
+        with NESTSimulation(dt=self.dt, seed=1) as sim:
+            NESTNetwork(model, build_version='CheckpointTest')
+            self.assertRaises(Pype9UsageError, sim.restore_state, path)
+
+    def _create_cell(self, Izhikevich):
+        cell = Izhikevich(self.izhi_props, U=-14.0 * un.mV / un.ms,
+                          V=-65.0 * un.mV)
+        cell.record('V')
+        return cell
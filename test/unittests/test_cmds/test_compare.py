@@ -0,0 +1,76 @@
+from __future__ import division
+import os.path
+import tempfile
+import shutil
+import numpy
+import quantities as pq
+import neo
+from pype9.cmd import compare
+from pype9.compare import (
+    rms_difference, spike_time_mismatches, compare_segments)
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+    import matplotlib
+    matplotlib.use('Agg')  # So DISPLAY environment variable doesn't need to be
+
+
+class TestCompare(TestCase):
+
+    t_stop = 100.0
+    dt = 0.01
+
+    def setUp(self):
+        self.work_dir = tempfile.mkdtemp()
+
+    def tearDown(self):
+        shutil.rmtree(self.work_dir)
+
+    def test_rms_difference(self):
+        times = numpy.arange(0.0, 10.0, 0.1)
+        sig1 = neo.AnalogSignal(numpy.sin(times), units='mV',
+                                sampling_period=0.1 * pq.ms)
+        # Same signal at half the resolution and in different units
+        sig2 = neo.AnalogSignal(numpy.sin(times[::2]) / 1000.0, units='V',
+                                sampling_period=0.2 * pq.ms)
+        self.assertLess(rms_difference(sig1, sig2), 0.01)
+        sig3 = neo.AnalogSignal(numpy.sin(times) + 0.5, units='mV',
+                                sampling_period=0.1 * pq.ms)
+        self.assertAlmostEqual(rms_difference(sig1, sig3), 0.5)
+
+    def test_spike_time_mismatches(self):
+        train1 = neo.SpikeTrain([1.0, 5.0, 9.0], units='ms', t_stop=10.0)
+        train2 = neo.SpikeTrain([1.05, 5.3], units='ms', t_stop=10.0)
+        self.assertEqual(spike_time_mismatches(train1, train2, 0.1 * pq.ms),
+                         3)
+        self.assertEqual(spike_time_mismatches(train1, train2, 0.5 * pq.ms),
+                         1)
+
+    def test_compare_segments(self):
+        seg1 = neo.Segment()
+        seg1.spiketrains.append(neo.SpikeTrain([1.0, 5.0], units='ms',
+                                               t_stop=10.0, name='spikes'))
+        seg2 = neo.Segment()
+        seg2.spiketrains.append(neo.SpikeTrain([1.0, 5.2], units='ms',
+                                               t_stop=10.0, name='spikes'))
+        comp, = compare_segments(seg1, seg2, rms_tolerance=1.0,
+                                 spike_tolerance=0.1 * pq.ms)
+        self.assertFalse(comp.passed)
+        comp, = compare_segments(seg1, seg2, rms_tolerance=1.0,
+                                 spike_tolerance=0.1 * pq.ms,
+                                 max_spike_mismatches=2)
+        self.assertTrue(comp.passed)
+
+    def test_compare_cmd(self):
+        plot_path = os.path.join(self.work_dir, 'compare.png')
+        argv = ("catalog://neuron/Izhikevich#SampleIzhikevich {t_stop} {dt} "
+                "--simulators neuron nest --record V "
+                "--init_value U -14.0 mV/ms --init_value V -65.0 mV "
+                "--rms_tolerance 1.0 --build_version Compare --plot {plot}"
+                .format(t_stop=self.t_stop, dt=self.dt, plot=plot_path))
+        self.assertFalse(compare.run(argv.split()))
+        self.assertTrue(os.path.exists(plot_path))
+        # Should fail with an unrealistically small tolerance
+        argv = argv.replace('--rms_tolerance 1.0', '--rms_tolerance 1e-12')
+        self.assertEqual(compare.run(argv.split()), 1)
@@ -122,6 +122,33 @@ class TestSimulateCell(TestCase):
             self.assertEqual(regimes.labels[0], 'subVb')
             self.assertTrue('subthreshold' in regimes.labels)
 
+    def test_voltage_clamp(self):
+        # The voltage clamp is a build option of NEST cells, which shouldn't
+        # be passed on to the simulation
+        clamp_path = '{}/clamp.pkl'.format(self.tmpdir)
+        out_path = '{}/clamp_current.pkl'.format(self.tmpdir)
+        neo.io.PickleIO(clamp_path).write(neo.Block(segments=[neo.Segment(
+            analogsignals=[neo.AnalogSignal(
+                np.concatenate((np.ones(500) * -65.0, np.ones(500) * -55.0)),
+                units='mV', sampling_period=0.1 * pq.ms)])]))
+        for simulator in ('neuron', 'nest'):
+            argv = (
+                "{nineml_model} {sim} 100.0 {dt} "
+                "--record clamp_current {out_path} "
+                "--init_value U {U} "
+                "--init_value V {V} "
+                "--init_regime subVb "
+                "--voltage_clamp {clamp_path} "
+                "--build_version CmdClamp "
+                .format(nineml_model=self.izhi_path, sim=simulator,
+                        out_path=out_path, clamp_path=clamp_path, dt=self.dt,
+                        U='{} {}'.format(*self.U), V='{} {}'.format(*self.V)))
+            simulate.run(argv.split())
+            current = neo.io.PickleIO(out_path).read()[0].analogsignals[0]
+            self.assertGreater(len(current), 0,
+                               "No clamp current recorded in {}"
+                               .format(simulator))
+
     def _ref_single_cell(self, simulator, isyn):
         if simulator == 'neuron':
             metaclass = NeuronCellMetaClass
@@ -0,0 +1,125 @@
+from __future__ import division
+import numpy
+from nineml import units as un
+from nineml.annotations import Annotations
+from pyNN.random import NumpyRNG
+from pype9.simulate.common.network.connection_rules import (
+    connection_rule_plugin, register_connection_rule,
+    unregister_connection_rule, registered_connection_rules,
+    ConnectionRulePlugin)
+from pype9.simulate.common.network.structure import set_structure, positions
+from pype9.exceptions import Pype9UsageError
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class DummyProperty(object):
+
+    def __init__(self, quantity):
+        self.quantity = quantity
+        self.value = quantity.value
+
+
+class DummyRuleProperties(object):
+    "Stands in for the properties of a user-defined ConnectionRule class"
+
+    def __init__(self, rule_name, **quantities):
+        self.name = rule_name + 'Props'
+        self.component_class = type('DummyRule', (object,), {
+            'standard_library': ('http://pype9.org/connectionrules/' +
+                                 rule_name)})
+        self._properties = dict((n, DummyProperty(q))
+                                for n, q in quantities.items())
+
+    @property
+    def property_names(self):
+        return iter(self._properties)
+
+    def property(self, name):
+        return self._properties[name]
+
+
+class DummyPopulation(object):
+
+    def __init__(self, name, size):
+        self.name = name
+        self.size = size
+        self.annotations = Annotations()
+
+
+class TestConnectionRules(TestCase):
+
+    def setUp(self):
+        self.rng = NumpyRNG(seed=1, parallel_safe=True)
+
+    def test_registry(self):
+        self.assertIn('GaussianDistanceProbability',
+                      registered_connection_rules())
+        props = DummyRuleProperties('GaussianDistanceProbability')
+        self.assertEqual(connection_rule_plugin(props).name,
+                         'GaussianDistanceProbability')
+        self.assertIsNone(connection_rule_plugin(
+            DummyRuleProperties('Unknown')))
+
+        @register_connection_rule
+        class AllToSelf(ConnectionRulePlugin):
+
+            name = 'AllToSelf'
+
+            def connection_map(self, properties, source_positions,
+                               destination_positions, rng):
+                return numpy.ones((source_positions.shape[1],
+                                   destination_positions.shape[1]),
+                                  dtype=bool)
+
+        try:
+            self.assertIsInstance(connection_rule_plugin(
+                DummyRuleProperties('AllToSelf')), AllToSelf)
+        finally:
+            unregister_connection_rule('AllToSelf')
+        self.assertNotIn('AllToSelf', registered_connection_rules())
+        self.assertRaises(Pype9UsageError, register_connection_rule, object)
+
+    def test_distance_dependent(self):
+        props = DummyRuleProperties(
+            'GaussianDistanceProbability', peak=1.0 * un.unitless,
+            sigma=1e6 * un.um, cutoff=15.0 * un.um)
+        plugin = connection_rule_plugin(props)
+        source_positions = numpy.array([[0.0, 10.0, 20.0, 30.0],
+                                        [0.0] * 4, [0.0] * 4])
+        destination_positions = numpy.array([[0.0, 30.0], [0.0, 0.0],
+                                             [0.0, 0.0]])
+        conns = plugin.connections(props, source_positions,
+                                   destination_positions, self.rng)
+        # Only the cells within the cutoff are connected (with probability ~1)
+        self.assertEqual(sorted(conns), [(0, 0), (1, 0), (2, 1), (3, 1)])
+        props = DummyRuleProperties(
+            'ExponentialDistanceProbability', peak=0.0 * un.unitless,
+            length_constant=10.0 * un.um, cutoff=100.0 * un.um)
+        self.assertEqual(
+            connection_rule_plugin(props).connections(
+                props, source_positions, destination_positions, self.rng),
+            [])
+        self.assertRaises(
+            Pype9UsageError, plugin.connections,
+            DummyRuleProperties('GaussianDistanceProbability',
+                                peak=1.0 * un.unitless),
+            source_positions, destination_positions, self.rng)
+
+    def test_structure(self):
+        pop = DummyPopulation('Exc', 9)
+        # Populations without a structure are arranged on a line
+        self.assertTrue(numpy.array_equal(positions(pop)[0],
+                                          numpy.arange(9, dtype=float)))
+        set_structure(pop, 'Grid2D', dx=20.0, dy=10.0)
+        grid = positions(pop)
+        self.assertEqual(grid.shape, (3, 9))
+        self.assertEqual(sorted(set(grid[0])), [0.0, 20.0, 40.0])
+        self.assertEqual(sorted(set(grid[1])), [0.0, 10.0, 20.0])
+        set_structure(pop, 'RandomSphere', radius=50.0)
+        rand = positions(pop, rng=self.rng)
+        self.assertTrue(numpy.all(numpy.sqrt((rand ** 2).sum(axis=0)) <=
+                                  50.0))
+        self.assertRaises(Pype9UsageError, set_structure, pop, 'Hexagonal')
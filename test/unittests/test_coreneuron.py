@@ -0,0 +1,86 @@
+from __future__ import division
+import os.path
+import shutil
+import tempfile
+from unittest import skipUnless
+import ninemlcatalog
+import numpy
+from nineml import units as un
+from pype9.simulate.neuron import CellMetaClass, Simulation, CodeGenerator
+from pype9.simulate.common.cells.with_synapses import WithSynapses
+from pype9.exceptions import Pype9Unsupported9MLException, Pype9UsageError
+import pype9.utils.logging.handlers.sysout  # @UnusedImport
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+try:
+    from neuron import coreneuron  # @UnusedImport
+except ImportError:
+    coreneuron_installed = False
+else:
+    coreneuron_installed = True
+
+
+class TestCoreNEURON(TestCase):
+
+    dt = 0.025 * un.ms
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.izhi = ninemlcatalog.load('neuron/Izhikevich', 'Izhikevich')
+        self.izhi_props = ninemlcatalog.load('neuron/Izhikevich',
+                                             'SampleIzhikevich')
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_generate(self):
+        code_gen = CodeGenerator(base_dir=self.tmp_dir, coreneuron=True)
+        self.assertNotEqual(code_gen,
+                            CodeGenerator(base_dir=self.tmp_dir))
+        build_class = code_gen.transform_for_build(
+            name='IzhikevichCoreNEURONTest',
+            component_class=WithSynapses.wrap(self.izhi))
+        code_gen.generate(build_class, build_mode='generate_only')
+        mod_path = os.path.join(
+            code_gen.get_source_dir(build_class.name, build_class.url),
+            build_class.name + '.mod')
+        with open(mod_path) as f:
+            self.assertIn('THREADSAFE', f.read())
+
+    def test_random_unsupported(self):
+        code_gen = CodeGenerator(base_dir=self.tmp_dir, coreneuron=True)
+        poisson = ninemlcatalog.load('input/Poisson#Poisson')
+        build_class = code_gen.transform_for_build(
+            name='PoissonCoreNEURONTest',
+            component_class=WithSynapses.wrap(poisson))
+        self.assertRaises(Pype9Unsupported9MLException, code_gen.generate,
+                          build_class, build_mode='generate_only')
+
+    def test_options(self):
+        self.assertRaises(Pype9UsageError, Simulation, dt=self.dt, gpu=True)
+        self.assertRaises(
+            Pype9UsageError, Simulation, dt=self.dt, coreneuron=True,
+            code_generator=CodeGenerator(base_dir=self.tmp_dir))
+
+    @skipUnless(coreneuron_installed, "CoreNEURON is not installed")
+    def test_simulate(self):
+        recordings = []
+        for use_coreneuron in (False, True):
+            with Simulation(dt=self.dt, seed=1,
+                            coreneuron=use_coreneuron) as sim:
+                # Separate build versions are required as the mechanisms
+                # are generated by different code generators
+                Izhikevich = CellMetaClass(
+                    self.izhi, build_version='CoreNEURONTest{}'.format(
+                        int(use_coreneuron)))
+                cell = Izhikevich(self.izhi_props, U=-14.0 * un.mV / un.ms,
+                                  V=-65.0 * un.mV)
+                cell.record('V')
+                sim.run(100.0 * un.ms)
+            recordings.append(cell.recording('V'))
+        self.assertTrue(numpy.allclose(numpy.asarray(recordings[0]),
+                                       numpy.asarray(recordings[1])),
+                        "CoreNEURON recording does not match NEURON recording")
@@ -0,0 +1,102 @@
+from __future__ import division
+import os
+import shutil
+import tempfile
+from pype9.simulate.common.code_gen import BaseCodeGenerator
+from pype9.simulate.common.code_gen.hooks import (
+    register_code_gen_hooks, unregister_code_gen_hooks,
+    registered_code_gen_hooks, code_gen_hooks, CodeGenHooks)
+from pype9.exceptions import Pype9UsageError
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class DummyCodeGenerator(BaseCodeGenerator):
+    "Renders the templates in a temporary directory"
+
+    SIMULATOR_NAME = 'dummy'
+    SIMULATOR_VERSION = '1.0'
+
+    def __init__(self, tmpl_dir, **kwargs):
+        self.BASE_TMPL_PATH = tmpl_dir
+        super(DummyCodeGenerator, self).__init__(base_dir=tmpl_dir,
+                                                 use_cache=False, **kwargs)
+
+    def generate_source_files(self, dynamics, src_dir, name, **kwargs):
+        pass
+
+    def compile_source_files(self, compile_dir, name):
+        pass
+
+
+class TestCodeGenHooks(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.tmpl_dir = os.path.join(self.tmp_dir, 'templates')
+        self.hooks_dir = os.path.join(self.tmp_dir, 'hooks')
+        os.makedirs(os.path.join(self.tmpl_dir, 'includes', 'default'))
+        os.makedirs(self.hooks_dir)
+        with open(os.path.join(self.tmpl_dir, 'main.tmpl'), 'w') as f:
+            f.write('{{name}}:{% include "body.tmpl" %}')
+        with open(os.path.join(self.tmpl_dir, 'includes', 'default',
+                               'body.tmpl'), 'w') as f:
+            f.write('default')
+        with open(os.path.join(self.hooks_dir, 'body.tmpl'), 'w') as f:
+            f.write('{{extra}}')
+        hooks_dir = self.hooks_dir
+
+        @register_code_gen_hooks
+        class Override(CodeGenHooks):
+
+            name = 'override'
+
+            def template_dirs(self, code_generator):
+                return [hooks_dir]
+
+            def template_args(self, code_generator, template, args):
+                return {'extra': 'overridden'}
+
+            def post_render(self, code_generator, template, filename,
+                            contents):
+                return contents.upper()
+
+            def link_flags(self, code_generator):
+                return ['-lextra']
+
+        @register_code_gen_hooks
+        class OtherSimulator(CodeGenHooks):
+
+            name = 'other_simulator'
+            simulators = ('other',)
+
+        self.code_generator = DummyCodeGenerator(self.tmpl_dir)
+
+    def tearDown(self):
+        unregister_code_gen_hooks('override')
+        unregister_code_gen_hooks('other_simulator')
+        shutil.rmtree(self.tmp_dir)
+
+    def test_registry(self):
+        self.assertIn('override', registered_code_gen_hooks())
+        self.assertEqual([h.name for h in code_gen_hooks('override')],
+                         ['override'])
+        self.assertEqual(code_gen_hooks(None), [])
+        self.assertRaises(Pype9UsageError, code_gen_hooks, ['unknown'])
+        self.assertRaises(Pype9UsageError, code_gen_hooks,
+                          ['other_simulator'], simulator='dummy')
+        self.assertRaises(Pype9UsageError, register_code_gen_hooks, object)
+
+    def test_render(self):
+        self.code_generator.render_to_file('main.tmpl', {'name': 'cell'},
+                                           'default.txt', self.tmp_dir)
+        self.code_generator._hooks = code_gen_hooks(['override'])
+        self.assertEqual(self.code_generator.hook_link_flags(), ['-lextra'])
+        self.code_generator.render_to_file('main.tmpl', {'name': 'cell'},
+                                           'hooked.txt', self.tmp_dir)
+        with open(os.path.join(self.tmp_dir, 'default.txt')) as f:
+            self.assertEqual(f.read(), 'cell:default')
+        with open(os.path.join(self.tmp_dir, 'hooked.txt')) as f:
+            self.assertEqual(f.read(), 'CELL:OVERRIDDEN')
@@ -0,0 +1,147 @@
+from __future__ import division
+import os.path
+import shutil
+import tempfile
+import numpy
+import ninemlcatalog
+import quantities as pq
+import neo
+from nineml import units as un
+from nineml.user import DynamicsProperties
+from nineml.abstraction import (
+    Dynamics, Parameter, Regime, AnalogReceivePort, AnalogSendPort)
+from pype9.simulate.common.cells.morphology import Morphology
+from pype9.simulate.neuron import (
+    CellMetaClass as NeuronCellMetaClass, Simulation as NeuronSimulation)
+from pype9.exceptions import Pype9UsageError
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+import pype9.utils.logging.handlers.sysout  # @UnusedImport
+
+
+swc_contents = """# Soma with a single dendrite that bifurcates
+1 1 0.0 0.0 0.0 5.0 -1
+2 3 5.0 0.0 0.0 1.0 1
+3 3 25.0 0.0 0.0 1.0 2
+4 3 45.0 10.0 0.0 0.5 3
+5 3 45.0 -10.0 0.0 0.5 3
+"""
+
+morphml_contents = """<?xml version="1.0" encoding="UTF-8"?>
+<neuroml xmlns="http://www.neuroml.org/schema/neuroml2" id="test">
+  <cell id="TestCell">
+    <morphology id="TestMorphology">
+      <segment id="0" name="soma">
+        <proximal x="0.0" y="0.0" z="0.0" diameter="10.0"/>
+        <distal x="10.0" y="0.0" z="0.0" diameter="10.0"/>
+      </segment>
+      <segment id="1" name="dend1">
+        <parent segment="0"/>
+        <distal x="30.0" y="0.0" z="0.0" diameter="1.0"/>
+      </segment>
+      <segment id="2" name="dend2">
+        <parent segment="1"/>
+        <distal x="50.0" y="0.0" z="0.0" diameter="1.0"/>
+      </segment>
+      <segmentGroup id="soma">
+        <member segment="0"/>
+      </segmentGroup>
+      <segmentGroup id="dendrite">
+        <member segment="1"/>
+        <member segment="2"/>
+      </segmentGroup>
+      <segmentGroup id="all">
+        <include segmentGroup="soma"/>
+        <include segmentGroup="dendrite"/>
+      </segmentGroup>
+    </morphology>
+  </cell>
+</neuroml>
+"""
+
+
+class TestMorphology(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.swc_path = os.path.join(self.tmp_dir, 'test.swc')
+        with open(self.swc_path, 'w') as f:
+            f.write(swc_contents)
+        self.morphml_path = os.path.join(self.tmp_dir, 'test.nml')
+        with open(self.morphml_path, 'w') as f:
+            f.write(morphml_contents)
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_swc(self):
+        morph = Morphology.read(self.swc_path)
+        self.assertEqual(morph.num_sections, 4)
+        self.assertEqual(morph.soma.name, 'soma_0')
+        self.assertEqual(len(morph.group('dendrite')), 3)
+        self.assertEqual(len(morph.group('all')), 4)
+        trunk = morph.section('dendrite_0')
+        self.assertIs(trunk.parent, morph.soma)
+        self.assertEqual(trunk.parent_loc, 0.5)
+        self.assertAlmostEqual(trunk.length, 20.0)
+        for name in ('dendrite_1', 'dendrite_2'):
+            branch = morph.section(name)
+            self.assertIs(branch.parent, trunk)
+            self.assertEqual(branch.parent_loc, 1.0)
+            # Branches start from the end of the parent section
+            self.assertTrue(numpy.all(branch.points[0, :3] ==
+                                      trunk.points[-1, :3]))
+        self.assertRaises(Pype9UsageError, morph.group, 'axon')
+
+    def test_morphml(self):
+        morph = Morphology.read(self.morphml_path)
+        self.assertEqual(morph.name, 'TestMorphology')
+        self.assertEqual(morph.num_sections, 2)
+        self.assertEqual(morph.soma.name, 'soma_0')
+        dend = morph.section('dendrite_0')
+        self.assertEqual(len(dend.points), 3)
+        self.assertAlmostEqual(dend.length, 40.0)
+        self.assertEqual(morph.group_names, set(['all', 'soma', 'dendrite']))
+
+    def test_neuron_distributed_mechanisms(self):
+        leak = Dynamics(
+            name='TestLeak',
+            aliases=['i := g * (e - v)'],
+            regimes=[Regime(name='default')],
+            analog_ports=[AnalogReceivePort('v', dimension=un.voltage),
+                          AnalogSendPort('i', dimension=un.currentDensity)],
+            parameters=[Parameter('g', dimension=un.conductanceDensity),
+                        Parameter('e', dimension=un.voltage)])
+        leak_props = DynamicsProperties(
+            name='TestLeakProps', definition=leak,
+            properties={'g': 0.0001 * un.S / un.cm ** 2, 'e': -70.0 * un.mV})
+        izhi = ninemlcatalog.load('neuron/Izhikevich', 'Izhikevich')
+        izhi_props = ninemlcatalog.load('neuron/Izhikevich',
+                                        'SampleIzhikevich')
+        Izhikevich = NeuronCellMetaClass(
+            izhi, morphology=self.swc_path,
+            distributed_mechanisms={'dendrite': [leak_props]},
+            build_version='Morphology')
+        with NeuronSimulation(dt=0.025 * un.ms) as sim:
+            cell = Izhikevich(izhi_props, U=-14.0 * un.mV / un.ms,
+                              V=-65.0 * un.mV)
+            self.assertEqual(sorted(cell.section_names),
+                             ['dendrite_0', 'dendrite_1', 'dendrite_2',
+                              'soma_0'])
+            cell.record('v', section='dendrite_1', location=0.5)
+            cell.record('i', section='dendrite_0', location=0.5)
+            self.assertRaises(Pype9UsageError, cell.record, 'i',
+                              section='soma_0')
+            cell.play('Isyn', neo.AnalogSignal(
+                numpy.ones(400) * 0.1, units='nA',
+                sampling_period=0.25 * pq.ms), section='dendrite_2')
+            sim.run(100.0 * un.ms)
+        v = cell.recording('v', section='dendrite_1', location=0.5)
+        i = cell.recording('i', section='dendrite_0', location=0.5)
+        self.assertEqual(len(v), len(i))
+        # The injected current should depolarise the neighbouring dendrite
+        self.assertGreater(float(v.max()), float(v[0]))
+        self.assertEqual(
+            len(cell.recordings().analogsignals), 2)
@@ -0,0 +1,59 @@
+from __future__ import division
+import numpy
+import quantities as pq
+import neo
+from pype9.utils.mpi import merge_segments, gather_segment, rank_path
+from pype9.exceptions import Pype9UsageError
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestMergeSegments(TestCase):
+
+    def test_rank_path(self):
+        self.assertEqual(rank_path('data/exc.neo.pkl', 3),
+                         'data/exc.neo.3.pkl')
+        self.assertEqual(rank_path('exc', 0), 'exc.0')
+
+    def test_merge(self):
+        # Cells are distributed round-robin over two processes
+        segments = [self._segment([0, 2]), self._segment([1, 3])]
+        merged = merge_segments(segments)
+        self.assertEqual(
+            [st.annotations['source_index'] for st in merged.spiketrains],
+            [0, 1, 2, 3])
+        self.assertEqual(len(merged.analogsignals), 1)
+        v = merged.analogsignals[0]
+        self.assertEqual(v.shape, (10, 4))
+        self.assertEqual(list(v.annotations['source_ids']), [0, 1, 2, 3])
+        self.assertTrue(numpy.array_equal(numpy.asarray(v)[0, :],
+                                          [0.0, 1.0, 2.0, 3.0]))
+
+    def test_gather_single_process(self):
+        gathered = gather_segment(self._segment([0, 1]))
+        self.assertEqual(len(gathered.spiketrains), 2)
+        self.assertEqual(gathered.analogsignals[0].shape, (10, 2))
+
+    def test_mismatched_times(self):
+        segment = self._segment([1])
+        segment.analogsignals[0] = neo.AnalogSignal(
+            numpy.zeros((10, 1)), units='mV', sampling_period=0.2 * pq.ms,
+            name='v')
+        self.assertRaises(Pype9UsageError, merge_segments,
+                          [self._segment([0]), segment])
+
+    def _segment(self, indices):
+        segment = neo.Segment()
+        for i in indices:
+            st = neo.SpikeTrain([1.0 + i, 5.0 + i], units='ms',
+                                t_stop=10.0 * pq.ms)
+            st.annotate(source_index=i)
+            segment.spiketrains.append(st)
+        v = neo.AnalogSignal(
+            numpy.tile(numpy.asarray(indices, dtype=float), (10, 1)),
+            units='mV', sampling_period=0.1 * pq.ms, name='v')
+        v.annotate(source_ids=numpy.asarray(indices))
+        segment.analogsignals.append(v)
+        return segment
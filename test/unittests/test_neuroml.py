@@ -0,0 +1,122 @@
+from __future__ import division
+import os.path
+import shutil
+import tempfile
+from nineml import units as un
+from pype9.io import neuroml
+from pype9.exceptions import Pype9UsageError, Pype9Unsupported9MLException
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+LIF_NML = """<?xml version="1.0" encoding="UTF-8"?>
+<neuroml xmlns="http://www.neuroml.org/schema/neuroml2" id="LIFTest">
+  <ComponentType name="baseTestCell">
+    <Exposure name="v" dimension="voltage"/>
+    <EventPort name="spike" direction="out"/>
+  </ComponentType>
+  <ComponentType name="testLIF" extends="baseTestCell">
+    <Parameter name="C" dimension="capacitance"/>
+    <Parameter name="leakConductance" dimension="conductance"/>
+    <Parameter name="leakReversal" dimension="voltage"/>
+    <Parameter name="thresh" dimension="voltage"/>
+    <Parameter name="reset" dimension="voltage"/>
+    <Parameter name="refract" dimension="time"/>
+    <Exposure name="iSyn" dimension="current"/>
+    <Dynamics>
+      <StateVariable name="v" dimension="voltage" exposure="v"/>
+      <StateVariable name="lastSpike" dimension="time"/>
+      <DerivedVariable name="iSyn" dimension="current"
+                       select="synapses[*]/i" reduce="add"/>
+      <DerivedVariable name="iLeak" dimension="current"
+                       value="leakConductance * (leakReversal - v)"/>
+      <OnStart>
+        <StateAssignment variable="v" value="leakReversal"/>
+        <StateAssignment variable="lastSpike" value="0"/>
+      </OnStart>
+      <Regime name="integrating" initial="true">
+        <TimeDerivative variable="v" value="(iLeak + iSyn) / C"/>
+        <OnCondition test="v .gt. thresh">
+          <EventOut port="spike"/>
+          <Transition regime="refractory"/>
+        </OnCondition>
+      </Regime>
+      <Regime name="refractory">
+        <OnEntry>
+          <StateAssignment variable="lastSpike" value="t"/>
+          <StateAssignment variable="v" value="reset"/>
+        </OnEntry>
+        <OnCondition test="t .gt. lastSpike + refract">
+          <Transition regime="integrating"/>
+        </OnCondition>
+      </Regime>
+    </Dynamics>
+  </ComponentType>
+  <testLIF id="lif0" C="20pF" leakConductance="10nS" leakReversal="-65mV"
+           thresh="-50mV" reset="-70mV" refract="0.002s"/>
+  <unknownCell id="missing" a="1"/>
+</neuroml>
+"""
+
+
+class TestNeuroML(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.path = os.path.join(self.tmp_dir, 'lif.nml')
+        with open(self.path, 'w') as f:
+            f.write(LIF_NML)
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_read(self):
+        doc = neuroml.read(self.path)
+        lif = doc['testLIF']
+        self.assertEqual(
+            sorted(lif.parameter_names),
+            ['C', 'leakConductance', 'leakReversal', 'refract', 'reset',
+             'thresh'])
+        self.assertEqual(sorted(lif.state_variable_names), ['lastSpike', 'v'])
+        self.assertEqual(sorted(lif.regime_names),
+                         ['integrating', 'refractory'])
+        self.assertEqual(list(lif.analog_reduce_port_names), ['iSyn'])
+        self.assertEqual(list(lif.analog_send_port_names), ['v'])
+        self.assertEqual(list(lif.event_send_port_names), ['spike'])
+        self.assertEqual(lif.state_variable('v').dimension, un.voltage)
+        # OnEntry assignments are merged into the transition into the regime
+        to_refractory = next(lif.regime('integrating').on_conditions)
+        self.assertEqual(sorted(to_refractory.state_assignment_variables),
+                         ['lastSpike', 'v'])
+        props = doc['lif0']
+        self.assertEqual(props.component_class, lif)
+        self.assertEqual(props.property('C').quantity, 20.0 * un.pF)
+        self.assertEqual(props.property('refract').quantity, 0.002 * un.s)
+        self.assertEqual(props.initial_value('v').quantity, -65.0 * un.mV)
+        self.assertEqual(props.initial_value('lastSpike').value, 0.0)
+        self.assertEqual(props.initial_regime, 'integrating')
+
+    def test_quantity(self):
+        reader = neuroml.LemsReader()
+        self.assertEqual(reader.quantity('-60mV'), -60.0 * un.mV)
+        self.assertEqual(reader.quantity('0.03 per_ms'), 0.03 * un.per_ms)
+        self.assertEqual(reader.quantity('2min').value, 120.0)
+        self.assertEqual(reader.quantity('0.5').units, un.unitless)
+        self.assertRaises(Pype9UsageError, reader.quantity, '1 furlong')
+
+    def test_unsupported(self):
+        path = os.path.join(self.tmp_dir, 'random.nml')
+        with open(path, 'w') as f:
+            f.write(LIF_NML.replace(
+                'value="leakConductance * (leakReversal - v)"',
+                'value="leakConductance * (leakReversal - v) * random(1)"'))
+        self.assertRaises(Pype9Unsupported9MLException, neuroml.read, path)
+
+    def test_is_neuroml(self):
+        self.assertTrue(neuroml.is_neuroml(self.path))
+        nineml_path = os.path.join(self.tmp_dir, 'lif.xml')
+        with open(nineml_path, 'w') as f:
+            f.write('<NineML xmlns="http://nineml.net/9ML/1.0"/>')
+        self.assertFalse(neuroml.is_neuroml(nineml_path))
@@ -0,0 +1,48 @@
+from __future__ import division
+import os.path
+import shutil
+import tempfile
+import numpy
+import quantities as pq
+import neo
+from pype9.io import nwb
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestNWB(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_write_read(self):
+        seg = neo.Segment(description="Simulation of 'Izhikevich' cell")
+        seg.analogsignals.append(neo.AnalogSignal(
+            numpy.arange(10.0), units='mV', sampling_period=0.5 * pq.ms,
+            t_start=1.0 * pq.ms, name='V'))
+        seg.spiketrains.append(neo.SpikeTrain(
+            [5.0, 15.0], units='ms', t_stop=20.0 * pq.ms, name='spike'))
+        metadata = {'model_url': 'izhikevich.xml', 'simulator': 'NEST',
+                    'dt_ms': 0.5, 'dynamics_seeds': [1, 2]}
+        path = os.path.join(self.tmp_dir, 'output.nwb')
+        nwb.write(path, seg, metadata=metadata)
+        read_seg = nwb.read(path)
+        self.assertEqual(read_seg.description, seg.description)
+        for key, value in metadata.items():
+            self.assertEqual(read_seg.annotations[key], value)
+        self.assertEqual(len(read_seg.analogsignals), 1)
+        sig = read_seg.analogsignals[0]
+        self.assertEqual(sig.name, 'V')
+        self.assertTrue(numpy.allclose(numpy.ravel(sig), numpy.arange(10.0)))
+        self.assertAlmostEqual(float(sig.t_start.rescale(pq.ms)), 1.0)
+        self.assertAlmostEqual(float(sig.sampling_period.rescale(pq.ms)),
+                               0.5)
+        self.assertEqual(len(read_seg.spiketrains), 1)
+        self.assertTrue(numpy.allclose(
+            numpy.asarray(read_seg.spiketrains[0].rescale(pq.ms)),
+            [5.0, 15.0]))
@@ -0,0 +1,180 @@
+from __future__ import division
+import math
+import sympy
+from nineml import units as un
+from nineml.abstraction import (
+    Dynamics, Regime, OnEvent, StateVariable, Parameter, AnalogSendPort,
+    AnalogReceivePort, EventReceivePort)
+from nineml.user import DynamicsProperties, Property, Initial
+from nineml.exceptions import NineMLNameError
+from pype9.simulate.common.network.plasticity import (
+    EventDrivenPlasticity, EventDrivenSynapse, has_state, is_event_driven,
+    LAST_EVENT_TIME)
+from pype9.exceptions import Pype9Unsupported9MLException
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class DummyPortConnection(object):
+
+    def __init__(self, sender_role, send_port_name, receiver_role,
+                 receive_port_name, communicates):
+        self.sender_role = sender_role
+        self.send_port_name = send_port_name
+        self.receiver_role = receiver_role
+        self.receive_port_name = receive_port_name
+        self.communicates = communicates
+
+
+class DummyProjection(object):
+    "Stands in for a nineml.Projection with a plasticity that has state"
+
+    def __init__(self, name, plasticity, response, port_connections):
+        self.name = name
+        self.plasticity = plasticity
+        self.response = response
+        self.port_connections = port_connections
+
+
+def stdp_dynamics(k_plus_deriv='-K_plus / tau_plus'):
+    return Dynamics(
+        name='STDP',
+        parameters=[Parameter('tau_plus', dimension=un.time),
+                    Parameter('tau_minus', dimension=un.time),
+                    Parameter('A_plus', dimension=un.conductance),
+                    Parameter('A_minus', dimension=un.conductance)],
+        state_variables=[StateVariable('K_plus', dimension=un.dimensionless),
+                         StateVariable('K_minus', dimension=un.dimensionless),
+                         StateVariable('w', dimension=un.conductance)],
+        regimes=[
+            Regime(
+                'dK_plus/dt = ' + k_plus_deriv,
+                'dK_minus/dt = -K_minus / tau_minus',
+                transitions=[
+                    OnEvent('incoming_spike',
+                            state_assignments=[
+                                'K_plus = K_plus + 1',
+                                'w = w - A_minus * K_minus']),
+                    OnEvent('outgoing_spike',
+                            state_assignments=[
+                                'K_minus = K_minus + 1',
+                                'w = w + A_plus * K_plus'])],
+                name='sole')],
+        event_ports=[EventReceivePort('incoming_spike'),
+                     EventReceivePort('outgoing_spike')],
+        analog_ports=[AnalogSendPort('w', dimension=un.conductance)])
+
+
+def response_dynamics():
+    return Dynamics(
+        name='Exponential',
+        parameters=[Parameter('tau', dimension=un.time)],
+        state_variables=[StateVariable('g', dimension=un.conductance)],
+        regimes=[
+            Regime(
+                'dg/dt = -g / tau',
+                transitions=[OnEvent('spike',
+                                     state_assignments=['g = g + weight'])],
+                name='sole')],
+        event_ports=[EventReceivePort('spike')],
+        analog_ports=[AnalogReceivePort('weight', dimension=un.conductance),
+                      AnalogSendPort('g', dimension=un.conductance)])
+
+
+def projection(plasticity_dynamics=None):
+    if plasticity_dynamics is None:
+        plasticity_dynamics = stdp_dynamics()
+    plasticity = DynamicsProperties(
+        name='STDPProps', definition=plasticity_dynamics,
+        properties=[Property('tau_plus', 20.0 * un.ms),
+                    Property('tau_minus', 20.0 * un.ms),
+                    Property('A_plus', 0.01 * un.nS),
+                    Property('A_minus', 0.012 * un.nS)],
+        initial_values=[Initial('K_plus', 0.0 * un.unitless),
+                        Initial('K_minus', 0.0 * un.unitless),
+                        Initial('w', 1.0 * un.nS)])
+    response = DynamicsProperties(
+        name='ExponentialProps', definition=response_dynamics(),
+        properties=[Property('tau', 5.0 * un.ms)],
+        initial_values=[Initial('g', 0.0 * un.nS)])
+    return DummyProjection(
+        'Excitation', plasticity, response, [
+            DummyPortConnection('pre', 'spike', 'plasticity',
+                                'incoming_spike', 'event'),
+            DummyPortConnection('post', 'spike', 'plasticity',
+                                'outgoing_spike', 'event'),
+            DummyPortConnection('pre', 'spike', 'response', 'spike',
+                                'event'),
+            DummyPortConnection('plasticity', 'w', 'response', 'weight',
+                                'analog')])
+
+
+class TestEventDrivenPlasticity(TestCase):
+
+    def setUp(self):
+        self.proj = projection()
+        self.plasticity = EventDrivenPlasticity(self.proj)
+        self.synapse = EventDrivenSynapse(self.plasticity.dynamics(
+            'spike__psr__Excitation', 'weight__psr__Excitation'))
+
+    def test_has_state(self):
+        self.assertTrue(has_state(self.proj))
+        self.proj.plasticity = None
+        self.assertFalse(has_state(self.proj))
+
+    def test_ports(self):
+        self.assertEqual(self.plasticity.pre_port, 'incoming_spike')
+        self.assertEqual(self.plasticity.post_port, 'outgoing_spike')
+        self.assertEqual(self.plasticity.weight_port, 'w')
+        self.assertEqual(self.plasticity.response_port, 'weight')
+        self.assertEqual(self.plasticity.response_event_port, 'spike')
+
+    def test_response(self):
+        response = self.plasticity.response.component_class
+        self.assertEqual(response.name, 'Exponential_plastic')
+        self.assertIn('weight', response.parameter_names)
+        self.assertNotIn('weight', response.analog_receive_port_names)
+
+    def test_synapse(self):
+        self.assertTrue(is_event_driven(self.synapse.dynamics))
+        self.assertEqual(self.synapse.name, 'Excitation')
+        self.assertEqual(self.synapse.receive_port, 'spike__psr__Excitation')
+        self.assertEqual(self.synapse.weight_parameter,
+                         'weight__psr__Excitation')
+        self.assertEqual(self.synapse.weight, 'w__Excitation')
+        self.assertEqual(
+            self.synapse.state_variable_names,
+            sorted(['K_plus__Excitation', 'K_minus__Excitation',
+                    'w__Excitation', LAST_EVENT_TIME + '__Excitation']))
+        self.assertEqual(self.synapse.state_variable('w').name,
+                         'w__Excitation')
+        self.assertRaises(NineMLNameError, self.synapse.state_variable,
+                          'g')
+
+    def test_decay(self):
+        # The state variables are decayed from the time of the previous event
+        # before the state assignments of the event are applied
+        assignments = dict(
+            (sa.variable, sa.rhs)
+            for sa in self.synapse.pre_on_event.state_assignments)
+        values = {'K_plus__Excitation': 0.5, 'K_minus__Excitation': 0.25,
+                  'w__Excitation': 1.0, 'A_minus__Excitation': 0.012,
+                  'tau_plus__Excitation': 20.0,
+                  'tau_minus__Excitation': 20.0,
+                  LAST_EVENT_TIME + '__Excitation': 10.0, 't': 30.0}
+        subs = dict((sympy.Symbol(n), v) for n, v in values.items())
+        self.assertAlmostEqual(
+            float(assignments['K_plus__Excitation'].xreplace(subs)),
+            0.5 * math.exp(-1.0) + 1.0)
+        self.assertAlmostEqual(
+            float(assignments['w__Excitation'].xreplace(subs)),
+            1.0 - 0.012 * 0.25 * math.exp(-1.0))
+        self.assertEqual(
+            str(assignments[LAST_EVENT_TIME + '__Excitation']), 't')
+
+    def test_nonlinear(self):
+        self.assertRaises(
+            Pype9Unsupported9MLException, EventDrivenPlasticity,
+            projection(stdp_dynamics('-K_plus * K_plus / tau_plus')))
@@ -0,0 +1,101 @@
+import os.path
+import tempfile
+import shutil
+import numpy
+import neo
+import quantities as pq
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+    import matplotlib
+    matplotlib.use('Agg')  # So DISPLAY environment variable doesn't need to be
+from pype9.plot import (  # @IgnorePep8
+    plot, parse_panels, raster_data, firing_rates, group_spiketrains)
+from pype9.cmd.plot import combine_segments  # @IgnorePep8
+from pype9.exceptions import Pype9UsageError  # @IgnorePep8
+
+
+def spiketrain(times, population):
+    st = neo.SpikeTrain(times, units='ms', t_start=0.0 * pq.ms,
+                        t_stop=100.0 * pq.ms)
+    if population is not None:
+        st.annotate(source_population=population)
+    return st
+
+
+class TestPlot(TestCase):
+
+    def setUp(self):
+        self.work_dir = tempfile.mkdtemp()
+        self.seg = neo.Segment()
+        self.seg.spiketrains.extend([
+            spiketrain([10.0, 20.0, 30.0], 'Exc'),
+            spiketrain([15.0], 'Exc'),
+            spiketrain([5.0, 55.0], 'Inh')])
+        self.seg.analogsignals.append(neo.AnalogSignal(
+            numpy.linspace(-70.0, -50.0, 1000), units='mV',
+            sampling_period=0.1 * pq.ms, name='V'))
+
+    def tearDown(self):
+        shutil.rmtree(self.work_dir)
+
+    def test_groups(self):
+        groups = group_spiketrains(self.seg.spiketrains)
+        self.assertEqual(list(groups), ['Exc', 'Inh'])
+        data = raster_data(self.seg.spiketrains)
+        self.assertEqual(data[0][2], [0, 0, 0, 1])
+        self.assertEqual(data[1][2], [2, 2])
+        self.assertEqual(list(data[1][1]), [5.0, 55.0])
+        # Spike trains without the annotation are grouped together
+        self.assertEqual(list(group_spiketrains(self.seg.spiketrains,
+                                                group_by='missing')), [None])
+
+    def test_rates(self):
+        rates = dict((name, (centres, r)) for name, centres, r in
+                     firing_rates(self.seg.spiketrains, 50.0))
+        centres, exc_rates = rates['Exc']
+        self.assertEqual(list(centres), [25.0, 75.0])
+        # 4 spikes from 2 cells in 50 ms = 40 Hz
+        self.assertEqual(list(exc_rates), [40.0, 0.0])
+        self.assertEqual(list(rates['Inh'][1]), [20.0, 20.0])
+
+    def test_panels(self):
+        self.assertEqual(parse_panels(self.seg),
+                         [('raster', None), ('analog', None)])
+        self.assertEqual(parse_panels(self.seg, bin_width=5.0),
+                         [('raster', None), ('rate', None),
+                          ('analog', None)])
+        self.assertEqual(parse_panels(self.seg, ['analog:V', 'raster']),
+                         [('analog', 'V'), ('raster', None)])
+        self.assertRaises(Pype9UsageError, parse_panels, self.seg, ['rate'])
+        self.assertRaises(Pype9UsageError, parse_panels, self.seg,
+                          ['analog:U'])
+        self.assertRaises(Pype9UsageError, parse_panels, self.seg,
+                          ['histogram'])
+
+    def test_multi_panel(self):
+        style_path = os.path.join(self.work_dir, 'test.mplstyle')
+        with open(style_path, 'w') as f:
+            f.write('lines.linewidth: 3\naxes.grid: True\n')
+        out_path = os.path.join(self.work_dir, 'multi.png')
+        plot(self.seg, dims=(5, 5), resolution=50.0, save=out_path,
+             show=False, panels=['raster', 'rate', 'analog:V'],
+             bin_width=10.0, style=style_path)
+        self.assertTrue(os.path.exists(out_path))
+
+    def test_combine(self):
+        exc = neo.Segment()
+        exc.spiketrains.append(spiketrain([1.0], None))
+        inh = neo.Segment()
+        inh.spiketrains.append(spiketrain([2.0], 'Inhibitory'))
+        inh.analogsignals.append(neo.AnalogSignal(
+            numpy.zeros(10), units='mV', sampling_period=0.1 * pq.ms,
+            name='V'))
+        combined = combine_segments([exc, inh], ['/tmp/exc.neo.pkl',
+                                                 'inh.neo.pkl'],
+                                    'source_population')
+        self.assertEqual(
+            list(group_spiketrains(combined.spiketrains)),
+            ['exc', 'Inhibitory'])
+        self.assertEqual(combined.analogsignals[0].name, 'inh.V')
@@ -0,0 +1,120 @@
+from __future__ import division
+import os.path
+import shutil
+import tempfile
+import numpy
+import quantities as pq
+import neo
+from pype9.protocol import Protocol, Epoch, Stimulus
+from pype9.exceptions import Pype9UsageError
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+PROTOCOL_YAML = """
+repeats: 2
+inter_trial_interval: 50.0
+seed: 1
+epochs:
+  - name: baseline
+    duration: 20.0
+    record: false
+  - name: step
+    duration: 100.0
+    stimuli:
+      i_ext: {type: step, amplitude: 0.5, units: nA}
+  - name: pulses
+    duration: 30.0
+    stimuli:
+      i_ext: {type: pulses, amplitude: 100.0, width: 2.0,
+              onsets: [5.0, 15.0], units: pA}
+      spike_in: {type: spikes, times: [1.0, 10.0, 40.0]}
+trials:
+  epoch: step
+  port: i_ext
+  parameter: amplitude
+  values: [0.1, 0.2, 0.3]
+"""
+
+
+class TestProtocol(TestCase):
+
+    dt = 0.1
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.path = os.path.join(self.tmp_dir, 'protocol.yml')
+        with open(self.path, 'w') as f:
+            f.write(PROTOCOL_YAML)
+        self.protocol = Protocol.read(self.path)
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_timeline(self):
+        self.assertEqual(self.protocol.num_trials, 6)
+        self.assertEqual(self.protocol.trial_duration, 150.0)
+        self.assertEqual(self.protocol.duration, 6 * 150.0 + 5 * 50.0)
+        timeline = self.protocol.timeline()
+        self.assertEqual(len(timeline), 18)
+        self.assertEqual([te.t_start for te in timeline[3:6]],
+                         [200.0, 220.0, 320.0])
+        self.assertEqual(
+            [te.stimuli['i_ext'].parameters['amplitude']
+             for te in timeline if te.epoch.name == 'step'],
+            [0.1, 0.2, 0.3, 0.1, 0.2, 0.3])
+
+    def test_stimuli(self):
+        stimuli = self.protocol.stimuli(self.dt)
+        i_ext = stimuli['i_ext']
+        self.assertEqual(len(i_ext),
+                         int(round(self.protocol.duration / self.dt)))
+        values = numpy.asarray(i_ext.rescale(pq.nA)).ravel()
+        # Baseline, step of second trial and pulses (converted from pA)
+        self.assertEqual(values[int(10.0 / self.dt)], 0.0)
+        self.assertAlmostEqual(values[int(250.0 / self.dt)], 0.2)
+        self.assertAlmostEqual(values[int(326.0 / self.dt)], 0.1)
+        self.assertEqual(values[int(330.0 / self.dt)], 0.0)
+        spikes = stimuli['spike_in']
+        # The spike outside of the pulses epoch is dropped
+        self.assertEqual(len(spikes), 12)
+        self.assertAlmostEqual(float(spikes[0]), 121.0)
+
+    def test_split(self):
+        segment = neo.Segment()
+        num_samples = int(round(self.protocol.duration / self.dt))
+        segment.analogsignals.append(neo.AnalogSignal(
+            numpy.arange(num_samples, dtype=float), units='mV',
+            sampling_period=self.dt * pq.ms, name='v'))
+        segment.spiketrains.append(neo.SpikeTrain(
+            [25.0, 130.0, 400.0], units='ms',
+            t_stop=self.protocol.duration * pq.ms))
+        block = self.protocol.split(segment)
+        # Baseline epochs aren't recorded
+        self.assertEqual(len(block.segments), 12)
+        first = block.segments[0]
+        self.assertEqual(first.annotations['epoch'], 'step')
+        self.assertEqual(first.annotations['amplitude'], 0.1)
+        self.assertEqual(len(first.analogsignals[0]),
+                         int(round(100.0 / self.dt)))
+        self.assertEqual(float(first.analogsignals[0][0]),
+                         20.0 / self.dt)
+        self.assertEqual(len(first.spiketrains[0]), 1)
+        self.assertEqual(block.segments[1].annotations['epoch'], 'pulses')
+        self.assertEqual(len(block.segments[1].spiketrains[0]), 1)
+
+    def test_invalid(self):
+        self.assertRaises(Pype9UsageError, Stimulus, 'step',
+                          {'amplitude': 1.0})
+        self.assertRaises(Pype9UsageError, Stimulus, 'triangle',
+                          {'amplitude': 1.0}, units='nA')
+        self.assertRaises(Pype9UsageError, Stimulus, 'pulses',
+                          {'amplitude': 1.0, 'width': 1.0}, units='nA')
+        epoch = Epoch('step', 10.0,
+                      {'i_ext': Stimulus('step', {'amplitude': 1.0}, 'nA')})
+        self.assertRaises(Pype9UsageError, Protocol, [epoch],
+                          variation={'epoch': 'step', 'port': 'i_syn',
+                                     'parameter': 'amplitude',
+                                     'values': [1.0]})
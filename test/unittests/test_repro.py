@@ -0,0 +1,99 @@
+from __future__ import division
+import os.path
+from copy import deepcopy
+import shutil
+import tempfile
+from pype9.repro import Manifest, code_generator_hash, software_versions
+from pype9.exceptions import Pype9UsageError
+from pype9.utils.testing import DummyCodeGenerator
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestManifest(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+        self.model_path = os.path.join(self.tmp_dir, 'izhi.xml')
+        with open(self.model_path, 'w') as f:
+            f.write('<NineML xmlns="http://nineml.net/9ML/2.0"/>')
+        self.manifest = Manifest(
+            model={'url': self.model_path, 'name': 'Izhikevich',
+                   'hash': 'abc123'},
+            simulation={'simulator': 'neuron', 'simulator_version': '7.5',
+                        'dt_ms': 0.01, 't_stop_ms': 100.0,
+                        'solver': 'derivimplicit',
+                        'code_generator_hash': 'def456',
+                        'num_processes': 1, 'num_threads': 1},
+            seeds={'seed': 12345, 'properties_seed': None,
+                   'dynamics_seeds': [678], 'properties_seeds': [910],
+                   'global_seed': 1112},
+            versions=software_versions(),
+            properties={'a': [0.02, 'per_ms']},
+            initial_values={'V': [-65.0, 'mV']},
+            initial_regime='subthreshold',
+            command={'argv': ['izhi.xml#Izhikevich', 'neuron', '100.0',
+                              '0.01', '--record', 'V', 'out/v.neo.pkl',
+                              '--seed', '1', '--init_value', 'V', '-65.0',
+                              'mV', '--save_state', 'out/state.h5'],
+                     'cwd': self.tmp_dir})
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_write_read(self):
+        path = os.path.join(self.tmp_dir, 'izhi.manifest.json')
+        self.manifest.write(path)
+        reread = Manifest.read(path)
+        self.assertEqual(reread.to_dict(), self.manifest.to_dict())
+        self.assertEqual(reread.differences(self.manifest), [])
+        self.assertEqual(reread.environment_differences(num_processes=1), [])
+        self.assertEqual(len(reread.environment_differences(num_processes=4)),
+                         1)
+
+    def test_differences(self):
+        other = Manifest.from_dict(deepcopy(self.manifest.to_dict()))
+        other.seeds['dynamics_seeds'] = [679]
+        other.simulation['t_stop_ms'] = 200.0
+        other.properties = {'a': [0.03, 'per_ms']}
+        diffs = self.manifest.differences(other)
+        self.assertEqual(len(diffs), 2)
+        self.assertTrue(diffs[0].startswith('seeds.dynamics_seeds'))
+        self.assertTrue(diffs[1].startswith('properties'))
+
+    def test_reproduce_argv(self):
+        output_dir = os.path.join(self.tmp_dir, 'replay')
+        argv = self.manifest.reproduce_argv(output_dir)
+        self.assertEqual(
+            argv,
+            [os.path.join(self.tmp_dir, 'izhi.xml#Izhikevich'), 'neuron',
+             '100.0', '0.01', '--record', 'V',
+             os.path.join(output_dir, 'v.neo.pkl'), '--init_value', 'V',
+             '-65.0', 'mV', '--save_state',
+             os.path.join(output_dir, 'state.h5'), '--seed', '12345'])
+
+    def test_invalid(self):
+        path = os.path.join(self.tmp_dir, 'invalid.json')
+        with open(path, 'w') as f:
+            f.write('{"model": {}}')
+        self.assertRaises(Pype9UsageError, Manifest.read, path)
+        self.manifest.command = None
+        self.assertRaises(Pype9UsageError, self.manifest.reproduce_argv,
+                          self.tmp_dir)
+
+    def test_code_generator_hash(self):
+        template_dir = os.path.join(self.tmp_dir, 'templates')
+        os.mkdir(template_dir)
+        with open(os.path.join(template_dir, 'main.tmpl'), 'w') as f:
+            f.write('template')
+        code_gen = DummyCodeGenerator(template_dir)
+        hsh = code_generator_hash(code_gen)
+        self.assertEqual(hsh, code_generator_hash(code_gen))
+        self.assertNotEqual(
+            hsh, code_generator_hash(DummyCodeGenerator(template_dir,
+                                                        flags=['-O3'])))
+        with open(os.path.join(template_dir, 'main.tmpl'), 'w') as f:
+            f.write('modified template')
+        self.assertNotEqual(hsh, code_generator_hash(code_gen))
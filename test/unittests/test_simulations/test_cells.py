@@ -3,6 +3,8 @@ from __future__ import print_function
 from __future__ import division
 from builtins import zip
 import sys
+import numpy
+import neo
 import quantities as pq
 from itertools import chain, repeat
 import logging
@@ -22,12 +24,22 @@ from pype9.simulate.nest import (  # @IgnorePep8
     CellMetaClass as NESTCellMetaClass,
     Simulation as NESTSimulation)
 from pype9.utils.testing import Comparer, input_step, input_freq  # @IgnorePep8
+from pype9.simulate import load_backend  # @IgnorePep8
 from pype9.simulate.nest.units import UnitHandler as UnitHandlerNEST  # @IgnorePep8
 import pype9.utils.logging.handlers.sysout  # @IgnorePep8
+try:
+    import arbor  # @UnusedImport
+except ImportError:
+    arbor = None
+try:
+    import pygenn  # @UnusedImport
+except ImportError:
+    pygenn = None
 if __name__ == '__main__':
     from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
 else:
     from unittest import TestCase  # @Reimport
+from unittest import skip, skipIf  # @IgnorePep8
 
 
 cell_metaclasses = {'neuron': NeuronCellMetaClass,
@@ -35,11 +47,19 @@ cell_metaclasses = {'neuron': NeuronCellMetaClass,
 
 NEST_RNG_SEED = 1234567890
 NEURON_RNG_SEED = 987654321
+ARBOR_RNG_SEED = 135792468
+GENN_RNG_SEED = 246813579
 
 SIMULATORS_TO_TEST = ['neuron', 'nest']
 PLOT_DEFAULT = False
 BUILD_MODE_DEFAULT = 'purge'
 
+# Arbor mechanisms cannot write to the membrane voltage, so the voltage resets
+# of integrate-and-fire models aren't supported by the Arbor pipeline (see
+# doc/source/unsupported.rst)
+ARBOR_VOLTAGE_RESET_SKIP = (
+    "Membrane voltage resets are not supported by the Arbor pipeline")
+
 
 class TestDynamics(TestCase):
 
@@ -436,14 +456,211 @@ class TestDynamics(TestCase):
                      sim_name, recorded_rate, ref_rate, 2.5 * pq.Hz,
                      recorded_rate - ref_rate)))
 
+    def test_voltage_clamp(self, simulators=SIMULATORS_TO_TEST, dt=0.01,
+                           duration=100.0, v_clamp=-60.0,
+                           series_resistance=0.01,
+                           build_mode=BUILD_MODE_DEFAULT, **kwargs):  # @UnusedVariable @IgnorePep8
+        nineml_model = ninemlcatalog.load(
+            'neuron/LeakyIntegrateAndFire', 'PyNNLeakyIntegrateAndFire')
+        properties = ninemlcatalog.load(
+            'neuron/LeakyIntegrateAndFire',
+            'PyNNLeakyIntegrateAndFireProperties')
+        build_args = {'neuron': {'build_mode': build_mode,
+                                 'build_version': 'VClamp',
+                                 'external_currents': ['i_synaptic']},
+                      'nest': {'build_mode': build_mode,
+                               'build_version': 'VClamp',
+                               'voltage_clamp': True}}
+        # Clamp the voltage from the start of the simulation (after the
+        # device delay) to a subthreshold voltage
+        voltages = neo.AnalogSignal(
+            numpy.ones(int(duration / dt)) * v_clamp, units='mV',
+            sampling_period=dt * pq.ms, t_start=1.0 * pq.ms)
+        # The steady-state clamp current balances the leak current
+        cm, tau, e_leak = (UnitHandlerNEST.to_pq_quantity(
+            properties.property(n).quantity) for n in ('Cm', 'tau', 'e_leak'))
+        ref_current = pq.Quantity(
+            cm * (v_clamp * pq.mV - e_leak) / tau, 'nA')
+        for sim_name in simulators:
+            meta_class = cell_metaclasses[sim_name]
+            celltype = meta_class(nineml_model, **build_args[sim_name])
+            if sim_name == 'neuron':
+                Simulation = NeuronSimulation(dt=dt * un.ms,
+                                              seed=NEURON_RNG_SEED)
+            else:
+                Simulation = NESTSimulation(dt=dt * un.ms, seed=NEST_RNG_SEED)
+            with Simulation as sim:
+                cell = celltype(properties, regime_='subthreshold',
+                                **self.liaf_initial_states)
+                cell.record('v')
+                cell.voltage_clamp(voltages,
+                                   series_resistance=series_resistance)
+                sim.run(duration * un.ms)
+            v = cell.recording('v')
+            current = cell.clamp_current()
+            # Compare the final 10 ms after the clamp has settled
+            v_diff = abs(float(v[-int(10 / dt):].mean()) - v_clamp)
+            self.assertLess(
+                v_diff, 0.1,
+                "{} voltage clamp did not hold the membrane voltage at {} mV "
+                "(difference {} mV)".format(sim_name, v_clamp, v_diff))
+            i_diff = abs(pq.Quantity(current[-int(10 / dt):].mean(), 'nA') -
+                         ref_current)
+            self.assertLess(
+                i_diff, abs(ref_current) * 0.05,
+                "{} clamp current ({}) did not match the leak current ({})"
+                .format(sim_name, current[-1], ref_current))
+
+
+class TestBackendComparisons(TestCase):
+    """
+    Compares the simulations of the backends without native reference models
+    with the 9ML simulations in NEURON and NEST
+    """
+
+    # The seeds of the other backends passed to the comparer
+    rng_seeds = {'arbor': ARBOR_RNG_SEED, 'genn': GENN_RNG_SEED}
+
+    def _compare(self, simulator, nineml_model, properties, state_variable,
+                 initial_states, input_signal, tolerance, dt=0.001,
+                 duration=100.0, initial_regime=None, print_comparisons=False,
+                 build_mode=BUILD_MODE_DEFAULT):
+        build_args = {'build_mode': build_mode,
+                      'build_version': 'TestBackends'}
+        comparer = Comparer(
+            nineml_model=nineml_model, properties=properties,
+            state_variable=state_variable, dt=dt,
+            simulators=['neuron', 'nest', simulator],
+            initial_states=initial_states, initial_regime=initial_regime,
+            input_signal=input_signal, neuron_build_args=build_args,
+            nest_build_args=build_args,
+            build_args={simulator: build_args})
+        comparer.simulate(duration * un.ms, nest_rng_seed=NEST_RNG_SEED,
+                          neuron_rng_seed=NEURON_RNG_SEED,
+                          rng_seeds=self.rng_seeds)
+        comparisons = comparer.compare()
+        if print_comparisons:
+            for (name1, name2), diff in comparisons.items():
+                print('{} v {}: {}'.format(name1, name2, diff))
+        for other in ('neuron', 'nest'):
+            key = tuple(sorted(('9ML-' + simulator, '9ML-' + other)))
+            self.assertLess(
+                comparisons[key], tolerance,
+                "{} {} 9ML simulation did not match {} 9ML simulation within "
+                "{} ({})".format(nineml_model.name, simulator, other,
+                                 tolerance, comparisons[key]))
+
+    @skipIf(arbor is None, "Arbor is not installed")
+    @skip(ARBOR_VOLTAGE_RESET_SKIP)
+    def test_arbor_izhi(self, dt=0.001, **kwargs):
+        # The recordings are compared in mV whereas the rate of change of 'U'
+        # is in mV/ms and the input current in nA, all of which are scaled
+        # into the units of Arbor's mechanisms
+        self._compare(
+            'arbor', ninemlcatalog.load('neuron/Izhikevich', 'Izhikevich'),
+            ninemlcatalog.load('neuron/Izhikevich', 'SampleIzhikevich'),
+            'V', {'U': -14.0 * pq.mV / pq.ms, 'V': -65.0 * pq.mV},
+            input_step('Isyn', 0.02, 50, 100, dt, 30), 0.4 * pq.mV, dt=dt,
+            **kwargs)
+
+    @skipIf(arbor is None, "Arbor is not installed")
+    @skip(ARBOR_VOLTAGE_RESET_SKIP)
+    def test_arbor_liaf(self, dt=0.001, **kwargs):
+        self._compare(
+            'arbor', ninemlcatalog.load('neuron/LeakyIntegrateAndFire',
+                                        'PyNNLeakyIntegrateAndFire'),
+            ninemlcatalog.load('neuron/LeakyIntegrateAndFire',
+                               'PyNNLeakyIntegrateAndFireProperties'),
+            'v', TestDynamics.liaf_initial_states,
+            input_step('i_synaptic', 1, 50, 100, dt, 20), 0.55 * pq.mV,
+            dt=dt, initial_regime='subthreshold', **kwargs)
+
+    @skipIf(arbor is None, "Arbor is not installed")
+    def test_arbor_hh(self, dt=0.001, **kwargs):
+        # Unlike the integrate-and-fire models, Hodgkin-Huxley doesn't reset
+        # the membrane voltage so it can be built by the Arbor pipeline
+        self._compare(
+            'arbor', ninemlcatalog.load('neuron/HodgkinHuxley',
+                                        'PyNNHodgkinHuxley'),
+            ninemlcatalog.load('neuron/HodgkinHuxley',
+                               'PyNNHodgkinHuxleyProperties'),
+            'v', {'v': -65.0 * pq.mV, 'm': 0.0, 'h': 1.0, 'n': 0.0},
+            input_step('iExt', 0.5, 50, 100, dt, 10), 0.5 * pq.mV, dt=dt,
+            **kwargs)
+
+    @skipIf(pygenn is None, "GeNN (pygenn) is not installed")
+    def test_genn_izhi(self, dt=0.001, **kwargs):
+        self._compare(
+            'genn', ninemlcatalog.load('neuron/Izhikevich', 'Izhikevich'),
+            ninemlcatalog.load('neuron/Izhikevich', 'SampleIzhikevich'),
+            'V', {'U': -14.0 * pq.mV / pq.ms, 'V': -65.0 * pq.mV},
+            input_step('Isyn', 0.02, 50, 100, dt, 30), 0.4 * pq.mV, dt=dt,
+            **kwargs)
+
+    @skipIf(pygenn is None, "GeNN (pygenn) is not installed")
+    def test_genn_liaf(self, dt=0.001, **kwargs):
+        self._compare(
+            'genn', ninemlcatalog.load('neuron/LeakyIntegrateAndFire',
+                                       'PyNNLeakyIntegrateAndFire'),
+            ninemlcatalog.load('neuron/LeakyIntegrateAndFire',
+                               'PyNNLeakyIntegrateAndFireProperties'),
+            'v', TestDynamics.liaf_initial_states,
+            input_step('i_synaptic', 1, 50, 100, dt, 20), 0.55 * pq.mV,
+            dt=dt, initial_regime='subthreshold', **kwargs)
+
+
+class TestGeNNRecording(TestCase):
+
+    @skipIf(pygenn is None, "GeNN (pygenn) is not installed")
+    def test_recording_interval(self, dt=0.025, build_mode=BUILD_MODE_DEFAULT):
+        # The recordings copied from the device whenever the buffers fill up
+        # over several runs should match those of a single run that fits
+        # in the buffers, including when the buffers are sized by a first
+        # run that is shorter than the recording interval
+        genn = load_backend('genn')
+        Izhikevich = genn.CellMetaClass(
+            ninemlcatalog.load('neuron/Izhikevich', 'Izhikevich'),
+            build_mode=build_mode, build_version='TestGeNNRecording')
+        recordings = []
+        for interval, durations in ((100.0, (100.0,)),
+                                    (1.3, (17.0, 45.0, 38.0)),
+                                    (10.0, (0.6, 34.2, 65.2))):
+            with genn.Simulation(dt=dt * un.ms, seed=GENN_RNG_SEED,
+                                 recording_interval=interval * un.ms) as sim:
+                cell = Izhikevich(
+                    ninemlcatalog.load('neuron/Izhikevich',
+                                       'SampleIzhikevich'),
+                    U=-14.0 * un.mV / un.ms, V=-65.0 * un.mV)
+                cell.play(*input_step('Isyn', 0.02, 20, 100, dt, 10))
+                cell.record('V')
+                cell.record('spike')
+                for duration in durations:
+                    sim.run(duration * un.ms)
+                recordings.append((numpy.asarray(cell.recording('V')),
+                                   numpy.asarray(cell.recording('spike'))))
+        (v, spikes) = recordings[0]
+        self.assertGreater(len(spikes), 0, "GeNN cell did not spike")
+        for chunked_v, chunked_spikes in recordings[1:]:
+            self.assertEqual(
+                len(chunked_v), len(v),
+                "Number of samples recorded in chunks ({}) does not match "
+                "single run ({})".format(len(chunked_v), len(v)))
+            self.assertTrue(
+                numpy.allclose(chunked_v, v),
+                "Samples recorded in chunks do not match single run")
+            self.assertTrue(
+                len(chunked_spikes) == len(spikes) and
+                numpy.allclose(chunked_spikes, spikes),
+                "Spikes recorded in chunks ({}) do not match single run ({})"
+                .format(chunked_spikes, spikes))
 
 if __name__ == '__main__':
     import argparse
     parser = argparse.ArgumentParser()
     parser.add_argument('--test', type=str, default='izhi',
                         help=("Which test to run, can be one of: 'alpha_syn', "
-                              "'izhi', 'izhiFS', 'liaf', 'poisson' or 'hh' "
-                              "(default: %(default)s )"))
+                              "'izhi', 'izhiFS', 'liaf', 'poisson', 'hh' or "
+                              "'voltage_clamp' (default: %(default)s )"))
     parser.add_argument('--plot', action='store_true',
                         help="Plot the traces on the same plot")
     parser.add_argument('--print_comparisons', action='store_true',
@@ -38,17 +38,24 @@ import nest  # @IgnorePep8
 from pype9.simulate.nest.network import Network as NestPype9Network  # @IgnorePep8
 from pype9.simulate.nest import Simulation as NESTSimulation  # @IgnorePep8
 from pype9.utils.testing import ReferenceBrunel2000  # @IgnorePep8
+from pype9.exceptions import Pype9Unsupported9MLException  # @IgnorePep8
 import pype9.utils.logging.handlers.sysout  # @IgnorePep8
 
 try:
     from matplotlib import pyplot as plt
 except ImportError:
     pass
+try:
+    from pype9.simulate.genn import (
+        Network as GeNNPype9Network, Simulation as GeNNSimulation)
+except ImportError:
+    GeNNPype9Network = None
 if __name__ == '__main__':
     # Import dummy test case
     from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport @UnresolvedImport @IgnorePep8
 else:
     from unittest import TestCase  # @Reimport
+from unittest import skipIf  # @IgnorePep8
 
 nest_bookkeeping = (
     'element_type', 'global_id', 'local_id', 'receptor_types',
@@ -60,6 +67,7 @@ nest_bookkeeping = (
 
 NEST_RNG_SEED = 12345
 NEURON_RNG_SEED = 54321
+GENN_RNG_SEED = 13579
 
 
 class TestBrunel2000(TestCase):
@@ -1083,3 +1091,153 @@ class TestNetwork(TestCase):
             "Mismatch between generated and expected connection groups:\n {}"
             .format(
                 connection_groups['Proj4'] .find_mismatch(conn_group6)))
+
+
+class TestRandomProperties(TestCase):
+
+    size = 1000
+    properties_seed = 24680
+
+    def test_random_properties(self, **kwargs):  # @UnusedVariable
+        cell_cls = Dynamics(
+            name='RandomCell',
+            state_variables=[
+                StateVariable('SV1', dimension=un.voltage)],
+            regimes=[
+                Regime(
+                    'dSV1/dt = -SV1 / P1',
+                    transitions=[On('SV1 > P2', do=[OutputEvent('spike')])],
+                    name='R1')],
+            analog_ports=[EventSendPort('spike')],
+            parameters=[Parameter('P1', dimension=un.time),
+                        Parameter('P2', dimension=un.voltage)])
+        normal = un.Quantity(RandomDistributionValue(
+            RandomDistributionProperties(
+                name="normal",
+                definition=ninemlcatalog.load(
+                    'randomdistribution/Normal', 'NormalDistribution'),
+                properties={'mean': 10.0, 'variance': 4.0})), un.ms)
+        uniform = un.Quantity(RandomDistributionValue(
+            RandomDistributionProperties(
+                name="uniform",
+                definition=ninemlcatalog.load(
+                    'randomdistribution/Uniform', 'UniformDistribution'),
+                properties={'minimum': -70.0, 'maximum': -60.0})), un.mV)
+        cell = DynamicsProperties(
+            name="RandomCellProps", definition=cell_cls,
+            properties={'P1': normal, 'P2': -50.0 * un.mV},
+            initial_values={'SV1': uniform})
+        network = Network(
+            name="RandomNet",
+            populations=[Population(name="Pop", size=self.size, cell=cell)])
+        drawn = {}
+        for NetworkClass, Simulation, seed in (
+                (NestPype9Network, NESTSimulation, NEST_RNG_SEED),
+                (NeuronPype9Network, NeuronSimulation, NEURON_RNG_SEED)):
+            # The values are drawn from the properties RNG, so the same
+            # properties seed should give the same values in both backends
+            with Simulation(dt=0.1 * un.ms, seed=seed,
+                            properties_seed=self.properties_seed):
+                array = NetworkClass(network).component_array('Pop')
+                if NetworkClass is NestPype9Network:
+                    cells = list(array.all_cells)
+                    p1 = numpy.asarray(nest.GetStatus(cells, 'P1__cell'))
+                    sv1 = numpy.asarray(nest.GetStatus(cells, 'SV1__cell'))
+                    self.assertTrue(numpy.all(sv1 >= -70.0) and
+                                    numpy.all(sv1 <= -60.0),
+                                    "Initial values of 'SV1' are outside "
+                                    "the uniform distribution in NEST")
+                else:
+                    p1 = numpy.asarray([c._cell._get('P1__cell')
+                                        for c in array.all_cells])
+                self.assertAlmostEqual(
+                    p1.mean(), 10.0, delta=0.3,
+                    msg="Mean of 'P1' ({}) does not match distribution in {}"
+                    .format(p1.mean(), Simulation.name))
+                # The standard deviation is the square root of the variance
+                self.assertAlmostEqual(
+                    p1.std(), 2.0, delta=0.3,
+                    msg="Standard deviation of 'P1' ({}) does not match "
+                    "distribution in {}".format(p1.std(), Simulation.name))
+            drawn[Simulation.name] = p1
+        self.assertTrue(
+            numpy.allclose(drawn[NESTSimulation.name],
+                           drawn[NeuronSimulation.name]),
+            "Values of 'P1' drawn with the same properties seed differ "
+            "between NEST and Neuron")
+
+
+class TestGeNNNetwork(TestCase):
+
+    @skipIf(GeNNPype9Network is None, "GeNN (pygenn) is not installed")
+    def test_plasticity_unsupported(self, **kwargs):  # @UnusedVariable
+        cell_cls = Dynamics(
+            name='Cell',
+            state_variables=[
+                StateVariable('SV1', dimension=un.voltage)],
+            regimes=[
+                Regime(
+                    'dSV1/dt = -SV1 / P1 + i_ext / P2',
+                    transitions=[On('SV1 > P3', do=[OutputEvent('spike')])],
+                    name='R1')],
+            analog_ports=[AnalogReducePort('i_ext', dimension=un.current,
+                                           operator='+'),
+                          EventSendPort('spike')],
+            parameters=[Parameter('P1', dimension=un.time),
+                        Parameter('P2', dimension=un.capacitance),
+                        Parameter('P3', dimension=un.voltage)])
+        exc_cls = Dynamics(
+            name="Exc",
+            aliases=["i := SV1"],
+            regimes=[
+                Regime(
+                    name="default",
+                    time_derivatives=["dSV1/dt = -SV1/tau"],
+                    transitions=On('spike', do=["SV1 = SV1 + weight"]))],
+            state_variables=[StateVariable('SV1', dimension=un.current)],
+            analog_ports=[AnalogSendPort("i", dimension=un.current),
+                          AnalogReceivePort("weight", dimension=un.current)],
+            parameters=[Parameter('tau', dimension=un.time)])
+        # Plasticity with state, which would need to be translated into a
+        # GeNN weight-update model
+        facilitation_cls = Dynamics(
+            name="Facilitation",
+            parameters=[Parameter('increment', dimension=un.current)],
+            state_variables=[StateVariable('w', dimension=un.current)],
+            analog_ports=[AnalogSendPort('w', dimension=un.current)],
+            event_ports=[EventReceivePort('incoming_spike')],
+            regimes=[
+                Regime(
+                    name="sole",
+                    transitions=On(
+                        'incoming_spike',
+                        do=[StateAssignment('w', 'w + increment')]))])
+        cell = DynamicsProperties(
+            name="CellProps", definition=cell_cls,
+            properties={'P1': 10 * un.ms, 'P2': 100 * un.uF,
+                        'P3': -50 * un.mV})
+        pre = Population(name="Pre", size=5, cell=cell)
+        post = Population(name="Post", size=5, cell=cell)
+        proj = Projection(
+            name="Proj", pre=pre, post=post,
+            response=DynamicsProperties(
+                name="ExcProps", definition=exc_cls,
+                properties={'tau': 1 * ms}),
+            plasticity=DynamicsProperties(
+                name="FacilitationProps", definition=facilitation_cls,
+                properties={'increment': 0.1 * un.nA},
+                initial_values={'w': 1.0 * un.nA}),
+            connection_rule_properties=ConnectionRuleProperties(
+                'all_to_all_props',
+                ninemlcatalog.load('/connectionrule/AllToAll', 'AllToAll')),
+            port_connections=[
+                ('pre', 'spike', 'response', 'spike'),
+                ('response', 'i', 'post', 'i_ext'),
+                ('plasticity', 'w', 'response', 'weight'),
+                ('pre', 'spike', 'plasticity', 'incoming_spike')],
+            delay=1.0 * un.ms)
+        network = Network(name="PlasticNet", populations=(pre, post),
+                          projections=(proj,))
+        with GeNNSimulation(dt=0.1 * un.ms, seed=GENN_RNG_SEED):
+            self.assertRaises(Pype9Unsupported9MLException,
+                              GeNNPype9Network, network)
@@ -0,0 +1,180 @@
+from __future__ import division
+import os.path
+import json
+import shutil
+import tempfile
+import numpy
+import h5py
+import quantities as pq
+import neo
+import nineml
+from nineml import units as un
+from nineml.user import DynamicsProperties
+from nineml.abstraction import (
+    Dynamics, Parameter, Regime, StateVariable, On, OutputEvent,
+    StateAssignment, AnalogReducePort, AnalogReceivePort, AnalogSendPort,
+    EventSendPort, EventReceivePort)
+from pype9.io import sonata
+from pype9.exceptions import Pype9UsageError
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestSonata(TestCase):
+
+    def setUp(self):
+        self.tmp_dir = tempfile.mkdtemp()
+
+    def tearDown(self):
+        shutil.rmtree(self.tmp_dir)
+
+    def test_read(self):
+        config_path = self._write_network()
+        network = sonata.read(config_path)
+        self.assertEqual(network.name, 'circuit_config')
+        self.assertEqual(sorted(network.population_names),
+                         ['cortex_exc', 'cortex_inh'])
+        exc = network.population('cortex_exc')
+        inh = network.population('cortex_inh')
+        self.assertEqual(exc.size, 3)
+        self.assertEqual(inh.size, 2)
+        # Per-node values should override the properties of the template
+        self.assertEqual(list(exc.cell.property('P3').value),
+                         [-50.0, -45.0, -40.0])
+        self.assertEqual(float(inh.cell.property('P3').value), -50.0)
+        self.assertEqual(sonata.get_node_ids(exc), ('cortex', [0, 2, 4]))
+        self.assertEqual(sonata.get_node_ids(inh), ('cortex', [1, 3]))
+        self.assertEqual(network.num_projections, 2)
+        proj = network.projection('recurrent_100_cortex_exc_to_cortex_inh')
+        self.assertEqual(
+            list(proj.connectivity.rule_properties.property(
+                'sourceIndicies').value), [0, 2])
+        self.assertEqual(
+            list(proj.connectivity.rule_properties.property(
+                'destinationIndicies').value), [0, 1])
+        self.assertEqual(float(proj.delay.value), 1.5)
+        self.assertEqual(
+            list(proj.plasticity.property('weight').value), [2.0, 3.0])
+
+    def test_recursive_manifest(self):
+        config_path = os.path.join(self.tmp_dir, 'recursive_config.json')
+        with open(config_path, 'w') as f:
+            json.dump({'manifest': {'$A': '$B/x', '$B': '$A/y'},
+                       'network': {'nodes_dir': '$A'}}, f)
+        self.assertRaises(Pype9UsageError, sonata.read_config, config_path)
+        with open(config_path, 'w') as f:
+            json.dump({'manifest': {'$BASE': '${configdir}/base',
+                                    '$NET': '$BASE/network'},
+                       'network': {'nodes_dir': '$NET/nodes'}}, f)
+        self.assertEqual(
+            sonata.read_config(config_path)['network']['nodes_dir'],
+            os.path.join(self.tmp_dir, 'base', 'network', 'nodes'))
+
+    def test_write(self):
+        seg = neo.Segment()
+        for i, times in enumerate(([5.0, 15.0], [10.0], [])):
+            st = neo.SpikeTrain(times, units='ms', t_stop=20.0 * pq.ms)
+            st.annotate(source_index=i)
+            seg.spiketrains.append(st)
+        for i in range(3):
+            seg.analogsignals.append(neo.AnalogSignal(
+                numpy.arange(10) + i, units='mV',
+                sampling_period=0.5 * pq.ms, t_start=1.0 * pq.ms))
+        path = os.path.join(self.tmp_dir, 'output.h5')
+        sonata.write(path, seg, population='cortex', node_ids=[4, 2, 0])
+        with h5py.File(path, 'r') as f:
+            spikes = f['spikes']['cortex']
+            self.assertEqual(list(spikes['timestamps'][...]),
+                             [5.0, 10.0, 15.0])
+            self.assertEqual(list(spikes['node_ids'][...]), [4, 2, 4])
+            report = f['report']['cortex']
+            self.assertEqual(report['data'].shape, (10, 3))
+            self.assertEqual(report['data'].attrs['units'], 'mV')
+            self.assertEqual(list(report['mapping']['node_ids'][...]),
+                             [4, 2, 0])
+            self.assertEqual(list(report['mapping']['time'][...]),
+                             [1.0, 6.0, 0.5])
+
+    def _write_network(self):
+        cell_cls = Dynamics(
+            name='Cell',
+            state_variables=[StateVariable('SV1', dimension=un.voltage)],
+            regimes=[
+                Regime(
+                    'dSV1/dt = -SV1 / P1 + i_ext / P2',
+                    transitions=[On('SV1 > P3', do=[OutputEvent('spike')])],
+                    name='R1')],
+            analog_ports=[AnalogReducePort('i_ext', dimension=un.current,
+                                           operator='+'),
+                          EventSendPort('spike')],
+            parameters=[Parameter('P1', dimension=un.time),
+                        Parameter('P2', dimension=un.capacitance),
+                        Parameter('P3', dimension=un.voltage)])
+        cell_props = DynamicsProperties(
+            name='CellProps', definition=cell_cls,
+            properties={'P1': 10 * un.ms, 'P2': 100 * un.pF,
+                        'P3': -50 * un.mV})
+        syn_cls = Dynamics(
+            name='Syn',
+            aliases=['i := SV1'],
+            regimes=[
+                Regime(
+                    name='default',
+                    time_derivatives=['dSV1/dt = -SV1 / tau'],
+                    transitions=[On('spike', do=[
+                        StateAssignment('SV1', 'SV1 + weight')])])],
+            state_variables=[StateVariable('SV1', dimension=un.current)],
+            analog_ports=[AnalogSendPort('i', dimension=un.current),
+                          AnalogReceivePort('weight', dimension=un.current),
+                          EventReceivePort('spike')],
+            parameters=[Parameter('tau', dimension=un.time)])
+        syn_props = DynamicsProperties(
+            name='SynProps', definition=syn_cls,
+            properties={'tau': 5 * un.ms})
+        doc_path = os.path.join(self.tmp_dir, 'models.xml')
+        nineml.Document(cell_cls, cell_props, syn_cls, syn_props).write(
+            doc_path)
+        with open(os.path.join(self.tmp_dir, 'node_types.csv'), 'w') as f:
+            f.write("node_type_id pop_name model_type model_template\n"
+                    "1 exc point_process nineml:./models.xml#CellProps\n"
+                    "2 inh point_process nineml:./models.xml#CellProps\n")
+        with open(os.path.join(self.tmp_dir, 'edge_types.csv'), 'w') as f:
+            f.write("edge_type_id delay model_template\n"
+                    "100 1.5 nineml:./models.xml#SynProps\n")
+        with h5py.File(os.path.join(self.tmp_dir, 'nodes.h5'), 'w') as f:
+            pop = f.create_group('nodes').create_group('cortex')
+            pop.create_dataset('node_id', data=[0, 1, 2, 3, 4])
+            pop.create_dataset('node_type_id', data=[1, 2, 1, 2, 1])
+            pop.create_dataset('node_group_id', data=[0, 1, 0, 1, 0])
+            pop.create_dataset('node_group_index', data=[0, 0, 1, 1, 2])
+            params = pop.create_group('0').create_group('dynamics_params')
+            params.create_dataset('P3', data=[-50.0, -45.0, -40.0])
+            pop.create_group('1')
+        with h5py.File(os.path.join(self.tmp_dir, 'edges.h5'), 'w') as f:
+            pop = f.create_group('edges').create_group('recurrent')
+            src = pop.create_dataset('source_node_id', data=[0, 4, 1])
+            src.attrs['node_population'] = 'cortex'
+            tgt = pop.create_dataset('target_node_id', data=[1, 3, 2])
+            tgt.attrs['node_population'] = 'cortex'
+            pop.create_dataset('edge_type_id', data=[100, 100, 100])
+            pop.create_dataset('edge_group_id', data=[0, 0, 0])
+            pop.create_dataset('edge_group_index', data=[0, 1, 2])
+            pop.create_group('0').create_dataset('syn_weight',
+                                                 data=[2.0, 3.0, 4.0])
+        config_path = os.path.join(self.tmp_dir, 'circuit_config.json')
+        with open(config_path, 'w') as f:
+            json.dump({
+                'manifest': {'$NETWORK_DIR': '${configdir}'},
+                'components': {'point_neuron_models_dir': '${configdir}',
+                               'synaptic_models_dir': '${configdir}'},
+                'networks': {
+                    'nodes': [{
+                        'nodes_file': '$NETWORK_DIR/nodes.h5',
+                        'node_types_file': '$NETWORK_DIR/node_types.csv'}],
+                    'edges': [{
+                        'edges_file': '$NETWORK_DIR/edges.h5',
+                        'edge_types_file': '$NETWORK_DIR/edge_types.csv'}]}},
+                f)
+        return config_path
@@ -0,0 +1,111 @@
+from __future__ import division
+import os.path
+import tempfile
+import shutil
+import numpy
+import neo
+from neo.io import proxyobjects
+import quantities as pq
+from pype9.simulate.common.cells.storage import (
+    RecordingStore, AnalogSignalProxy, SpikeTrainProxy)
+from pype9.exceptions import Pype9UsageError
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestRecordingStore(TestCase):
+
+    def setUp(self):
+        self.work_dir = tempfile.mkdtemp()
+        self.store = RecordingStore(os.path.join(self.work_dir, 'recs.h5'),
+                                    chunk_size=16)
+        # Append the samples in chunks like a spooling simulation
+        self.samples = numpy.arange(101, dtype=float)
+        for chunk in numpy.array_split(self.samples, 7):
+            self.store.append('cell_0', 'v', chunk, units='mV',
+                              sampling_period=0.5, t_start=10.0)
+        self.spikes = numpy.array([12.0, 20.5, 33.0, 48.25])
+        for chunk in numpy.array_split(self.spikes, 3):
+            self.store.append('cell_0', 'spike', chunk)
+
+    def tearDown(self):
+        self.store.close()
+        shutil.rmtree(self.work_dir)
+
+    def test_analog(self):
+        proxy = self.store.recording('cell_0', 'v', t_stop=60.0 * pq.ms)
+        self.assertIsInstance(proxy, AnalogSignalProxy)
+        # The sample at the stop time is dropped
+        self.assertEqual(len(proxy), 100)
+        self.assertEqual(proxy.t_start, 10.0 * pq.ms)
+        self.assertEqual(proxy.t_stop, 60.0 * pq.ms)
+        signal = proxy.load()
+        self.assertIsInstance(signal, neo.AnalogSignal)
+        self.assertEqual(signal.units, pq.mV)
+        self.assertTrue(numpy.array_equal(numpy.asarray(signal).ravel(),
+                                          self.samples[:-1]))
+        chunk = proxy.load(time_slice=(20.0 * pq.ms, 1.5 * pq.s))
+        self.assertEqual(chunk.t_start, 20.0 * pq.ms)
+        self.assertTrue(numpy.array_equal(numpy.asarray(chunk).ravel(),
+                                          self.samples[20:100]))
+        # Recordings from a later start time
+        late = self.store.recording('cell_0', 'v', t_start=30.0 * pq.ms,
+                                    t_stop=60.0 * pq.ms)
+        self.assertEqual(len(late), 60)
+        self.assertEqual(float(late.load()[0, 0]), 40.0)
+        self.assertRaises(Pype9UsageError, self.store.recording, 'cell_0',
+                          'v', t_start=5.0 * pq.ms)
+
+    def test_spikes(self):
+        proxy = self.store.recording('cell_0', 'spike', t_start=0.0 * pq.ms,
+                                     t_stop=60.0 * pq.ms)
+        self.assertIsInstance(proxy, SpikeTrainProxy)
+        self.assertEqual(len(proxy), 4)
+        train = proxy.load()
+        self.assertIsInstance(train, neo.SpikeTrain)
+        self.assertEqual(train.t_stop, 60.0 * pq.ms)
+        self.assertTrue(numpy.array_equal(numpy.asarray(train),
+                                          self.spikes))
+        chunk = proxy.load(time_slice=(20.5 * pq.ms, 48.25 * pq.ms))
+        self.assertEqual(list(numpy.asarray(chunk)), [20.5, 33.0])
+
+    def test_neo_proxy(self):
+        proxy = self.store.recording('cell_0', 'v', t_stop=60.0 * pq.ms)
+        self.assertIsInstance(proxy, proxyobjects.AnalogSignalProxy)
+        self.assertEqual(proxy.name, 'v')
+        self.assertEqual(proxy.units, pq.mV)
+        self.assertEqual(proxy.sampling_period, 0.5 * pq.ms)
+        self.assertEqual(proxy.sampling_rate, 2.0 * pq.kHz)
+        self.assertEqual(len(proxy.times), 100)
+        self.assertEqual(proxy.times[10], 15.0 * pq.ms)
+        self.assertRaises(Pype9UsageError, proxy.load,
+                          time_slice=(20.0 * pq.ms, 1.5 * pq.s),
+                          strict_slicing=True)
+        spikes = self.store.recording('cell_0', 'spike', t_stop=60.0 * pq.ms)
+        self.assertIsInstance(spikes, proxyobjects.SpikeTrainProxy)
+        self.assertEqual(spikes.units, pq.ms)
+        self.assertEqual(list(numpy.asarray(spikes.times)), list(self.spikes))
+        # The proxies can be held in Neo segments like lazily-read data
+        seg = neo.Segment()
+        seg.analogsignals.append(proxy)
+        seg.spiketrains.append(spikes)
+        self.assertIs(seg.analogsignals[0], proxy)
+
+    def test_clear(self):
+        self.assertIn(('cell_0', 'v'), self.store)
+        self.store.clear('cell_0')
+        self.assertNotIn(('cell_0', 'v'), self.store)
+        self.assertRaises(Pype9UsageError, self.store.recording, 'cell_0',
+                          'v')
+
+    def test_temporary(self):
+        store = RecordingStore()
+        path = store.path
+        store.append('cell_0', 'spike', [1.0])
+        self.assertTrue(os.path.exists(path))
+        store.close()
+        self.assertFalse(os.path.exists(path))
+        self.assertRaises(Pype9UsageError, store.append, 'cell_0', 'spike',
+                          [2.0])
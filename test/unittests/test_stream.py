@@ -0,0 +1,167 @@
+from __future__ import division
+import ninemlcatalog
+import numpy
+from nineml import units as un
+from pype9.simulate.neuron import (
+    CellMetaClass as NeuronCellMetaClass, Simulation as NeuronSimulation)
+from pype9.simulate.nest import (
+    CellMetaClass as NESTCellMetaClass, Simulation as NESTSimulation)
+from pype9.exceptions import Pype9UsageError
+import pype9.utils.logging.handlers.sysout  # @UnusedImport
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestStream(TestCase):
+
+    dt = 0.025 * un.ms
+    backends = ((NeuronCellMetaClass, NeuronSimulation),
+                (NESTCellMetaClass, NESTSimulation))
+
+    def setUp(self):
+        self.izhi = ninemlcatalog.load('neuron/Izhikevich', 'Izhikevich')
+        self.izhi_props = ninemlcatalog.load('neuron/Izhikevich',
+                                             'SampleIzhikevich')
+
+    def test_callback(self):
+        for CellMetaClass, Simulation in self.backends:
+            Izhikevich = CellMetaClass(self.izhi, build_version='StreamTest')
+            chunks = []
+            with Simulation(dt=self.dt, seed=1) as sim:
+                cell = Izhikevich(self.izhi_props, U=-14.0 * un.mV / un.ms,
+                                  V=-65.0 * un.mV)
+                cell.record('V', callback=chunks.append,
+                            callback_interval=10.0 * un.ms)
+                sim.run(95.0 * un.ms)
+                full = cell.recording('V')
+            # 9 intervals plus the remainder at the end of the run
+            self.assertEqual(len(chunks), 10,
+                             "Incorrect number of chunks passed to callback "
+                             "for {} ({})".format(Simulation.name,
+                                                  len(chunks)))
+            self.assertTrue(
+                numpy.array_equal(
+                    numpy.concatenate([numpy.asarray(c) for c in chunks]),
+                    numpy.asarray(full)[:sum(len(c) for c in chunks)]),
+                "Streamed chunks do not match full recording for {}"
+                .format(Simulation.name))
+
+    def test_stop(self):
+        for CellMetaClass, Simulation in self.backends:
+            Izhikevich = CellMetaClass(self.izhi, build_version='StreamTest')
+            with Simulation(dt=self.dt, seed=1) as sim:
+                cell = Izhikevich(self.izhi_props, U=-14.0 * un.mV / un.ms,
+                                  V=-65.0 * un.mV)
+
+                def stop_on_spike(spikes):
+                    if len(spikes):
+                        sim.stop()
+
+                cell.record('spike', callback=stop_on_spike,
+                            callback_interval=5.0 * un.ms)
+                sim.run(1000.0 * un.ms)
+                self.assertLess(float(sim.t.in_units(un.ms)), 1000.0,
+                                "Simulation was not stopped early for {}"
+                                .format(Simulation.name))
+                self.assertGreater(len(cell.recording('spike')), 0)
+
+    def test_run_stream(self):
+        for CellMetaClass, Simulation in self.backends:
+            Izhikevich = CellMetaClass(self.izhi, build_version='StreamTest')
+            with Simulation(dt=self.dt, seed=1) as sim:
+                cell = Izhikevich(self.izhi_props, U=-14.0 * un.mV / un.ms,
+                                  V=-65.0 * un.mV)
+                cell.record('V')
+                times = []
+                for t in sim.run_stream(100.0 * un.ms, chunk=20.0 * un.ms):
+                    times.append(float(t.in_units(un.ms)))
+                    if len(times) == 3:
+                        break
+                self.assertTrue(numpy.allclose(times, [20.0, 40.0, 60.0]))
+                # Resume the simulation after breaking out of the loop
+                sim.run(40.0 * un.ms)
+                self.assertAlmostEqual(float(sim.t.in_units(un.ms)), 100.0)
+
+    def test_invalid_interval(self):
+        Izhikevich = NeuronCellMetaClass(self.izhi, build_version='StreamTest')
+        with NeuronSimulation(dt=self.dt, seed=1):
+            cell = Izhikevich(self.izhi_props, U=-14.0 * un.mV / un.ms,
+                              V=-65.0 * un.mV)
+            self.assertRaises(Pype9UsageError, cell.record, 'V',
+                              callback=lambda c: None,
+                              callback_interval=0.01 * un.ms)
+
+    def test_spool(self):
+        for CellMetaClass, Simulation in self.backends:
+            Izhikevich = CellMetaClass(self.izhi, build_version='StreamTest')
+            recordings = []
+            for spool in (None, True):
+                with Simulation(dt=self.dt, seed=1, spool_recordings=spool,
+                                spool_interval=10.0 * un.ms) as sim:
+                    cell = Izhikevich(self.izhi_props,
+                                      U=-14.0 * un.mV / un.ms,
+                                      V=-65.0 * un.mV)
+                    cell.record('V')
+                    cell.record('spike')
+                    sim.run(95.0 * un.ms)
+                recordings.append((cell.recording('V'),
+                                   cell.recording('spike')))
+            (v, spikes), (v_proxy, spikes_proxy) = recordings
+            self.assertEqual(len(v_proxy), len(v),
+                             "Length of spooled recording ({}) does not "
+                             "match that of the in-memory recording ({}) for "
+                             "{}".format(len(v_proxy), len(v),
+                                         Simulation.name))
+            self.assertTrue(
+                numpy.array_equal(numpy.asarray(v_proxy.load()),
+                                  numpy.asarray(v)),
+                "Spooled recording does not match in-memory recording for {}"
+                .format(Simulation.name))
+            self.assertTrue(
+                numpy.array_equal(numpy.asarray(spikes_proxy.load()),
+                                  numpy.asarray(spikes)),
+                "Spooled spikes do not match in-memory spikes for {}"
+                .format(Simulation.name))
+            sim.recording_store.close()
+
+    def test_progress(self):
+        for CellMetaClass, Simulation in self.backends:
+            Izhikevich = CellMetaClass(self.izhi, build_version='StreamTest')
+            reports = []
+            with Simulation(dt=self.dt, seed=1) as sim:
+                Izhikevich(self.izhi_props, U=-14.0 * un.mV / un.ms,
+                           V=-65.0 * un.mV)
+                sim.register_progress(reports.append,
+                                      interval=10.0 * un.ms)
+                sim.run(95.0 * un.ms)
+            # 9 intervals plus the report at the end of the run
+            self.assertEqual(len(reports), 10,
+                             "Incorrect number of progress reports for {} "
+                             "({})".format(Simulation.name, len(reports)))
+            self.assertAlmostEqual(reports[0].percent, 100.0 * 10.0 / 95.0)
+            self.assertAlmostEqual(reports[-1].fraction, 1.0)
+            self.assertAlmostEqual(reports[-1].eta, 0.0)
+            self.assertIsNotNone(reports[-1].wall_time_per_second)
+
+    def test_cancel(self):
+        for CellMetaClass, Simulation in self.backends:
+            Izhikevich = CellMetaClass(self.izhi, build_version='StreamTest')
+            with Simulation(dt=self.dt, seed=1) as sim:
+                cell = Izhikevich(self.izhi_props, U=-14.0 * un.mV / un.ms,
+                                  V=-65.0 * un.mV)
+                cell.record('V')
+
+                def cancel_at_half(progress):
+                    if progress.fraction >= 0.5:
+                        sim.cancel()
+
+                sim.register_progress(cancel_at_half, interval=10.0 * un.ms)
+                sim.run(100.0 * un.ms)
+                self.assertTrue(sim.cancelled)
+                self.assertAlmostEqual(float(sim.t.in_units(un.ms)), 50.0)
+            # The recording up to the cancellation is still available
+            v = cell.recording('V')
+            self.assertGreater(len(v), 0)
+            self.assertLess(float(v.t_stop.rescale('ms')), 60.0)
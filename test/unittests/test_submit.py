@@ -0,0 +1,132 @@
+import os.path
+import tempfile
+import shutil
+from pype9.submit import (
+    Job, SlurmScheduler, PbsScheduler, schedulers, PENDING, RUNNING,
+    COMPLETED, FAILED, CANCELLED, UNKNOWN, EXIT_STATUS_FILE)
+from pype9.exceptions import Pype9UsageError
+if __name__ == '__main__':
+    from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
+else:
+    from unittest import TestCase  # @Reimport
+
+
+class TestJob(TestCase):
+
+    def setUp(self):
+        self.cwd = tempfile.mkdtemp()
+        self.jobs_dir = tempfile.mkdtemp()
+        for fname in ('izhikevich.xml', 'current.neo.pkl', 'fi_curve.yml'):
+            with open(os.path.join(self.cwd, fname), 'w') as f:
+                f.write(fname)
+        os.makedirs(os.path.join(self.cwd, 'build', 'src'))
+        self.argv = ['izhikevich.xml#SampleIzhikevich', 'nest', '100.0',
+                     '0.01', '--record', 'V', 'data/v.neo.pkl',
+                     '--play', 'iSyn', 'current.neo.pkl',
+                     '--protocol=fi_curve.yml', '--build_dir', 'build',
+                     '--seed', '12345']
+
+    def tearDown(self):
+        shutil.rmtree(self.cwd)
+        shutil.rmtree(self.jobs_dir)
+
+    def job(self, scheduler='slurm', **resources):
+        return Job.create(self.argv, scheduler, base_dir=self.jobs_dir,
+                          cwd=self.cwd, **resources)
+
+    def test_package(self):
+        job = self.job()
+        self.assertEqual(job.name, 'SampleIzhikevich')
+        inputs = os.path.join(job.path, 'inputs')
+        self.assertEqual(sorted(os.listdir(inputs)),
+                         ['current.neo.pkl', 'fi_curve.yml',
+                          'izhikevich.xml'])
+        self.assertTrue(os.path.isdir(os.path.join(job.path, 'build',
+                                                   'src')))
+        v_path = os.path.join(job.path, 'outputs', 'v.neo.pkl')
+        self.assertEqual(job.job_argv, [
+            os.path.join(inputs, 'izhikevich.xml') + '#SampleIzhikevich',
+            'nest', '100.0', '0.01', '--record', 'V', v_path,
+            '--play', 'iSyn', os.path.join(inputs, 'current.neo.pkl'),
+            '--protocol', os.path.join(inputs, 'fi_curve.yml'),
+            '--seed', '12345', '--build_dir',
+            os.path.join(job.path, 'build')])
+        self.assertEqual(job.outputs, [
+            (v_path, os.path.join(self.cwd, 'data', 'v.neo.pkl'))])
+        self.assertRaises(Pype9UsageError, Job.create,
+                          ['missing.xml', 'nest', '100.0', '0.01', '--play',
+                           'iSyn', 'missing.neo.pkl'], 'slurm',
+                          base_dir=self.jobs_dir, cwd=self.cwd)
+
+    def test_slurm_script(self):
+        job = self.job(nodes=2, tasks_per_node=8, walltime='02:00:00',
+                       queue='compute', modules=['nest/2.14'])
+        job.job_argv.append('--mpi')
+        script = SlurmScheduler(**job.resources).script(job)
+        self.assertIn('#SBATCH --nodes=2', script)
+        self.assertIn('#SBATCH --ntasks-per-node=8', script)
+        self.assertIn('#SBATCH --time=02:00:00', script)
+        self.assertIn('#SBATCH --partition=compute', script)
+        self.assertIn('module load nest/2.14', script)
+        self.assertIn('srun pype9 simulate ', script)
+        self.assertIn('echo $status > ' + EXIT_STATUS_FILE, script)
+
+    def test_pbs_script(self):
+        job = self.job('pbs', nodes=2, tasks_per_node=4, cpus_per_task=2,
+                       memory='8gb', account='lab')
+        script = PbsScheduler(**job.resources).script(job)
+        self.assertIn('#PBS -N SampleIzhikevic\n', script)
+        self.assertIn('#PBS -l select=2:ncpus=8:mpiprocs=4:mem=8gb', script)
+        self.assertIn('#PBS -A lab', script)
+        self.assertNotIn('mpirun', script)
+
+    def test_whitespace_path(self):
+        jobs_dir = os.path.join(self.jobs_dir, 'with space')
+        job = Job.create(self.argv, 'slurm', base_dir=jobs_dir, cwd=self.cwd)
+        for scheduler in (SlurmScheduler(), PbsScheduler()):
+            self.assertRaises(Pype9UsageError, scheduler.script, job)
+
+    def test_parse(self):
+        slurm = SlurmScheduler()
+        self.assertEqual(slurm.parse_job_id('1234;cluster\n'), '1234')
+        self.assertEqual(slurm.parse_state('PENDING\n'), PENDING)
+        self.assertEqual(slurm.parse_state('COMPLETING\n'), RUNNING)
+        self.assertEqual(slurm.parse_state('CANCELLED by 100\n'), CANCELLED)
+        self.assertEqual(slurm.parse_state('TIMEOUT\n'), FAILED)
+        self.assertEqual(slurm.parse_state(''), UNKNOWN)
+        pbs = PbsScheduler()
+        self.assertEqual(pbs.parse_job_id('1234.server\n'), '1234.server')
+        self.assertEqual(
+            pbs.parse_state('Job Id: 1234.server\n    job_state = R\n'),
+            RUNNING)
+
+    def test_submit_and_retrieve(self):
+
+        class DummyScheduler(SlurmScheduler):
+
+            def _run(self, cmd, cwd=None):
+                return {'sbatch': '5678\n',
+                        'squeue': 'RUNNING\n'}[cmd[0]]
+
+        schedulers['slurm'] = DummyScheduler
+        try:
+            job = self.job()
+            self.assertEqual(job.submit(), '5678')
+            self.assertTrue(os.path.isfile(job.script_path))
+            self.assertEqual(Job.find('5678', base_dir=self.jobs_dir).path,
+                             job.path)
+            self.assertEqual(job.update(), RUNNING)
+            self.assertRaises(Pype9UsageError, job.retrieve)
+            src, dest = job.outputs[0]
+            with open(src, 'w') as f:
+                f.write('recording')
+            with open(os.path.join(job.path, EXIT_STATUS_FILE), 'w') as f:
+                f.write('0\n')
+            self.assertEqual(job.update(), COMPLETED)
+            self.assertEqual(job.retrieve(), [dest])
+            with open(dest) as f:
+                self.assertEqual(f.read(), 'recording')
+            self.assertTrue(Job.load(job.path).retrieved)
+            self.assertRaises(Pype9UsageError, job.submit)
+        finally:
+            schedulers['slurm'] = SlurmScheduler
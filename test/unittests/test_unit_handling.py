@@ -11,6 +11,12 @@ from nineml.abstraction import (
     StateVariable)
 import numpy
 from nineml.units import Quantity
+from nineml.user import RandomDistributionProperties
+from nineml.values import RandomDistributionValue
+import ninemlcatalog
+from pyNN.random import NumpyRNG
+from pype9.simulate.common.network.values import (
+    get_random_distribution, random_distribution_params)
 import pype9.utils.logging.handlers.sysout  # @UnusedImport
 if __name__ == '__main__':
     from pype9.utils.testing import DummyTestCase as TestCase  # @UnusedImport
@@ -182,6 +188,78 @@ class TestUnitAssignment(TestCase):
                              "scale ({} -> {})".format(unit.name, unit.power,
                                                        new_power))
 
+
+class TestRandomDistributionScaling(TestCase):
+
+    num_draws = 100000
+
+    def draw(self, distribution, properties, units):
+        qty = Quantity(RandomDistributionValue(
+            RandomDistributionProperties(
+                name=distribution.lower(),
+                definition=ninemlcatalog.load(
+                    'randomdistribution/' + distribution,
+                    distribution + 'Distribution'),
+                properties=properties)), units)
+        # Handler 2 uses uF for capacitance, i.e. 1 nF -> 1e-3 uF
+        rv = get_random_distribution(qty, TestUnitHandler2,
+                                     NumpyRNG(seed=12345))
+        return numpy.asarray(rv.next(self.num_draws))
+
+    def test_normal(self):
+        values = self.draw('Normal', {'mean': 2.0, 'variance': 0.25}, un.nF)
+        self.assertAlmostEqual(values.mean(), 2e-3, delta=1e-5)
+        # Standard deviation is the square root of the variance
+        self.assertAlmostEqual(values.std(), 0.5e-3, delta=1e-5)
+
+    def test_uniform(self):
+        values = self.draw('Uniform', {'minimum': 1.0, 'maximum': 3.0},
+                           un.nF)
+        self.assertGreaterEqual(values.min(), 1e-3)
+        self.assertLessEqual(values.max(), 3e-3)
+
+    def test_exponential(self):
+        values = self.draw('Exponential', {'rate': 0.5}, un.nF)
+        self.assertAlmostEqual(values.mean(), 2e-3, delta=5e-5)
+
+    def test_unscaled(self):
+        values = self.draw('Normal', {'mean': 2.0, 'variance': 0.25}, un.ms)
+        self.assertAlmostEqual(values.mean(), 2.0, delta=1e-2)
+
+
+class TestNormalVariance(TestCase):
+    """
+    UncertML defines normal distributions by their variance whereas PyNN
+    (and the native distributions of the simulators) take the standard
+    deviation, so the variance needs to be converted
+    """
+
+    def normal(self, variance, units=un.ms):
+        return Quantity(RandomDistributionValue(
+            RandomDistributionProperties(
+                name='normal',
+                definition=ninemlcatalog.load('randomdistribution/Normal',
+                                              'NormalDistribution'),
+                properties={'mean': 1.0, 'variance': variance})), units)
+
+    def test_variance_to_sigma(self):
+        rv_name, rv_params = random_distribution_params(self.normal(9.0),
+                                                        TestUnitHandler2)
+        self.assertEqual(rv_name, 'normal')
+        self.assertEqual(rv_params, [1.0, 3.0])
+        # The standard deviation (not the variance) is scaled with the mean
+        _, scaled_params = random_distribution_params(
+            self.normal(9.0, un.nF), TestUnitHandler2)
+        self.assertAlmostEqual(scaled_params[0], 1e-3)
+        self.assertAlmostEqual(scaled_params[1], 3e-3)
+
+    def test_drawn_standard_deviation(self):
+        rv = get_random_distribution(self.normal(16.0), TestUnitHandler2,
+                                     NumpyRNG(seed=54321))
+        values = numpy.asarray(rv.next(100000))
+        self.assertAlmostEqual(values.std(), 4.0, delta=0.05)
+
+
 if __name__ == '__main__':
     tester = TestUnitAssignment()
     tester.test_scaling_and_assignment()